@@ -7,11 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"strings"
+	"sync"
 
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -23,6 +27,9 @@ var (
 // WrapS3 slightly wraps I/O around our S3 store with convenience methods.
 type WrapS3 struct {
 	Client *minio.Client
+
+	mu      sync.Mutex
+	buckets map[string]bool // buckets known to exist
 }
 
 // WrapS3Options mostly contains pass through options for minio client.
@@ -32,21 +39,51 @@ type WrapS3Options struct {
 	SecretKey     string
 	DefaultBucket string
 	UseSSL        bool
+	// Signature is the request signature version, "v2" or "v4", defaults to
+	// "v2". Note: seaweedfs (version 8000GB 1.79 linux amd64) may not work
+	// with V4, AWS S3 requires V4.
+	Signature string
+	// Region is required by some stores, e.g. AWS S3 outside us-east-1.
+	Region string
+	// PathStyle forces path style requests, like http://host/bucket/key,
+	// needed by stores that do not support virtual host style addressing.
+	PathStyle bool
+}
+
+// s3Credentials returns static credentials for a signature version.
+func s3Credentials(opts *WrapS3Options) (*credentials.Credentials, error) {
+	switch strings.ToLower(opts.Signature) {
+	case "", "v2":
+		return credentials.NewStaticV2(opts.AccessKey, opts.SecretKey, ""), nil
+	case "v4":
+		return credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""), nil
+	default:
+		return nil, fmt.Errorf("unknown signature version: %q, use v2 or v4", opts.Signature)
+	}
 }
 
 // NewWrapS3 creates a new, slim wrapper around S3.
 func NewWrapS3(endpoint string, opts *WrapS3Options) (*WrapS3, error) {
+	creds, err := s3Credentials(opts)
+	if err != nil {
+		return nil, err
+	}
+	bucketLookup := minio.BucketLookupAuto
+	if opts.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
 	client, err := minio.New(endpoint,
 		&minio.Options{
-			// Note: seaweedfs (version 8000GB 1.79 linux amd64) may not work
-			// with V4!
-			Creds:  credentials.NewStaticV2(opts.AccessKey, opts.SecretKey, ""),
-			Secure: opts.UseSSL,
+			Creds:        creds,
+			Secure:       opts.UseSSL,
+			Region:       opts.Region,
+			BucketLookup: bucketLookup,
 		},
 	)
 	if err != nil {
 		return nil, err
 	}
+	client.SetAppInfo("blobproc", strings.TrimSpace(Version))
 	// Quick, additional sanity check if we can connect to S3.
 	buckets, err := client.ListBuckets(context.Background())
 	if err != nil {
@@ -77,12 +114,18 @@ func NewWrapS3(endpoint string, opts *WrapS3Options) (*WrapS3, error) {
 // - "sandcrawler" for sandcrawler_text_bucket
 // - "thumbnail" for sandcrawler_thumbnail_bucket
 type BlobRequestOptions struct {
-	Folder  string
-	Blob    []byte
+	Folder string
+	Blob   []byte
+	// Path is a file to store instead of Blob, which is streamed from disk
+	// with PutFile.
+	Path    string
 	SHA1Hex string
 	Ext     string
 	Prefix  string
 	Bucket  string
+	// Metadata is stored as user metadata with the object, in addition to
+	// the blobproc version.
+	Metadata map[string]string
 }
 
 // PutBlobResponse wraps a blob put request response.
@@ -103,9 +146,18 @@ func blobPath(folder, sha1hex, ext, prefix string) string {
 
 // PutBlob takes puts data in to S3 with key derived from the given options. If
 // the options do not contain the SHA1 of the content, it gets computed here.
-// If no bucket name is given, a default bucket name is used. If the bucket
-// does not exist, if gets created.
-func (wrap *WrapS3) PutBlob(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+// If no bucket name is given, a default bucket name is used. The bucket must
+// exist, cf. InitBucket.
+func (wrap *WrapS3) PutBlob(ctx context.Context, req *BlobRequestOptions) (resp *PutBlobResponse, err error) {
+	if req.Bucket == "" {
+		req.Bucket = DefaultBucket
+	}
+	ctx, span := startSpan(ctx, "s3.PutBlob",
+		attribute.String("bucket", req.Bucket),
+		attribute.String("folder", req.Folder),
+		attribute.Int("size", len(req.Blob)),
+	)
+	defer func() { endSpan(span, err) }()
 	if req.SHA1Hex == "" {
 		h := sha1.New()
 		_, err := io.Copy(h, bytes.NewReader(req.Blob))
@@ -117,41 +169,61 @@ func (wrap *WrapS3) PutBlob(ctx context.Context, req *BlobRequestOptions) (*PutB
 	if len(req.SHA1Hex) != 40 {
 		return nil, ErrInvalidHash
 	}
-	objPath := blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix)
+	opts := minio.PutObjectOptions{
+		ContentType:  ContentType(req.Ext, req.Blob),
+		UserMetadata: objectMetadata(req.Metadata),
+	}
+	return wrap.putObject(ctx, req, func(objPath string) (minio.UploadInfo, error) {
+		return wrap.Client.PutObject(ctx, req.Bucket, objPath,
+			bytes.NewReader(req.Blob), int64(len(req.Blob)), opts)
+	})
+}
+
+// PutFile stores the file at req.Path like PutBlob, but streams it from disk,
+// so large files, like original PDFs, are not read into memory. The SHA1 of
+// the file must be given.
+func (wrap *WrapS3) PutFile(ctx context.Context, req *BlobRequestOptions) (resp *PutBlobResponse, err error) {
 	if req.Bucket == "" {
 		req.Bucket = DefaultBucket
 	}
-	ok, err := wrap.Client.BucketExists(context.Background(), req.Bucket)
-	if err != nil {
-		slog.Error("bucket exist failed", "err", err)
-		return nil, err
+	ctx, span := startSpan(ctx, "s3.PutFile",
+		attribute.String("bucket", req.Bucket),
+		attribute.String("folder", req.Folder),
+		attribute.String("path", req.Path),
+	)
+	defer func() { endSpan(span, err) }()
+	if len(req.SHA1Hex) != 40 {
+		return nil, ErrInvalidHash
 	}
-	if !ok {
-		opts := minio.MakeBucketOptions{}
-		if err := wrap.Client.MakeBucket(ctx, req.Bucket, opts); err != nil {
-			slog.Error("make bucket failed", "err", err)
-			return nil, err
+	contentType := ContentType(req.Ext, nil)
+	if contentType == "application/octet-stream" {
+		if mtype, err := mimetype.DetectFile(req.Path); err == nil {
+			contentType = mtype.String()
 		}
 	}
-	contentType := "application/octet-stream"
-	if strings.HasSuffix(req.Ext, ".xml") {
-		contentType = "application/xml"
-	}
-	if strings.HasSuffix(req.Ext, ".png") {
-		contentType = "image/png"
-	}
-	if strings.HasSuffix(req.Ext, ".jpg") || strings.HasSuffix(req.Ext, ".jpeg") {
-		contentType = "image/jpeg"
-	}
-	if strings.HasSuffix(req.Ext, ".txt") {
-		contentType = "text/plain"
-	}
 	opts := minio.PutObjectOptions{
-		ContentType: contentType,
+		ContentType:  contentType,
+		UserMetadata: objectMetadata(req.Metadata),
 	}
-	info, err := wrap.Client.PutObject(ctx, req.Bucket, objPath,
-		bytes.NewReader(req.Blob), int64(len(req.Blob)), opts)
+	return wrap.putObject(ctx, req, func(objPath string) (minio.UploadInfo, error) {
+		return wrap.Client.FPutObject(ctx, req.Bucket, objPath, req.Path, opts)
+	})
+}
+
+// putObject runs a put for the object path derived from req into the bucket
+// of req, which must exist, and checks the response.
+func (wrap *WrapS3) putObject(ctx context.Context, req *BlobRequestOptions, put func(objPath string) (minio.UploadInfo, error)) (*PutBlobResponse, error) {
+	objPath := blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix)
+	if err := wrap.checkBucket(ctx, req.Bucket); err != nil {
+		return nil, err
+	}
+	info, err := put(objPath)
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchBucket" {
+			// Bucket got removed, check again next time.
+			wrap.forgetBucket(req.Bucket)
+			return nil, fmt.Errorf("%w: %s, see blobproc s3 init", ErrNoSuchBucket, req.Bucket)
+		}
 		slog.Error("put object failed", "err", err)
 		return nil, err
 	}
@@ -167,6 +239,49 @@ func (wrap *WrapS3) PutBlob(ctx context.Context, req *BlobRequestOptions) (*PutB
 	}, nil
 }
 
+// checkBucket returns ErrNoSuchBucket, if a bucket does not exist. Existing
+// buckets are remembered, so there is only one round trip per bucket.
+func (wrap *WrapS3) checkBucket(ctx context.Context, bucket string) error {
+	wrap.mu.Lock()
+	known := wrap.buckets[bucket]
+	wrap.mu.Unlock()
+	if known {
+		return nil
+	}
+	ok, err := wrap.Client.BucketExists(ctx, bucket)
+	if err != nil {
+		slog.Error("bucket exist failed", "err", err)
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s, see blobproc s3 init", ErrNoSuchBucket, bucket)
+	}
+	wrap.mu.Lock()
+	if wrap.buckets == nil {
+		wrap.buckets = make(map[string]bool)
+	}
+	wrap.buckets[bucket] = true
+	wrap.mu.Unlock()
+	return nil
+}
+
+// forgetBucket removes a bucket from the known buckets.
+func (wrap *WrapS3) forgetBucket(bucket string) {
+	wrap.mu.Lock()
+	delete(wrap.buckets, bucket)
+	wrap.mu.Unlock()
+}
+
+// objectMetadata returns the user metadata for an object, the provenance of
+// the derivative and the given metadata.
+func objectMetadata(md map[string]string) map[string]string {
+	result := provenanceMetadata(Provenance())
+	for k, v := range md {
+		result[k] = v
+	}
+	return result
+}
+
 // GetBlob returns the object bytes given a blob request.
 func (wrap *WrapS3) GetBlob(ctx context.Context, req *BlobRequestOptions) ([]byte, error) {
 	objPath := blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix)
@@ -177,5 +292,76 @@ func (wrap *WrapS3) GetBlob(ctx context.Context, req *BlobRequestOptions) ([]byt
 	if err != nil {
 		return nil, err
 	}
+	defer object.Close()
 	return io.ReadAll(object)
 }
+
+// GetResult is the outcome of fetching a single blob with GetMany.
+type GetResult struct {
+	Req  BlobRequestOptions
+	Blob []byte
+	Err  error // Wraps fs.ErrNotExist, if the object is not stored.
+}
+
+// GetMany fetches blobs with up to concurrency parallel requests. Results
+// are sent over the returned channel in completion order, which is closed
+// after the last result or once ctx is done.
+func (wrap *WrapS3) GetMany(ctx context.Context, reqs []BlobRequestOptions, concurrency int) <-chan GetResult {
+	var (
+		queue   = make(chan int)
+		results = make(chan GetResult)
+		wg      sync.WaitGroup
+	)
+	go func() {
+		defer close(queue)
+		for i := range reqs {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	n := min(max(concurrency, 1), max(len(reqs), 1))
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				req := reqs[j]
+				blob, err := wrap.GetBlob(ctx, &req)
+				switch minio.ToErrorResponse(err).Code {
+				case "NoSuchKey", "NoSuchBucket":
+					err = fmt.Errorf("%s/%s: %w", req.Bucket, blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix), fs.ErrNotExist)
+				}
+				select {
+				case results <- GetResult{Req: req, Blob: blob, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Exists returns true, if the object for a given blob request is stored.
+func (wrap *WrapS3) Exists(ctx context.Context, req *BlobRequestOptions) (bool, error) {
+	objPath := blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix)
+	if req.Bucket == "" {
+		req.Bucket = DefaultBucket
+	}
+	_, err := wrap.Client.StatObject(ctx, req.Bucket, objPath, minio.StatObjectOptions{})
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchKey", "NoSuchBucket":
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -2,13 +2,22 @@ package blobproc
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"os/user"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 )
@@ -63,6 +72,327 @@ func TestBlobPath(t *testing.T) {
 	}
 }
 
+func TestS3Credentials(t *testing.T) {
+	var cases = []struct {
+		signature string
+		want      credentials.SignatureType
+		err       bool
+	}{
+		{"", credentials.SignatureV2, false},
+		{"v2", credentials.SignatureV2, false},
+		{"V4", credentials.SignatureV4, false},
+		{"v3", credentials.SignatureDefault, true},
+	}
+	for _, c := range cases {
+		creds, err := s3Credentials(&WrapS3Options{AccessKey: "a", SecretKey: "b", Signature: c.signature})
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error %v", c.signature, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.SignerType != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.signature, v.SignerType, c.want)
+		}
+	}
+}
+
+// fakeS3 counts requests and knows a fixed set of buckets.
+type fakeS3 struct {
+	mu       sync.Mutex
+	buckets  map[string]bool
+	objects  map[string]int // bucket and key to size, for HEAD requests, updated by PUT
+	requests map[string]int // method to number of requests
+	pageSize int            // maximum number of keys per listing, if positive
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method]++
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !s.buckets[bucket] {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "<Error><Code>NoSuchBucket</Code><BucketName>%s</BucketName></Error>", bucket)
+		return
+	}
+	if r.Method == "PUT" && key != "" && s.objects != nil {
+		size := r.ContentLength
+		if v := r.Header.Get("X-Amz-Decoded-Content-Length"); v != "" {
+			fmt.Sscan(v, &size)
+		}
+		s.objects[bucket+"/"+key] = int(size)
+	}
+	if r.Method == "DELETE" && key != "" && s.objects != nil {
+		delete(s.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method == "GET" && key == "" && r.URL.Query().Get("list-type") == "2" {
+		s.list(w, r, bucket)
+		return
+	}
+	if r.Method == "GET" && key != "" && s.objects != nil {
+		size, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Last-Modified", "Mon, 12 Oct 2026 10:00:00 GMT")
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		fmt.Fprint(w, strings.Repeat("x", size))
+		return
+	}
+	if r.Method == "HEAD" && key != "" {
+		size, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			// HEAD responses have no body, minio infers the error code.
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Last-Modified", "Mon, 12 Oct 2026 10:00:00 GMT")
+	}
+	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+}
+
+// list answers a ListObjectsV2 request, using the last key as continuation
+// token.
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	var (
+		q     = r.URL.Query()
+		after = q.Get("start-after")
+		keys  []string
+	)
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+	for k := range s.objects {
+		key := strings.TrimPrefix(k, bucket+"/")
+		if strings.HasPrefix(k, bucket+"/") && strings.HasPrefix(key, q.Get("prefix")) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var truncated bool
+	if s.pageSize > 0 && len(keys) > s.pageSize {
+		keys, truncated = keys[:s.pageSize], true
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><KeyCount>%d</KeyCount><IsTruncated>%v</IsTruncated>`, bucket, len(keys), truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2026-10-12T10:00:00.000Z</LastModified><ETag>&quot;d41d8cd98f00b204e9800998ecf8427e&quot;</ETag><Size>%d</Size></Contents>", key, s.objects[bucket+"/"+key])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func TestPutBlobBucketCache(t *testing.T) {
+	var (
+		fake = &fakeS3{buckets: map[string]bool{"abc": true}, requests: make(map[string]int)}
+		srv  = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wrap = &WrapS3{Client: client}
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := wrap.PutBlob(context.Background(), &BlobRequestOptions{
+				Bucket: "abc",
+				Blob:   []byte(fmt.Sprintf("blob %d", i)),
+			}); err != nil {
+				t.Errorf("got %v, want nil", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	fake.mu.Lock()
+	heads, puts := fake.requests["HEAD"], fake.requests["PUT"]
+	fake.mu.Unlock()
+	// Concurrent puts may each check the bucket before it is known.
+	if heads > 10 || puts != 10 {
+		t.Fatalf("got %d HEAD, %d PUT, want at most 10 HEAD, 10 PUT", heads, puts)
+	}
+	if _, err := wrap.PutBlob(context.Background(), &BlobRequestOptions{Bucket: "abc", Blob: []byte("x")}); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if got := fake.requests["HEAD"]; got != heads {
+		t.Fatalf("got %d HEAD, want %d, bucket not cached", got, heads)
+	}
+	// Bucket gets removed, the next put fails and the one after checks again.
+	fake.mu.Lock()
+	delete(fake.buckets, "abc")
+	fake.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := wrap.PutBlob(context.Background(), &BlobRequestOptions{Bucket: "abc", Blob: []byte("x")}); !errors.Is(err, ErrNoSuchBucket) {
+			t.Fatalf("got %v, want %v", err, ErrNoSuchBucket)
+		}
+	}
+	if got := fake.requests["HEAD"]; got != heads+1 {
+		t.Fatalf("got %d HEAD, want %d", got, heads+1)
+	}
+}
+
+func TestPutBlobSpanBucket(t *testing.T) {
+	var (
+		fake = &fakeS3{buckets: map[string]bool{DefaultBucket: true}, requests: make(map[string]int)}
+		srv  = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := recordSpans(t)
+	wrap := &WrapS3{Client: client}
+	if _, err := wrap.PutBlob(context.Background(), &BlobRequestOptions{Blob: []byte("x")}); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	ended := sr.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans, want 1", len(ended))
+	}
+	// The span names the bucket actually written to.
+	if v, _ := spanAttr(ended[0], "bucket"); v.AsString() != DefaultBucket {
+		t.Fatalf("got %q, want %q", v.AsString(), DefaultBucket)
+	}
+}
+
+func TestPutFile(t *testing.T) {
+	var (
+		fake = &fakeS3{
+			buckets:  map[string]bool{"raw": true},
+			objects:  make(map[string]int),
+			requests: make(map[string]int),
+		}
+		srv  = httptest.NewServer(fake)
+		path = "testdata/pdf/1906.02444.pdf"
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wrap = &WrapS3{Client: client}
+		req  = &BlobRequestOptions{
+			Bucket:  "raw",
+			Folder:  "pdf",
+			Path:    path,
+			SHA1Hex: "4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6",
+			Ext:     "pdf",
+		}
+	)
+	resp, err := wrap.PutFile(context.Background(), req)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if want := "pdf/4e/6c/4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6.pdf"; resp.ObjectPath != want {
+		t.Fatalf("got %v, want %v", resp.ObjectPath, want)
+	}
+	if got := fake.objects["raw/"+resp.ObjectPath]; int64(got) != fi.Size() {
+		t.Fatalf("got %v, want %v", got, fi.Size())
+	}
+	if _, err := wrap.PutFile(context.Background(), &BlobRequestOptions{Path: path}); !errors.Is(err, ErrInvalidHash) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidHash)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	const missing = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	var (
+		fake = &fakeS3{
+			buckets: map[string]bool{"sandcrawler": true},
+			objects: map[string]int{
+				"sandcrawler/text/4e/12/" + fakeSHA1Hex + ".txt":                      10,
+				"sandcrawler/text/4e/6c/4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6.txt": 20,
+			},
+			requests: make(map[string]int),
+		}
+		srv = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wrap = &WrapS3{Client: client}
+		d    = Derivative{Bucket: "sandcrawler", Folder: "text", Ext: "txt"}
+		reqs = []BlobRequestOptions{
+			*d.Request(fakeSHA1Hex, nil),
+			*d.Request("4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6", nil),
+			*d.Request(missing, nil),
+		}
+	)
+	var cases = []struct {
+		about       string
+		concurrency int
+	}{
+		{"sequential", 1},
+		{"parallel", 4},
+		{"zero", 0},
+	}
+	for _, c := range cases {
+		sizes := make(map[string]int)
+		for result := range wrap.GetMany(context.Background(), reqs, c.concurrency) {
+			switch {
+			case result.Req.SHA1Hex == missing:
+				if !errors.Is(result.Err, fs.ErrNotExist) {
+					t.Fatalf("[%s] got %v, want %v", c.about, result.Err, fs.ErrNotExist)
+				}
+			case result.Err != nil:
+				t.Fatalf("[%s] got %v, want nil", c.about, result.Err)
+			}
+			sizes[result.Req.SHA1Hex] = len(result.Blob)
+		}
+		want := map[string]int{fakeSHA1Hex: 10, "4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6": 20, missing: 0}
+		if !reflect.DeepEqual(sizes, want) {
+			t.Fatalf("[%s] got %v, want %v", c.about, sizes, want)
+		}
+	}
+	// Cancelling stops fetching and closes the channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	results := wrap.GetMany(ctx, reqs, 1)
+	cancel()
+	for range results {
+	}
+}
+
 func TestPutGetObject(t *testing.T) {
 	var hostPort string
 	switch os.Getenv("TEST_LOCAL_MINIO") {
@@ -120,6 +450,20 @@ func TestPutGetObject(t *testing.T) {
 	if err != nil {
 		t.Fatalf("got %v, want nil", err)
 	}
+	if _, err := wrap.PutBlob(context.TODO(), &BlobRequestOptions{Blob: []byte("x")}); !errors.Is(err, ErrNoSuchBucket) {
+		t.Fatalf("got %v, want %v", err, ErrNoSuchBucket)
+	}
+	for i := 0; i < 2; i++ {
+		// Running init again must not fail.
+		if err := wrap.InitBucket(context.TODO(), BucketConfig{
+			Name:         DefaultBucket,
+			Versioning:   true,
+			ReadPrefixes: []string{"thumbnails/"},
+			Expire:       []ExpireRule{{Prefix: "tmp/", Days: 1}},
+		}); err != nil {
+			t.Fatalf("init bucket: got %v, want nil", err)
+		}
+	}
 	var cases = []struct {
 		opts         *BlobRequestOptions
 		expectedPath string
@@ -0,0 +1,115 @@
+package blobproc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// ErrNoSuchBucket is returned, if a bucket does not exist. Buckets are set up
+// with "blobproc s3 init".
+var ErrNoSuchBucket = errors.New("no such bucket")
+
+// BucketConfig describes a bucket and its settings, as applied by InitBucket.
+// Settings not given are left untouched, so rules and policies set up by
+// other means survive.
+type BucketConfig struct {
+	Name string `yaml:"name"`
+	// Versioning enables object versioning.
+	Versioning bool `yaml:"versioning"`
+	// ReadPrefixes are made readable without credentials, e.g. "pdf/" for
+	// thumbnails. Replaces any existing bucket policy.
+	ReadPrefixes []string `yaml:"read_prefixes"`
+	// Expire deletes objects under a prefix after a number of days. Replaces
+	// any existing lifecycle rules.
+	Expire []ExpireRule `yaml:"expire"`
+}
+
+// ExpireRule deletes objects under a prefix after a number of days.
+type ExpireRule struct {
+	Prefix string `yaml:"prefix"`
+	Days   int    `yaml:"days"`
+}
+
+// InitBucket creates a bucket, if it does not exist yet, and applies
+// versioning, lifecycle rules and read policy. Safe to run repeatedly.
+func (wrap *WrapS3) InitBucket(ctx context.Context, bucket BucketConfig) error {
+	ok, err := wrap.Client.BucketExists(ctx, bucket.Name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		err := wrap.Client.MakeBucket(ctx, bucket.Name, minio.MakeBucketOptions{})
+		if err != nil && minio.ToErrorResponse(err).Code != "BucketAlreadyOwnedByYou" {
+			return fmt.Errorf("make bucket: %w", err)
+		}
+		slog.Info("created bucket", "bucket", bucket.Name)
+	}
+	if bucket.Versioning {
+		if err := wrap.Client.EnableVersioning(ctx, bucket.Name); err != nil {
+			return fmt.Errorf("versioning: %w", err)
+		}
+	}
+	if len(bucket.Expire) > 0 {
+		if err := wrap.Client.SetBucketLifecycle(ctx, bucket.Name, lifecycleConfig(bucket.Expire)); err != nil {
+			return fmt.Errorf("lifecycle: %w", err)
+		}
+	}
+	if len(bucket.ReadPrefixes) > 0 {
+		policy, err := readPolicy(bucket.Name, bucket.ReadPrefixes)
+		if err != nil {
+			return err
+		}
+		if err := wrap.Client.SetBucketPolicy(ctx, bucket.Name, policy); err != nil {
+			return fmt.Errorf("policy: %w", err)
+		}
+	}
+	return nil
+}
+
+// lifecycleConfig returns a lifecycle configuration expiring objects.
+func lifecycleConfig(rules []ExpireRule) *lifecycle.Configuration {
+	config := lifecycle.NewConfiguration()
+	for i, r := range rules {
+		config.Rules = append(config.Rules, lifecycle.Rule{
+			ID:         fmt.Sprintf("blobproc-expire-%d", i),
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: r.Prefix},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(r.Days)},
+		})
+	}
+	return config
+}
+
+// readPolicy returns a bucket policy, that allows anonymous reads of objects
+// under the given prefixes.
+func readPolicy(bucket string, prefixes []string) (string, error) {
+	type statement struct {
+		Effect    string              `json:"Effect"`
+		Principal map[string][]string `json:"Principal"`
+		Action    []string            `json:"Action"`
+		Resource  []string            `json:"Resource"`
+	}
+	var resources []string
+	for _, prefix := range prefixes {
+		resources = append(resources, fmt.Sprintf("arn:aws:s3:::%s/%s*", bucket, prefix))
+	}
+	b, err := json.Marshal(struct {
+		Version   string      `json:"Version"`
+		Statement []statement `json:"Statement"`
+	}{
+		Version: "2012-10-17",
+		Statement: []statement{{
+			Effect:    "Allow",
+			Principal: map[string][]string{"AWS": {"*"}},
+			Action:    []string{"s3:GetObject"},
+			Resource:  resources,
+		}},
+	})
+	return string(b), err
+}
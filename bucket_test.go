@@ -0,0 +1,31 @@
+package blobproc
+
+import "testing"
+
+func TestReadPolicy(t *testing.T) {
+	var cases = []struct {
+		bucket   string
+		prefixes []string
+		result   string
+	}{
+		{
+			bucket:   "thumbnail",
+			prefixes: []string{"pdf/"},
+			result:   `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::thumbnail/pdf/*"]}]}`,
+		},
+		{
+			bucket:   "sandcrawler",
+			prefixes: []string{"text/", "grobid/"},
+			result:   `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":["*"]},"Action":["s3:GetObject"],"Resource":["arn:aws:s3:::sandcrawler/text/*","arn:aws:s3:::sandcrawler/grobid/*"]}]}`,
+		},
+	}
+	for _, c := range cases {
+		result, err := readPolicy(c.bucket, c.prefixes)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.bucket, err)
+		}
+		if result != c.result {
+			t.Fatalf("[%s] got %v, want %v", c.bucket, result, c.result)
+		}
+	}
+}
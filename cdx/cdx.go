@@ -3,79 +3,244 @@ package cdx
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
 var ErrParsingFailed = errors.New("cdx parsing failed")
 
+// DefaultFields are the CDX field letters used, if a file has no header line,
+// as written by heritrix and in the CDX-2015 format: N b a m s k r M S V g.
+var DefaultFields = []string{"N", "b", "a", "m", "s", "k", "r", "M", "S", "V", "g"}
+
 // New returns a Reader that allows to access CDX records.
 func New(r io.Reader) *Reader {
-	return &Reader{r: bufio.NewReader(r)}
+	return &Reader{r: bufio.NewReader(r), fields: DefaultFields}
 }
 
-// Record is a subset of fields from a CDX line. TODO: build this out to a full
-// CDX parser. Format documetation:
+// Record is a subset of fields from a CDX line. Format documentation:
 // https://iipc.github.io/warc-specifications/specifications/cdx-format/cdx-2015/.
 // Defaults: CDX N b a m s k r M S V g. Example:
 // 30,50,51,193)/favicon.ico 20170807235758 http://193.51.50.30/favicon.ico text/html 404 OQZG7JRK66WRSYE2XJWDQ53JJYH7K44S - - 562 543915129 MSAG-PDF-CRAWL-2017-08-04-20170807232818704-00000-00009-wbgrp-svc284/MSAG-PDF-CRAWL-2017-08-04-20170807235601196-00006-3480~wbgrp-svc284.us.archive.org~8443.warc.gz
+//
+// CDXJ records, as written by pywb and other modern tools, are supported as
+// well. Example:
+// org,example)/ 20240101120000 {"url": "https://example.org/", "mime": "text/html", "status": "200", "digest": "sha1:...", "length": "562", "offset": "543915129", "filename": "example.warc.gz"}
 type Record struct {
-	URL                  string // [2]
-	MimeType             string // [3]
-	ResponseCode         int    // [4]
-	CompressedRecordSize int    // [8]
-	CompressedOffset     int    // [9]
-	Filename             string // [10]
+	SURT                 string // N
+	Timestamp            string // b
+	URL                  string // a
+	MimeType             string // m
+	ResponseCode         int    // s, zero, if missing
+	Digest               string // k
+	CompressedRecordSize int    // S
+	CompressedOffset     int    // V
+	Filename             string // g
 }
 
 // ParseRecord parses a line into a record. Default heritrix fields for the
 // moment: CDX N b a m s k r M S V g
 func ParseRecord(line string) (*Record, error) {
-	fields := strings.Fields(line)
-	if len(fields) < 11 {
+	return ParseRecordFields(line, DefaultFields)
+}
+
+// ParseRecordFields parses a line into a record, with the field letters given
+// e.g. by a CDX header line. Unknown field letters are ignored.
+func ParseRecordFields(line string, fields []string) (*Record, error) {
+	values := strings.Fields(line)
+	if len(values) < len(fields) {
 		return nil, ErrParsingFailed
 	}
-	var err error
+	var (
+		record = &Record{}
+		err    error
+	)
+	for i, f := range fields {
+		v := values[i]
+		if v == "-" {
+			v = "" // missing value
+		}
+		switch f {
+		case "N":
+			record.SURT = v
+		case "b":
+			record.Timestamp = v
+		case "a":
+			record.URL = v
+		case "m":
+			record.MimeType = v
+		case "s":
+			record.ResponseCode, err = atoi(v)
+		case "k":
+			record.Digest = v
+		case "S":
+			record.CompressedRecordSize, err = atoi(v)
+		case "V":
+			record.CompressedOffset, err = atoi(v)
+		case "g":
+			record.Filename = v
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// cdxjBlock are the fields of a CDXJ JSON block we are interested in. Numeric
+// values are usually encoded as strings.
+type cdxjBlock struct {
+	URL      string      `json:"url"`
+	Mime     string      `json:"mime,omitempty"`
+	Status   json.Number `json:"status,omitempty"`
+	Digest   string      `json:"digest,omitempty"`
+	Length   json.Number `json:"length"`
+	Offset   json.Number `json:"offset"`
+	Filename string      `json:"filename"`
+}
+
+// ParseCDXJ parses a CDXJ line, consisting of a SURT, a timestamp and a JSON
+// block.
+func ParseCDXJ(line string) (*Record, error) {
+	parts := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	if len(parts) < 3 {
+		return nil, ErrParsingFailed
+	}
+	var block cdxjBlock
+	if err := json.Unmarshal([]byte(parts[2]), &block); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrParsingFailed, err)
+	}
 	record := &Record{
-		URL:      fields[2],
-		MimeType: fields[3],
-		Filename: fields[10],
+		SURT:      parts[0],
+		Timestamp: parts[1],
+		URL:       block.URL,
+		MimeType:  block.Mime,
+		Digest:    block.Digest,
+		Filename:  block.Filename,
 	}
-	if record.ResponseCode, err = strconv.Atoi(fields[4]); err != nil {
+	var err error
+	if record.ResponseCode, err = atoi(block.Status.String()); err != nil {
 		return nil, err
 	}
-	if record.CompressedRecordSize, err = strconv.Atoi(fields[8]); err != nil {
+	if record.CompressedRecordSize, err = atoi(block.Length.String()); err != nil {
 		return nil, err
 	}
-	if record.CompressedOffset, err = strconv.Atoi(fields[9]); err != nil {
+	if record.CompressedOffset, err = atoi(block.Offset.String()); err != nil {
 		return nil, err
 	}
 	return record, nil
 }
 
-// Reader is a CDX reader.
+// Header is the CDX header line matching the fields written by Record.CDX.
+const Header = " CDX N b a m s k r M S V g"
+
+// CDX formats the record as a CDX line, with the default fields. Missing
+// values are written as "-".
+func (r *Record) CDX() string {
+	return strings.Join([]string{
+		dash(r.SURT),
+		dash(r.Timestamp),
+		dash(r.URL),
+		dash(r.MimeType),
+		dashInt(r.ResponseCode),
+		dash(r.Digest),
+		"-", // r, redirect
+		"-", // M, meta tags
+		strconv.Itoa(r.CompressedRecordSize),
+		strconv.Itoa(r.CompressedOffset),
+		dash(r.Filename),
+	}, " ")
+}
+
+// CDXJ formats the record as a CDXJ line.
+func (r *Record) CDXJ() (string, error) {
+	block := cdxjBlock{
+		URL:      r.URL,
+		Mime:     r.MimeType,
+		Digest:   r.Digest,
+		Length:   json.Number(strconv.Itoa(r.CompressedRecordSize)),
+		Offset:   json.Number(strconv.Itoa(r.CompressedOffset)),
+		Filename: r.Filename,
+	}
+	if r.ResponseCode > 0 {
+		block.Status = json.Number(strconv.Itoa(r.ResponseCode))
+	}
+	b, err := json.Marshal(block)
+	if err != nil {
+		return "", err
+	}
+	return r.SURT + " " + r.Timestamp + " " + string(b), nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func dashInt(v int) string {
+	if v == 0 {
+		return "-"
+	}
+	return strconv.Itoa(v)
+}
+
+// isCDXJ returns true, if a line looks like a CDXJ record.
+func isCDXJ(line string) bool {
+	parts := strings.SplitN(line, " ", 3)
+	return len(parts) == 3 && strings.HasPrefix(parts[2], "{")
+}
+
+// atoi converts a string to an integer, treating missing values ("-" or the
+// empty string) as zero.
+func atoi(s string) (int, error) {
+	if s == "" || s == "-" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// Reader is a CDX reader. It detects CDX header lines, which define the
+// fields of the following records, and CDXJ records.
 type Reader struct {
-	r *bufio.Reader
+	r      *bufio.Reader
+	fields []string
 }
 
 // Next returns the next parsed CDX record or an error if processing failed.
 // Returns io.EOF, if there are no more records.
 func (r *Reader) Next() (*Record, error) {
-	line, err := r.r.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	line = strings.TrimSpace(line)
-	if strings.HasPrefix(line, "CDX") {
-		line, err = r.r.ReadString('\n')
-		if err != nil {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
 			return nil, err
 		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "!"):
+			// Empty lines and CDXJ metadata, e.g. "!OpenWayback-CDXJ 1.0".
+			continue
+		case strings.HasPrefix(line, "CDX"):
+			if fields := strings.Fields(line)[1:]; len(fields) > 0 {
+				r.fields = fields
+			}
+			continue
+		case isCDXJ(line):
+			return ParseCDXJ(line)
+		default:
+			return ParseRecordFields(line, r.fields)
+		}
 	}
-	return ParseRecord(line)
 }
 
 // Doer is a minimal http client surface.
@@ -83,14 +248,80 @@ type Doer interface {
 	Do(req http.Request) (resp http.Response, err error)
 }
 
-// LocalFetcher plucks out a blob from a downloaded, compressed WARC file using streaming gz format.
+// ErrNoPayload is returned, if a WARC record has no payload, e.g. a revisit.
+var ErrNoPayload = errors.New("record has no payload")
+
+// LocalFetcher plucks out a blob from a downloaded, compressed WARC file using
+// streaming gz format. Path is either the WARC file or a directory containing
+// the WARC files named in the records.
 type LocalFetcher struct {
 	Path string
 }
 
-// Fetch fetches the actual blob from wayback with range requests.
+// Fetch reads the single gzip member at the compressed offset of the record
+// and returns the payload of the WARC record, i.e. the HTTP response body for
+// response records or the content for resource records.
 func (f *LocalFetcher) Fetch(record *Record) ([]byte, error) {
-	return nil, nil
+	path := f.Path
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, record.Filename)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if _, err := file.Seek(int64(record.CompressedOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if record.CompressedRecordSize > 0 {
+		r = io.LimitReader(file, int64(record.CompressedRecordSize))
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	return readPayload(bufio.NewReader(zr))
+}
+
+// readPayload reads a WARC record and returns its payload.
+func readPayload(br *bufio.Reader) ([]byte, error) {
+	tp := textproto.NewReader(br)
+	version, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("%w: not a warc record: %q", ErrParsingFailed, version)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: content length: %v", ErrParsingFailed, err)
+	}
+	content := io.LimitReader(br, length)
+	switch header.Get("WARC-Type") {
+	case "response":
+		if !strings.HasPrefix(header.Get("Content-Type"), "application/http") {
+			return io.ReadAll(content)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(content), nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	case "resource":
+		return io.ReadAll(content)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNoPayload, header.Get("WARC-Type"))
+	}
 }
 
 // WaybackFetcher can fetch the blob for a given CDX record efficiently with
@@ -0,0 +1,107 @@
+package cdx
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	var cases = []struct {
+		about  string
+		input  string
+		result []Record
+		err    error
+	}{
+		{about: "empty", input: "", result: nil},
+		{
+			about: "default fields, no header",
+			input: "30,50,51,193)/favicon.ico 20170807235758 http://193.51.50.30/favicon.ico text/html 404 OQZG7JRK66WRSYE2XJWDQ53JJYH7K44S - - 562 543915129 a.warc.gz\n",
+			result: []Record{{
+				SURT:                 "30,50,51,193)/favicon.ico",
+				Timestamp:            "20170807235758",
+				URL:                  "http://193.51.50.30/favicon.ico",
+				MimeType:             "text/html",
+				ResponseCode:         404,
+				Digest:               "OQZG7JRK66WRSYE2XJWDQ53JJYH7K44S",
+				CompressedRecordSize: 562,
+				CompressedOffset:     543915129,
+				Filename:             "a.warc.gz",
+			}},
+		},
+		{
+			about: "cdx-2015 header, revisit without status, no trailing newline",
+			input: " CDX N b a m s k r M S V g\n" +
+				"org,example)/a.pdf 20150101000000 http://example.org/a.pdf warc/revisit - AAAA - - 300 1000 b.warc.gz",
+			result: []Record{{
+				SURT:                 "org,example)/a.pdf",
+				Timestamp:            "20150101000000",
+				URL:                  "http://example.org/a.pdf",
+				MimeType:             "warc/revisit",
+				Digest:               "AAAA",
+				CompressedRecordSize: 300,
+				CompressedOffset:     1000,
+				Filename:             "b.warc.gz",
+			}},
+		},
+		{
+			about: "legacy 9 field header",
+			input: " CDX N b a m s k r V g\n" +
+				"org,example)/ 20060101000000 http://example.org/ text/html 200 BBBB - 42 c.arc.gz\n",
+			result: []Record{{
+				SURT:             "org,example)/",
+				Timestamp:        "20060101000000",
+				URL:              "http://example.org/",
+				MimeType:         "text/html",
+				ResponseCode:     200,
+				Digest:           "BBBB",
+				CompressedOffset: 42,
+				Filename:         "c.arc.gz",
+			}},
+		},
+		{
+			about: "cdxj",
+			input: "!OpenWayback-CDXJ 1.0\n" +
+				`org,example)/a.pdf 20240101120000 {"url": "https://example.org/a.pdf", "mime": "application/pdf", "status": "200", "digest": "sha1:CCCC", "length": "562", "offset": "1234", "filename": "d.warc.gz"}` + "\n\n",
+			result: []Record{{
+				SURT:                 "org,example)/a.pdf",
+				Timestamp:            "20240101120000",
+				URL:                  "https://example.org/a.pdf",
+				MimeType:             "application/pdf",
+				ResponseCode:         200,
+				Digest:               "sha1:CCCC",
+				CompressedRecordSize: 562,
+				CompressedOffset:     1234,
+				Filename:             "d.warc.gz",
+			}},
+		},
+		{about: "short line", input: "org,example)/ 20240101120000 http://example.org/\n", err: ErrParsingFailed},
+		{about: "broken cdxj", input: "org,example)/ 20240101120000 {\"url\": \n", err: ErrParsingFailed},
+	}
+	for _, c := range cases {
+		var (
+			r      = New(strings.NewReader(c.input))
+			result []Record
+			err    error
+		)
+		for {
+			var record *Record
+			record, err = r.Next()
+			if err != nil {
+				break
+			}
+			result = append(result, *record)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		}
+		if !reflect.DeepEqual(result, c.result) {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, result, c.result)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cdx_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miku/blobproc/cdx"
+	"github.com/miku/blobproc/warcutil"
+)
+
+// writeWARC writes a compressed WARC file with one gzip member per record.
+func writeWARC(t *testing.T, path string, records ...string) {
+	var buf bytes.Buffer
+	for _, r := range records {
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func warcRecord(typ, uri, contentType, block string) string {
+	return fmt.Sprintf("WARC/1.0\r\nWARC-Type: %s\r\nWARC-Target-URI: %s\r\n"+
+		"WARC-Date: 2024-01-01T12:00:00Z\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s\r\n\r\n",
+		typ, uri, contentType, len(block), block)
+}
+
+func TestLocalFetcher(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "test.warc.gz")
+	)
+	writeWARC(t, path,
+		warcRecord("warcinfo", "", "application/warc-fields", "software: test\r\n"),
+		warcRecord("response", "http://example.org/a.pdf", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\nContent-Length: 8\r\n\r\n%PDF-1.4"),
+		warcRecord("resource", "file:///notes.txt", "text/plain", "notes"),
+		warcRecord("revisit", "http://example.org/a.pdf", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\n\r\n"),
+	)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []*cdx.Record
+	ix := &warcutil.Indexer{Filename: "test.warc.gz"}
+	if err := ix.Records(f, func(r *cdx.Record) error {
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about   string
+		fetcher *cdx.LocalFetcher
+		record  *cdx.Record
+		result  string
+		err     error
+	}{
+		{"response from file", &cdx.LocalFetcher{Path: path}, records[0], "%PDF-1.4", nil},
+		{"response from dir", &cdx.LocalFetcher{Path: dir}, records[0], "%PDF-1.4", nil},
+		{"resource", &cdx.LocalFetcher{Path: path}, records[1], "notes", nil},
+		{"revisit", &cdx.LocalFetcher{Path: path}, records[2], "", cdx.ErrNoPayload},
+	}
+	for _, c := range cases {
+		b, err := c.fetcher.Fetch(c.record)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		}
+		if string(b) != c.result {
+			t.Fatalf("[%s] got %q, want %q", c.about, b, c.result)
+		}
+	}
+}
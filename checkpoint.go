@@ -0,0 +1,179 @@
+package blobproc
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Checkpoint records the last fully processed shard of a spool directory in a
+// file, so a restarted walk can skip shards it has already seen. A shard is
+// identified by its two level prefix, e.g. "3f/a2". The spool must be walked
+// in lexical order, one file after another, as done by filepath.Walk.
+//
+// Files are registered with Add when they are dispatched and with Done after
+// processing. A shard is complete, once the walk moved past it and all its
+// files are done. The checkpoint only advances over contiguous complete
+// shards, so no file is skipped on restart, even if workers finish out of
+// order.
+type Checkpoint struct {
+	Path string // File to persist the checkpoint in.
+	Dir  string // Spool directory.
+
+	mu          sync.Mutex
+	last        string         // Last complete shard, loaded or advanced.
+	order       []string       // Shards seen, in walk order, not yet complete.
+	outstanding map[string]int // Number of files dispatched, but not done.
+	current     string         // Shard currently walked.
+}
+
+// OpenCheckpoint returns a checkpoint for a spool directory, reading a
+// previous checkpoint from path, if it exists.
+func OpenCheckpoint(path, dir string) (*Checkpoint, error) {
+	c := &Checkpoint{
+		Path:        path,
+		Dir:         dir,
+		outstanding: make(map[string]int),
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		c.last = strings.TrimSpace(string(b))
+		if c.last != "" {
+			slog.Info("resuming walk from checkpoint", "shard", c.last, "checkpoint", path)
+		}
+	}
+	return c, nil
+}
+
+// Last returns the last complete shard, or the empty string.
+func (c *Checkpoint) Last() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// shard returns the two level shard prefix for a path in the spool, or the
+// empty string, if the path is not within a shard.
+func (c *Checkpoint) shard(path string) string {
+	rel, err := filepath.Rel(c.Dir, path)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 || parts[0] == ".." {
+		return ""
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// SkipDir returns true, if a directory belongs to shards that have been
+// completely processed in a previous run.
+func (c *Checkpoint) SkipDir(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == "" {
+		return false
+	}
+	rel, err := filepath.Rel(c.Dir, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	switch {
+	case rel == "." || parts[0] == "..":
+		return false
+	case len(parts) == 1:
+		// A first level shard can be skipped, if all its second level shards
+		// are done, that is, if it sorts before the checkpoint.
+		return parts[0] < c.last[:strings.Index(c.last+"/", "/")]
+	case len(parts) == 2:
+		return parts[0]+"/"+parts[1] <= c.last
+	default:
+		return false
+	}
+}
+
+// Add registers a file that is about to be processed.
+func (c *Checkpoint) Add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shard := c.shard(path)
+	if shard == "" {
+		return
+	}
+	if shard != c.current {
+		c.current = shard
+		c.order = append(c.order, shard)
+	}
+	c.outstanding[shard]++
+}
+
+// Done marks a previously added file as processed.
+func (c *Checkpoint) Done(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shard := c.shard(path)
+	if shard == "" {
+		return
+	}
+	c.outstanding[shard]--
+	c.advance()
+}
+
+// advance moves the checkpoint forward over all complete shards and persists
+// it, if it changed. The currently walked shard is never complete, since more
+// files may follow.
+func (c *Checkpoint) advance() {
+	var i int
+	for i < len(c.order) {
+		shard := c.order[i]
+		if c.outstanding[shard] > 0 || shard == c.current {
+			break
+		}
+		delete(c.outstanding, shard)
+		c.last = shard
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	c.order = c.order[i:]
+	if err := c.write(); err != nil {
+		slog.Warn("could not write checkpoint", "err", err, "checkpoint", c.Path)
+	}
+}
+
+// write persists the checkpoint atomically.
+func (c *Checkpoint) write() error {
+	tmp := c.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(c.last+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// Finish is called after the walk ended and all files have been processed.
+// If the walk completed, the checkpoint file is removed, so the next run
+// starts from the beginning again. Otherwise the checkpoint is advanced as
+// far as possible.
+func (c *Checkpoint) Finish(complete bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if complete {
+		c.last, c.order = "", nil
+		if err := os.Remove(c.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	c.advance()
+	return nil
+}
@@ -0,0 +1,103 @@
+package blobproc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointSkipDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "checkpoint")
+	if err := os.WriteFile(file, []byte("3f/a2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenCheckpoint(file, "/spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		path   string
+		result bool
+	}{
+		{"/spool", false},
+		{"/spool/00", true},
+		{"/spool/3e", true},
+		{"/spool/3f", false},
+		{"/spool/40", false},
+		{"/spool/3f/00", true},
+		{"/spool/3f/a2", true},
+		{"/spool/3f/a3", false},
+		{"/spool/40/00", false},
+		{"/other/00", false},
+	}
+	for _, tc := range cases {
+		if got := c.SkipDir(tc.path); got != tc.result {
+			t.Fatalf("[%s] got %v, want %v", tc.path, got, tc.result)
+		}
+	}
+}
+
+func TestCheckpointAdvance(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		file = filepath.Join(dir, "checkpoint")
+	)
+	c, err := OpenCheckpoint(file, "/spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readCheckpoint := func() string {
+		b, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(b))
+	}
+	c.Add("/spool/00/00/a")
+	c.Add("/spool/00/00/b")
+	c.Add("/spool/00/01/c")
+	c.Add("/spool/01/00/d")
+	// Shard 00/01 finishes first, but 00/00 is still outstanding.
+	c.Done("/spool/00/01/c")
+	if got := readCheckpoint(); got != "" {
+		t.Fatalf("got %q, want empty checkpoint", got)
+	}
+	c.Done("/spool/00/00/a")
+	c.Done("/spool/00/00/b")
+	if got := c.Last(); got != "00/01" {
+		t.Fatalf("got %v, want %v", got, "00/01")
+	}
+	if got := readCheckpoint(); got != "00/01" {
+		t.Fatalf("got %v, want %v", got, "00/01")
+	}
+	// The current shard is not complete, until the walk moves on.
+	c.Done("/spool/01/00/d")
+	if got := c.Last(); got != "00/01" {
+		t.Fatalf("got %v, want %v", got, "00/01")
+	}
+	if err := c.Finish(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCheckpoint(); got != "00/01" {
+		t.Fatalf("got %v, want %v", got, "00/01")
+	}
+	// A resumed walk picks up the checkpoint, a completed walk removes it.
+	c, err = OpenCheckpoint(file, "/spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Last(); got != "00/01" {
+		t.Fatalf("got %v, want %v", got, "00/01")
+	}
+	if err := c.Finish(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want checkpoint file removed", err)
+	}
+}
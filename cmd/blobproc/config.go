@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miku/blobproc"
+)
+
+// grobidOptions are only set in the config file, there are no flags for them.
+var grobidOptions = defaults.Grobid.Options
+
+// profiles are only set in the config file.
+var profiles []blobproc.Profile
+
+// configFlags maps config values to command line flags.
+func configFlags(cfg *blobproc.Config) map[string]string {
+	return map[string]string{
+		"spool":               cfg.Spool,
+		"logfile":             cfg.Log.File,
+		"debug":               strconv.FormatBool(cfg.Log.Debug),
+		"T":                   cfg.Processing.Timeout.String(),
+		"k":                   strconv.FormatBool(cfg.Processing.KeepSpool),
+		"P":                   strconv.FormatBool(cfg.Processing.Parallel),
+		"w":                   strconv.Itoa(cfg.Processing.Workers),
+		"grobid-workers":      strconv.Itoa(cfg.Processing.GrobidWorkers),
+		"scratch":             cfg.Processing.ScratchDir,
+		"min-scratch-free":    strconv.FormatInt(cfg.Processing.MinScratchFree, 10),
+		"sweep-age":           cfg.Processing.SweepAge.String(),
+		"stages":              strings.Join(cfg.Processing.Stages, ","),
+		"parallel-walk":       strconv.FormatBool(cfg.Processing.ParallelWalk),
+		"s3-spool":            cfg.Processing.S3Spool,
+		"s3-spool-shard":      cfg.Processing.S3SpoolShard,
+		"lease-ttl":           cfg.Processing.LeaseTTL.String(),
+		"order":               cfg.Processing.Order,
+		"rejected":            cfg.Processing.RejectedDir,
+		"require":             strings.Join(cfg.Processing.Require, ","),
+		"failed":              cfg.Processing.FailedDir,
+		"trash":               cfg.Processing.TrashDir,
+		"trash-retention":     cfg.Processing.TrashRetention.String(),
+		"checkpoint":          cfg.Processing.Checkpoint,
+		"pidfile":             cfg.Processing.Pidfile,
+		"tool-memory-limit":   strconv.FormatInt(cfg.Processing.ToolMemoryLimit, 10),
+		"tool-cpu-limit":      cfg.Processing.ToolCPULimit.String(),
+		"cache":               strconv.FormatBool(cfg.Processing.Cache),
+		"min-text-quality":    strconv.FormatFloat(cfg.Processing.MinTextQuality, 'f', -1, 64),
+		"first-page":          strconv.FormatBool(cfg.Processing.FirstPage),
+		"max-filesize":        strconv.FormatInt(cfg.Processing.MaxFileSize, 10),
+		"max-pages":           strconv.Itoa(cfg.Processing.MaxPages),
+		"max-page-size":       strconv.FormatFloat(cfg.Processing.MaxPageSize, 'f', -1, 64),
+		"pdfcpu":              cfg.Processing.PDFCPU,
+		"trust-spool-names":   strconv.FormatBool(cfg.Processing.TrustSpoolNames),
+		"store-result":        strconv.FormatBool(cfg.Processing.StoreResult),
+		"grobid-host":         cfg.Grobid.Host,
+		"references-only":     strconv.FormatBool(cfg.Grobid.ReferencesOnly),
+		"grobid-max-filesize": strconv.FormatInt(cfg.Grobid.MaxFileSize, 10),
+		"raw-bucket":          cfg.S3.RawBucket,
+		"raw-folder":          cfg.S3.RawFolder,
+		"urlmap":              cfg.Server.URLMap,
+		"s3-endpoint":         cfg.S3.Endpoint,
+		"s3-access-key":       cfg.S3.AccessKey,
+		"s3-secret-key":       cfg.S3.SecretKey,
+		"s3-signature":        cfg.S3.Signature,
+		"s3-region":           cfg.S3.Region,
+		"s3-path-style":       strconv.FormatBool(cfg.S3.PathStyle),
+		"otlp-endpoint":       cfg.Tracing.OTLPEndpoint,
+	}
+}
+
+// flagConfig sets flags from the config file, unless given on the command
+// line, also on reload.
+var flagConfig = &blobproc.FlagConfig{FlagSet: flag.CommandLine, Flags: configFlags}
+
+// applyConfig reads the config file, if any, and BLOBPROC_* environment
+// variables and sets all flags, that have not been given on the command line.
+func applyConfig() error {
+	flagConfig.File = *configFile
+	cfg, err := flagConfig.Apply()
+	if err != nil {
+		return err
+	}
+	grobidOptions = cfg.Grobid.Options
+	profiles = cfg.Profiles
+	return nil
+}
+
+// reloader applies safe-to-change settings from the config file on SIGHUP.
+// Walker and pipeline are optional.
+type reloader struct {
+	level    *slog.LevelVar
+	walker   *blobproc.WalkFast
+	pipeline *blobproc.Pipeline
+}
+
+// run reloads the config on each SIGHUP, until the context is cancelled.
+func (r *reloader) run(ctx context.Context) {
+	flagConfig.ReloadOnHangup(ctx, r.level, r.reload)
+}
+
+// reload applies number of workers, GROBID host and options, unless given on
+// the command line. Other settings require a restart.
+func (r *reloader) reload(cfg *blobproc.Config) error {
+	if r.walker != nil && !flagConfig.Cmdline("w") {
+		if err := r.walker.SetWorkers(cfg.Processing.Workers); err != nil {
+			return err
+		}
+	}
+	if r.pipeline != nil && !flagConfig.Cmdline("grobid-host") && cfg.Grobid.Host != *grobidHost {
+		r.pipeline.SetGrobid(blobproc.NewGrobid(cfg.Grobid.Host))
+		*grobidHost = cfg.Grobid.Host
+	}
+	if r.pipeline != nil {
+		r.pipeline.SetGrobidOptions(cfg.Grobid.Options)
+	}
+	slog.Info("settings reloaded", "workers", cfg.Processing.Workers, "grobid", *grobidHost)
+	return nil
+}
+
+// runConfig implements the config subcommand.
+func runConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	probe := fs.Bool("probe", false, "check, that GROBID and S3 are reachable (validate)")
+	showSecrets := fs.Bool("show-secrets", false, "do not mask S3 credentials (env)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc config validate [-probe] [FILE]")
+		fmt.Fprintln(fs.Output(), "       blobproc config env [-show-secrets] [FILE]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "validate checks value ranges, unknown keys and a writable spool directory;")
+		fmt.Fprintln(fs.Output(), "env prints the effective config as BLOBPROC_* environment variables.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "env") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	filename := blobproc.ConfigPath(fs.Arg(0))
+	if args[0] == "env" {
+		cfg, err := blobproc.LoadConfigEnv(filename)
+		if err != nil {
+			return err
+		}
+		for _, k := range cfg.Keys() {
+			v := k.Value()
+			if !*showSecrets && v != "" && strings.HasSuffix(k.Key, "_key") {
+				v = "***"
+			}
+			fmt.Printf("%s=%s\n", k.Env, v)
+		}
+		return nil
+	}
+	if filename == "" {
+		return errors.New("no config file given and no default config found at " + blobproc.DefaultConfigPath)
+	}
+	cfg, err := blobproc.LoadConfigEnv(filename)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Check(context.Background(), *probe); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, line)
+		}
+		return fmt.Errorf("%s: config invalid", filename)
+	}
+	fmt.Printf("%s: ok\n", filename)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miku/blobproc"
+	"github.com/miku/blobproc/pdfextract"
+)
+
+// samplePDF is a single page PDF used for an end-to-end extraction check.
+//
+//go:embed sample.pdf
+var samplePDF []byte
+
+// doctorTool is an external tool to look for, with the arguments to print its
+// version.
+type doctorTool struct {
+	Name     string
+	Args     []string
+	Optional bool
+}
+
+var doctorTools = []doctorTool{
+	{Name: "pdftotext", Args: []string{"-v"}},
+	{Name: "pdftoppm", Args: []string{"-v"}},
+	{Name: "pdfinfo", Args: []string{"-v"}},
+	{Name: "pdfcpu", Args: []string{"version"}},
+	{Name: "pdfimages", Args: []string{"-v"}, Optional: true},
+	{Name: "tesseract", Args: []string{"--version"}, Optional: true},
+	{Name: "qpdf", Args: []string{"--version"}, Optional: true},
+	{Name: "mutool", Args: []string{"-v"}, Optional: true},
+}
+
+// toolVersion returns the first line of the version output of a tool.
+func toolVersion(ctx context.Context, t doctorTool) (string, error) {
+	path, err := exec.LookPath(t.Name)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	// Some tools print the version to stderr and exit non-zero.
+	out, _ := exec.CommandContext(ctx, path, t.Args...).CombinedOutput()
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	if line == "" {
+		line = path
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// runDoctor implements the doctor subcommand, checking that everything needed
+// for processing is in place.
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var (
+		config  = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		offline = fs.Bool("offline", false, "do not check GROBID and S3 connectivity")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc doctor [-config FILE] [-offline]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Checks external tools and their versions, runs an extraction on a sample")
+		fmt.Fprintln(fs.Output(), "PDF and verifies that GROBID and S3 are reachable.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var (
+		ctx    = context.Background()
+		tw     = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		failed int
+	)
+	report := func(ok bool, check, detail string) {
+		status := "ok"
+		if !ok {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, check, detail)
+	}
+	// External tools
+	// --------------
+	for _, t := range doctorTools {
+		version, err := toolVersion(ctx, t)
+		switch {
+		case err == nil:
+			report(true, t.Name, version)
+		case t.Optional:
+			fmt.Fprintf(tw, "-\t%s\tnot installed (optional)\n", t.Name)
+		default:
+			report(false, t.Name, "not installed")
+		}
+	}
+	// End-to-end extraction
+	// ---------------------
+	tempDir, err := os.MkdirTemp("", "blobproc-doctor-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	extractCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	result := pdfextract.ProcessBlob(extractCtx, samplePDF, &pdfextract.Options{
+		Dim:       pdfextract.Dim{W: 180, H: 300},
+		ThumbType: "JPEG",
+		TempDir:   tempDir,
+	})
+	switch {
+	case result.Status != pdfextract.StatusSuccess:
+		report(false, "extraction", fmt.Sprintf("%s: %s: %v", result.Status, result.Code, result.Err))
+	case !strings.Contains(result.Text, "blobproc doctor sample"):
+		report(false, "extraction", fmt.Sprintf("unexpected text: %q", result.Text))
+	default:
+		report(true, "extraction", fmt.Sprintf("sample PDF, %d bytes text, thumbnail: %v",
+			len(result.Text), result.HasPage0Thumbnail()))
+	}
+	// Configuration and services
+	// --------------------------
+	filename := blobproc.ConfigPath(*config)
+	cfg, err := blobproc.LoadConfigEnv(filename)
+	switch {
+	case err != nil:
+		report(false, "config", err.Error())
+		cfg = blobproc.DefaultConfig()
+	case filename == "":
+		report(true, "config", "no config file, using defaults and environment")
+	default:
+		report(true, "config", filename)
+	}
+	if err := cfg.Check(ctx, !*offline); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			report(false, "config", line)
+		}
+	} else if !*offline {
+		report(true, "services", fmt.Sprintf("grobid %s, s3 %s", cfg.Grobid.Host, cfg.S3.Endpoint))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("doctor: %d checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miku/blobproc"
+)
+
+// runExport implements the export subcommand, writing a kind of derivative
+// for a list of files into a directory or a bundle.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		config      = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		kind        = fs.String("kind", "text", "kind of derivative to export")
+		ids         = fs.String("ids", "", "file with one SHA1 per line, FILE argument or stdin if empty")
+		dir         = fs.String("dir", "", "directory to write derivatives to, as SHA1 with the extension of the kind")
+		output      = fs.String("o", "", "bundle to write derivatives to, a .tar, .tar.gz, .tgz or .zip file, - for a tar stream on stdout")
+		concurrency = fs.Int("c", 8, "number of parallel S3 requests")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc export [-config FILE] [-kind KIND] [-c N] -dir DIR|-o FILE [-ids FILE|FILE]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Fetches a kind of derivative for each SHA1 read from the ids file or stdin,")
+		fmt.Fprintln(fs.Output(), "one per line, and writes them to a directory or a tar or zip bundle, named")
+		fmt.Fprintln(fs.Output(), "by SHA1 with the extension of the kind. The bundle format follows from the")
+		fmt.Fprintln(fs.Output(), "file extension. Missing derivatives are reported on stderr. KIND is one of:")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintf(fs.Output(), "  %s\n", strings.Join(blobproc.DerivativeKinds(), ", "))
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "or raw for the archived original, if s3.raw_bucket is set.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*dir == "") == (*output == "") || fs.NArg() > 1 || (*ids != "" && fs.NArg() == 1) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if fs.NArg() == 1 {
+		*ids = fs.Arg(0)
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	registerRawDerivative(cfg.S3.RawBucket, cfg.S3.RawFolder)
+	d, err := blobproc.LookupDerivative(*kind)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *ids != "" {
+		f, err := os.Open(*ids)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	set, err := blobproc.ReadSHA1Set(r)
+	if err != nil {
+		return err
+	}
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	var b bundle
+	if *dir != "" {
+		b, err = newDirBundle(*dir)
+	} else {
+		b, err = newFileBundle(*output)
+	}
+	if err != nil {
+		return err
+	}
+	defer b.Abort()
+	reqs := make([]blobproc.BlobRequestOptions, len(set))
+	for i, digest := range set {
+		reqs[i] = *d.Request(hex.EncodeToString(digest[:]), nil)
+	}
+	ext := d.Ext
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		exported    int
+		missing     int
+	)
+	defer cancel()
+	for result := range wrapS3.GetMany(ctx, reqs, *concurrency) {
+		switch {
+		case errors.Is(result.Err, iofs.ErrNotExist):
+			fmt.Fprintf(os.Stderr, "missing\t%s\n", result.Req.SHA1Hex)
+			missing++
+			continue
+		case result.Err != nil:
+			return fmt.Errorf("%s: %w", result.Req.SHA1Hex, result.Err)
+		}
+		if err := b.Add(result.Req.SHA1Hex+ext, result.Blob); err != nil {
+			return err
+		}
+		exported++
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d, missing %d\n", exported, missing)
+	return nil
+}
+
+// bundle receives exported derivatives.
+type bundle interface {
+	Add(name string, blob []byte) error
+	// Close completes the bundle.
+	Close() error
+	// Abort removes an incomplete bundle, after Close it does nothing.
+	Abort()
+}
+
+// dirBundle writes derivatives as files into a directory.
+type dirBundle struct{ dir string }
+
+func newDirBundle(dir string) (*dirBundle, error) {
+	return &dirBundle{dir: dir}, os.MkdirAll(dir, 0755)
+}
+
+func (b *dirBundle) Add(name string, blob []byte) error {
+	return os.WriteFile(filepath.Join(b.dir, name), blob, 0644)
+}
+
+func (b *dirBundle) Close() error { return nil }
+func (b *dirBundle) Abort()       {}
+
+// fileBundle writes derivatives into a tar or zip file, which only appears
+// under its name once complete, or as a tar stream to stdout.
+type fileBundle struct {
+	name   string
+	f      *os.File // temporary file, nil for stdout
+	tw     *tar.Writer
+	zw     *zip.Writer
+	closer []func() error // in order, innermost writer first
+	now    time.Time
+	done   bool
+}
+
+func newFileBundle(name string) (*fileBundle, error) {
+	b := &fileBundle{name: name, now: time.Now()}
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+		if err != nil {
+			return nil, err
+		}
+		b.f, w = f, f
+	}
+	bw := bufio.NewWriter(w)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		b.zw = zip.NewWriter(bw)
+		b.closer = append(b.closer, b.zw.Close)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		gw := gzip.NewWriter(bw)
+		b.tw = tar.NewWriter(gw)
+		b.closer = append(b.closer, b.tw.Close, gw.Close)
+	case strings.HasSuffix(name, ".tar"), name == "-":
+		b.tw = tar.NewWriter(bw)
+		b.closer = append(b.closer, b.tw.Close)
+	default:
+		b.Abort()
+		return nil, fmt.Errorf("unknown bundle format: %s, use .tar, .tar.gz, .tgz or .zip", name)
+	}
+	b.closer = append(b.closer, bw.Flush)
+	return b, nil
+}
+
+func (b *fileBundle) Add(name string, blob []byte) error {
+	if b.zw != nil {
+		w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: b.now})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(blob)
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(blob)), ModTime: b.now}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(blob)
+	return err
+}
+
+func (b *fileBundle) Close() error {
+	for _, fn := range b.closer {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	if b.f != nil {
+		if err := b.f.Close(); err != nil {
+			return err
+		}
+		// Temporary files are created with mode 0600, use the same mode as
+		// for files written by dirBundle.
+		if err := os.Chmod(b.f.Name(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(b.f.Name(), b.name); err != nil {
+			return err
+		}
+	}
+	b.done = true
+	return nil
+}
+
+func (b *fileBundle) Abort() {
+	if b.done || b.f == nil {
+		return
+	}
+	b.f.Close()
+	os.Remove(b.f.Name())
+}
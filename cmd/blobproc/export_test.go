@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readBundle returns the entries of a tar or zip bundle, by name.
+func readBundle(t *testing.T, name string) map[string]string {
+	entries := make(map[string]string)
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[f.Name] = string(b)
+		}
+		return entries
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = string(b)
+	}
+	return entries
+}
+
+func TestFileBundle(t *testing.T) {
+	var cases = []struct {
+		about string
+		name  string
+	}{
+		{"tar", "bundle.tar"},
+		{"tar.gz", "bundle.tar.gz"},
+		{"tgz", "bundle.tgz"},
+		{"zip", "bundle.zip"},
+	}
+	want := map[string]string{
+		"4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.tei.xml": "<TEI/>",
+		"4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.txt":     "hello",
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		name := filepath.Join(dir, c.name)
+		b, err := newFileBundle(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range want {
+			if err := b.Add(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The bundle only appears under its name once complete.
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("[%s] got %v, want incomplete bundle hidden", c.about, err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0644 {
+			t.Fatalf("[%s] got %v, want %v", c.about, fi.Mode().Perm(), os.FileMode(0644))
+		}
+		got := readBundle(t, name)
+		if len(got) != len(want) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, want)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatalf("[%s] got %v, want %v", c.about, got[k], v)
+			}
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("[%s] got %v, want only the bundle", c.about, len(entries))
+		}
+	}
+	if _, err := newFileBundle(filepath.Join(t.TempDir(), "bundle.rar")); err == nil {
+		t.Fatalf("got nil, want error for unknown format")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miku/blobproc/warcutil"
+)
+
+// runExtract implements the extract subcommand, writing the payloads of WARC
+// files to a directory, with a manifest to trace them back to their records.
+func runExtract(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	var (
+		dir        = fs.String("dir", ".", "directory to write payloads to")
+		sha1Names  = fs.Bool("sha1", false, "name files by the SHA1 of their content, instead of the URL")
+		manifest   = fs.String("manifest", "", "append a JSON line per file written to this file, defaults to manifest.jsonl in the directory, - to disable")
+		verify     = fs.Bool("verify", false, "only keep files, whose content matches their media type")
+		quarantine = fs.String("quarantine", "", "with -verify, move mismatching files here, instead of removing them")
+		minSize    = fs.Int64("min-size", 0, "skip payloads smaller than this number of bytes")
+		maxSize    = fs.Int64("max-size", 0, "skip payloads larger than this number of bytes, 0 means no limit")
+		types      = fs.String("types", "application/pdf", "comma separated media types of payloads to extract, all if empty")
+		workers    = fs.Int("w", 0, "number of payloads to write concurrently")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc extract [-dir DIR] [-sha1] [-verify] FILE.warc.gz [FILE ...]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Writes the payloads of successful responses and resources in WARC files to a")
+		fmt.Fprintln(fs.Output(), "directory and appends a line for each file to a manifest, with the URL,")
+		fmt.Fprintln(fs.Output(), "SHA1, size, content type, WARC file and record offset.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	d := &warcutil.DirProcessor{
+		Dir:        *dir,
+		NameBySHA1: *sha1Names,
+		Verify:     *verify,
+		Quarantine: *quarantine,
+	}
+	if *manifest == "" {
+		*manifest = filepath.Join(*dir, "manifest.jsonl")
+	}
+	if *manifest != "-" {
+		if err := os.MkdirAll(filepath.Dir(*manifest), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(*manifest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		d.Manifest = f
+	}
+	var (
+		e = &warcutil.Extractor{
+			MinPayloadSize: *minSize,
+			MaxPayloadSize: *maxSize,
+			Processors:     []warcutil.Processor{d},
+			Workers:        *workers,
+		}
+		total = new(warcutil.ExtractStats)
+	)
+	if *types != "" {
+		for _, t := range strings.Split(*types, ",") {
+			e.MediaTypes = append(e.MediaTypes, strings.TrimSpace(t))
+		}
+	}
+	for _, name := range fs.Args() {
+		stats, err := extractFile(e, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		total.Add(stats)
+	}
+	return json.NewEncoder(os.Stdout).Encode(total)
+}
+
+// extractFile extracts the payloads of a single WARC file.
+func extractFile(e *warcutil.Extractor, name string) (*warcutil.ExtractStats, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e.Filename = filepath.Base(name)
+	return e.Extract(f)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miku/blobproc"
+)
+
+// runGC implements the gc subcommand, reporting or deleting derivatives of
+// files, that are not known.
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var (
+		config     = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		knownFile  = fs.String("known", "", "file with the SHA1 of all files, whose derivatives are kept, one per line")
+		urlMapFile = fs.String("urlmap", "", "URL map database, derivatives of files with an URL, state or stored derivative recorded are kept")
+		kinds      = fs.String("kinds", "", "comma separated kinds of derivatives to check, all but raw if empty")
+		minAge     = fs.Duration("min-age", 24*time.Hour, "keep derivatives modified more recently, e.g. by a running blobproc")
+		del        = fs.Bool("delete", false, "delete orphaned derivatives, only report them otherwise")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc gc [-config FILE] -known FILE|-urlmap FILE [-kinds KINDS] [-min-age D] [-delete]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Lists derivatives in S3, whose file is neither in the known list nor in the")
+		fmt.Fprintln(fs.Output(), "URL map, with kind, location and size. They are only deleted with -delete.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*knownFile == "") == (*urlMapFile == "") || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	registerRawDerivative(cfg.S3.RawBucket, cfg.S3.RawFolder)
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	gc := &blobproc.GC{S3: wrapS3, MinAge: *minAge, Delete: *del}
+	if *kinds != "" {
+		for _, kind := range strings.Split(*kinds, ",") {
+			if _, err := blobproc.LookupDerivative(strings.TrimSpace(kind)); err != nil {
+				return err
+			}
+			gc.Kinds = append(gc.Kinds, strings.TrimSpace(kind))
+		}
+	}
+	switch {
+	case *knownFile != "":
+		f, err := os.Open(*knownFile)
+		if err != nil {
+			return err
+		}
+		set, err := blobproc.ReadSHA1Set(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", *knownFile, err)
+		}
+		if len(set) == 0 {
+			// Most likely a mistake, that would make every derivative an
+			// orphan.
+			return errors.New("no SHA1 in known list")
+		}
+		gc.Known = set.Contains
+	default:
+		if _, err := os.Stat(*urlMapFile); err != nil {
+			return err
+		}
+		urlMap := &blobproc.URLMap{Path: *urlMapFile}
+		if err := urlMap.EnsureDB(); err != nil {
+			return err
+		}
+		defer urlMap.Close()
+		gc.Known = urlMap.Known
+	}
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	stats, err := gc.Run(context.Background(), func(d blobproc.DerivativeInfo) {
+		fmt.Fprintf(bw, "%s\t%s/%s\t%d\n", d.Kind, d.Bucket, d.Path, d.Size)
+	})
+	fmt.Fprintf(os.Stderr, "checked %d, orphaned %d (%d bytes), deleted %d\n",
+		stats.Checked, stats.Orphaned, stats.OrphanedBytes, stats.Deleted)
+	return err
+}
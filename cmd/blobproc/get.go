@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miku/blobproc"
+)
+
+// runGet implements the get subcommand, writing a derivative to stdout.
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	var (
+		config = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		output = fs.String("o", "", "output file, stdout if empty")
+		list   = fs.Bool("l", false, "list all stored derivatives of a file, with size and modification time")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc get [-config FILE] [-o FILE] KIND SHA1")
+		fmt.Fprintln(fs.Output(), "       blobproc get [-config FILE] -l SHA1")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Fetches a derivative from S3. KIND is one of:")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintf(fs.Output(), "  %s\n", strings.Join(blobproc.DerivativeKinds(), ", "))
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "or raw for the archived original, if s3.raw_bucket is set.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	registerRawDerivative(cfg.S3.RawBucket, cfg.S3.RawFolder)
+	if (*list && fs.NArg() != 1) || (!*list && fs.NArg() != 2) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	sha1hex := strings.ToLower(fs.Arg(fs.NArg() - 1))
+	if len(sha1hex) != 40 {
+		return fmt.Errorf("%w: %s", blobproc.ErrInvalidHash, sha1hex)
+	}
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	if *list {
+		derivatives, err := wrapS3.ListForSHA1(context.Background(), sha1hex)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, d := range derivatives {
+			fmt.Fprintf(tw, "%s\t%s/%s\t%d\t%s\n", d.Kind, d.Bucket, d.Path, d.Size, d.LastModified.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+	kind := fs.Arg(0)
+	b, err := wrapS3.GetDerivative(context.Background(), sha1hex, kind)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		return os.WriteFile(*output, b, 0644)
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
+
+// registerRawDerivative makes the archived original available as the "raw"
+// derivative, if a raw bucket is configured.
+func registerRawDerivative(bucket, folder string) {
+	if bucket == "" {
+		return
+	}
+	blobproc.RegisterDerivative("raw", blobproc.Derivative{Bucket: bucket, Folder: folder, Ext: "pdf"})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/miku/blobproc"
+)
+
+// runImport implements the import subcommand, seeding the spool from local
+// directories and tarballs.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		config     = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		spoolDir   = fs.String("spool", "", "spool directory to import into, defaults to the spool of the config")
+		provenance = fs.Bool("provenance", false, "record the original location of each file as file URL in a metadata sidecar, the URL and crawl timestamp for WARC payloads")
+		minSize    = fs.Int64("min-size", 0, "skip files smaller than this number of bytes")
+		maxSize    = fs.Int64("max-size", 0, "skip files larger than this number of bytes, 0 means no limit")
+		types      = fs.String("types", "application/pdf", "comma separated media types of WARC payloads to import, all if empty")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc import [-config FILE] [-spool DIR] [-provenance] DIR|TAR|WARC|- ...")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Copies all files of directory trees or tarballs, optionally gzip compressed,")
+		fmt.Fprintln(fs.Output(), "or the payloads of successful responses in WARC files, named .warc or")
+		fmt.Fprintln(fs.Output(), ".warc.gz, into the spool directory, sharded by the SHA1 of their content.")
+		fmt.Fprintln(fs.Output(), "Files already in the spool are skipped, so an interrupted import can be run")
+		fmt.Fprintln(fs.Output(), "again.")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "With -, a WARC file, a tarball or a length prefixed stream of files is read")
+		fmt.Fprintln(fs.Output(), "from stdin, the latter with each file preceded by a line with its size and")
+		fmt.Fprintln(fs.Output(), "an optional name or URL:")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "  <size> [name]\\n<content>")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *spoolDir == "" {
+		cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+		if err != nil {
+			return err
+		}
+		*spoolDir = cfg.Spool
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var (
+		opts = &blobproc.ImportOptions{
+			Spool:      *spoolDir,
+			Provenance: *provenance,
+			MinSize:    *minSize,
+			MaxSize:    *maxSize,
+		}
+		stats = new(blobproc.ImportStats)
+		err   error
+	)
+	if *types != "" {
+		for _, t := range strings.Split(*types, ",") {
+			opts.MediaTypes = append(opts.MediaTypes, strings.TrimSpace(t))
+		}
+	}
+	for _, src := range fs.Args() {
+		if err = blobproc.Import(ctx, src, opts, stats); err != nil {
+			break
+		}
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(stats); err != nil {
+		return err
+	}
+	return err
+}
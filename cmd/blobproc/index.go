@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/miku/blobproc/warcutil"
+)
+
+// runIndex implements the index subcommand, writing CDX or CDXJ lines for WARC
+// files to stdout.
+func runIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	cdxj := fs.Bool("cdxj", false, "emit CDXJ instead of CDX")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc index [-cdxj] FILE.warc.gz [FILE ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	bw := bufio.NewWriter(os.Stdout)
+	defer bw.Flush()
+	for _, name := range fs.Args() {
+		if err := indexFile(name, *cdxj, bw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// indexFile writes index lines for a single WARC file.
+func indexFile(name string, cdxj bool, w *bufio.Writer) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	ix := &warcutil.Indexer{Filename: filepath.Base(name), CDXJ: cdxj}
+	return ix.Index(f, w)
+}
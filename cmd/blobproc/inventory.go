@@ -0,0 +1,86 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miku/blobproc"
+)
+
+// runInventory implements the inventory subcommand, writing all object keys
+// below a folder with sizes and ETags as JSON lines.
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet("inventory", flag.ExitOnError)
+	var (
+		config = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		bucket = fs.String("bucket", blobproc.DefaultBucket, "bucket to list")
+		folder = fs.String("folder", "", "folder to list, e.g. grobid, the whole bucket if empty")
+		output = fs.String("o", "", "output file, gzip compressed, if the name ends with .gz, stdout if empty")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc inventory [-config FILE] [-bucket NAME] [-folder NAME] [-o FILE]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Lists all objects of a bucket below a folder as JSON lines, with key, SHA1")
+		fmt.Fprintln(fs.Output(), "of the original file, size, ETag and modification time.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err := wrapS3.WriteInventory(context.Background(), os.Stdout, *bucket, *folder)
+		return err
+	}
+	// Write to a temporary file first, so an interrupted run does not leave
+	// an incomplete inventory behind.
+	f, err := os.CreateTemp(filepath.Dir(*output), filepath.Base(*output)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	var (
+		w  io.Writer = f
+		zw *gzip.Writer
+	)
+	if strings.HasSuffix(*output, ".gz") {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	n, err := wrapS3.WriteInventory(context.Background(), w, *bucket, *folder)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *output); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d entries to %s\n", n, *output)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miku/blobproc"
+)
+
+// errLimit stops a listing, once enough derivatives have been written.
+var errLimit = errors.New("limit reached")
+
+// runLs implements the ls subcommand, listing the stored derivatives of a
+// kind.
+func runLs(args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	var (
+		config     = fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+		prefix     = fs.String("prefix", "", "only list derivatives of files, whose SHA1 starts with this hex prefix")
+		startAfter = fs.String("start-after", "", "only list derivatives of files after this SHA1, to continue a listing")
+		limit      = fs.Int("n", 0, "list at most this many derivatives, 0 means no limit")
+		format     = fs.String("format", "tsv", "format: tsv or jsonl")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc ls [-config FILE] [-prefix HEX] [-start-after SHA1] [-n N] [-format tsv|jsonl] KIND")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Lists stored derivatives of a kind in SHA1 order, with SHA1, size and")
+		fmt.Fprintln(fs.Output(), "modification time. KIND is one of:")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintf(fs.Output(), "  %s\n", strings.Join(blobproc.DerivativeKinds(), ", "))
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "or raw for the archived original, if s3.raw_bucket is set.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if !slices.Contains([]string{"tsv", "jsonl"}, *format) {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	registerRawDerivative(cfg.S3.RawBucket, cfg.S3.RawFolder)
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	var (
+		bw  = bufio.NewWriter(os.Stdout)
+		enc = json.NewEncoder(bw)
+		n   int
+	)
+	err = wrapS3.ListDerivatives(context.Background(), fs.Arg(0), *prefix, strings.ToLower(*startAfter), func(d blobproc.DerivativeInfo) error {
+		if *limit > 0 && n == *limit {
+			return errLimit
+		}
+		n++
+		if *format == "jsonl" {
+			return enc.Encode(d)
+		}
+		_, err := fmt.Fprintf(bw, "%s\t%d\t%s\n", d.SHA1Hex, d.Size, d.LastModified.Format(time.RFC3339))
+		return err
+	})
+	if err != nil && !errors.Is(err, errLimit) {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
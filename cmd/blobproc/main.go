@@ -5,18 +5,16 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/fs"
 	"log"
 	"log/slog"
 	"os"
-	"path"
-	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/adrg/xdg"
 	"github.com/miku/blobproc"
 	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/procutil"
 	"github.com/miku/grobidclient"
 )
 
@@ -26,32 +24,132 @@ Emit JSON with locally extracted data:
 
   $ blobproc -f file.pdf | jq .
 
+Commands
+
+  config     validate a config file or print the effective config as env vars
+  doctor     check external tools, a sample extraction, GROBID and S3
+  extract    write payloads of WARC files to a directory, with a manifest
+  export     write a kind of derivative for a list of SHA1 to a directory or tar
+  gc         report or delete derivatives of files, that are not known
+  get        fetch a derivative of a file by SHA1 from S3
+  import     copy files of directories, tarballs or WARC files into the spool
+  index      write CDX or CDXJ lines for WARC files
+  inventory  list all objects below a folder with sizes and ETags
+  ls         list stored derivatives of a kind, with SHA1, size and time
+  s3         set up buckets, lifecycle rules and policies
+  spool      migrate files to another spool directory or blobprocd
+  stats      report spool statistics
+  trash      purge or restore processed files kept in the trash
+  urlmap     export or import (url, sha1) pairs
+
 Flags
 `
 
+// defaults are the default config values, also used as flag defaults.
+var defaults = blobproc.DefaultConfig()
+
 var (
+	configFile        = flag.String("config", "", "YAML config file, flags take precedence; "+blobproc.DefaultConfigPath+" is used, if it exists")
 	singleFile        = flag.String("f", "", "process a single file (local tools only), for testing")
-	spoolDir          = flag.String("spool", path.Join(xdg.DataHome, "/blobproc/spool"), "")
-	logFile           = flag.String("logfile", "", "structured log output file, stderr if empty")
-	debug             = flag.Bool("debug", false, "more verbose output")
-	timeout           = flag.Duration("T", 300*time.Second, "subprocess timeout")
-	keepSpool         = flag.Bool("k", false, "keep files in spool after processing, mainly for debugging")
+	spoolDir          = flag.String("spool", defaults.Spool, "")
+	logFile           = flag.String("logfile", defaults.Log.File, "structured log output file, stderr if empty")
+	debug             = flag.Bool("debug", defaults.Log.Debug, "more verbose output")
+	timeout           = flag.Duration("T", defaults.Processing.Timeout, "subprocess timeout")
+	keepSpool         = flag.Bool("k", defaults.Processing.KeepSpool, "keep files in spool after processing, mainly for debugging")
 	showVersion       = flag.Bool("version", false, "show version")
-	walkFast          = flag.Bool("P", false, "run processing in parallel (exp)")
-	numWorkers        = flag.Int("w", 4, "number of parallel workers")
-	grobidHost        = flag.String("grobid-host", "http://localhost:8070", "grobid host, cf. https://is.gd/3wnssq") // TODO: add multiple servers
-	grobidMaxFileSize = flag.Int64("grobid-max-filesize", 256*1024*1024, "max file size to send to grobid in bytes")
-	s3Endpoint        = flag.String("s3-endpoint", "localhost:9000", "S3 endpoint")
-	s3AccessKey       = flag.String("s3-access-key", "minioadmin", "S3 access key")
-	s3SecretKey       = flag.String("s3-secret-key", "minioadmin", "S3 secret key")
+	walkFast          = flag.Bool("P", defaults.Processing.Parallel, "run processing in parallel (exp)")
+	dryRun            = flag.Bool("dry-run", false, "only show what would be processed, skipped or deleted, as JSON lines, without running any extraction or writing to S3")
+	numWorkers        = flag.Int("w", defaults.Processing.Workers, "number of parallel workers")
+	grobidWorkers     = flag.Int("grobid-workers", defaults.Processing.GrobidWorkers, "number of concurrent GROBID requests in parallel mode, decoupled from local extraction workers; 0 sends to GROBID from each worker")
+	minScratchFree    = flag.Int64("min-scratch-free", defaults.Processing.MinScratchFree, "pause dispatching files in parallel mode, while less than this number of bytes are free in the scratch directory, 0 disables the check")
+	scratchDir        = flag.String("scratch", defaults.Processing.ScratchDir, "base directory for per-worker scratch directories, a temporary directory if empty")
+	sweepAge          = flag.Duration("sweep-age", defaults.Processing.SweepAge, "at startup, remove blobproc temporary files older than this from the temp dir, 0 disables sweeping")
+	extraStages       = flag.String("stages", strings.Join(defaults.Processing.Stages, ","), "comma separated list of additional processing stages to run for each file, see -list-stages")
+	listStages        = flag.Bool("list-stages", false, "list available additional processing stages")
+	parallelWalk      = flag.Bool("parallel-walk", defaults.Processing.ParallelWalk, "walk top level spool shards in parallel, for parallel processing")
+	s3Spool           = flag.String("s3-spool", defaults.Processing.S3Spool, "process objects from an S3 bucket, given as bucket/prefix, instead of the spool directory, requires -P")
+	s3SpoolShard      = flag.String("s3-spool-shard", defaults.Processing.S3SpoolShard, "process only the objects of the S3 spool assigned to this instance, given as i/n, e.g. 0/4")
+	leaseTTL          = flag.Duration("lease-ttl", defaults.Processing.LeaseTTL, "claim files before processing, so several instances can share a spool directory in parallel mode; leases not renewed within this time are taken over, 0 disables claiming")
+	order             = flag.String("order", defaults.Processing.Order, "dispatch order for parallel processing: oldest, smallest or empty for walk order")
+	rejectedDir       = flag.String("rejected", defaults.Processing.RejectedDir, "directory to move files of unsupported types to, removed from spool if empty")
+	require           = flag.String("require", strings.Join(defaults.Processing.Require, ","), "comma separated kinds of derivatives, that must be stored, before a file is removed from the spool, e.g. text,tei; files are never removed, if storing a derivative failed")
+	failedDir         = flag.String("failed", defaults.Processing.FailedDir, "directory to move files with derivatives missing to, kept in spool for a retry if empty")
+	trashDir          = flag.String("trash", defaults.Processing.TrashDir, "directory to keep processed files in for -trash-retention, .trash in the spool directory if empty")
+	trashRetention    = flag.Duration("trash-retention", defaults.Processing.TrashRetention, "keep processed files in the trash for this long, so they can be restored, 0 removes processed files right away")
+	checkpointFile    = flag.String("checkpoint", defaults.Processing.Checkpoint, "file to record the last fully processed spool shard in, to resume an interrupted walk, disabled if empty")
+	pidFile           = flag.String("pidfile", defaults.Processing.Pidfile, "pidfile to lock, so only a single process works on the spool at a time, disabled if empty")
+	toolMemoryLimit   = flag.Int64("tool-memory-limit", defaults.Processing.ToolMemoryLimit, "maximum virtual memory in bytes for each external tool run, like pdftotext, 0 means no limit")
+	toolCPULimit      = flag.Duration("tool-cpu-limit", defaults.Processing.ToolCPULimit, "maximum CPU time for each external tool run, 0 means no limit")
+	minTextQuality    = flag.Float64("min-text-quality", defaults.Processing.MinTextQuality, "flag files with extracted text scoring lower, between 0 and 1, e.g. 0.5, for review or OCR, 0 disables flagging")
+	firstPage         = flag.Bool("first-page", defaults.Processing.FirstPage, "store the text of the first page and a title and abstract guessed from it, a cheap metadata signal also without GROBID")
+	maxFileSize       = flag.Int64("max-filesize", defaults.Processing.MaxFileSize, "reject PDF files larger than this number of bytes before extraction, 0 means no limit")
+	maxPages          = flag.Int("max-pages", defaults.Processing.MaxPages, "reject PDF files with more pages before extraction, 0 means no limit")
+	maxPageSize       = flag.Float64("max-page-size", defaults.Processing.MaxPageSize, "reject PDF files with a wider or higher first page, in pts, e.g. 14400 for 200 inches, 0 means no limit")
+	pdfcpuMode        = flag.String("pdfcpu", defaults.Processing.PDFCPU, "when to run pdfcpu for PDF metadata: always, fallback (only if pdfinfo fails) or never, saving a subprocess per file")
+	trustSpoolNames   = flag.Bool("trust-spool-names", defaults.Processing.TrustSpoolNames, "take the SHA1 of spool files from their names, as computed by blobprocd, instead of hashing them again")
+	storeResult       = flag.Bool("store-result", defaults.Processing.StoreResult, "store the extraction result of each PDF, with status, checksums, PDF metadata, text, links and source, as JSON metadata derivative")
+	cache             = flag.Bool("cache", defaults.Processing.Cache, "skip files processed successfully with the same blobproc and tool versions before, requires -urlmap")
+	grobidHost        = flag.String("grobid-host", defaults.Grobid.Host, "grobid host, cf. https://is.gd/3wnssq") // TODO: add multiple servers
+	referencesOnly    = flag.Bool("references-only", defaults.Grobid.ReferencesOnly, "only extract references with GROBID processReferences, instead of a full TEI document")
+	rawBucket         = flag.String("raw-bucket", defaults.S3.RawBucket, "S3 bucket to archive original PDF files in, keyed by SHA1, disabled if empty")
+	rawFolder         = flag.String("raw-folder", defaults.S3.RawFolder, "folder for archived original PDF files")
+	urlMapFile        = flag.String("urlmap", defaults.Server.URLMap, "URL map database shared with blobprocd, to store source URLs as S3 object metadata and to record processing states, disabled if empty")
+	grobidMaxFileSize = flag.Int64("grobid-max-filesize", defaults.Grobid.MaxFileSize, "max file size to send to grobid in bytes")
+	s3Endpoint        = flag.String("s3-endpoint", defaults.S3.Endpoint, "S3 endpoint")
+	s3AccessKey       = flag.String("s3-access-key", defaults.S3.AccessKey, "S3 access key")
+	s3SecretKey       = flag.String("s3-secret-key", defaults.S3.SecretKey, "S3 secret key")
+	s3Signature       = flag.String("s3-signature", defaults.S3.Signature, "S3 signature version, v2 or v4")
+	s3Region          = flag.String("s3-region", defaults.S3.Region, "S3 region, required by some stores")
+	s3PathStyle       = flag.Bool("s3-path-style", defaults.S3.PathStyle, "use path style S3 requests, for stores without virtual host style addressing")
+	otlpEndpoint      = flag.String("otlp-endpoint", defaults.Tracing.OTLPEndpoint, "OTLP/HTTP endpoint to export traces to, e.g. localhost:4318, tracing disabled if empty")
 )
 
+// subcommands take their own flags.
+var subcommands = map[string]func(args []string) error{
+	"config":    runConfig,
+	"doctor":    runDoctor,
+	"export":    runExport,
+	"extract":   runExtract,
+	"gc":        runGC,
+	"get":       runGet,
+	"import":    runImport,
+	"index":     runIndex,
+	"inventory": runInventory,
+	"ls":        runLs,
+	"s3":        runS3,
+	"spool":     runSpool,
+	"stats":     runStats,
+	"trash":     runTrash,
+	"urlmap":    runURLMap,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	flag.Usage = func() {
 		_, _ = fmt.Fprintln(os.Stderr, docs)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	if err := applyConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if *cache && *urlMapFile == "" {
+		log.Fatal("-cache requires -urlmap")
+	}
+	if !slices.Contains(pdfextract.PDFCPUModes, *pdfcpuMode) {
+		log.Fatalf("-pdfcpu must be one of %s", strings.Join(pdfextract.PDFCPUModes, ", "))
+	}
+	procutil.DefaultLimits = procutil.Limits{
+		Memory: *toolMemoryLimit,
+		CPU:    *toolCPULimit,
+	}
 	// By default, try to work through the whole spool dir, file by file.
 	//
 	// This whole block of code does reading files from disk, processing them
@@ -65,12 +163,13 @@ func main() {
 	//
 	// Logging
 	// -------
+	// The log level can be changed by reloading the config on SIGHUP.
 	var (
-		logLevel = slog.LevelInfo
+		logLevel = new(slog.LevelVar)
 		h        slog.Handler
 	)
 	if *debug {
-		logLevel = slog.LevelDebug
+		logLevel.Set(slog.LevelDebug)
 	}
 	switch {
 	case *logFile != "":
@@ -86,69 +185,167 @@ func main() {
 	}
 	logger := slog.New(h)
 	slog.SetDefault(logger)
+	// Tracing
+	// -------
+	shutdownTracing, err := blobproc.SetupTracing(context.Background(), "blobproc", *otlpEndpoint)
+	if err != nil {
+		slog.Error("cannot setup tracing", "err", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Warn("tracing shutdown failed", "err", err)
+		}
+	}()
 	switch {
 	case *showVersion:
 		fmt.Println(blobproc.Version)
+	case *listStages:
+		for _, name := range blobproc.RegisteredStages() {
+			fmt.Println(name)
+		}
 	case *singleFile != "":
 		// Run a single file through local commands only.
 		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 		defer cancel()
 		result := pdfextract.ProcessFile(ctx, *singleFile, &pdfextract.Options{
-			Dim:       pdfextract.Dim{180, 300},
-			ThumbType: "JPEG"},
-		)
-		if result.Err != nil {
-			log.Fatal(result.Err)
+			Dim:        pdfextract.Dim{W: 180, H: 300},
+			ThumbType:  "JPEG",
+			Provenance: blobproc.Provenance(),
+		})
+		// Failed extractions are written out as well, including the error.
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			log.Fatal(err)
 		}
-		if result.Status != "success" {
-			log.Fatalf("process failed with: %v", result.Status)
+		if result.Status != pdfextract.StatusSuccess {
+			log.Fatalf("process failed with: %v (%v)", result.Status, result.Err)
 		}
-		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+	case *dryRun:
+		// Only cheap checks, with the same options as a walk. S3 is used to
+		// look for existing derivatives, if it is reachable.
+		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, s3Options())
+		if err != nil {
+			slog.Warn("cannot access S3, not checking for existing derivatives", "err", err)
+			wrapS3 = nil
+		}
+		stages, err := blobproc.LookupStages(*extraStages)
+		if err != nil {
 			log.Fatal(err)
 		}
+		requiredKinds, err := blobproc.ParseRequire(*require)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checkpoint, err := openCheckpoint()
+		if err != nil {
+			log.Fatal(err)
+		}
+		urlMap, err := openURLMap()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeURLMap(urlMap)
+		walker := &blobproc.Walker{
+			Dir:         *spoolDir,
+			KeepSpool:   *keepSpool,
+			ScratchDir:  *scratchDir,
+			RejectedDir: *rejectedDir,
+			Require:     requiredKinds,
+			FailedDir:   *failedDir,
+			Trash:       trash(),
+			Checkpoint:  checkpoint,
+			Pipeline:    newPipeline(nil, wrapS3, stages, urlMap),
+		}
+		counts, err := walker.DryRun(context.Background(), os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("dry run done",
+			"process", counts["process"],
+			"skip", counts["skip"],
+			"reject", counts["reject"],
+			"fail", counts["fail"])
 	case *walkFast:
+		pidfile := lockPidfile()
+		defer releasePidfile(pidfile)
+		sweepTempFiles()
 		// Setup external services and data stores
 		// ---------------------------------------
-		grobid := grobidclient.New(*grobidHost)
+		grobid := blobproc.NewGrobid(*grobidHost)
 		slog.Info("grobid client", "host", *grobidHost)
-		s3opts := &blobproc.WrapS3Options{
-			AccessKey:     strings.TrimSpace(*s3AccessKey),
-			SecretKey:     strings.TrimSpace(*s3SecretKey),
-			DefaultBucket: "sandcrawler",
-			UseSSL:        false,
-		}
-		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, s3opts)
+		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, s3Options())
 		if err != nil {
 			slog.Error("cannot access S3", "err", err)
 			log.Fatalf("cannot access S3: %v", err)
 		}
 		slog.Info("s3 wrapper", "endpoint", *s3Endpoint)
+		dispatchOrder, err := blobproc.ParseOrder(*order)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stages, err := blobproc.LookupStages(*extraStages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		requiredKinds, err := blobproc.ParseRequire(*require)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checkpoint, err := openCheckpoint()
+		if err != nil {
+			log.Fatal(err)
+		}
+		urlMap, err := openURLMap()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeURLMap(urlMap)
 		// Setup parallel walker
 		// ---------------------
 		walker := blobproc.WalkFast{
-			Dir:               *spoolDir,
-			NumWorkers:        *numWorkers,
-			KeepSpool:         *keepSpool,
-			GrobidMaxFileSize: *grobidMaxFileSize,
-			Timeout:           *timeout,
-			Grobid:            grobid,
-			S3:                wrapS3,
-		}
-		if err := walker.Run(context.Background()); err != nil {
+			Dir:            *spoolDir,
+			NumWorkers:     *numWorkers,
+			GrobidWorkers:  *grobidWorkers,
+			KeepSpool:      *keepSpool,
+			Order:          dispatchOrder,
+			ScratchDir:     *scratchDir,
+			MinScratchFree: *minScratchFree,
+			S3Spool:        s3SpoolConfig(wrapS3),
+			Leaser:         leaser(),
+			RejectedDir:    *rejectedDir,
+			Require:        requiredKinds,
+			FailedDir:      *failedDir,
+			Trash:          trash(),
+			Checkpoint:     checkpoint,
+			Timeout:        *timeout,
+			Pipeline:       newPipeline(grobid, wrapS3, stages, urlMap),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go (&reloader{level: logLevel, walker: &walker, pipeline: walker.Pipeline}).run(ctx)
+		if err := walker.Run(ctx); err != nil {
 			log.Fatal(err)
 		}
 	default:
+		if *s3Spool != "" {
+			log.Fatal("-s3-spool requires -P")
+		}
+		if *leaseTTL > 0 {
+			log.Fatal("-lease-ttl requires -P")
+		}
+		pidfile := lockPidfile()
+		defer releasePidfile(pidfile)
+		sweepTempFiles()
+		if *scratchDir != "" {
+			if err := os.MkdirAll(*scratchDir, 0755); err != nil {
+				log.Fatal(err)
+			}
+		}
 		// Setup external services and data stores
 		// ---------------------------------------
-		grobid := grobidclient.New(*grobidHost)
+		grobid := blobproc.NewGrobid(*grobidHost)
 		slog.Info("grobid client", "host", *grobidHost)
-		s3opts := &blobproc.WrapS3Options{
-			AccessKey:     strings.TrimSpace(*s3AccessKey),
-			SecretKey:     strings.TrimSpace(*s3SecretKey),
-			DefaultBucket: "sandcrawler",
-			UseSSL:        false,
-		}
-		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, s3opts)
+		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, s3Options())
 		if err != nil {
 			slog.Error("cannot access S3", "err", err)
 			log.Fatalf("cannot access S3: %v", err)
@@ -161,130 +358,44 @@ func main() {
 		// local tools and send PDF to grobid, persist all results into S3.
 		//
 		// Partial success is accepted. However, the original PDF file will be
-		// removed from the spool folder by default. To reprocess, add the PDF
-		// to the spool folder again.
+		// removed from the spool folder by default, unless a derivative could
+		// not be stored or a required derivative is missing. To reprocess,
+		// add the PDF to the spool folder again.
 		started := time.Now()
-		var stats struct {
-			NumFiles   int // Total number of files seen in one pass.
-			NumOK      int // All went fine.
-			NumSkipped int // Skipped for any reason.
-		}
-		err = filepath.Walk(*spoolDir, func(path string, info fs.FileInfo, err error) error {
-			stats.NumFiles++
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				stats.NumSkipped++
-				return nil
-			}
-			if info.Size() == 0 {
-				stats.NumSkipped++
-				slog.Warn("skipping empty file", "path", path)
-				return nil
-			}
-			slog.Debug("processing", "path", path)
-			defer func() {
-				if !*keepSpool {
-					if _, err := os.Stat(path); err == nil {
-						// Only try to remove file, if it exists.
-						if err := os.Remove(path); err != nil {
-							slog.Warn("error removing file from spool", "err", err, "path", path)
-						}
-					}
-				} else {
-					slog.Debug("keeping file in spool", "path", path)
-				}
-			}()
-			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-			defer cancel()
-			// Fulltext and thumbail via local command line tools
-			// --------------------------------------------------
-			result := pdfextract.ProcessFile(ctx, path, &pdfextract.Options{
-				Dim:       pdfextract.Dim{180, 300},
-				ThumbType: "JPEG",
-			})
-			switch {
-			case result.Status != "success":
-				slog.Warn("pdfextract failed", "status", result.Status, "err", result.Err)
-			case len(result.SHA1Hex) != 40:
-				slog.Warn("invalid sha1 in response", "sha1", result.SHA1Hex)
-			case result.Status == "success":
-				// If we have a thumbnail, save it.
-				if result.HasPage0Thumbnail() {
-					opts := blobproc.BlobRequestOptions{
-						Bucket:  "thumbnail",
-						Folder:  "pdf",
-						Blob:    result.Page0Thumbnail,
-						SHA1Hex: result.SHA1Hex,
-						Ext:     "180px.jpg",
-						Prefix:  "",
-					}
-					resp, err := wrapS3.PutBlob(ctx, &opts)
-					if err != nil {
-						slog.Error("s3 failed (thumbnail)", "err", err, "sha1", result.SHA1Hex)
-					} else {
-						slog.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-					}
-				}
-				// If we have some text, save it.
-				if len(result.Text) > 0 {
-					opts := blobproc.BlobRequestOptions{
-						Bucket:  "sandcrawler",
-						Folder:  "text",
-						Blob:    []byte(result.Text),
-						SHA1Hex: result.SHA1Hex,
-						Ext:     "txt",
-						Prefix:  "",
-					}
-					resp, err := wrapS3.PutBlob(ctx, &opts)
-					if err != nil {
-						slog.Error("s3 failed (text)", "err", err, "sha1", result.SHA1Hex)
-					} else {
-						slog.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-					}
-				}
-			}
-			if info.Size() > *grobidMaxFileSize {
-				slog.Warn("skipping too large file", "path", path, "size", info.Size())
-				return nil
-			}
-			// Structured metadata from PDF via grobid
-			// ---------------------------------------
-			gres, err := grobid.ProcessPDFContext(ctx, path, "processFulltextDocument", &grobidclient.Options{
-				GenerateIDs:            true,
-				ConsolidateHeader:      true,
-				ConsolidateCitations:   false, // "too expensive for now"
-				IncludeRawCitations:    true,
-				IncluseRawAffiliations: true,
-				TEICoordinates:         []string{"ref", "figure", "persName", "formula", "biblStruct"},
-				SegmentSentences:       true,
-			})
-			switch {
-			case err != nil || gres.Err != nil:
-				slog.Warn("grobid failed", "err", err)
-				return nil
-			default:
-				opts := blobproc.BlobRequestOptions{
-					Bucket:  "sandcrawler",
-					Folder:  "grobid",
-					Blob:    gres.Body,
-					SHA1Hex: gres.SHA1Hex,
-					Ext:     "tei.xml",
-					Prefix:  "",
-				}
-				resp, err := wrapS3.PutBlob(ctx, &opts)
-				if err != nil {
-					slog.Error("s3 failed (text)", "err", err)
-					return nil
-				} else {
-					slog.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-				}
-			}
-			stats.NumOK++
-			slog.Debug("processing finished successfully", "path", path)
-			return nil
-		})
+		stages, err := blobproc.LookupStages(*extraStages)
+		if err != nil {
+			log.Fatal(err)
+		}
+		requiredKinds, err := blobproc.ParseRequire(*require)
+		if err != nil {
+			log.Fatal(err)
+		}
+		urlMap, err := openURLMap()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer closeURLMap(urlMap)
+		pipeline := newPipeline(grobid, wrapS3, stages, urlMap)
+		checkpoint, err := openCheckpoint()
+		if err != nil {
+			log.Fatal(err)
+		}
+		reloadCtx, cancelReload := context.WithCancel(context.Background())
+		defer cancelReload()
+		go (&reloader{level: logLevel, pipeline: pipeline}).run(reloadCtx)
+		walker := &blobproc.Walker{
+			Dir:         *spoolDir,
+			KeepSpool:   *keepSpool,
+			ScratchDir:  *scratchDir,
+			RejectedDir: *rejectedDir,
+			Require:     requiredKinds,
+			FailedDir:   *failedDir,
+			Trash:       trash(),
+			Checkpoint:  checkpoint,
+			Timeout:     *timeout,
+			Pipeline:    pipeline,
+		}
+		stats, err := walker.Run(context.Background())
 		if err != nil {
 			slog.Error("walk failed", "err", err)
 			os.Exit(1)
@@ -292,8 +403,156 @@ func main() {
 		slog.Info("directory walk done",
 			"t", time.Since(started),
 			"ts", time.Since(started).String(),
-			"total", stats.NumFiles,
-			"ok", stats.NumOK,
-			"skipped", stats.NumSkipped)
+			"processed", stats.Processed,
+			"ok", stats.OK)
+	}
+}
+
+// newPipeline returns the processing pipeline configured by the flags, so
+// walks and dry runs use the same options.
+func newPipeline(grobid *grobidclient.Grobid, wrapS3 *blobproc.WrapS3, stages []blobproc.Stage, urlMap *blobproc.URLMap) *blobproc.Pipeline {
+	return &blobproc.Pipeline{
+		Grobid:            grobid,
+		S3:                wrapS3,
+		GrobidMaxFileSize: *grobidMaxFileSize,
+		ReferencesOnly:    *referencesOnly,
+		GrobidOptions:     &grobidOptions,
+		RawBucket:         *rawBucket,
+		RawFolder:         *rawFolder,
+		Stages:            stages,
+		URLMap:            urlMap,
+		Profiles:          profiles,
+		Cache:             *cache,
+		MinTextQuality:    *minTextQuality,
+		FirstPage:         *firstPage,
+		Limits: pdfextract.Limits{
+			MaxFileSize: *maxFileSize,
+			MaxPages:    *maxPages,
+			MaxPageSize: *maxPageSize,
+		},
+		PDFCPU:          *pdfcpuMode,
+		TrustSpoolNames: *trustSpoolNames,
+		StoreResult:     *storeResult,
+	}
+}
+
+// openCheckpoint returns the walk checkpoint, or nil, if checkpoints are not
+// enabled.
+func openCheckpoint() (*blobproc.Checkpoint, error) {
+	if *checkpointFile == "" {
+		return nil, nil
+	}
+	return blobproc.OpenCheckpoint(*checkpointFile, *spoolDir)
+}
+
+// s3Options returns the S3 client options from the flags.
+func s3Options() *blobproc.WrapS3Options {
+	return &blobproc.WrapS3Options{
+		AccessKey:     strings.TrimSpace(*s3AccessKey),
+		SecretKey:     strings.TrimSpace(*s3SecretKey),
+		DefaultBucket: "sandcrawler",
+		UseSSL:        false,
+		Signature:     *s3Signature,
+		Region:        *s3Region,
+		PathStyle:     *s3PathStyle,
+	}
+}
+
+// leaser returns the leaser to claim files with, nil if claiming is disabled.
+func leaser() *blobproc.Leaser {
+	if *leaseTTL <= 0 {
+		return nil
+	}
+	return &blobproc.Leaser{Owner: blobproc.DefaultLeaseOwner(), TTL: *leaseTTL}
+}
+
+// trash returns the trash to move processed files to, nil if processed files
+// are removed right away.
+func trash() *blobproc.Trash {
+	if *trashRetention <= 0 {
+		return nil
+	}
+	dir := *trashDir
+	if dir == "" {
+		dir = blobproc.DefaultTrashDir(*spoolDir)
+	}
+	return &blobproc.Trash{Dir: dir, Retention: *trashRetention}
+}
+
+// s3SpoolConfig returns the S3 spool to process, nil if none is configured.
+func s3SpoolConfig(wrapS3 *blobproc.WrapS3) *blobproc.S3Spool {
+	if *s3Spool == "" {
+		return nil
+	}
+	bucket, prefix, err := blobproc.ParseS3Spool(*s3Spool)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spool := &blobproc.S3Spool{S3: wrapS3, Bucket: bucket, Prefix: prefix}
+	if *s3SpoolShard != "" {
+		if spool.Shard, spool.NumShards, err = blobproc.ParseShard(*s3SpoolShard); err != nil {
+			log.Fatal(err)
+		}
+	}
+	slog.Info("processing S3 spool", "bucket", bucket, "prefix", prefix, "shard", *s3SpoolShard)
+	return spool
+}
+
+// openURLMap opens the URL map, if configured, to look up source URLs.
+func openURLMap() (*blobproc.URLMap, error) {
+	if *urlMapFile == "" {
+		return nil, nil
+	}
+	urlMap := &blobproc.URLMap{Path: *urlMapFile}
+	if err := urlMap.EnsureDB(); err != nil {
+		return nil, err
+	}
+	slog.Info("url map", "path", *urlMapFile)
+	return urlMap, nil
+}
+
+// closeURLMap closes the URL map, if it has been opened.
+func closeURLMap(urlMap *blobproc.URLMap) {
+	if urlMap == nil {
+		return
+	}
+	if err := urlMap.Close(); err != nil {
+		slog.Warn("closing url map failed", "err", err)
+	}
+}
+
+// lockPidfile locks the pidfile, if configured, and exits, if another process
+// already holds the lock.
+func lockPidfile() *blobproc.Pidfile {
+	if *pidFile == "" {
+		return nil
+	}
+	pidfile, err := blobproc.LockPidfile(*pidFile)
+	if err != nil {
+		slog.Error("cannot lock pidfile, another instance may be running", "err", err)
+		log.Fatalf("cannot lock pidfile: %v", err)
+	}
+	return pidfile
+}
+
+// releasePidfile releases the pidfile lock, if any.
+func releasePidfile(pidfile *blobproc.Pidfile) {
+	if err := pidfile.Release(); err != nil {
+		slog.Warn("could not release pidfile", "err", err)
+	}
+}
+
+// sweepTempFiles removes stale temporary files, e.g. left behind by crashed
+// processes, from the default temp directory.
+func sweepTempFiles() {
+	if *sweepAge == 0 {
+		return
+	}
+	n, err := blobproc.SweepTempFiles("", blobproc.TempFilePatterns, *sweepAge)
+	if err != nil {
+		slog.Warn("sweeping temporary files failed", "err", err)
+	}
+	if n > 0 {
+		slog.Info("removed stale temporary files", "n", n)
 	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/miku/blobproc"
+)
+
+// runS3 implements the s3 subcommand, setting up buckets.
+func runS3(args []string) error {
+	fs := flag.NewFlagSet("s3", flag.ExitOnError)
+	config := fs.String("config", "", "YAML config file, "+blobproc.DefaultConfigPath+" is used, if it exists")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc s3 init [-config FILE]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "init creates the buckets listed in s3.buckets and the raw bucket, if they do")
+		fmt.Fprintln(fs.Output(), "not exist, and applies versioning, lifecycle rules and read policies. It is")
+		fmt.Fprintln(fs.Output(), "safe to run repeatedly.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if cmd != "init" {
+		fs.Usage()
+		return fmt.Errorf("unknown s3 command: %s", cmd)
+	}
+	cfg, err := blobproc.LoadConfigEnv(blobproc.ConfigPath(*config))
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	wrapS3, err := blobproc.NewWrapS3(cfg.S3.Endpoint, cfg.S3.Options())
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, bucket := range cfg.S3.AllBuckets() {
+		if err := wrapS3.InitBucket(context.Background(), bucket); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", bucket.Name, err))
+			continue
+		}
+		fmt.Printf("ok\t%s\n", bucket.Name)
+	}
+	return errors.Join(errs...)
+}
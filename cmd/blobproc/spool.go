@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/miku/blobproc"
+)
+
+// runSpool implements the spool subcommand, migrating files between spool
+// directories or to a blobprocd instance.
+func runSpool(args []string) error {
+	fs := flag.NewFlagSet("spool", flag.ExitOnError)
+	var (
+		from       = fs.String("from", "", "source directory, in any layout")
+		to         = fs.String("to", "", "destination spool directory or blobprocd URL, e.g. http://localhost:8000")
+		remove     = fs.Bool("remove", false, "remove files from the source, once they are stored at the destination")
+		source     = fs.String("source", "", "source to report to blobprocd, defaults to the client IP")
+		maxRetries = fs.Int("max-retries", 30, "number of times to send a file again, while blobprocd is busy")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc spool migrate -from DIR -to DIR|URL [-remove]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "migrate copies files into a spool directory, sharded by the SHA1 of their")
+		fmt.Fprintln(fs.Output(), "content, or sends them to blobprocd. Files named by a SHA1 not matching")
+		fmt.Fprintln(fs.Output(), "their content are skipped. Files already at the destination are skipped, so")
+		fmt.Fprintln(fs.Output(), "an interrupted migration can be run again.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if cmd != "migrate" {
+		fs.Usage()
+		return fmt.Errorf("unknown spool command: %s", cmd)
+	}
+	if *from == "" || *to == "" {
+		return errors.New("-from and -to required")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stats, err := blobproc.MigrateSpool(ctx, &blobproc.MigrateOptions{
+		From:       *from,
+		To:         *to,
+		Remove:     *remove,
+		Source:     *source,
+		MaxRetries: *maxRetries,
+	})
+	if stats != nil {
+		if err := json.NewEncoder(os.Stdout).Encode(stats); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d files not migrated", stats.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/miku/blobproc"
+)
+
+// runStats implements the stats subcommand, reporting spool statistics.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var (
+		dir    = fs.String("spool", path.Join(xdg.DataHome, "/blobproc/spool"), "spool directory")
+		asJSON = fs.Bool("json", false, "emit JSON instead of a table")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc stats [-spool DIR] [-json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	stats, err := blobproc.ComputeSpoolStats(context.Background(), *dir, time.Now())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(stats)
+	}
+	return writeStatsTable(os.Stdout, stats)
+}
+
+// writeStatsTable renders spool statistics as plain text tables.
+func writeStatsTable(w io.Writer, stats *blobproc.SpoolStats) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "spool\t%s\n", stats.Dir)
+	fmt.Fprintf(tw, "files\t%d\n", stats.NumFiles)
+	fmt.Fprintf(tw, "bytes\t%d\n", stats.TotalBytes)
+	if stats.NumFiles > 0 {
+		fmt.Fprintf(tw, "oldest\t%s\n", stats.Oldest.Format(time.RFC3339))
+		fmt.Fprintf(tw, "newest\t%s\n", stats.Newest.Format(time.RFC3339))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "age\tfiles\tbytes")
+	for _, b := range stats.Ages {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", b.Label, b.NumFiles, b.Bytes)
+	}
+	if len(stats.Shards) > 0 {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "shard\tfiles\tbytes")
+		for _, s := range stats.Shards {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", s.Shard, s.NumFiles, s.Bytes)
+		}
+	}
+	return tw.Flush()
+}
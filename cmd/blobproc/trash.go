@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/miku/blobproc"
+)
+
+// runTrash implements the trash subcommand, purging or restoring processed
+// files kept in the trash.
+func runTrash(args []string) error {
+	fs := flag.NewFlagSet("trash", flag.ExitOnError)
+	var (
+		dir       = fs.String("spool", defaults.Spool, "spool directory")
+		trashDir  = fs.String("trash", defaults.Processing.TrashDir, "trash directory, .trash in the spool directory if empty")
+		retention = fs.Duration("retention", defaults.Processing.TrashRetention, "purge: remove files kept in the trash for longer than this")
+		since     = fs.Duration("since", time.Hour, "restore: move files trashed within this time back into the spool")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc trash purge|restore [-spool DIR] [-trash DIR]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "purge removes files, that have been in the trash for longer than the")
+		fmt.Fprintln(fs.Output(), "retention period. restore moves recently trashed files back into the spool,")
+		fmt.Fprintln(fs.Output(), "so they are processed again, e.g. after an S3 outage.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	trash := &blobproc.Trash{Dir: *trashDir, Retention: *retention}
+	if trash.Dir == "" {
+		trash.Dir = blobproc.DefaultTrashDir(*dir)
+	}
+	switch cmd {
+	case "purge":
+		n, err := trash.Purge()
+		fmt.Printf("purged %d files from %s\n", n, trash.Dir)
+		return err
+	case "restore":
+		n, err := trash.Restore(*dir, time.Now().Add(-*since))
+		fmt.Printf("restored %d files to %s\n", n, *dir)
+		return err
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown trash command: %s", cmd)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/miku/blobproc"
+)
+
+// runURLMap implements the urlmap subcommand, exporting and importing (url,
+// sha1) pairs as JSON lines or CSV.
+func runURLMap(args []string) error {
+	fs := flag.NewFlagSet("urlmap", flag.ExitOnError)
+	var (
+		dbFile = fs.String("urlmap", "", "path to urlmap sqlite3 file, as used by blobprocd")
+		format = fs.String("format", "jsonl", "format: jsonl or csv")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: blobproc urlmap export|import -urlmap FILE [-format jsonl|csv] [FILE]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "export writes all pairs to stdout, import reads pairs from FILE or stdin.")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dbFile == "" {
+		return errors.New("urlmap file required")
+	}
+	if !slices.Contains([]string{"jsonl", "csv"}, *format) {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+	urlMap := &blobproc.URLMap{Path: *dbFile}
+	if err := urlMap.EnsureDB(); err != nil {
+		return err
+	}
+	defer urlMap.Close()
+	switch cmd {
+	case "export":
+		return exportURLMap(urlMap, *format, os.Stdout)
+	case "import":
+		var r io.Reader = os.Stdin
+		if fs.NArg() > 0 {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		entries, err := readURLMapEntries(r, *format)
+		if err != nil {
+			return err
+		}
+		n, err := urlMap.Import(entries)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "imported %d of %d entries\n", n, len(entries))
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown urlmap command: %s", cmd)
+	}
+}
+
+// exportURLMap writes all entries in the given format.
+func exportURLMap(urlMap *blobproc.URLMap, format string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	if format == "csv" {
+		cw := csv.NewWriter(bw)
+		if err := cw.Write([]string{"url", "sha1", "timestamp", "source"}); err != nil {
+			return err
+		}
+		if err := urlMap.Export(func(e blobproc.URLMapEntry) error {
+			return cw.Write([]string{e.URL, e.SHA1, e.Timestamp, e.Source})
+		}); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	enc := json.NewEncoder(bw)
+	return urlMap.Export(func(e blobproc.URLMapEntry) error {
+		return enc.Encode(e)
+	})
+}
+
+// readURLMapEntries reads entries in the given format. CSV input must have a
+// header row with url, sha1 and optionally timestamp and source columns.
+func readURLMapEntries(r io.Reader, format string) ([]blobproc.URLMapEntry, error) {
+	var entries []blobproc.URLMapEntry
+	if format == "csv" {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+		var (
+			header = records[0]
+			urlCol = slices.Index(header, "url")
+			shaCol = slices.Index(header, "sha1")
+			tsCol  = slices.Index(header, "timestamp")
+			srcCol = slices.Index(header, "source")
+		)
+		if urlCol < 0 || shaCol < 0 {
+			return nil, errors.New("csv header must contain url and sha1 columns")
+		}
+		for _, record := range records[1:] {
+			entry := blobproc.URLMapEntry{URL: record[urlCol], SHA1: record[shaCol]}
+			if tsCol >= 0 {
+				entry.Timestamp = record[tsCol]
+			}
+			if srcCol >= 0 {
+				entry.Source = record[srcCol]
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+	dec := json.NewDecoder(r)
+	for {
+		var entry blobproc.URLMapEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
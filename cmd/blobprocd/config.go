@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+
+	"github.com/miku/blobproc"
+)
+
+// configFlags maps config values to command line flags.
+func configFlags(cfg *blobproc.Config) map[string]string {
+	return map[string]string{
+		"spool":             cfg.Spool,
+		"addr":              cfg.Server.Addr,
+		"T":                 cfg.Server.Timeout.String(),
+		"debug":             strconv.FormatBool(cfg.Log.Debug),
+		"access-log":        cfg.Server.AccessLog,
+		"log":               cfg.Log.File,
+		"urlmap":            cfg.Server.URLMap,
+		"urlmap-batch":      strconv.Itoa(cfg.Server.URLMapBatch),
+		"urlmap-header":     cfg.Server.URLMapHeader,
+		"source-header":     cfg.Server.SourceHeader,
+		"quota":             strconv.FormatInt(cfg.Server.Quota, 10),
+		"min-free":          strconv.FormatInt(cfg.Server.MinFree, 10),
+		"max-backlog":       strconv.FormatInt(cfg.Server.MaxBacklog, 10),
+		"dedupe":            strconv.FormatBool(cfg.Server.Dedupe),
+		"status":            strconv.FormatBool(cfg.Server.Status),
+		"derivatives":       strconv.FormatBool(cfg.Server.Derivatives),
+		"sync-max-filesize": strconv.FormatInt(cfg.Server.SyncMaxFileSize, 10),
+		"s3-endpoint":       cfg.S3.Endpoint,
+		"s3-access-key":     cfg.S3.AccessKey,
+		"s3-secret-key":     cfg.S3.SecretKey,
+		"s3-signature":      cfg.S3.Signature,
+		"s3-region":         cfg.S3.Region,
+		"s3-path-style":     strconv.FormatBool(cfg.S3.PathStyle),
+		"ui":                strconv.FormatBool(cfg.Server.UI),
+		"sweep-age":         cfg.Server.SweepAge.String(),
+		"otlp-endpoint":     cfg.Tracing.OTLPEndpoint,
+	}
+}
+
+// flagConfig sets flags from the config file, unless given on the command
+// line, also on reload.
+var flagConfig = &blobproc.FlagConfig{FlagSet: flag.CommandLine, Flags: configFlags}
+
+// applyConfig reads the config file, if any, and BLOBPROC_* environment
+// variables and sets all flags, that have not been given on the command line.
+func applyConfig() error {
+	flagConfig.File = *configFile
+	_, err := flagConfig.Apply()
+	return err
+}
@@ -2,6 +2,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,41 +11,68 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"path"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/adrg/xdg"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/miku/blobproc"
+	"github.com/miku/blobproc/spool"
 )
 
+// defaults are the default config values, also used as flag defaults.
+var defaults = blobproc.DefaultConfig()
+
 var (
-	spoolDir         = flag.String("spool", path.Join(xdg.DataHome, "/blobproc/spool"), "")
-	listenAddr       = flag.String("addr", "0.0.0.0:8000", "host port to listen on")
-	timeout          = flag.Duration("T", 15*time.Second, "server timeout")
-	banner           = `{"id": "blobprocd", "about": "Send your PDF payload to %s/spool - a 200 OK status only confirms receipt, not successful postprocessing, which may take more time. Check Location header for spool id."}`
+	configFile       = flag.String("config", "", "YAML config file, flags take precedence; "+blobproc.DefaultConfigPath+" is used, if it exists")
+	spoolDir         = flag.String("spool", defaults.Spool, "")
+	listenAddr       = flag.String("addr", defaults.Server.Addr, "host port to listen on")
+	timeout          = flag.Duration("T", defaults.Server.Timeout, "server timeout")
+	banner           = `{"id": "blobprocd", "about": "Send your PDF payload to %s/spool - a 200 OK status only confirms receipt, not successful postprocessing, which may take more time. Check Location header for spool id, poll %s/status/{sha1} for the processing state."}`
 	showVersion      = flag.Bool("version", false, "show version")
-	debug            = flag.Bool("debug", false, "switch to log level DEBUG")
-	accessLogFile    = flag.String("access-log", "", "server access logfile, none if empty")
-	logFile          = flag.String("log", "", "structured log output file, stderr if empty")
-	urlMapFile       = flag.String("urlmap", "", "path to sqlite3 file that will record (url, sha1) pairs; if empty nothing is recorded")
-	urlMapHttpHeader = flag.String("urlmap-header", blobproc.DefaultURLMapHttpHeader, "HTTP header to use as URL for the URL map db, if available")
+	debug            = flag.Bool("debug", defaults.Log.Debug, "switch to log level DEBUG")
+	accessLogFile    = flag.String("access-log", defaults.Server.AccessLog, "server access logfile, none if empty")
+	logFile          = flag.String("log", defaults.Log.File, "structured log output file, stderr if empty")
+	urlMapFile       = flag.String("urlmap", defaults.Server.URLMap, "path to sqlite3 file that will record (url, sha1) pairs; if empty nothing is recorded")
+	urlMapBatch      = flag.Int("urlmap-batch", defaults.Server.URLMapBatch, "write (url, sha1) pairs asynchronously in batches of this size, 0 or 1 writes each pair synchronously")
+	urlMapHttpHeader = flag.String("urlmap-header", defaults.Server.URLMapHeader, "HTTP header to use as URL for the URL map db, if available")
+	sourceHttpHeader = flag.String("source-header", defaults.Server.SourceHeader, "HTTP header identifying the source of a payload, client IP is used if missing")
+	quota            = flag.Int64("quota", defaults.Server.Quota, "maximum number of bytes accepted per source and day, requires -urlmap, 0 means no limit")
+	minFree          = flag.Int64("min-free", defaults.Server.MinFree, "reject uploads with HTTP 507, if less than this number of bytes would remain free in the spool (or temp dir for /process), 0 disables the check")
+	maxBacklog       = flag.Int64("max-backlog", defaults.Server.MaxBacklog, "reject uploads with HTTP 429, while the GROBID backlog reported by blobproc exceeds this number of files, requires -urlmap shared with blobproc, 0 means no limit")
+	dedupe           = flag.Bool("dedupe", defaults.Server.Dedupe, "do not spool files, that have already been processed, i.e. have a GROBID result in S3")
+	syncMaxFileSize  = flag.Int64("sync-max-filesize", defaults.Server.SyncMaxFileSize, "enable POST /process, running local extraction inline for files up to this size in bytes, disabled if 0")
+	status           = flag.Bool("status", defaults.Server.Status, "include the derivatives of a file stored in S3 in /status/{sha1}")
+	derivatives      = flag.Bool("derivatives", defaults.Server.Derivatives, "serve derivatives stored in S3 at /derivative/{kind}/{sha1}")
+	s3Endpoint       = flag.String("s3-endpoint", defaults.S3.Endpoint, "S3 endpoint, used with -dedupe, -status and -derivatives")
+	s3AccessKey      = flag.String("s3-access-key", defaults.S3.AccessKey, "S3 access key")
+	s3SecretKey      = flag.String("s3-secret-key", defaults.S3.SecretKey, "S3 secret key")
+	s3Signature      = flag.String("s3-signature", defaults.S3.Signature, "S3 signature version, v2 or v4")
+	s3Region         = flag.String("s3-region", defaults.S3.Region, "S3 region, required by some stores")
+	s3PathStyle      = flag.Bool("s3-path-style", defaults.S3.PathStyle, "use path style S3 requests, for stores without virtual host style addressing")
+	enableUI         = flag.Bool("ui", defaults.Server.UI, "serve a dashboard at /ui")
+	sweepAge         = flag.Duration("sweep-age", defaults.Server.SweepAge, "at startup, remove blobprocd temporary files and unfinished uploads older than this from the temp and spool dir, 0 disables sweeping")
+	otlpEndpoint     = flag.String("otlp-endpoint", defaults.Tracing.OTLPEndpoint, "OTLP/HTTP endpoint to export traces to, e.g. localhost:4318, tracing disabled if empty")
 )
 
 func main() {
 	flag.Parse()
+	if err := applyConfig(); err != nil {
+		log.Fatal(err)
+	}
 	if *showVersion {
 		fmt.Println(blobproc.Version)
 		os.Exit(0)
 	}
+	// The log level can be changed by reloading the config on SIGHUP.
 	var (
-		logLevel        = slog.LevelInfo
+		logLevel        = new(slog.LevelVar)
 		h               slog.Handler
 		accessLogWriter io.Writer
 	)
 	if *debug {
-		logLevel = slog.LevelDebug
+		logLevel.Set(slog.LevelDebug)
 	}
 	switch {
 	case *logFile != "":
@@ -56,8 +85,18 @@ func main() {
 	default:
 		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})
 	}
+	dashboard := &blobproc.Dashboard{Dir: *spoolDir}
+	dashboard.Start()
+	if *enableUI {
+		h = dashboard.Handler(h)
+	}
 	logger := slog.New(h)
 	slog.SetDefault(logger)
+	shutdownTracing, err := blobproc.SetupTracing(context.Background(), "blobprocd", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(context.Background())
 	switch {
 	case *accessLogFile != "":
 		f, err := os.OpenFile(*accessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -69,28 +108,96 @@ func main() {
 	default:
 		accessLogWriter = io.Discard
 	}
+	if *sweepAge > 0 {
+		n, err := blobproc.SweepTempFiles("", []string{"blobprocd-*"}, *sweepAge)
+		if err != nil {
+			slog.Warn("sweeping temporary files failed", "err", err)
+		}
+		if n > 0 {
+			slog.Info("removed stale temporary files", "n", n)
+		}
+		// Uploads interrupted by a crash or power loss.
+		n, err = (&spool.Dir{Root: *spoolDir}).Sweep(*sweepAge)
+		if err != nil {
+			slog.Warn("sweeping unfinished uploads failed", "err", err)
+		}
+		if n > 0 {
+			slog.Info("removed unfinished uploads", "n", n)
+		}
+	}
 	svc := &blobproc.WebSpoolService{
 		Dir:              *spoolDir,
 		ListenAddr:       *listenAddr,
 		URLMapHttpHeader: *urlMapHttpHeader,
+		SourceHttpHeader: *sourceHttpHeader,
+		Quota:            *quota,
+		MaxBacklog:       *maxBacklog,
+		MinFreeSpace:     *minFree,
+		SyncMaxFileSize:  *syncMaxFileSize,
+	}
+	if *enableUI {
+		svc.Dashboard = dashboard
+	}
+	if *quota > 0 && *urlMapFile == "" {
+		log.Fatal("quota requires -urlmap to keep track of usage")
+	}
+	if *maxBacklog > 0 && *urlMapFile == "" {
+		log.Fatal("max-backlog requires -urlmap shared with blobproc")
+	}
+	if *dedupe || *status || *derivatives {
+		wrapS3, err := blobproc.NewWrapS3(*s3Endpoint, &blobproc.WrapS3Options{
+			AccessKey:     strings.TrimSpace(*s3AccessKey),
+			SecretKey:     strings.TrimSpace(*s3SecretKey),
+			DefaultBucket: "sandcrawler",
+			UseSSL:        false,
+			Signature:     *s3Signature,
+			Region:        *s3Region,
+			PathStyle:     *s3PathStyle,
+		})
+		if err != nil {
+			log.Fatalf("cannot access S3: %v", err)
+		}
+		if *dedupe {
+			svc.IsProcessed = blobproc.ProcessedInS3(wrapS3)
+		}
+		if *status {
+			svc.Derivatives = wrapS3.ListForSHA1
+		}
+		if *derivatives {
+			svc.OpenDerivative = wrapS3.OpenDerivative
+		}
 	}
 	if *urlMapFile != "" {
-		urlMap := blobproc.URLMap{Path: *urlMapFile}
+		urlMap := &blobproc.URLMap{Path: *urlMapFile, BatchSize: *urlMapBatch}
 		if err := urlMap.EnsureDB(); err != nil {
 			log.Fatal(err)
 		}
-		svc.URLMap = &urlMap
+		svc.URLMap = urlMap
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		_, err := fmt.Fprintf(w, banner+"\n", *listenAddr)
+		_, err := fmt.Fprintf(w, banner+"\n", *listenAddr, *listenAddr)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	})
 	r.HandleFunc("/spool", svc.BlobHandler).Methods("POST", "PUT")
 	r.HandleFunc("/spool", svc.SpoolListHandler).Methods("GET")
-	r.HandleFunc("/spool/{id}", svc.SpoolStatusHandler).Methods("GET")
+	r.HandleFunc("/spool/{id}", svc.SpoolStatusHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/spool/{id}/content", svc.SpoolContentHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/spool/{id}/meta", svc.SpoolMetaHandler).Methods("POST", "PUT")
+	if *derivatives {
+		r.HandleFunc("/derivative/{kind}/{id}", svc.DerivativeHandler).Methods("GET", "HEAD")
+	}
+	r.HandleFunc("/status", svc.BatchStatusHandler).Methods("POST")
+	if *syncMaxFileSize > 0 {
+		r.HandleFunc("/process", svc.ProcessHandler).Methods("POST")
+	}
+	r.HandleFunc("/status/{id}", svc.StatusHandler).Methods("GET")
+	r.HandleFunc("/backlog", svc.BacklogHandler).Methods("GET")
+	if *enableUI {
+		r.Handle("/ui", dashboard).Methods("GET")
+	}
 	loggedRouter := handlers.LoggingHandler(accessLogWriter, r)
 	srv := &http.Server{
 		Handler:      loggedRouter,
@@ -98,6 +205,33 @@ func main() {
 		WriteTimeout: *timeout,
 		ReadTimeout:  *timeout,
 	}
+	// Stop accepting uploads on SIGINT or SIGTERM and write pending urlmap
+	// entries before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Only the log level can be changed without a restart.
+	go flagConfig.ReloadOnHangup(ctx, logLevel, nil)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		slog.Info("shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("server shutdown failed", "err", err)
+		}
+	}()
 	slog.Info("starting server at", "hostport", srv.Addr, "spool", *spoolDir)
-	log.Fatal(srv.ListenAndServe())
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// ListenAndServe returns immediately on shutdown, wait for active
+	// requests to finish.
+	<-shutdownDone
+	if svc.URLMap != nil {
+		if err := svc.URLMap.Close(); err != nil {
+			slog.Warn("could not close urlmap", "err", err)
+		}
+	}
 }
@@ -0,0 +1,843 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/grobidclient"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables setting config values,
+// e.g. BLOBPROC_PROCESSING_WORKERS for processing.workers.
+const EnvPrefix = "BLOBPROC_"
+
+// DefaultConfigPath is the config file used, if no other file is given and
+// the file exists.
+var DefaultConfigPath = filepath.Join(xdg.ConfigHome, "blobproc", "blobproc.yaml")
+
+// Config is the configuration of blobproc and blobprocd, usually read from a
+// YAML file. Command line flags take precedence over config file values.
+type Config struct {
+	Spool      string           `yaml:"spool"`
+	Log        LogConfig        `yaml:"log"`
+	Processing ProcessingConfig `yaml:"processing"`
+	Grobid     GrobidConfig     `yaml:"grobid"`
+	S3         S3Config         `yaml:"s3"`
+	Server     ServerConfig     `yaml:"server"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	// Profiles adjust processing per spool subdirectory or source; config
+	// file only.
+	Profiles []Profile `yaml:"profiles"`
+}
+
+// LogConfig configures structured logging.
+type LogConfig struct {
+	File  string `yaml:"file"`
+	Debug bool   `yaml:"debug"`
+}
+
+// ProcessingConfig configures the spool processing of blobproc.
+type ProcessingConfig struct {
+	Workers       int           `yaml:"workers"`
+	GrobidWorkers int           `yaml:"grobid_workers"`
+	Parallel      bool          `yaml:"parallel"`
+	ParallelWalk  bool          `yaml:"parallel_walk"`
+	Order         string        `yaml:"order"`
+	Timeout       time.Duration `yaml:"timeout"`
+	KeepSpool     bool          `yaml:"keep_spool"`
+	ScratchDir    string        `yaml:"scratch"`
+	// MinScratchFree pauses dispatching files, while less bytes are free in
+	// the scratch directory.
+	MinScratchFree int64  `yaml:"min_scratch_free"`
+	RejectedDir    string `yaml:"rejected"`
+	// Require lists kinds of derivatives, that must be stored, before a
+	// file is removed from the spool; files with derivatives missing are
+	// moved to FailedDir, if set, or kept for a retry.
+	Require   []string `yaml:"require"`
+	FailedDir string   `yaml:"failed"`
+	// TrashDir keeps processed files for TrashRetention, defaults to .trash
+	// in the spool; zero retention removes processed files right away.
+	TrashDir       string        `yaml:"trash"`
+	TrashRetention time.Duration `yaml:"trash_retention"`
+	// S3Spool, as "bucket/prefix", is processed instead of the spool
+	// directory, by the instance given as S3SpoolShard, like "0/4".
+	S3Spool      string `yaml:"s3_spool"`
+	S3SpoolShard string `yaml:"s3_spool_shard"`
+	// LeaseTTL enables claiming files, when several instances share a
+	// spool; leases not renewed within this time are taken over. Requires
+	// Parallel.
+	LeaseTTL   time.Duration `yaml:"lease_ttl"`
+	Checkpoint string        `yaml:"checkpoint"`
+	Pidfile    string        `yaml:"pidfile"`
+	Stages     []string      `yaml:"stages"`
+	SweepAge   time.Duration `yaml:"sweep_age"`
+	// ToolMemoryLimit and ToolCPULimit limit each external tool run, like
+	// pdftotext, zero means no limit.
+	ToolMemoryLimit int64         `yaml:"tool_memory_limit"`
+	ToolCPULimit    time.Duration `yaml:"tool_cpu_limit"`
+	// Cache skips files processed successfully with the same versions
+	// before, as recorded in server.urlmap.
+	Cache bool `yaml:"cache"`
+	// MinTextQuality flags extracted text with a lower quality score,
+	// between 0 and 1, for review; zero disables flagging.
+	MinTextQuality float64 `yaml:"min_text_quality"`
+	// FirstPage stores the first page text and a guessed title and
+	// abstract.
+	FirstPage bool `yaml:"first_page"`
+	// MaxFileSize in bytes, MaxPages and MaxPageSize, the width or height
+	// of the first page in pts, reject pathological PDFs before any
+	// extraction; zero means no limit.
+	MaxFileSize int64   `yaml:"max_filesize"`
+	MaxPages    int     `yaml:"max_pages"`
+	MaxPageSize float64 `yaml:"max_page_size"`
+	// PDFCPU is always, fallback, to run pdfcpu only if pdfinfo fails, or
+	// never, which saves a subprocess per file.
+	PDFCPU string `yaml:"pdfcpu"`
+	// TrustSpoolNames takes the SHA1 of spool files from their names,
+	// instead of hashing them again.
+	TrustSpoolNames bool `yaml:"trust_spool_names"`
+	// StoreResult stores the extraction result, without the thumbnail, as
+	// JSON "metadata" derivative.
+	StoreResult bool `yaml:"store_result"`
+}
+
+// GrobidConfig configures access to GROBID.
+type GrobidConfig struct {
+	Host           string `yaml:"host"`
+	MaxFileSize    int64  `yaml:"max_filesize"`
+	ReferencesOnly bool   `yaml:"references_only"`
+	// Options are sent with each request.
+	Options GrobidOptions `yaml:"options"`
+}
+
+// GrobidOptions are sent with each GROBID request. Consolidation matches
+// extracted metadata against an external service, which improves quality,
+// but costs time, especially for citations, cf.
+// https://grobid.readthedocs.io/en/latest/Consolidation/. In references only
+// mode, only the citation options apply.
+type GrobidOptions struct {
+	ConsolidateHeader      bool `yaml:"consolidate_header"`
+	ConsolidateCitations   bool `yaml:"consolidate_citations"`
+	IncludeRawCitations    bool `yaml:"include_raw_citations"`
+	IncludeRawAffiliations bool `yaml:"include_raw_affiliations"`
+	GenerateIDs            bool `yaml:"generate_ids"`
+	// TEICoordinates lists TEI elements to annotate with their coordinates
+	// in the PDF, e.g. "figure" or "biblStruct".
+	TEICoordinates   []string `yaml:"tei_coordinates"`
+	SegmentSentences bool     `yaml:"segment_sentences"`
+}
+
+// teiCoordinateElements can be annotated with coordinates, cf.
+// https://grobid.readthedocs.io/en/latest/Coordinates-in-PDF/.
+var teiCoordinateElements = []string{
+	"affiliation", "biblStruct", "figure", "formula", "head", "note",
+	"p", "persName", "ref", "s", "title",
+}
+
+// DefaultGrobidOptions returns the options used, unless configured
+// otherwise. Citations are not consolidated, as that is too expensive.
+func DefaultGrobidOptions() GrobidOptions {
+	return GrobidOptions{
+		ConsolidateHeader:      true,
+		IncludeRawCitations:    true,
+		IncludeRawAffiliations: true,
+		GenerateIDs:            true,
+		TEICoordinates:         []string{"ref", "figure", "persName", "formula", "biblStruct"},
+		SegmentSentences:       true,
+	}
+}
+
+// ClientOptions returns the options as passed to the GROBID client.
+func (o GrobidOptions) ClientOptions() *grobidclient.Options {
+	return &grobidclient.Options{
+		GenerateIDs:            o.GenerateIDs,
+		ConsolidateHeader:      o.ConsolidateHeader,
+		ConsolidateCitations:   o.ConsolidateCitations,
+		IncludeRawCitations:    o.IncludeRawCitations,
+		IncluseRawAffiliations: o.IncludeRawAffiliations,
+		TEICoordinates:         slices.Clone(o.TEICoordinates),
+		SegmentSentences:       o.SegmentSentences,
+	}
+}
+
+// S3Config configures the S3 store for derivatives. Credentials can be given
+// inline, read from a file or from an environment variable; a relative file
+// name is looked up in $CREDENTIALS_DIRECTORY, as set by systemd
+// LoadCredential, if it is set.
+type S3Config struct {
+	Endpoint      string `yaml:"endpoint"`
+	AccessKey     string `yaml:"access_key"`
+	AccessKeyFile string `yaml:"access_key_file"`
+	AccessKeyEnv  string `yaml:"access_key_env"`
+	SecretKey     string `yaml:"secret_key"`
+	SecretKeyFile string `yaml:"secret_key_file"`
+	SecretKeyEnv  string `yaml:"secret_key_env"`
+	RawBucket     string `yaml:"raw_bucket"`
+	RawFolder     string `yaml:"raw_folder"`
+	// Signature is "v2" or "v4", Region and PathStyle are needed by some
+	// stores, cf. WrapS3Options.
+	Signature string `yaml:"signature"`
+	Region    string `yaml:"region"`
+	PathStyle bool   `yaml:"path_style"`
+	// Buckets are set up with "blobproc s3 init"; the raw bucket is added,
+	// if it is not listed.
+	Buckets []BucketConfig `yaml:"buckets"`
+}
+
+// Options returns the options to create an S3 client with.
+func (c S3Config) Options() *WrapS3Options {
+	return &WrapS3Options{
+		AccessKey: strings.TrimSpace(c.AccessKey),
+		SecretKey: strings.TrimSpace(c.SecretKey),
+		Signature: c.Signature,
+		Region:    c.Region,
+		PathStyle: c.PathStyle,
+	}
+}
+
+// AllBuckets returns the configured buckets, including the raw bucket.
+func (c S3Config) AllBuckets() []BucketConfig {
+	buckets := slices.Clone(c.Buckets)
+	if c.RawBucket != "" && !slices.ContainsFunc(buckets, func(b BucketConfig) bool {
+		return b.Name == c.RawBucket
+	}) {
+		buckets = append(buckets, BucketConfig{Name: c.RawBucket})
+	}
+	return buckets
+}
+
+// ServerConfig configures blobprocd.
+type ServerConfig struct {
+	Addr         string        `yaml:"addr"`
+	Timeout      time.Duration `yaml:"timeout"`
+	AccessLog    string        `yaml:"access_log"`
+	URLMap       string        `yaml:"urlmap"`
+	URLMapBatch  int           `yaml:"urlmap_batch"`
+	URLMapHeader string        `yaml:"urlmap_header"`
+	SourceHeader string        `yaml:"source_header"`
+	Quota        int64         `yaml:"quota"`
+	MaxBacklog   int64         `yaml:"max_backlog"`
+	MinFree      int64         `yaml:"min_free"`
+	Dedupe       bool          `yaml:"dedupe"`
+	Status       bool          `yaml:"status"`
+	Derivatives  bool          `yaml:"derivatives"`
+	// SyncMaxFileSize enables POST /process for files up to this size.
+	SyncMaxFileSize int64         `yaml:"sync_max_filesize"`
+	UI              bool          `yaml:"ui"`
+	SweepAge        time.Duration `yaml:"sweep_age"`
+}
+
+// TracingConfig configures trace export.
+type TracingConfig struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+// DefaultConfig returns the default configuration, which is also used for
+// the defaults of command line flags.
+func DefaultConfig() *Config {
+	return &Config{
+		Spool: path.Join(xdg.DataHome, "/blobproc/spool"),
+		Processing: ProcessingConfig{
+			Workers:        4,
+			Timeout:        300 * time.Second,
+			RejectedDir:    path.Join(xdg.DataHome, "/blobproc/rejected"),
+			SweepAge:       6 * time.Hour,
+			TrashRetention: 24 * time.Hour,
+			PDFCPU:         pdfextract.PDFCPUAlways,
+			StoreResult:    true,
+		},
+		Grobid: GrobidConfig{
+			Host:        "http://localhost:8070",
+			MaxFileSize: 256 * 1024 * 1024,
+			Options:     DefaultGrobidOptions(),
+		},
+		S3: S3Config{
+			Endpoint:  "localhost:9000",
+			AccessKey: "minioadmin",
+			SecretKey: "minioadmin",
+			RawFolder: "pdf",
+			Signature: "v2",
+			Buckets: []BucketConfig{
+				{Name: DefaultBucket},
+				{Name: "thumbnail"},
+			},
+		},
+		Server: ServerConfig{
+			Addr:         "0.0.0.0:8000",
+			Timeout:      15 * time.Second,
+			URLMapBatch:  100,
+			URLMapHeader: DefaultURLMapHttpHeader,
+			SourceHeader: DefaultSourceHttpHeader,
+			UI:           true,
+			SweepAge:     1 * time.Hour,
+		},
+	}
+}
+
+// LoadConfig reads a YAML config file. Values missing from the file keep their
+// defaults. Unknown keys are an error, so typos do not go unnoticed.
+func LoadConfig(filename string) (*Config, error) {
+	cfg, err := decodeConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// LoadConfigEnv returns the config from defaults, an optional config file and
+// BLOBPROC_* environment variables, in increasing order of precedence.
+// Command line flags, applied with SetFlags, take precedence over all of these.
+func LoadConfigEnv(filename string) (*Config, error) {
+	cfg := DefaultConfig()
+	if filename != "" {
+		var err error
+		if cfg, err = decodeConfig(filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func decodeConfig(filename string) (*Config, error) {
+	cfg := DefaultConfig()
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// ConfigKey is a single config value, addressable by its dotted key, e.g.
+// "processing.workers", or its environment variable.
+type ConfigKey struct {
+	Key   string
+	Env   string
+	field reflect.Value
+}
+
+// Value returns the config value formatted as in an environment variable.
+func (k ConfigKey) Value() string {
+	switch v := k.field.Interface().(type) {
+	case time.Duration:
+		return v.String()
+	case []string:
+		return strings.Join(v, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// set parses and sets a value, as given in an environment variable. Lists are
+// comma separated.
+func (k ConfigKey) set(s string) error {
+	switch k.field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		k.field.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+		k.field.Set(reflect.ValueOf(list))
+	case string:
+		k.field.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		k.field.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		k.field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		k.field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", k.field.Type())
+	}
+	return nil
+}
+
+// Keys returns all config keys in the order of the config file, with their
+// environment variables.
+func (c *Config) Keys() []ConfigKey {
+	var (
+		keys []ConfigKey
+		walk func(v reflect.Value, prefix string)
+	)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Tag.Get("yaml")
+			if name == "" {
+				continue
+			}
+			key, field := prefix+name, v.Field(i)
+			if field.Kind() == reflect.Struct {
+				walk(field, key+".")
+				continue
+			}
+			if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+				// Lists of sections can only be set in the config file.
+				continue
+			}
+			keys = append(keys, ConfigKey{
+				Key:   key,
+				Env:   EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_")),
+				field: field,
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return keys
+}
+
+// ApplyEnv sets config values from environment variables, looked up with
+// lookup, usually os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, k := range c.Keys() {
+		v, ok := lookup(k.Env)
+		if !ok {
+			continue
+		}
+		if err := k.set(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k.Env, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveSecrets sets the S3 credentials from files or environment variables,
+// if configured.
+func (c *Config) resolveSecrets() error {
+	var err error
+	if c.S3.AccessKey, err = resolveSecret("s3.access_key", c.S3.AccessKey, c.S3.AccessKeyFile, c.S3.AccessKeyEnv); err != nil {
+		return err
+	}
+	if c.S3.SecretKey, err = resolveSecret("s3.secret_key", c.S3.SecretKey, c.S3.SecretKeyFile, c.S3.SecretKeyEnv); err != nil {
+		return err
+	}
+	return nil
+}
+
+// resolveSecret returns the secret from a file or an environment variable, or
+// the inline value, if neither is given. Surrounding whitespace, like a
+// trailing newline in a file, is removed.
+func resolveSecret(key, value, file, env string) (string, error) {
+	switch {
+	case file != "" && env != "":
+		return "", fmt.Errorf("%s: use either %s_file or %s_env", key, key, key)
+	case file != "":
+		if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("%s_file: %w", key, err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case env != "":
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("%s_env: variable %s not set", key, env)
+		}
+		return strings.TrimSpace(v), nil
+	default:
+		return value, nil
+	}
+}
+
+// SetFlags sets flags from config values, given as a map from flag name to
+// value, unless the flag has been set on the command line already, so flags
+// take precedence over the config file.
+func SetFlags(fs *flag.FlagSet, values map[string]string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, value := range values {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config: %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ConfigPath returns the config file to use: name, if given, otherwise
+// DefaultConfigPath, if it exists, or the empty string, if there is none.
+func ConfigPath(name string) string {
+	if name != "" {
+		return name
+	}
+	if _, err := os.Stat(DefaultConfigPath); err == nil {
+		return DefaultConfigPath
+	}
+	return ""
+}
+
+// FlagConfig applies the config file and BLOBPROC_* environment variables to
+// command line flags. Flags given on the command line take precedence, also
+// when the config is reloaded.
+type FlagConfig struct {
+	FlagSet *flag.FlagSet
+	// File is the config file given on the command line, if any.
+	File string
+	// Flags maps config values to flag names.
+	Flags   func(*Config) map[string]string
+	cmdline map[string]bool
+}
+
+// Apply records the flags given on the command line and sets all other flags
+// from the config. Returns the config read.
+func (fc *FlagConfig) Apply() (*Config, error) {
+	fc.cmdline = make(map[string]bool)
+	fc.FlagSet.Visit(func(f *flag.Flag) { fc.cmdline[f.Name] = true })
+	cfg, err := LoadConfigEnv(ConfigPath(fc.File))
+	if err != nil {
+		return nil, err
+	}
+	if err := SetFlags(fc.FlagSet, fc.Flags(cfg)); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Cmdline reports whether a flag has been given on the command line.
+func (fc *FlagConfig) Cmdline(name string) bool {
+	return fc.cmdline[name]
+}
+
+// ReloadOnHangup reads and validates the config file on each SIGHUP, until the
+// context is cancelled. It sets the log level, unless the debug flag has been
+// given on the command line, and passes the config to reload, if not nil.
+// Failed reloads are logged and keep the current settings.
+func (fc *FlagConfig) ReloadOnHangup(ctx context.Context, level *slog.LevelVar, reload func(*Config) error) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := fc.reload(level, reload); err != nil {
+				slog.Warn("config reload failed, keeping current settings", "err", err)
+			}
+		}
+	}
+}
+
+func (fc *FlagConfig) reload(level *slog.LevelVar, reload func(*Config) error) error {
+	filename := ConfigPath(fc.File)
+	if filename == "" {
+		return errors.New("no config file to reload")
+	}
+	cfg, err := LoadConfigEnv(filename)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if !fc.Cmdline("debug") {
+		if cfg.Log.Debug {
+			level.Set(slog.LevelDebug)
+		} else {
+			level.Set(slog.LevelInfo)
+		}
+	}
+	if reload != nil {
+		if err := reload(cfg); err != nil {
+			return err
+		}
+	}
+	slog.Info("config reloaded", "config", filename, "level", level.Level())
+	return nil
+}
+
+// Validate checks config values for consistency and sane ranges and returns
+// all problems found.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	if c.Spool == "" {
+		add("spool", "spool directory required")
+	}
+	p := c.Processing
+	if p.Workers < 1 {
+		add("processing.workers", "must be at least 1, got %d", p.Workers)
+	}
+	if p.GrobidWorkers < 0 {
+		add("processing.grobid_workers", "must not be negative, got %d", p.GrobidWorkers)
+	}
+	if p.Timeout < time.Second || p.Timeout > 24*time.Hour {
+		add("processing.timeout", "must be between 1s and 24h, got %s", p.Timeout)
+	}
+	if p.SweepAge < 0 {
+		add("processing.sweep_age", "must not be negative, got %s", p.SweepAge)
+	}
+	if p.MinScratchFree < 0 {
+		add("processing.min_scratch_free", "must not be negative, got %d", p.MinScratchFree)
+	}
+	if p.ToolMemoryLimit != 0 && p.ToolMemoryLimit < 64<<20 {
+		add("processing.tool_memory_limit", "must be 0 or at least 64MB, got %d", p.ToolMemoryLimit)
+	}
+	if p.ToolCPULimit < 0 {
+		add("processing.tool_cpu_limit", "must not be negative, got %s", p.ToolCPULimit)
+	}
+	if _, err := ParseOrder(p.Order); err != nil {
+		add("processing.order", "%v, use oldest, smallest or leave empty", err)
+	}
+	if _, err := LookupStages(strings.Join(p.Stages, ",")); err != nil {
+		add("processing.stages", "%v, available: %s", err, strings.Join(RegisteredStages(), ", "))
+	}
+	if p.Checkpoint != "" && (p.ParallelWalk || p.Order != "") {
+		add("processing.checkpoint", "cannot be combined with parallel_walk or order")
+	}
+	if p.S3Spool != "" {
+		if _, _, err := ParseS3Spool(p.S3Spool); err != nil {
+			add("processing.s3_spool", "%v", err)
+		}
+		if p.Checkpoint != "" || p.ParallelWalk || p.Order != "" {
+			add("processing.s3_spool", "cannot be combined with checkpoint, parallel_walk or order")
+		}
+	}
+	if _, err := ParseRequire(strings.Join(p.Require, ",")); err != nil {
+		add("processing.require", "%v", err)
+	} else if slices.Contains(p.Require, "raw") && c.S3.RawBucket == "" {
+		add("processing.require", "raw requires s3.raw_bucket")
+	}
+	if p.TrashRetention < 0 {
+		add("processing.trash_retention", "must not be negative, got %s", p.TrashRetention)
+	}
+	if p.LeaseTTL != 0 && p.LeaseTTL < time.Second {
+		add("processing.lease_ttl", "must be 0 or at least 1s, got %s", p.LeaseTTL)
+	}
+	if p.LeaseTTL > 0 && !p.Parallel {
+		// Only the parallel walk claims files, sequential walks sharing a
+		// spool would process the same files.
+		add("processing.lease_ttl", "requires parallel")
+	}
+	if p.S3SpoolShard != "" {
+		if _, _, err := ParseShard(p.S3SpoolShard); err != nil {
+			add("processing.s3_spool_shard", "%v", err)
+		}
+	}
+	if u, err := url.Parse(c.Grobid.Host); err != nil || u.Scheme == "" || u.Host == "" {
+		add("grobid.host", "must be an URL like http://localhost:8070, got %q", c.Grobid.Host)
+	}
+	if c.Grobid.MaxFileSize < 1 {
+		add("grobid.max_filesize", "must be at least 1, got %d", c.Grobid.MaxFileSize)
+	}
+	for _, elem := range c.Grobid.Options.TEICoordinates {
+		if !slices.Contains(teiCoordinateElements, elem) {
+			add("grobid.options.tei_coordinates", "unknown element %q, use one of %s", elem, strings.Join(teiCoordinateElements, ", "))
+		}
+	}
+	if c.S3.Endpoint == "" {
+		add("s3.endpoint", "endpoint required")
+	} else if strings.Contains(c.S3.Endpoint, "://") {
+		add("s3.endpoint", "must be host:port without scheme, got %q", c.S3.Endpoint)
+	}
+	if c.S3.RawBucket != "" && c.S3.RawFolder == "" {
+		add("s3.raw_folder", "required with raw_bucket")
+	}
+	if _, err := s3Credentials(c.S3.Options()); err != nil {
+		add("s3.signature", "%v", err)
+	}
+	for i, b := range c.S3.Buckets {
+		key := fmt.Sprintf("s3.buckets[%d]", i)
+		if b.Name == "" {
+			add(key+".name", "name required")
+		}
+		for j, r := range b.Expire {
+			if r.Prefix == "" {
+				add(fmt.Sprintf("%s.expire[%d].prefix", key, j), "prefix required, refusing to expire the whole bucket")
+			}
+			if r.Days < 1 {
+				add(fmt.Sprintf("%s.expire[%d].days", key, j), "must be at least 1, got %d", r.Days)
+			}
+		}
+	}
+	var (
+		names = make(map[string]bool)
+		dirs  = make(map[string]bool)
+	)
+	for i := range c.Profiles {
+		pr := &c.Profiles[i]
+		key := fmt.Sprintf("profiles[%d]", i)
+		if err := pr.Validate(); err != nil {
+			add(key, "%v", err)
+			continue
+		}
+		if names[pr.Name] {
+			add(key+".name", "duplicate profile name %q", pr.Name)
+		}
+		if pr.Dir != "" && dirs[pr.Dir] {
+			add(key+".dir", "duplicate profile dir %q", pr.Dir)
+		}
+		names[pr.Name], dirs[pr.Dir] = true, true
+		if pr.GrobidOptions == nil {
+			continue
+		}
+		for _, elem := range pr.GrobidOptions.TEICoordinates {
+			if !slices.Contains(teiCoordinateElements, elem) {
+				add(key+".grobid_options.tei_coordinates", "unknown element %q, use one of %s", elem, strings.Join(teiCoordinateElements, ", "))
+			}
+		}
+	}
+	if p.MaxFileSize < 0 {
+		add("processing.max_filesize", "must not be negative, got %d", p.MaxFileSize)
+	}
+	if p.MaxPages < 0 {
+		add("processing.max_pages", "must not be negative, got %d", p.MaxPages)
+	}
+	if p.MaxPageSize < 0 {
+		add("processing.max_page_size", "must not be negative, got %v", p.MaxPageSize)
+	}
+	if p.PDFCPU != "" && !slices.Contains(pdfextract.PDFCPUModes, p.PDFCPU) {
+		add("processing.pdfcpu", "unknown mode %q, use one of %s", p.PDFCPU, strings.Join(pdfextract.PDFCPUModes, ", "))
+	}
+	if p.MinTextQuality < 0 || p.MinTextQuality > 1 {
+		add("processing.min_text_quality", "must be between 0 and 1, got %v", p.MinTextQuality)
+	}
+	if p.Cache && c.Server.URLMap == "" {
+		add("processing.cache", "requires server.urlmap to record results")
+	}
+	s := c.Server
+	if s.Timeout < time.Second || s.Timeout > time.Hour {
+		add("server.timeout", "must be between 1s and 1h, got %s", s.Timeout)
+	}
+	if s.Quota < 0 {
+		add("server.quota", "must not be negative, got %d", s.Quota)
+	}
+	if s.Quota > 0 && s.URLMap == "" {
+		add("server.quota", "requires server.urlmap to keep track of usage")
+	}
+	if s.MaxBacklog < 0 {
+		add("server.max_backlog", "must not be negative, got %d", s.MaxBacklog)
+	}
+	if s.MaxBacklog > 0 && s.URLMap == "" {
+		add("server.max_backlog", "requires server.urlmap shared with blobproc")
+	}
+	if s.MinFree < 0 {
+		add("server.min_free", "must not be negative, got %d", s.MinFree)
+	}
+	if s.URLMapBatch < 0 {
+		add("server.urlmap_batch", "must not be negative, got %d", s.URLMapBatch)
+	}
+	if s.SyncMaxFileSize < 0 {
+		add("server.sync_max_filesize", "must not be negative, got %d", s.SyncMaxFileSize)
+	}
+	if s.SweepAge < 0 {
+		add("server.sweep_age", "must not be negative, got %s", s.SweepAge)
+	}
+	return errors.Join(errs...)
+}
+
+// Check validates the config and checks, that the spool directory is
+// writable. With probe, it also checks that GROBID and S3 are reachable.
+func (c *Config) Check(ctx context.Context, probe bool) error {
+	var errs []error
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Spool != "" {
+		if err := checkWritable(c.Spool); err != nil {
+			errs = append(errs, fmt.Errorf("spool: %w", err))
+		}
+	}
+	if probe {
+		if err := probeGrobid(ctx, c.Grobid.Host); err != nil {
+			errs = append(errs, fmt.Errorf("grobid.host: %w", err))
+		}
+		if _, err := NewWrapS3(c.S3.Endpoint, c.S3.Options()); err != nil {
+			errs = append(errs, fmt.Errorf("s3.endpoint: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkWritable checks, if a file can be created in dir, which is created, if
+// necessary.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".blobproc-check-*")
+	if err != nil {
+		return fmt.Errorf("directory not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// probeGrobid checks, if a GROBID server is alive.
+func probeGrobid(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(host, "/")+"/api/isalive", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", UserAgent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not alive: %s", resp.Status)
+	}
+	return nil
+}
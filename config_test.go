@@ -0,0 +1,376 @@
+package blobproc
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	var cases = []struct {
+		about   string
+		content string
+		err     string
+	}{
+		{about: "empty", content: ""},
+		{about: "partial", content: "processing:\n  workers: 8\n  timeout: 2m\n"},
+		{about: "unknown key", content: "processing:\n  wrokers: 8\n", err: "field wrokers not found"},
+		{about: "wrong type", content: "processing:\n  workers: many\n", err: "cannot unmarshal"},
+		{about: "buckets", content: "s3:\n  buckets:\n    - name: tmp\n      expire:\n        - prefix: tmp/\n          days: 7\n"},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(t.TempDir(), "blobproc.yaml")
+		if err := os.WriteFile(filename, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(filename)
+		switch {
+		case c.err == "" && err != nil:
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		case c.about == "partial":
+			if cfg.Processing.Workers != 8 || cfg.Processing.Timeout != 2*time.Minute {
+				t.Fatalf("[%s] got %v, %v, want 8, 2m", c.about, cfg.Processing.Workers, cfg.Processing.Timeout)
+			}
+			// Values missing from the file keep their defaults.
+			if cfg.Grobid.Host != DefaultConfig().Grobid.Host {
+				t.Fatalf("[%s] got %v, want default grobid host", c.about, cfg.Grobid.Host)
+			}
+		case c.about == "buckets":
+			// Configured buckets replace the default ones.
+			if len(cfg.S3.Buckets) != 1 || cfg.S3.Buckets[0].Expire[0].Days != 7 {
+				t.Fatalf("[%s] got %v, want a single bucket", c.about, cfg.S3.Buckets)
+			}
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	var cases = []struct {
+		about  string
+		modify func(*Config)
+		err    string
+	}{
+		{about: "defaults", modify: func(*Config) {}},
+		{about: "workers", modify: func(c *Config) { c.Processing.Workers = 0 }, err: "processing.workers"},
+		{about: "timeout", modify: func(c *Config) { c.Processing.Timeout = time.Millisecond }, err: "processing.timeout"},
+		{about: "order", modify: func(c *Config) { c.Processing.Order = "random" }, err: "processing.order"},
+		{about: "stages", modify: func(c *Config) { c.Processing.Stages = []string{"nope"} }, err: "processing.stages"},
+		{about: "grobid host", modify: func(c *Config) { c.Grobid.Host = "localhost:8070" }, err: "grobid.host"},
+		{about: "s3 endpoint", modify: func(c *Config) { c.S3.Endpoint = "http://localhost:9000" }, err: "s3.endpoint"},
+		{about: "quota", modify: func(c *Config) { c.Server.Quota = 100 }, err: "server.quota"},
+		{about: "max backlog", modify: func(c *Config) { c.Server.MaxBacklog = 100 }, err: "server.max_backlog"},
+		{about: "min free", modify: func(c *Config) { c.Server.MinFree = -1 }, err: "server.min_free"},
+		{about: "min scratch free", modify: func(c *Config) { c.Processing.MinScratchFree = -1 }, err: "processing.min_scratch_free"},
+		{about: "s3 spool", modify: func(c *Config) { c.Processing.S3Spool = "x" }, err: "processing.s3_spool"},
+		{about: "s3 spool order", modify: func(c *Config) { c.Processing.S3Spool, c.Processing.Order = "spool/in", "oldest" }, err: "processing.s3_spool"},
+		{about: "lease ttl", modify: func(c *Config) { c.Processing.LeaseTTL = time.Millisecond }, err: "processing.lease_ttl"},
+		{about: "lease ttl sequential", modify: func(c *Config) { c.Processing.LeaseTTL = time.Minute }, err: "processing.lease_ttl"},
+		{about: "lease ttl parallel", modify: func(c *Config) { c.Processing.LeaseTTL, c.Processing.Parallel = time.Minute, true }},
+		{about: "require", modify: func(c *Config) { c.Processing.Require = []string{"text", "x"} }, err: "processing.require"},
+		{about: "require raw", modify: func(c *Config) { c.Processing.Require = []string{"raw"} }, err: "processing.require"},
+		{about: "tei coordinates", modify: func(c *Config) { c.Grobid.Options.TEICoordinates = []string{"figure", "x"} }, err: "grobid.options.tei_coordinates"},
+		{about: "profile selector", modify: func(c *Config) { c.Profiles = []Profile{{Name: "thesis"}} }, err: "profiles[0]"},
+		{about: "profile grobid", modify: func(c *Config) { c.Profiles = []Profile{{Name: "thesis", Dir: "thesis", Grobid: "x"}} }, err: "profiles[0]"},
+		{about: "profile name", modify: func(c *Config) { c.Profiles = []Profile{{Name: "a", Dir: "a"}, {Name: "a", Dir: "b"}} }, err: "profiles[1].name"},
+		{about: "cache", modify: func(c *Config) { c.Processing.Cache, c.Server.URLMap = true, "" }, err: "processing.cache"},
+		{about: "max filesize", modify: func(c *Config) { c.Processing.MaxFileSize = -1 }, err: "processing.max_filesize"},
+		{about: "max pages", modify: func(c *Config) { c.Processing.MaxPages = -1 }, err: "processing.max_pages"},
+		{about: "max page size", modify: func(c *Config) { c.Processing.MaxPageSize = -1 }, err: "processing.max_page_size"},
+		{about: "pdfcpu", modify: func(c *Config) { c.Processing.PDFCPU = "sometimes" }, err: "processing.pdfcpu"},
+		{about: "min text quality", modify: func(c *Config) { c.Processing.MinTextQuality = 1.5 }, err: "processing.min_text_quality"},
+		{about: "trash retention", modify: func(c *Config) { c.Processing.TrashRetention = -time.Hour }, err: "processing.trash_retention"},
+		{about: "s3 spool shard", modify: func(c *Config) { c.Processing.S3SpoolShard = "4/4" }, err: "processing.s3_spool_shard"},
+		{about: "tool memory", modify: func(c *Config) { c.Processing.ToolMemoryLimit = 1024 }, err: "processing.tool_memory_limit"},
+		{about: "tool cpu", modify: func(c *Config) { c.Processing.ToolCPULimit = -time.Second }, err: "processing.tool_cpu_limit"},
+		{about: "s3 signature", modify: func(c *Config) { c.S3.Signature = "v3" }, err: "s3.signature"},
+		{about: "bucket name", modify: func(c *Config) { c.S3.Buckets[1].Name = "" }, err: "s3.buckets[1].name"},
+		{
+			about:  "bucket expire",
+			modify: func(c *Config) { c.S3.Buckets[0].Expire = []ExpireRule{{Days: 7}} },
+			err:    "s3.buckets[0].expire[0].prefix",
+		},
+		{
+			about:  "checkpoint",
+			modify: func(c *Config) { c.Processing.Checkpoint = "cp"; c.Processing.ParallelWalk = true },
+			err:    "processing.checkpoint",
+		},
+	}
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		c.modify(cfg)
+		err := cfg.Validate()
+		switch {
+		case c.err == "" && err != nil:
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		case c.err != "" && (err == nil || !strings.HasPrefix(err.Error(), c.err)):
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		}
+	}
+}
+
+func TestConfigCheckSpool(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Spool = filepath.Join(t.TempDir(), "spool")
+	if err := cfg.Check(context.Background(), false); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	f := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(f, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Spool = filepath.Join(f, "spool")
+	if err := cfg.Check(context.Background(), false); err == nil {
+		t.Fatalf("got nil, want error for spool below a file")
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var (
+		w = fs.Int("w", 4, "")
+		s = fs.String("spool", "default", "")
+	)
+	if err := fs.Parse([]string{"-w", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFlags(fs, map[string]string{"w": "8", "spool": "/config"}); err != nil {
+		t.Fatal(err)
+	}
+	if *w != 2 || *s != "/config" {
+		t.Fatalf("got %v, %v, want 2, /config", *w, *s)
+	}
+	if err := SetFlags(fs, map[string]string{"w": "x", "spool": "/config"}); err != nil {
+		t.Fatalf("got %v, want flag from command line untouched", err)
+	}
+}
+
+func TestFlagConfig(t *testing.T) {
+	var (
+		filename = filepath.Join(t.TempDir(), "blobproc.yaml")
+		fs       = flag.NewFlagSet("test", flag.ContinueOnError)
+		w        = fs.Int("w", 4, "")
+		s        = fs.String("spool", "default", "")
+		fc       = &FlagConfig{
+			FlagSet: fs,
+			File:    filename,
+			Flags: func(cfg *Config) map[string]string {
+				return map[string]string{"w": strconv.Itoa(cfg.Processing.Workers), "spool": cfg.Spool}
+			},
+		}
+	)
+	if err := os.WriteFile(filename, []byte("spool: /config\nprocessing:\n  workers: 8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-w", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fc.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if *w != 2 || *s != "/config" {
+		t.Fatalf("got %v, %v, want 2, /config", *w, *s)
+	}
+	if !fc.Cmdline("w") || fc.Cmdline("spool") {
+		t.Fatalf("got %v, %v, want only w from command line", fc.Cmdline("w"), fc.Cmdline("spool"))
+	}
+	if err := os.WriteFile(filename, []byte("spool: /config\nlog:\n  debug: true\nprocessing:\n  workers: 16\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		level   = new(slog.LevelVar)
+		workers int
+	)
+	err := fc.reload(level, func(cfg *Config) error {
+		workers = cfg.Processing.Workers
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level.Level() != slog.LevelDebug || workers != 16 {
+		t.Fatalf("got %v, %v, want %v, %v", level.Level(), workers, slog.LevelDebug, 16)
+	}
+	// Invalid configs are not applied.
+	if err := os.WriteFile(filename, []byte("processing:\n  workers: 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = fc.reload(level, func(cfg *Config) error {
+		t.Fatalf("got reload with invalid config")
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("got nil, want validation error")
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BLOBPROC_TEST_ACCESS_KEY", "access")
+	var cases = []struct {
+		about     string
+		content   string
+		accessKey string
+		secretKey string
+		err       string
+	}{
+		{
+			about:     "inline",
+			content:   "s3:\n  access_key: a\n  secret_key: b\n",
+			accessKey: "a",
+			secretKey: "b",
+		},
+		{
+			about:     "file and env",
+			content:   "s3:\n  access_key_env: BLOBPROC_TEST_ACCESS_KEY\n  secret_key_file: " + filepath.Join(dir, "secret") + "\n",
+			accessKey: "access",
+			secretKey: "s3cr3t",
+		},
+		{
+			about:   "missing file",
+			content: "s3:\n  secret_key_file: " + filepath.Join(dir, "missing") + "\n",
+			err:     "s3.secret_key_file",
+		},
+		{
+			about:   "unset env",
+			content: "s3:\n  access_key_env: BLOBPROC_TEST_UNSET\n",
+			err:     "s3.access_key_env",
+		},
+		{
+			about:   "conflicting file and env",
+			content: "s3:\n  secret_key_file: x\n  secret_key_env: y\n",
+			err:     "use either",
+		},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(t.TempDir(), "blobproc.yaml")
+		if err := os.WriteFile(filename, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(filename)
+		switch {
+		case c.err == "" && err != nil:
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		case c.err == "" && (cfg.S3.AccessKey != c.accessKey || cfg.S3.SecretKey != c.secretKey):
+			t.Fatalf("[%s] got %v, %v, want %v, %v", c.about, cfg.S3.AccessKey, cfg.S3.SecretKey, c.accessKey, c.secretKey)
+		}
+	}
+}
+
+func TestResolveSecretCredentialsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "s3-secret"), []byte("from-systemd"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	v, err := resolveSecret("s3.secret_key", "", "s3-secret", "")
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if v != "from-systemd" {
+		t.Fatalf("got %v, want %v", v, "from-systemd")
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	var cases = []struct {
+		about string
+		env   map[string]string
+		check func(*Config) bool
+		err   string
+	}{
+		{
+			about: "no env",
+			check: func(c *Config) bool { return c.Processing.Workers == DefaultConfig().Processing.Workers },
+		},
+		{
+			about: "types",
+			env: map[string]string{
+				"BLOBPROC_SPOOL":              "/env/spool",
+				"BLOBPROC_PROCESSING_WORKERS": "12",
+				"BLOBPROC_PROCESSING_TIMEOUT": "90s",
+				"BLOBPROC_PROCESSING_STAGES":  "a, b",
+				"BLOBPROC_SERVER_DEDUPE":      "true",
+				"BLOBPROC_SERVER_QUOTA":       "1000",
+			},
+			check: func(c *Config) bool {
+				return c.Spool == "/env/spool" &&
+					c.Processing.Workers == 12 &&
+					c.Processing.Timeout == 90*time.Second &&
+					slices.Equal(c.Processing.Stages, []string{"a", "b"}) &&
+					c.Server.Dedupe &&
+					c.Server.Quota == 1000
+			},
+		},
+		{
+			about: "invalid",
+			env:   map[string]string{"BLOBPROC_PROCESSING_WORKERS": "many"},
+			err:   "BLOBPROC_PROCESSING_WORKERS",
+		},
+	}
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		err := cfg.ApplyEnv(func(k string) (string, bool) {
+			v, ok := c.env[k]
+			return v, ok
+		})
+		switch {
+		case c.err == "" && err != nil:
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		case c.check != nil && !c.check(cfg):
+			t.Fatalf("[%s] got %+v, want env values applied", c.about, cfg)
+		}
+	}
+}
+
+func TestConfigKeys(t *testing.T) {
+	keys := make(map[string]string)
+	for _, k := range DefaultConfig().Keys() {
+		keys[k.Key] = k.Env
+	}
+	var cases = []struct {
+		key string
+		env string
+	}{
+		{"spool", "BLOBPROC_SPOOL"},
+		{"processing.grobid_workers", "BLOBPROC_PROCESSING_GROBID_WORKERS"},
+		{"s3.secret_key_file", "BLOBPROC_S3_SECRET_KEY_FILE"},
+		{"server.urlmap_header", "BLOBPROC_SERVER_URLMAP_HEADER"},
+		{"tracing.otlp_endpoint", "BLOBPROC_TRACING_OTLP_ENDPOINT"},
+	}
+	for _, c := range cases {
+		if keys[c.key] != c.env {
+			t.Fatalf("[%s] got %v, want %v", c.key, keys[c.key], c.env)
+		}
+	}
+}
+
+func TestLoadConfigEnvPrecedence(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "blobproc.yaml")
+	if err := os.WriteFile(filename, []byte("processing:\n  workers: 8\n  timeout: 2m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BLOBPROC_PROCESSING_WORKERS", "16")
+	cfg, err := LoadConfigEnv(filename)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if cfg.Processing.Workers != 16 || cfg.Processing.Timeout != 2*time.Minute {
+		t.Fatalf("got %v, %v, want 16, 2m", cfg.Processing.Workers, cfg.Processing.Timeout)
+	}
+}
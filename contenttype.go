@@ -0,0 +1,64 @@
+package blobproc
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	contentTypesMu sync.RWMutex
+	// contentTypes maps extensions, with a leading dot, to content types.
+	// Compound extensions, like ".tei.xml", take precedence over their last
+	// part.
+	contentTypes = map[string]string{
+		".gz":      "application/gzip",
+		".html":    "text/html",
+		".jpeg":    "image/jpeg",
+		".jpg":     "image/jpeg",
+		".json":    "application/json",
+		".jsonl":   "application/jsonl",
+		".pdf":     "application/pdf",
+		".png":     "image/png",
+		".tei.xml": "application/tei+xml",
+		".txt":     "text/plain",
+		".webp":    "image/webp",
+		".xml":     "application/xml",
+		".zst":     "application/zstd",
+	}
+)
+
+// RegisterContentType sets the content type for objects stored with a given
+// extension, e.g. by stages adding new derivative types. The extension may be
+// given with or without a leading dot; a previous registration is replaced.
+func RegisterContentType(ext, contentType string) {
+	contentTypesMu.Lock()
+	defer contentTypesMu.Unlock()
+	contentTypes["."+strings.TrimPrefix(ext, ".")] = contentType
+}
+
+// ContentType returns the content type for an object with a given extension,
+// e.g. "180px.jpg" or "refs.tei.xml". The longest registered suffix wins. If
+// no suffix is registered, the type is detected from the blob, which may be
+// nil, and is "application/octet-stream" in the worst case.
+func ContentType(ext string, blob []byte) string {
+	ext = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	contentTypesMu.RLock()
+	for suffix := ext; suffix != ""; {
+		if contentType, ok := contentTypes[suffix]; ok {
+			contentTypesMu.RUnlock()
+			return contentType
+		}
+		i := strings.Index(suffix[1:], ".")
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	contentTypesMu.RUnlock()
+	if len(blob) == 0 {
+		return "application/octet-stream"
+	}
+	return mimetype.Detect(blob).String()
+}
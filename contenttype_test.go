@@ -0,0 +1,32 @@
+package blobproc
+
+import "testing"
+
+func TestContentType(t *testing.T) {
+	RegisterContentType("test.bin", "application/x-blobproc-test")
+	var cases = []struct {
+		ext  string
+		blob []byte
+		want string
+	}{
+		{"pdf", nil, "application/pdf"},
+		{".pdf", nil, "application/pdf"},
+		{"180px.jpg", nil, "image/jpeg"},
+		{"tei.xml", nil, "application/tei+xml"},
+		{"refs.tei.xml", nil, "application/tei+xml"},
+		{"xml", nil, "application/xml"},
+		{"text.jsonl", nil, "application/jsonl"},
+		{"0001.webp", nil, "image/webp"},
+		{"JSON", nil, "application/json"},
+		{"test.bin", nil, "application/x-blobproc-test"},
+		{"", nil, "application/octet-stream"},
+		{"unknown", nil, "application/octet-stream"},
+		{"unknown", []byte("%PDF-1.5\n"), "application/pdf"},
+		{"", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	}
+	for _, c := range cases {
+		if got := ContentType(c.ext, c.blob); got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.ext, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package blobproc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Dashboard keeps recent uploads and errors in memory and serves a small HTML
+// page with the state of the service, so operators get a quick overview
+// without a metrics stack.
+type Dashboard struct {
+	Dir string // Spool directory.
+	// MaxEntries is the number of recent uploads and errors kept, defaults to
+	// 100.
+	MaxEntries int
+	// SpoolStatsTTL is the time spool statistics are cached, as walking the
+	// spool may be expensive, defaults to one minute.
+	SpoolStatsTTL time.Duration
+
+	mu         sync.Mutex
+	started    time.Time
+	uploads    ring[UploadEvent]
+	errors     ring[ErrorEvent]
+	numUploads int64
+	numBytes   int64
+	window     []UploadEvent // uploads within the rate window
+	spoolStats *SpoolStats
+	spoolAt    time.Time
+}
+
+// UploadEvent is a single spooled file.
+type UploadEvent struct {
+	Time    time.Time `json:"t"`
+	SHA1Hex string    `json:"sha1hex"`
+	Size    int64     `json:"size"`
+	Source  string    `json:"source,omitempty"`
+}
+
+// ErrorEvent is a single error logged by the service.
+type ErrorEvent struct {
+	Time    time.Time `json:"t"`
+	Message string    `json:"msg"`
+	Err     string    `json:"err,omitempty"`
+}
+
+// DashboardStatus is a snapshot of the dashboard data.
+type DashboardStatus struct {
+	Time          time.Time     `json:"t"`
+	Uptime        string        `json:"uptime"`
+	NumUploads    int64         `json:"num_uploads"`
+	NumBytes      int64         `json:"num_bytes"`
+	RateWindow    string        `json:"rate_window"`
+	FilesPerMin   float64       `json:"files_per_min"`
+	BytesPerSec   float64       `json:"bytes_per_sec"`
+	Spool         *SpoolStats   `json:"spool,omitempty"`
+	DiskFree      uint64        `json:"disk_free"`
+	DiskTotal     uint64        `json:"disk_total"`
+	RecentUploads []UploadEvent `json:"recent_uploads"`
+	RecentErrors  []ErrorEvent  `json:"recent_errors"`
+}
+
+// rateWindow is the time window for ingest rate calculation.
+const rateWindow = 5 * time.Minute
+
+// ring is a fixed size ring buffer.
+type ring[T any] struct {
+	items []T
+	next  int // position of the oldest item, once the buffer is full
+}
+
+func (r *ring[T]) add(v T, size int) {
+	if len(r.items) < size {
+		r.items = append(r.items, v)
+		return
+	}
+	r.items[r.next] = v
+	r.next = (r.next + 1) % len(r.items)
+}
+
+// latest returns all items, most recent first.
+func (r *ring[T]) latest() []T {
+	result := make([]T, 0, len(r.items))
+	for i := 0; i < len(r.items); i++ {
+		j := (r.next - 1 - i + 2*len(r.items)) % len(r.items)
+		result = append(result, r.items[j])
+	}
+	return result
+}
+
+func (d *Dashboard) maxEntries() int {
+	if d.MaxEntries > 0 {
+		return d.MaxEntries
+	}
+	return 100
+}
+
+// RecordUpload records a spooled file.
+func (d *Dashboard) RecordUpload(ev UploadEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.uploads.add(ev, d.maxEntries())
+	d.numUploads++
+	d.numBytes += ev.Size
+	d.window = append(d.window, ev)
+	d.trimWindow(ev.Time)
+}
+
+// RecordError records an error.
+func (d *Dashboard) RecordError(ev ErrorEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors.add(ev, d.maxEntries())
+}
+
+// trimWindow removes uploads older than the rate window.
+func (d *Dashboard) trimWindow(now time.Time) {
+	var i int
+	for i < len(d.window) && now.Sub(d.window[i].Time) > rateWindow {
+		i++
+	}
+	d.window = d.window[i:]
+}
+
+// Status returns a snapshot of the dashboard data.
+func (d *Dashboard) Status(ctx context.Context) *DashboardStatus {
+	now := time.Now()
+	d.mu.Lock()
+	if d.started.IsZero() {
+		d.started = now
+	}
+	d.trimWindow(now)
+	var windowBytes int64
+	for _, ev := range d.window {
+		windowBytes += ev.Size
+	}
+	status := &DashboardStatus{
+		Time:          now,
+		Uptime:        now.Sub(d.started).Round(time.Second).String(),
+		NumUploads:    d.numUploads,
+		NumBytes:      d.numBytes,
+		RateWindow:    rateWindow.String(),
+		FilesPerMin:   float64(len(d.window)) / rateWindow.Minutes(),
+		BytesPerSec:   float64(windowBytes) / rateWindow.Seconds(),
+		RecentUploads: d.uploads.latest(),
+		RecentErrors:  d.errors.latest(),
+	}
+	ttl := d.SpoolStatsTTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	refresh := d.spoolStats == nil || now.Sub(d.spoolAt) > ttl
+	d.mu.Unlock()
+	if refresh && d.Dir != "" {
+		stats, err := ComputeSpoolStats(ctx, d.Dir, now)
+		if err != nil {
+			slog.Warn("could not compute spool stats", "err", err)
+		} else {
+			d.mu.Lock()
+			d.spoolStats, d.spoolAt = stats, now
+			d.mu.Unlock()
+		}
+	}
+	d.mu.Lock()
+	status.Spool = d.spoolStats
+	d.mu.Unlock()
+	if d.Dir != "" {
+		free, total, err := diskUsage(d.Dir)
+		if err != nil {
+			slog.Warn("could not determine disk usage", "err", err)
+		}
+		status.DiskFree, status.DiskTotal = free, total
+	}
+	return status
+}
+
+// Start sets the start time, used to calculate uptime.
+func (d *Dashboard) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = time.Now()
+}
+
+// Handler wraps a log handler and records all errors logged.
+func (d *Dashboard) Handler(next slog.Handler) slog.Handler {
+	return &dashboardLogHandler{Handler: next, d: d}
+}
+
+// dashboardLogHandler records error log records in a dashboard.
+type dashboardLogHandler struct {
+	slog.Handler
+	d *Dashboard
+}
+
+func (h *dashboardLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		ev := ErrorEvent{Time: r.Time, Message: r.Message}
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "err" {
+				ev.Err = a.Value.String()
+				return false
+			}
+			return true
+		})
+		h.d.RecordError(ev)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *dashboardLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &dashboardLogHandler{Handler: h.Handler.WithAttrs(attrs), d: h.d}
+}
+
+func (h *dashboardLogHandler) WithGroup(name string) slog.Handler {
+	return &dashboardLogHandler{Handler: h.Handler.WithGroup(name), d: h.d}
+}
+
+// ServeHTTP renders the dashboard as HTML or, with "format=json", as JSON.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := d.Status(r.Context())
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			slog.Warn("could not write dashboard", "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, status); err != nil {
+		slog.Warn("could not render dashboard", "err", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": humanBytes,
+	"pct": func(a, b uint64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return 100 * float64(a) / float64(b)
+	},
+	"ts": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>blobprocd</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { padding: 0.2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+.err { color: #a00; }
+</style>
+</head>
+<body>
+<h1>blobprocd</h1>
+<table>
+<tr><th>uptime</th><td>{{ .Uptime }}</td></tr>
+<tr><th>uploads</th><td>{{ .NumUploads }} ({{ bytes .NumBytes }})</td></tr>
+<tr><th>ingest rate ({{ .RateWindow }})</th><td>{{ printf "%.1f" .FilesPerMin }} files/min, {{ bytes .BytesPerSec }}/s</td></tr>
+{{ with .Spool }}<tr><th>spool</th><td>{{ .NumFiles }} files ({{ bytes .TotalBytes }})</td></tr>{{ end }}
+<tr><th>disk free</th><td>{{ bytes .DiskFree }} of {{ bytes .DiskTotal }} ({{ printf "%.1f" (pct .DiskFree .DiskTotal) }}%)</td></tr>
+</table>
+<h2>Recent uploads</h2>
+<table>
+<tr><th>time</th><th>sha1</th><th>size</th><th>source</th></tr>
+{{ range .RecentUploads }}<tr><td>{{ ts .Time }}</td><td>{{ .SHA1Hex }}</td><td>{{ bytes .Size }}</td><td>{{ .Source }}</td></tr>
+{{ end }}</table>
+<h2>Recent errors</h2>
+<table>
+<tr><th>time</th><th>message</th><th>error</th></tr>
+{{ range .RecentErrors }}<tr class="err"><td>{{ ts .Time }}</td><td>{{ .Message }}</td><td>{{ .Err }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
+
+// humanBytes formats a number of bytes with a binary unit prefix.
+func humanBytes(v any) string {
+	var n float64
+	switch t := v.(type) {
+	case int64:
+		n = float64(t)
+	case uint64:
+		n = float64(t)
+	case float64:
+		n = t
+	}
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
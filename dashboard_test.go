@@ -0,0 +1,89 @@
+package blobproc
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	var cases = []struct {
+		about  string
+		n      int
+		result []int
+	}{
+		{"empty", 0, []int{}},
+		{"partial", 2, []int{1, 0}},
+		{"full", 3, []int{2, 1, 0}},
+		{"wrapped", 5, []int{4, 3, 2}},
+	}
+	for _, c := range cases {
+		var r ring[int]
+		for i := 0; i < c.n; i++ {
+			r.add(i, 3)
+		}
+		if result := r.latest(); !slices.Equal(result, c.result) {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	d := &Dashboard{Dir: t.TempDir()}
+	d.Start()
+	now := time.Now()
+	d.RecordUpload(UploadEvent{Time: now.Add(-time.Hour), SHA1Hex: "old", Size: 100})
+	d.RecordUpload(UploadEvent{Time: now, SHA1Hex: "new", Size: 300})
+	logger := slog.New(d.Handler(slog.NewTextHandler(&strings.Builder{}, nil)))
+	logger.Warn("not recorded")
+	logger.Error("upload failed", "err", "disk full")
+	status := d.Status(context.Background())
+	if status.NumUploads != 2 || status.NumBytes != 400 {
+		t.Fatalf("got %v uploads, %v bytes, want 2, 400", status.NumUploads, status.NumBytes)
+	}
+	if status.FilesPerMin != 0.2 {
+		t.Fatalf("got %v, want %v", status.FilesPerMin, 0.2)
+	}
+	if len(status.RecentUploads) != 2 || status.RecentUploads[0].SHA1Hex != "new" {
+		t.Fatalf("got %v, want most recent upload first", status.RecentUploads)
+	}
+	if len(status.RecentErrors) != 1 || status.RecentErrors[0].Err != "disk full" {
+		t.Fatalf("got %v, want a single error", status.RecentErrors)
+	}
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/ui", nil))
+	if !strings.Contains(rec.Body.String(), "disk full") {
+		t.Fatalf("got %v, want error in dashboard", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/ui?format=json", nil))
+	var v DashboardStatus
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.NumUploads != 2 {
+		t.Fatalf("got %v, want %v", v.NumUploads, 2)
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	var cases = []struct {
+		v      any
+		result string
+	}{
+		{int64(0), "0B"},
+		{int64(1023), "1023B"},
+		{uint64(1536), "1.5KiB"},
+		{float64(3 * 1024 * 1024), "3.0MiB"},
+	}
+	for _, c := range cases {
+		if result := humanBytes(c.v); result != c.result {
+			t.Fatalf("[%v] got %v, want %v", c.v, result, c.result)
+		}
+	}
+}
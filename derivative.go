@@ -0,0 +1,248 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrUnknownDerivative is returned for a derivative kind, that has not been
+// registered.
+var ErrUnknownDerivative = errors.New("unknown derivative")
+
+// Derivative describes where a kind of derivative is stored, keyed by the
+// SHA1 of the original file.
+type Derivative struct {
+	Bucket string
+	Folder string
+	Ext    string
+}
+
+// Request returns the blob request options for a derivative of a file.
+func (d Derivative) Request(sha1hex string, blob []byte) *BlobRequestOptions {
+	return &BlobRequestOptions{
+		Bucket:  d.Bucket,
+		Folder:  d.Folder,
+		Blob:    blob,
+		SHA1Hex: sha1hex,
+		Ext:     d.Ext,
+	}
+}
+
+var (
+	derivativesMu sync.RWMutex
+	// derivatives are keyed by kind, as passed to Pipeline.store.
+	derivatives = map[string]Derivative{
+		"thumbnail":   {Bucket: "thumbnail", Folder: "pdf", Ext: "180px.jpg"},
+		"text":        {Bucket: "sandcrawler", Folder: "text", Ext: "txt"},
+		"tei":         {Bucket: "sandcrawler", Folder: "grobid", Ext: "tei.xml"},
+		"refs":        {Bucket: "sandcrawler", Folder: "grobid_refs", Ext: "refs.tei.xml"},
+		"header":      {Bucket: "sandcrawler", Folder: "grobid_header", Ext: "header.tei.xml"},
+		"html_body":   {Bucket: "sandcrawler", Folder: "html_body", Ext: "tei.xml"},
+		"xml_doc":     {Bucket: "sandcrawler", Folder: "xml_doc", Ext: "xml"},
+		"weblinks":    {Bucket: "sandcrawler", Folder: "weblinks", Ext: "json"},
+		"sentences":   {Bucket: "sandcrawler", Folder: "sentences", Ext: "text.jsonl"},
+		"first_page":  {Bucket: "sandcrawler", Folder: "first_page", Ext: "txt"},
+		"frontmatter": {Bucket: "sandcrawler", Folder: "frontmatter", Ext: "json"},
+		"metadata":    {Bucket: "sandcrawler", Folder: "metadata", Ext: "json"},
+	}
+)
+
+// RegisterDerivative sets the location of a kind of derivative, e.g. for
+// stages or for the archived original, whose bucket is configurable. A
+// previous registration is replaced.
+func RegisterDerivative(kind string, d Derivative) {
+	derivativesMu.Lock()
+	defer derivativesMu.Unlock()
+	derivatives[kind] = d
+}
+
+// LookupDerivative returns the location of a kind of derivative.
+func LookupDerivative(kind string) (Derivative, error) {
+	derivativesMu.RLock()
+	defer derivativesMu.RUnlock()
+	d, ok := derivatives[kind]
+	if !ok {
+		return Derivative{}, fmt.Errorf("%w: %s", ErrUnknownDerivative, kind)
+	}
+	return d, nil
+}
+
+// DerivativeKinds returns the sorted names of all registered derivatives.
+func DerivativeKinds() []string {
+	derivativesMu.RLock()
+	defer derivativesMu.RUnlock()
+	var kinds []string
+	for kind := range derivatives {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// GetDerivative returns a derivative of a file, given the SHA1 of the file
+// and the kind of derivative, e.g. "text" or "tei".
+func (wrap *WrapS3) GetDerivative(ctx context.Context, sha1hex, kind string) ([]byte, error) {
+	d, err := LookupDerivative(kind)
+	if err != nil {
+		return nil, err
+	}
+	return wrap.GetBlob(ctx, d.Request(sha1hex, nil))
+}
+
+// DerivativeInfo describes a stored derivative.
+type DerivativeInfo struct {
+	SHA1Hex      string    `json:"sha1hex,omitempty"` // Set, when listing a kind.
+	Kind         string    `json:"kind"`
+	Bucket       string    `json:"bucket"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ListForSHA1 returns all derivatives stored for a file, ordered by kind.
+// Missing derivatives are skipped.
+func (wrap *WrapS3) ListForSHA1(ctx context.Context, sha1hex string) ([]DerivativeInfo, error) {
+	if len(sha1hex) != 40 {
+		return nil, ErrInvalidHash
+	}
+	var result []DerivativeInfo
+	for _, kind := range DerivativeKinds() {
+		d, err := LookupDerivative(kind)
+		if err != nil {
+			return nil, err
+		}
+		path := blobPath(d.Folder, sha1hex, d.Ext, "")
+		info, err := wrap.Client.StatObject(ctx, d.Bucket, path, minio.StatObjectOptions{})
+		if err != nil {
+			switch minio.ToErrorResponse(err).Code {
+			case "NoSuchKey", "NoSuchBucket":
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		result = append(result, DerivativeInfo{
+			Kind:         kind,
+			Bucket:       d.Bucket,
+			Path:         path,
+			Size:         info.Size,
+			LastModified: info.LastModified.UTC(),
+		})
+	}
+	return result, nil
+}
+
+// ListDerivatives calls fn for each stored derivative of a kind, in key
+// order, optionally only for files whose SHA1 starts with prefix, and after
+// the file with SHA1 startAfter. Objects not named after a SHA1 are skipped.
+// Listing stops at the first error returned by fn.
+func (wrap *WrapS3) ListDerivatives(ctx context.Context, kind, prefix, startAfter string, fn func(DerivativeInfo) error) error {
+	d, err := LookupDerivative(kind)
+	if err != nil {
+		return err
+	}
+	prefix = strings.ToLower(prefix)
+	if !isHex(prefix) || len(prefix) > 40 {
+		return fmt.Errorf("%w: invalid prefix %q", ErrInvalidHash, prefix)
+	}
+	opts := minio.ListObjectsOptions{Prefix: derivativePrefix(d.Folder, prefix), Recursive: true}
+	if startAfter != "" {
+		if !isSHA1Hex(startAfter) {
+			return fmt.Errorf("%w: %s", ErrInvalidHash, startAfter)
+		}
+		opts.StartAfter = blobPath(d.Folder, startAfter, d.Ext, "")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the listing goroutine of minio
+	ext := d.Ext
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	for object := range wrap.Client.ListObjects(ctx, d.Bucket, opts) {
+		if object.Err != nil {
+			return object.Err
+		}
+		sha1hex := strings.TrimSuffix(path.Base(object.Key), ext)
+		if !isSHA1Hex(sha1hex) || !strings.HasPrefix(sha1hex, prefix) || object.Key != blobPath(d.Folder, sha1hex, d.Ext, "") {
+			continue
+		}
+		info := DerivativeInfo{
+			SHA1Hex:      sha1hex,
+			Kind:         kind,
+			Bucket:       d.Bucket,
+			Path:         object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified.UTC(),
+		}
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// derivativePrefix returns the longest object key prefix shared by all
+// derivatives in folder, whose SHA1 starts with prefix.
+func derivativePrefix(folder, prefix string) string {
+	switch {
+	case len(prefix) >= 4:
+		return fmt.Sprintf("%s/%s/%s/%s", folder, prefix[0:2], prefix[2:4], prefix)
+	case len(prefix) >= 2:
+		return fmt.Sprintf("%s/%s/%s", folder, prefix[0:2], prefix[2:])
+	default:
+		return fmt.Sprintf("%s/%s", folder, prefix)
+	}
+}
+
+// DerivativeReader reads a stored derivative.
+type DerivativeReader struct {
+	io.ReadSeekCloser
+	Info        DerivativeInfo
+	ETag        string
+	ContentType string
+}
+
+// OpenDerivative opens a derivative of a file for reading, given the SHA1 of
+// the file and the kind of derivative. Returns an error wrapping
+// fs.ErrNotExist, if the derivative is not stored.
+func (wrap *WrapS3) OpenDerivative(ctx context.Context, sha1hex, kind string) (*DerivativeReader, error) {
+	d, err := LookupDerivative(kind)
+	if err != nil {
+		return nil, err
+	}
+	path := blobPath(d.Folder, sha1hex, d.Ext, "")
+	object, err := wrap.Client.GetObject(ctx, d.Bucket, path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchKey", "NoSuchBucket":
+			return nil, fmt.Errorf("%s: %w", kind, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+	return &DerivativeReader{
+		ReadSeekCloser: object,
+		Info: DerivativeInfo{
+			Kind:         kind,
+			Bucket:       d.Bucket,
+			Path:         path,
+			Size:         info.Size,
+			LastModified: info.LastModified.UTC(),
+		},
+		ETag:        info.ETag,
+		ContentType: ContentType(d.Ext, nil),
+	}, nil
+}
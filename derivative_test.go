@@ -0,0 +1,155 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestLookupDerivative(t *testing.T) {
+	RegisterDerivative("test-raw", Derivative{Bucket: "raw", Folder: "pdf", Ext: "pdf"})
+	var cases = []struct {
+		kind   string
+		bucket string
+		path   string
+		err    error
+	}{
+		{"text", "sandcrawler", "text/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.txt", nil},
+		{"thumbnail", "thumbnail", "pdf/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.180px.jpg", nil},
+		{"tei", "sandcrawler", "grobid/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.tei.xml", nil},
+		{"test-raw", "raw", "pdf/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.pdf", nil},
+		{"nope", "", "", ErrUnknownDerivative},
+	}
+	for _, c := range cases {
+		d, err := LookupDerivative(c.kind)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, want %v", c.kind, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
+		req := d.Request(fakeSHA1Hex, nil)
+		if req.Bucket != c.bucket {
+			t.Fatalf("[%s] got %v, want %v", c.kind, req.Bucket, c.bucket)
+		}
+		if path := blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix); path != c.path {
+			t.Fatalf("[%s] got %v, want %v", c.kind, path, c.path)
+		}
+	}
+	if _, err := (&WrapS3{}).GetDerivative(context.Background(), fakeSHA1Hex, "nope"); !errors.Is(err, ErrUnknownDerivative) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownDerivative)
+	}
+}
+
+func TestListForSHA1(t *testing.T) {
+	var (
+		fake = &fakeS3{
+			buckets: map[string]bool{"sandcrawler": true},
+			objects: map[string]int{
+				"sandcrawler/text/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.txt":       10,
+				"sandcrawler/grobid/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.tei.xml": 20,
+			},
+			requests: make(map[string]int),
+		}
+		srv = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrap := &WrapS3{Client: client}
+	result, err := wrap.ListForSHA1(context.Background(), fakeSHA1Hex)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	var cases = []struct {
+		kind string
+		size int64
+	}{
+		{"tei", 20},
+		{"text", 10},
+	}
+	if len(result) != len(cases) {
+		t.Fatalf("got %v, want %v", result, cases)
+	}
+	for i, c := range cases {
+		if result[i].Kind != c.kind || result[i].Size != c.size {
+			t.Fatalf("[%s] got %v, want %v", c.kind, result[i], c)
+		}
+		if result[i].LastModified.IsZero() {
+			t.Fatalf("[%s] got zero modification time", c.kind)
+		}
+	}
+}
+
+func TestListDerivatives(t *testing.T) {
+	const other = "4e99a8dfc787a8b33e92773df3674fadf4d4cdb6"
+	var (
+		fake = &fakeS3{
+			buckets: map[string]bool{"sandcrawler": true},
+			objects: map[string]int{
+				"sandcrawler/text/4e/12/" + fakeSHA1Hex + ".txt":                            10,
+				"sandcrawler/text/4e/99/" + other + ".txt":                                  20,
+				"sandcrawler/text/aa/f4/aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d.txt":       30,
+				"sandcrawler/text/aa/f4/README":                                             1,
+				"sandcrawler/grobid/4e/12/4e1243bd22c66e76c2ba9eddc1f91394e57f9f83.tei.xml": 40,
+			},
+			requests: make(map[string]int),
+			pageSize: 1,
+		}
+		srv = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrap := &WrapS3{Client: client}
+	var cases = []struct {
+		about      string
+		kind       string
+		prefix     string
+		startAfter string
+		result     []string
+		err        error
+	}{
+		{"all", "text", "", "", []string{fakeSHA1Hex, other, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}, nil},
+		{"short prefix", "text", "4", "", []string{fakeSHA1Hex, other}, nil},
+		{"shard prefix", "text", "4e9", "", []string{other}, nil},
+		{"long prefix", "text", "4E1243", "", []string{fakeSHA1Hex}, nil},
+		{"start after", "text", "", fakeSHA1Hex, []string{other, "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"}, nil},
+		{"other kind", "tei", "", "", []string{fakeSHA1Hex}, nil},
+		{"invalid prefix", "text", "xyz", "", nil, ErrInvalidHash},
+		{"unknown kind", "nope", "", "", nil, ErrUnknownDerivative},
+	}
+	for _, c := range cases {
+		var result []string
+		err := wrap.ListDerivatives(context.Background(), c.kind, c.prefix, c.startAfter, func(d DerivativeInfo) error {
+			if d.Kind != c.kind || d.Size == 0 || d.LastModified.IsZero() {
+				return fmt.Errorf("incomplete info: %v", d)
+			}
+			result = append(result, d.SHA1Hex)
+			return nil
+		})
+		if !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		}
+		if !slices.Equal(result, c.result) {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+		}
+	}
+}
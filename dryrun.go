@@ -0,0 +1,172 @@
+package blobproc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/miku/blobproc/pdfinfo"
+	"github.com/miku/blobproc/spool"
+)
+
+// Plan describes what processing a single spool file would do. Plans are
+// computed with cheap checks only, without running any extraction tools,
+// GROBID or writes to S3. Only if page limits are set, pdfinfo runs for PDF
+// files.
+type Plan struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Mimetype string `json:"mimetype,omitempty"`
+	SHA1Hex  string `json:"sha1hex,omitempty"`
+	Action   string `json:"action"` // One of "process", "skip", "reject" or "fail".
+	Reason   string `json:"reason,omitempty"`
+	Profile  string `json:"profile,omitempty"` // Processing profile, if any.
+	State    string `json:"state,omitempty"`   // Processing state recorded by a previous run, if any.
+	Grobid   bool   `json:"grobid"`            // File would be sent to GROBID.
+	Exists   bool   `json:"exists"`            // Main derivative is already stored.
+	Delete   bool   `json:"delete"`            // File would be removed from the spool.
+	Target   string `json:"target,omitempty"`  // Directory the file would be moved to, e.g. the trash.
+}
+
+// plan returns the planned action for a single file, with the same options
+// as a walk. Files, that a walk with a cache would skip, are planned as
+// "skip". The SHA1 is taken from the spool name, if possible, otherwise the
+// file is hashed.
+func (w *Walker) plan(ctx context.Context, payload Payload) *Plan {
+	var (
+		p    = w.Pipeline
+		path = payload.Path
+		id   = spool.ID(path)
+		plan = &Plan{
+			Path:   path,
+			Size:   payload.FileInfo.Size(),
+			Action: "process",
+		}
+	)
+	defer w.planDisposal(plan)
+	if p.URLMap != nil && isSHA1Hex(id) {
+		plan.SHA1Hex = id
+		st, err := p.URLMap.State(id)
+		switch {
+		case err != nil:
+			slog.Warn("could not read processing state", "err", err, "sha1", id)
+		case st != nil:
+			plan.State = st.State
+		}
+	}
+	if pr := p.cachedResult(path); pr != nil {
+		plan.Action, plan.Reason = "skip", "processed with the same versions before"
+		return plan
+	}
+	plan.Mimetype = sniffMimetype(path)
+	var kind string
+	switch documentType(plan.Mimetype) {
+	case "html":
+		kind = "html_body"
+	case "xml":
+		kind = "xml_doc"
+	case "pdf":
+		var info *pdfinfo.Info
+		if p.Limits.NeedInfo() {
+			var err error
+			if info, err = pdfinfo.RunInfo(ctx, path); err != nil {
+				plan.Action, plan.Reason = "fail", err.Error()
+				return plan
+			}
+		}
+		if status, err := p.Limits.Check(plan.Size, info); err != nil {
+			plan.Action, plan.Reason = "reject", fmt.Sprintf("%s: %v", status, err)
+			return plan
+		}
+		profile := p.profile(path)
+		if profile != nil {
+			plan.Profile = profile.Name
+		}
+		kind = p.teiKind(profile)
+		switch {
+		case kind == "":
+			// Without GROBID, text is the main derivative.
+			kind = "text"
+		case p.GrobidMaxFileSize > 0 && plan.Size > p.GrobidMaxFileSize:
+			plan.Reason = "too large for grobid"
+		default:
+			plan.Grobid = true
+		}
+	default:
+		plan.Action, plan.Reason = "reject", fmt.Sprintf("unsupported mimetype: %s", plan.Mimetype)
+		return plan
+	}
+	if !isSHA1Hex(id) {
+		sha1hex, err := fileSHA1(path)
+		if err != nil {
+			plan.Action, plan.Reason, plan.Grobid = "fail", err.Error(), false
+			return plan
+		}
+		id = sha1hex
+	}
+	plan.SHA1Hex = id
+	if p.ExistsFunc == nil && p.S3 == nil {
+		return plan
+	}
+	d, err := LookupDerivative(kind)
+	if err != nil {
+		plan.Action, plan.Reason = "fail", err.Error()
+		return plan
+	}
+	req := d.Request(id, nil)
+	exists := p.ExistsFunc
+	if exists == nil {
+		exists = p.S3.Exists
+	}
+	ok, err := exists(ctx, req)
+	if err != nil {
+		slog.Warn("could not check for existing derivative", "err", err, "path", path)
+		return plan
+	}
+	if ok {
+		plan.Exists = true
+		plan.Reason = "already stored, would be overwritten"
+	}
+	return plan
+}
+
+// planDisposal records, what would happen to a file after processing, like
+// the disposal of a walk. Processed files may still be kept or moved to the
+// directory for failed files, if derivatives cannot be stored.
+func (w *Walker) planDisposal(plan *Plan) {
+	switch {
+	case w.KeepSpool:
+	case plan.Action == "reject" && w.RejectedDir != "":
+		plan.Target = w.RejectedDir
+	case plan.Action == "fail" && len(w.Require) > 0:
+		// Required derivatives will be missing, so the file is moved to the
+		// directory for failed files, or kept for a retry, if there is none.
+		plan.Target = w.FailedDir
+	case w.Trash != nil:
+		plan.Target = w.Trash.Dir
+	default:
+		plan.Delete = true
+	}
+}
+
+// DryRun walks the spool directory like Run and writes the plan for each
+// file as a JSON line to out, without changing anything. Like a walk, it
+// ignores empty files. Returns the number of files per planned action.
+func (w *Walker) DryRun(ctx context.Context, out io.Writer) (map[string]int, error) {
+	skipDir, err := w.skipDir()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		enc    = json.NewEncoder(out)
+		counts = make(map[string]int)
+	)
+	err = walkSpool(ctx, w.Dir, false, skipDir, func(payload Payload) error {
+		plan := w.plan(ctx, payload)
+		counts[plan.Action]++
+		return enc.Encode(plan)
+	})
+	return counts, err
+}
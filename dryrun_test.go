@@ -0,0 +1,192 @@
+package blobproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miku/blobproc/fileutils"
+	"github.com/miku/blobproc/pdfextract"
+)
+
+func TestWalkerPlan(t *testing.T) {
+	var cases = []struct {
+		about    string
+		path     string
+		maxSize  int64
+		limits   pdfextract.Limits
+		exists   bool
+		keep     bool
+		trash    bool
+		rejected bool // use a directory for rejected files
+		action   string
+		mimetype string
+		grobid   bool
+		delete   bool
+		target   string
+	}{
+		{about: "pdf", path: "testdata/pdf/1906.02444.pdf", action: "process", mimetype: "application/pdf", grobid: true, delete: true},
+		{about: "pdf, keep spool", path: "testdata/pdf/1906.02444.pdf", keep: true, action: "process", mimetype: "application/pdf", grobid: true},
+		{about: "pdf, trash", path: "testdata/pdf/1906.02444.pdf", trash: true, action: "process", mimetype: "application/pdf", grobid: true, target: "trash"},
+		{about: "pdf too large", path: "testdata/pdf/1906.02444.pdf", maxSize: 1024, action: "process", mimetype: "application/pdf", delete: true},
+		{about: "pdf exceeds limit", path: "testdata/pdf/1906.02444.pdf", limits: pdfextract.Limits{MaxFileSize: 1024}, action: "reject", mimetype: "application/pdf", delete: true},
+		{about: "pdf exists", path: "testdata/pdf/1906.02444.pdf", exists: true, action: "process", mimetype: "application/pdf", grobid: true, delete: true},
+		{about: "html", path: "htmlextract/testdata/article.html", action: "process", mimetype: "text/html", delete: true},
+		{about: "xml", path: "testdata/xml/jats.xml", action: "process", mimetype: "text/xml", delete: true},
+		{about: "unsupported", path: "testdata/misc/wordle.py", action: "reject", mimetype: "text/plain; charset=utf-8", delete: true},
+		{about: "unsupported, rejected dir", path: "testdata/misc/wordle.py", rejected: true, action: "reject", mimetype: "text/plain; charset=utf-8", target: "rejected"},
+		// Unreadable files are processed like PDF, and fail.
+		{about: "unreadable", path: "testdata/pdf/missing.pdf", action: "fail", delete: true},
+	}
+	fi, err := os.Stat("testdata/pdf/1906.02444.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		var checked []string
+		w := &Walker{
+			KeepSpool: c.keep,
+			Pipeline: &Pipeline{
+				GrobidMaxFileSize: c.maxSize,
+				Limits:            c.limits,
+				ExistsFunc: func(_ context.Context, req *BlobRequestOptions) (bool, error) {
+					checked = append(checked, req.Folder)
+					return c.exists, nil
+				},
+			},
+		}
+		if c.trash {
+			w.Trash = &Trash{Dir: "trash"}
+		}
+		if c.rejected {
+			w.RejectedDir = "rejected"
+		}
+		payload := Payload{Path: c.path, FileInfo: fi}
+		if st, err := os.Stat(c.path); err == nil {
+			payload.FileInfo = st
+		}
+		plan := w.plan(context.Background(), payload)
+		if plan.Action != c.action {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Action, c.action)
+		}
+		if plan.Mimetype != c.mimetype {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Mimetype, c.mimetype)
+		}
+		if plan.Grobid != c.grobid {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Grobid, c.grobid)
+		}
+		if plan.Delete != c.delete {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Delete, c.delete)
+		}
+		if plan.Target != c.target {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Target, c.target)
+		}
+		if plan.Exists != c.exists {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Exists, c.exists)
+		}
+		if c.action == "process" && len(checked) != 1 {
+			t.Fatalf("[%s] got %v, want a single existence check", c.about, checked)
+		}
+	}
+}
+
+func TestWalkerPlanCached(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := urlMap.SetState(fakeSHA1Hex, StateDone, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := urlMap.SetResultVersion(fakeSHA1Hex, (&Pipeline{}).resultVersion(nil)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), fakeSHA1Hex[:2], fakeSHA1Hex[2:4], fakeSHA1Hex[4:])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileutils.CopyFile(path, "testdata/pdf/1906.02444.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about  string
+		cache  bool
+		action string
+	}{
+		{"cache", true, "skip"},
+		{"no cache", false, "process"},
+	}
+	for _, c := range cases {
+		w := &Walker{Pipeline: &Pipeline{URLMap: urlMap, Cache: c.cache}}
+		plan := w.plan(context.Background(), Payload{Path: path, FileInfo: fi})
+		if plan.Action != c.action {
+			t.Fatalf("[%s] got %v, want %v", c.about, plan.Action, c.action)
+		}
+		if plan.State != StateDone || plan.SHA1Hex != fakeSHA1Hex {
+			t.Fatalf("[%s] got %v, %v, want recorded state and sha1 from name", c.about, plan.State, plan.SHA1Hex)
+		}
+	}
+}
+
+func TestWalkerDryRun(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		scratch = filepath.Join(dir, "scratch")
+	)
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1906.02444.pdf", "1906.11632.pdf"} {
+		if err := fileutils.CopyFile(filepath.Join(dir, name), filepath.Join("testdata/pdf", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files in the scratch directory are not part of the spool.
+	if err := fileutils.CopyFile(filepath.Join(scratch, "tmp.pdf"), "testdata/pdf/1906.02444.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	w := &Walker{
+		Dir:        dir,
+		ScratchDir: scratch,
+		Pipeline: &Pipeline{
+			ExtractFunc: func(_ context.Context, path string, _ *pdfextract.Options) *pdfextract.Result {
+				t.Fatalf("extraction must not run in dry run mode")
+				return nil
+			},
+		},
+	}
+	var buf bytes.Buffer
+	counts, err := w.DryRun(context.Background(), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts["process"] != 2 {
+		t.Fatalf("got %v, want %v", counts, map[string]int{"process": 2})
+	}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var plan Plan
+		if err := dec.Decode(&plan); err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.SHA1Hex) != 40 {
+			t.Fatalf("got %v, want sha1", plan.SHA1Hex)
+		}
+	}
+	// Dry run must not touch the spool.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %v, want %v", len(entries), 3)
+	}
+}
@@ -0,0 +1,165 @@
+package blobproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/miku/blobproc/htmlextract"
+	"github.com/miku/blobproc/pdfextract"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// sniffLength is the number of leading bytes used to detect the mimetype.
+const sniffLength = 512
+
+// sniffMimetype returns a coarse mimetype for a file, based on its first
+// bytes: "text/html", "text/xml" for any XML based format or the detected
+// mimetype otherwise. Returns the empty string, if the file cannot be read.
+func sniffMimetype(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return ""
+	}
+	mtype := mimetype.Detect(buf[:n])
+	for m := mtype; m != nil; m = m.Parent() {
+		switch {
+		case m.Is("text/html"):
+			return "text/html"
+		case m.Is("text/xml"):
+			return "text/xml"
+		}
+	}
+	return mtype.String()
+}
+
+// RejectFile moves a file, that cannot be processed, into a directory for
+// rejected files and writes the reason for the rejection next to it, into a
+// file with a ".reason" extension.
+func RejectFile(path, dir, reason string) error {
+	dst := filepath.Join(dir, filepath.Base(path))
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	return os.WriteFile(dst+".reason", []byte(reason+"\n"), 0644)
+}
+
+// HoldIncomplete handles a processed file, whose derivatives have not all
+// been stored: the file is moved to failedDir along with the reason, if
+// failedDir is set, or stays in the spool to be processed again by the next
+// walk. Returns true, if the file is still in the spool.
+func HoldIncomplete(path, failedDir string, missing []string) (bool, error) {
+	if failedDir == "" {
+		return true, nil
+	}
+	reason := "derivatives not stored: " + strings.Join(missing, ", ")
+	if err := RejectFile(path, failedDir, reason); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// processHTML extracts the main text from an HTML document and stores it as
+// TEI-XML in the "html_body" folder.
+func (p *Pipeline) processHTML(ctx context.Context, path string, pr *ProcessResult, store func(string, *BlobRequestOptions)) {
+	_, span := startSpan(ctx, "htmlextract")
+	result := htmlextract.ProcessFile(path)
+	endSpan(span, result.Err)
+	pr.SHA1Hex, pr.Status = result.SHA1Hex, result.Status
+	if result.Status != "success" {
+		slog.Warn("htmlextract failed", "path", path, "status", result.Status, "err", result.Err)
+		pr.Errors = append(pr.Errors, fmt.Errorf("htmlextract failed with status %q", result.Status))
+		return
+	}
+	tei, err := result.TEI()
+	if err != nil {
+		pr.Errors = append(pr.Errors, fmt.Errorf("html tei serialization failed: %w", err))
+		return
+	}
+	store("html_body", &BlobRequestOptions{
+		Blob:    tei,
+		SHA1Hex: result.SHA1Hex,
+	})
+}
+
+// processXML checks an XML document, e.g. JATS or TEI provided by a
+// publisher, for well-formedness and stores it unaltered in the "xml_doc"
+// folder.
+func (p *Pipeline) processXML(ctx context.Context, path string, pr *ProcessResult, store func(string, *BlobRequestOptions)) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		pr.Errors = append(pr.Errors, err)
+		return
+	}
+	var fi pdfextract.FileInfo
+	fi.FromBytes(b)
+	pr.SHA1Hex = fi.SHA1Hex
+	_, span := startSpan(ctx, "xmlcheck", attribute.String("sha1", fi.SHA1Hex))
+	root, err := CheckXML(bytes.NewReader(b))
+	endSpan(span, err)
+	if err != nil {
+		pr.Status = "bad-xml"
+		slog.Warn("xml not well-formed", "path", path, "err", err)
+		pr.Errors = append(pr.Errors, fmt.Errorf("xml not well-formed: %w", err))
+		return
+	}
+	pr.Status = "success"
+	slog.Debug("xml document", "path", path, "root", root, "sha1", fi.SHA1Hex, "size", fi.Size)
+	store("xml_doc", &BlobRequestOptions{
+		Blob:    b,
+		SHA1Hex: fi.SHA1Hex,
+	})
+}
+
+// CheckXML reads an XML document and returns the local name of the root
+// element, e.g. "article" for JATS or "TEI" for TEI documents. Returns an
+// error, if the document is not well-formed.
+func CheckXML(r io.Reader) (root string, err error) {
+	dec := xml.NewDecoder(r)
+	dec.Strict = true
+	// Publishers use all kinds of encodings, we only check structure.
+	dec.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	// Named entities are usually declared in a DTD, which we do not resolve.
+	dec.Entity = xml.HTMLEntity
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				if root != "" {
+					return "", fmt.Errorf("multiple root elements")
+				}
+				root = t.Name.Local
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if root == "" {
+		return "", fmt.Errorf("no root element")
+	}
+	return root, nil
+}
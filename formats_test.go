@@ -0,0 +1,127 @@
+package blobproc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckXML(t *testing.T) {
+	var cases = []struct {
+		about string
+		doc   string
+		root  string
+		err   bool
+	}{
+		{about: "empty", doc: "", err: true},
+		{about: "minimal", doc: "<a/>", root: "a"},
+		{about: "tei", doc: `<TEI xmlns="http://www.tei-c.org/ns/1.0"><text/></TEI>`, root: "TEI"},
+		{about: "unclosed", doc: "<a><b></a>", err: true},
+		{about: "two roots", doc: "<a/><b/>", err: true},
+		{about: "latin1", doc: `<?xml version="1.0" encoding="ISO-8859-1"?><a>x</a>`, root: "a"},
+	}
+	for _, c := range cases {
+		root, err := CheckXML(strings.NewReader(c.doc))
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error: %v", c.about, err, c.err)
+		}
+		if root != c.root {
+			t.Fatalf("[%s] got %v, want %v", c.about, root, c.root)
+		}
+	}
+}
+
+func TestSniffMimetype(t *testing.T) {
+	var cases = []struct {
+		path   string
+		result string
+	}{
+		{path: "testdata/xml/jats.xml", result: "text/xml"},
+		{path: "htmlextract/testdata/article.html", result: "text/html"},
+		{path: "testdata/pdf/1906.02444.pdf", result: "application/pdf"},
+		{path: "testdata/does-not-exist", result: ""},
+	}
+	for _, c := range cases {
+		if result := sniffMimetype(c.path); result != c.result {
+			t.Fatalf("[%s] got %v, want %v", c.path, result, c.result)
+		}
+	}
+}
+
+func TestPipelineProcessXML(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			GrobidFunc: fakeGrobidOK,
+			PutFunc:    store.put,
+		}
+		path = "testdata/xml/jats.xml"
+	)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fi}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want ok", pr.Errors)
+	}
+	if want := []string{"xml_doc"}; !slices.Equal(store.folders, want) {
+		t.Fatalf("got %v, want %v", store.folders, want)
+	}
+}
+
+func TestPipelineProcessRejected(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc:  fakeGrobidOK,
+			PutFunc:     store.put,
+		}
+		path = "testdata/misc/wordle.py"
+	)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fi}, "")
+	if pr.Rejected == "" || pr.OK() {
+		t.Fatalf("got %v, %v, want rejected file", pr.Rejected, pr.OK())
+	}
+	if len(store.folders) > 0 {
+		t.Fatalf("got %v, want nothing stored", store.folders)
+	}
+}
+
+func TestRejectFile(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		path     = filepath.Join(dir, "spool", "a.bin")
+		rejected = filepath.Join(dir, "rejected")
+	)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RejectFile(path, rejected, "unsupported mimetype: application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want file removed from spool", err)
+	}
+	b, err := os.ReadFile(filepath.Join(rejected, "a.bin.reason"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "application/octet-stream") {
+		t.Fatalf("got %q, want reason", string(b))
+	}
+	if _, err := os.Stat(filepath.Join(rejected, "a.bin")); err != nil {
+		t.Fatal(err)
+	}
+}
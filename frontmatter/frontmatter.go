@@ -0,0 +1,284 @@
+// Package frontmatter guesses the title and abstract of a paper from the text
+// of its first page, as extracted with pdftotext -layout. The heuristics are
+// cheap and rough, but give a metadata signal for documents, that are not
+// sent to GROBID. Text in multiple columns is handled by only looking at the
+// column of the title or abstract heading, as columns are separated by runs of
+// spaces in layout mode.
+package frontmatter
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Frontmatter is the metadata found on the first page.
+type Frontmatter struct {
+	Title    string `json:"title,omitempty"`
+	Abstract string `json:"abstract,omitempty"`
+}
+
+const (
+	maxTitleLength    = 300
+	maxAbstractLength = 5000
+	maxTitleLines     = 4
+)
+
+var (
+	// rxAbstract matches an abstract heading, with the abstract possibly
+	// following on the same line.
+	rxAbstract = regexp.MustCompile(`^(Abstract|ABSTRACT)\b[\s.:—–-]*`)
+	// rxAbstractEnd matches lines, that follow an abstract.
+	rxAbstractEnd = regexp.MustCompile(`^(?i)(keywords|key words|index terms|ccs concepts|(1|i)\.?\s+introduction|introduction)\b`)
+	// rxStamp matches the arXiv stamp in the margin of the first page.
+	rxStamp = regexp.MustCompile(`^arXiv:\d{4}\.\d{4,5}`)
+	// rxColumnGap separates columns in layout mode.
+	rxColumnGap = regexp.MustCompile(`\s{3,}`)
+)
+
+// junk are lowercase fragments of lines, that appear above a title, like
+// journal names or license statements.
+var junk = []string{
+	"arxiv", "doi", "http", "www.", "@", "journal", "proceedings", "vol.",
+	"volume", "issn", "isbn", "copyright", "©", "preprint", "received",
+	"accepted", "published", "submitted", "license", "conference",
+	"university of", "faculty of", "department of",
+}
+
+// connectors are words, after which a title likely continues on the next
+// line.
+var connectors = map[string]bool{
+	"a": true, "an": true, "and": true, "for": true, "from": true, "in": true,
+	"of": true, "on": true, "the": true, "to": true, "with": true, "via": true,
+}
+
+// FirstPage returns the text of the first page, as pdftotext separates pages
+// with form feeds.
+func FirstPage(text string) string {
+	page, _, _ := strings.Cut(text, "\f")
+	return page
+}
+
+// Parse guesses title and abstract from the first page of a text.
+func Parse(text string) *Frontmatter {
+	lines := splitLines(FirstPage(text))
+	return &Frontmatter{
+		Title:    title(lines),
+		Abstract: abstract(lines),
+	}
+}
+
+// segment is a part of a line in a single column, with its offset in runes.
+type segment struct {
+	start int
+	text  string
+}
+
+func (s segment) end() int { return s.start + len([]rune(s.text)) }
+
+// splitLines splits a page into lines of column segments. The arXiv stamp and
+// the empty lines following it are dropped, as the stamp is printed across
+// columns in the margin.
+func splitLines(page string) [][]segment {
+	var (
+		result    [][]segment
+		skipEmpty bool
+	)
+	for _, line := range strings.Split(page, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case rxStamp.MatchString(trimmed):
+			skipEmpty = true
+			continue
+		case trimmed == "" && skipEmpty:
+			continue
+		}
+		skipEmpty = false
+		var segments []segment
+		for _, loc := range columnSegments(line) {
+			segments = append(segments, segment{
+				start: len([]rune(line[:loc[0]])),
+				text:  line[loc[0]:loc[1]],
+			})
+		}
+		result = append(result, segments)
+	}
+	return result
+}
+
+// columnSegments returns the byte offsets of the non-space parts of a line,
+// that are separated by at least three spaces.
+func columnSegments(line string) [][2]int {
+	line = strings.TrimRightFunc(line, unicode.IsSpace)
+	var (
+		result [][2]int
+		prev   int
+	)
+	for _, gap := range append(rxColumnGap.FindAllStringIndex(line, -1), []int{len(line), len(line)}) {
+		if seg := strings.TrimLeftFunc(line[prev:gap[0]], unicode.IsSpace); seg != "" {
+			result = append(result, [2]int{gap[0] - len(seg), gap[0]})
+		}
+		prev = gap[1]
+	}
+	return result
+}
+
+// inColumn returns the segment of a line, that starts between lo and hi, if
+// any.
+func inColumn(line []segment, lo, hi int) (segment, bool) {
+	for _, s := range line {
+		if s.start >= lo && s.start < hi {
+			return s, true
+		}
+	}
+	return segment{}, false
+}
+
+// isJunk returns true for lines, which are not part of a title.
+func isJunk(s string) bool {
+	lower := strings.ToLower(s)
+	for _, j := range junk {
+		if strings.Contains(lower, j) {
+			return true
+		}
+	}
+	var letters int
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return letters < 4
+}
+
+// isUpper returns true, if s has letters and all of them are uppercase.
+func isUpper(s string) bool {
+	return strings.ContainsFunc(s, unicode.IsLetter) && !strings.ContainsFunc(s, unicode.IsLower)
+}
+
+// title returns the first plausible line of a page, along with lines
+// continuing it. All uppercase titles may span lines separated by empty
+// lines.
+func title(lines [][]segment) string {
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		first := line[0]
+		if rxAbstract.MatchString(first.text) || rxAbstractEnd.MatchString(first.text) {
+			return ""
+		}
+		if isJunk(first.text) {
+			continue
+		}
+		var (
+			parts  = []string{first.text}
+			upper  = isUpper(first.text)
+			empty  int
+			lo, hi = first.start - 30, first.end()
+		)
+		for _, next := range lines[i+1:] {
+			if len(parts) == maxTitleLines {
+				break
+			}
+			s, ok := inColumn(next, lo, hi)
+			if !ok {
+				if empty++; !upper || empty > 3 {
+					break
+				}
+				continue
+			}
+			if isJunk(s.text) || !(upper && isUpper(s.text)) && !(empty == 0 && continues(parts[len(parts)-1], s.text)) {
+				break
+			}
+			parts = append(parts, s.text)
+			empty = 0
+		}
+		return joinTitle(parts)
+	}
+	return ""
+}
+
+// continues returns true, if next likely continues a title line.
+func continues(prev, next string) bool {
+	if strings.HasSuffix(prev, ":") || strings.HasSuffix(prev, "-") {
+		return true
+	}
+	if r := []rune(next); len(r) > 0 && unicode.IsLower(r[0]) {
+		return true
+	}
+	words := strings.Fields(prev)
+	return connectors[strings.ToLower(words[len(words)-1])]
+}
+
+// joinTitle joins title lines and limits the length.
+func joinTitle(parts []string) string {
+	t := joinLines(parts)
+	if len(t) > maxTitleLength {
+		return ""
+	}
+	return t
+}
+
+// abstract returns the text following an abstract heading, in the column of
+// the heading, until an empty line in that column is followed by another or
+// a line, that usually follows the abstract.
+func abstract(lines [][]segment) string {
+	for i, line := range lines {
+		for _, seg := range line {
+			loc := rxAbstract.FindStringIndex(seg.text)
+			if loc == nil {
+				continue
+			}
+			var (
+				parts []string
+				empty int
+				hi    = seg.end() + 10
+			)
+			if rest := strings.TrimSpace(seg.text[loc[1]:]); rest != "" {
+				parts = append(parts, rest)
+			}
+			for _, next := range lines[i+1:] {
+				s, ok := inColumn(next, 0, hi)
+				if !ok {
+					// Empty lines before the abstract do not count.
+					if empty++; len(parts) > 0 && empty > 1 {
+						break
+					}
+					continue
+				}
+				if rxAbstractEnd.MatchString(s.text) {
+					break
+				}
+				parts = append(parts, s.text)
+				empty = 0
+			}
+			a := joinLines(parts)
+			if len(a) > maxAbstractLength {
+				a = a[:strings.LastIndex(a[:maxAbstractLength], " ")]
+			}
+			return a
+		}
+	}
+	return ""
+}
+
+// joinLines joins lines with spaces, collapsing whitespace and removing
+// hyphens at the end of a line, if the next line starts in lowercase.
+func joinLines(lines []string) string {
+	var result string
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		switch {
+		case line == "":
+			continue
+		case result == "":
+		case strings.HasSuffix(result, "-") && unicode.IsLower([]rune(line)[0]):
+			result = strings.TrimSuffix(result, "-")
+		default:
+			result += " "
+		}
+		result += line
+	}
+	return result
+}
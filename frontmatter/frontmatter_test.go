@@ -0,0 +1,86 @@
+package frontmatter
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var cases = []struct {
+		about    string
+		text     string
+		title    string
+		abstract string
+	}{
+		{about: "empty"},
+		{
+			about:    "simple",
+			text:     "Journal of Things, Vol. 3\n\nA Study of Things\nand Their Names\n\nJane Doe\n\nAbstract\nWe study things. Some are hyphen-\nated.\n\nKeywords: things\n\fPage two",
+			title:    "A Study of Things and Their Names",
+			abstract: "We study things. Some are hyphenated.",
+		},
+		{
+			about:    "abstract inline",
+			text:     "Short Title\n\nAbstract—We propose a method.\n\n\n1 Introduction\n",
+			title:    "Short Title",
+			abstract: "We propose a method.",
+		},
+		{
+			about:    "two columns",
+			text:     "         Columns Everywhere\n\n   Abstract               Right column.\n   Left column            More right.\n   text.\n\n\n   1. Introduction\n",
+			title:    "Columns Everywhere",
+			abstract: "Left column text.",
+		},
+		{about: "abstract only on second page", text: "Title Page\n\fAbstract\nNot here.", title: "Title Page"},
+	}
+	for _, c := range cases {
+		fm := Parse(c.text)
+		if fm.Title != c.title {
+			t.Fatalf("[%s] got %q, want %q", c.about, fm.Title, c.title)
+		}
+		if fm.Abstract != c.abstract {
+			t.Fatalf("[%s] got %q, want %q", c.about, fm.Abstract, c.abstract)
+		}
+	}
+}
+
+func TestParseSnapshots(t *testing.T) {
+	var cases = []struct {
+		snapshot string
+		title    string
+		abstract string // prefix and suffix, separated by "..."
+	}{
+		{
+			snapshot: "../testdata/extract/1906.02444.json",
+			title:    "FAULT DIAGNOSIS OF ROTARY MACHINES USING DEEP CONVOLUTIONAL NEURAL NETWORK WITH RAW THREE AXIS SIGNAL INPUT",
+			abstract: "Recent trends focusing on Industry 4.0...enabling high classification accuracy.",
+		},
+		{
+			snapshot: "../testdata/extract/1906.11632.json",
+			title:    "A Survey on GANs for Anomaly Detection",
+			abstract: "Anomaly detection is a significant problem...Open Source toolbox for Anomaly Detection using GANs.",
+		},
+	}
+	for _, c := range cases {
+		b, err := os.ReadFile(c.snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			t.Fatal(err)
+		}
+		fm := Parse(doc.Text)
+		if fm.Title != c.title {
+			t.Fatalf("[%s] got %q, want %q", c.snapshot, fm.Title, c.title)
+		}
+		prefix, suffix, _ := strings.Cut(c.abstract, "...")
+		if !strings.HasPrefix(fm.Abstract, prefix) || !strings.HasSuffix(fm.Abstract, suffix) {
+			t.Fatalf("[%s] got %q, want %q", c.snapshot, fm.Abstract, c.abstract)
+		}
+	}
+}
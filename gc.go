@@ -0,0 +1,136 @@
+package blobproc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// GC finds derivatives in S3, that do not belong to any known file, e.g. left
+// behind by aborted or superseded runs, and reports or deletes them.
+type GC struct {
+	S3 *WrapS3
+	// Known returns true for the SHA1 of a file, whose derivatives are to be
+	// kept, e.g. SHA1Set.Contains or URLMap.Known.
+	Known func(sha1hex string) (bool, error)
+	// Kinds of derivatives to check, defaults to all registered kinds but
+	// the archived original, which is only checked, if listed explicitly.
+	Kinds []string
+	// MinAge spares objects modified more recently, which may belong to a
+	// file, that is still being processed.
+	MinAge time.Duration
+	// Delete removes orphaned objects, otherwise they are only reported.
+	Delete bool
+}
+
+// GCStats summarizes a garbage collection.
+type GCStats struct {
+	Checked       int   `json:"checked"`
+	Orphaned      int   `json:"orphaned"`
+	OrphanedBytes int64 `json:"orphaned_bytes"`
+	Deleted       int   `json:"deleted"`
+}
+
+// Run checks all derivatives of the configured kinds and calls fn, if not
+// nil, for each orphaned derivative, before it is deleted.
+func (gc *GC) Run(ctx context.Context, fn func(DerivativeInfo)) (*GCStats, error) {
+	kinds := gc.Kinds
+	if len(kinds) == 0 {
+		for _, kind := range DerivativeKinds() {
+			if kind != "raw" {
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+	var (
+		stats  = &GCStats{}
+		cutoff = time.Now().Add(-gc.MinAge)
+	)
+	for _, kind := range kinds {
+		err := gc.S3.ListDerivatives(ctx, kind, "", "", func(d DerivativeInfo) error {
+			stats.Checked++
+			if d.LastModified.After(cutoff) {
+				return nil
+			}
+			known, err := gc.Known(d.SHA1Hex)
+			if err != nil || known {
+				return err
+			}
+			stats.Orphaned++
+			stats.OrphanedBytes += d.Size
+			if fn != nil {
+				fn(d)
+			}
+			if !gc.Delete {
+				return nil
+			}
+			if err := gc.S3.Client.RemoveObject(ctx, d.Bucket, d.Path, minio.RemoveObjectOptions{}); err != nil {
+				return fmt.Errorf("%s/%s: %w", d.Bucket, d.Path, err)
+			}
+			stats.Deleted++
+			return nil
+		})
+		switch {
+		case minio.ToErrorResponse(err).Code == "NoSuchBucket":
+			// Nothing stored for this kind.
+		case err != nil:
+			return stats, fmt.Errorf("%s: %w", kind, err)
+		}
+	}
+	return stats, nil
+}
+
+// SHA1Set is a set of SHA1, kept as a sorted slice of digests, which takes a
+// fraction of the memory of a map of hex strings, for lists of many millions.
+type SHA1Set [][20]byte
+
+// ReadSHA1Set reads a set of SHA1 from r, one hex encoded SHA1 per line.
+// Empty lines and lines starting with # are skipped.
+func ReadSHA1Set(r io.Reader) (SHA1Set, error) {
+	var (
+		set SHA1Set
+		br  = bufio.NewScanner(r)
+		i   int
+	)
+	for br.Scan() {
+		i++
+		line := strings.TrimSpace(br.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var digest [20]byte
+		if len(line) != 40 {
+			return nil, fmt.Errorf("line %d: %w: %s", i, ErrInvalidHash, line)
+		}
+		if _, err := hex.Decode(digest[:], []byte(line)); err != nil {
+			return nil, fmt.Errorf("line %d: %w: %s", i, ErrInvalidHash, line)
+		}
+		set = append(set, digest)
+	}
+	if err := br.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(set, func(a, b [20]byte) int { return bytes.Compare(a[:], b[:]) })
+	return slices.Compact(set), nil
+}
+
+// Contains returns true, if the set contains a hex encoded SHA1.
+func (s SHA1Set) Contains(sha1hex string) (bool, error) {
+	var digest [20]byte
+	if len(sha1hex) != 40 {
+		return false, fmt.Errorf("%w: %s", ErrInvalidHash, sha1hex)
+	}
+	if _, err := hex.Decode(digest[:], []byte(sha1hex)); err != nil {
+		return false, fmt.Errorf("%w: %s", ErrInvalidHash, sha1hex)
+	}
+	_, found := slices.BinarySearchFunc(s, digest, func(a, b [20]byte) int { return bytes.Compare(a[:], b[:]) })
+	return found, nil
+}
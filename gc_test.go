@@ -0,0 +1,114 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestGC(t *testing.T) {
+	const orphan = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	set, err := ReadSHA1Set(strings.NewReader("# known files\n" + fakeSHA1Hex + "\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about    string
+		kinds    []string
+		minAge   time.Duration
+		delete   bool
+		orphaned []string
+		remain   int
+	}{
+		{"report", nil, 0, false, []string{"tei", "text"}, 4},
+		{"text only", []string{"text"}, 0, false, []string{"text"}, 4},
+		{"too recent", nil, 100 * 365 * 24 * time.Hour, true, nil, 4},
+		{"delete", nil, 0, true, []string{"tei", "text"}, 2},
+	}
+	for _, c := range cases {
+		var (
+			fake = &fakeS3{
+				buckets: map[string]bool{"sandcrawler": true},
+				objects: map[string]int{
+					"sandcrawler/text/4e/12/" + fakeSHA1Hex + ".txt":       10,
+					"sandcrawler/text/aa/f4/" + orphan + ".txt":            20,
+					"sandcrawler/grobid/4e/12/" + fakeSHA1Hex + ".tei.xml": 30,
+					"sandcrawler/grobid/aa/f4/" + orphan + ".tei.xml":      40,
+				},
+				requests: make(map[string]int),
+			}
+			srv = httptest.NewServer(fake)
+		)
+		client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+			Creds:  credentials.NewStaticV4("key", "secret", ""),
+			Region: "us-east-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			gc = &GC{
+				S3:     &WrapS3{Client: client},
+				Known:  set.Contains,
+				Kinds:  c.kinds,
+				MinAge: c.minAge,
+				Delete: c.delete,
+			}
+			orphaned []string
+		)
+		stats, err := gc.Run(context.Background(), func(d DerivativeInfo) {
+			if d.SHA1Hex != orphan {
+				t.Fatalf("[%s] got %v, want only %v", c.about, d.SHA1Hex, orphan)
+			}
+			orphaned = append(orphaned, d.Kind)
+		})
+		srv.Close()
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if strings.Join(orphaned, ",") != strings.Join(c.orphaned, ",") {
+			t.Fatalf("[%s] got %v, want %v", c.about, orphaned, c.orphaned)
+		}
+		if stats.Orphaned != len(c.orphaned) {
+			t.Fatalf("[%s] got %v, want %v", c.about, stats.Orphaned, len(c.orphaned))
+		}
+		if len(fake.objects) != c.remain {
+			t.Fatalf("[%s] got %v, want %v objects", c.about, len(fake.objects), c.remain)
+		}
+	}
+}
+
+func TestSHA1Set(t *testing.T) {
+	set, err := ReadSHA1Set(strings.NewReader(fakeSHA1Hex + "\n" + strings.ToUpper(fakeSHA1Hex) + "\naaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 2 {
+		t.Fatalf("got %v, want %v", len(set), 2)
+	}
+	var cases = []struct {
+		sha1hex string
+		result  bool
+		err     error
+	}{
+		{fakeSHA1Hex, true, nil},
+		{"aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d", true, nil},
+		{"0000000000000000000000000000000000000000", false, nil},
+		{"abc", false, ErrInvalidHash},
+	}
+	for _, c := range cases {
+		result, err := set.Contains(c.sha1hex)
+		if result != c.result || !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, %v, want %v, %v", c.sha1hex, result, err, c.result, c.err)
+		}
+	}
+	if _, err := ReadSHA1Set(strings.NewReader("abc\n")); !errors.Is(err, ErrInvalidHash) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidHash)
+	}
+}
@@ -0,0 +1,271 @@
+// Package htmlextract extracts the main text and some bibliographic metadata
+// from HTML documents, similar in spirit to trafilatura or readability, and
+// serializes the result as a minimal TEI-XML document.
+package htmlextract
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miku/blobproc/pdfextract"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// minParagraphLength is the minimum number of characters for a block of text
+// to be considered part of the main content.
+const minParagraphLength = 40
+
+// skipElements are never considered content.
+var skipElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Form:     true,
+	atom.Button:   true,
+	atom.Select:   true,
+	atom.Svg:      true,
+	atom.Iframe:   true,
+	atom.Template: true,
+}
+
+// blockElements start a new paragraph.
+var blockElements = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.Div:        true,
+	atom.Section:    true,
+	atom.Article:    true,
+	atom.Main:       true,
+	atom.Li:         true,
+	atom.Blockquote: true,
+	atom.Pre:        true,
+	atom.Td:         true,
+	atom.Th:         true,
+	atom.Dd:         true,
+	atom.Dt:         true,
+	atom.Figcaption: true,
+	atom.Br:         true,
+	atom.Tr:         true,
+}
+
+// headingElements are kept as headings.
+var headingElements = map[atom.Atom]bool{
+	atom.H1: true,
+	atom.H2: true,
+	atom.H3: true,
+	atom.H4: true,
+	atom.H5: true,
+	atom.H6: true,
+}
+
+// Block is a single unit of text, either a heading or a paragraph.
+type Block struct {
+	Heading bool   `json:"heading,omitempty"`
+	Text    string `json:"text"`
+}
+
+// Result of an HTML extraction.
+type Result struct {
+	SHA1Hex  string               `json:"sha1hex,omitempty"`
+	Status   string               `json:"status,omitempty"`
+	Err      error                `json:"-"`
+	FileInfo *pdfextract.FileInfo `json:"fileinfo,omitempty"`
+	Title    string               `json:"title,omitempty"`
+	Lang     string               `json:"lang,omitempty"`
+	Meta     map[string][]string  `json:"meta,omitempty"` // Bibliographic meta tags, e.g. citation_doi.
+	Blocks   []Block              `json:"blocks,omitempty"`
+}
+
+// Text returns the main text, blocks separated by empty lines.
+func (r *Result) Text() string {
+	var texts []string
+	for _, b := range r.Blocks {
+		texts = append(texts, b.Text)
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// ProcessFile extracts text and metadata from an HTML file.
+func ProcessFile(filename string) *Result {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return &Result{Status: "error", Err: err}
+	}
+	return ProcessBlob(b)
+}
+
+// ProcessBlob extracts text and metadata from an HTML blob.
+func ProcessBlob(blob []byte) *Result {
+	var fi = new(pdfextract.FileInfo)
+	fi.FromBytes(blob)
+	doc, err := html.Parse(bytes.NewReader(blob))
+	if err != nil {
+		return &Result{SHA1Hex: fi.SHA1Hex, Status: "parse-error", Err: err, FileInfo: fi}
+	}
+	result := &Result{
+		SHA1Hex:  fi.SHA1Hex,
+		FileInfo: fi,
+		Meta:     make(map[string][]string),
+	}
+	var (
+		buf   strings.Builder
+		flush = func(heading bool) {
+			s := strings.Join(strings.Fields(buf.String()), " ")
+			buf.Reset()
+			if s == "" || (!heading && len(s) < minParagraphLength) {
+				return
+			}
+			result.Blocks = append(result.Blocks, Block{Heading: heading, Text: s})
+		}
+		walk func(n *html.Node)
+	)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch {
+			case n.DataAtom == atom.Html:
+				result.Lang = attr(n, "lang")
+			case n.DataAtom == atom.Title:
+				if result.Title == "" && n.FirstChild != nil {
+					result.Title = strings.TrimSpace(n.FirstChild.Data)
+				}
+				return
+			case n.DataAtom == atom.Meta:
+				name := strings.ToLower(attr(n, "name"))
+				if isBibliographicMeta(name) {
+					if v := strings.TrimSpace(attr(n, "content")); v != "" {
+						result.Meta[name] = append(result.Meta[name], v)
+					}
+				}
+				return
+			case skipElements[n.DataAtom]:
+				return
+			case headingElements[n.DataAtom]:
+				flush(false)
+				for c := n.FirstChild; c != nil; c = c.NextSibling {
+					walk(c)
+				}
+				flush(true)
+				return
+			case blockElements[n.DataAtom]:
+				flush(false)
+				defer flush(false)
+			}
+		}
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+			buf.WriteString(" ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	flush(false)
+	if v, ok := result.Meta["citation_title"]; ok {
+		result.Title = v[0]
+	}
+	if len(result.Blocks) == 0 {
+		result.Status = "empty-html"
+		return result
+	}
+	result.Status = "success"
+	return result
+}
+
+// isBibliographicMeta returns true for meta tag names commonly used by
+// publishers to describe scholarly documents.
+func isBibliographicMeta(name string) bool {
+	for _, prefix := range []string{"citation_", "dc.", "dcterms.", "prism.", "og:"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return name == "description" || name == "keywords" || name == "author"
+}
+
+// attr returns the value of an attribute, or the empty string.
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// TEI is a minimal TEI document, just enough to carry title, authors and the
+// extracted main text.
+type TEI struct {
+	XMLName xml.Name `xml:"http://www.tei-c.org/ns/1.0 TEI"`
+	Lang    string   `xml:"xml:lang,attr,omitempty"`
+	Header  struct {
+		FileDesc struct {
+			TitleStmt struct {
+				Title   string   `xml:"title"`
+				Authors []string `xml:"author,omitempty"`
+			} `xml:"titleStmt"`
+			SourceDesc struct {
+				Bibl struct {
+					IDNo []TEIIdno `xml:"idno,omitempty"`
+				} `xml:"bibl"`
+			} `xml:"sourceDesc"`
+		} `xml:"fileDesc"`
+	} `xml:"teiHeader"`
+	Text struct {
+		Body struct {
+			Elements []TEIElement `xml:",any"`
+		} `xml:"body"`
+	} `xml:"text"`
+}
+
+// TEIIdno is an identifier, e.g. a DOI.
+type TEIIdno struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// TEIElement is a paragraph or heading.
+type TEIElement struct {
+	XMLName xml.Name
+	Text    string `xml:",chardata"`
+}
+
+// TEI returns the extraction result as TEI-XML.
+func (r *Result) TEI() ([]byte, error) {
+	var doc TEI
+	doc.Lang = r.Lang
+	doc.Header.FileDesc.TitleStmt.Title = r.Title
+	doc.Header.FileDesc.TitleStmt.Authors = r.Meta["citation_author"]
+	for _, v := range r.Meta["citation_doi"] {
+		doc.Header.FileDesc.SourceDesc.Bibl.IDNo = append(doc.Header.FileDesc.SourceDesc.Bibl.IDNo,
+			TEIIdno{Type: "DOI", Value: v})
+	}
+	for _, b := range r.Blocks {
+		name := "p"
+		if b.Heading {
+			name = "head"
+		}
+		doc.Text.Body.Elements = append(doc.Text.Body.Elements, TEIElement{
+			XMLName: xml.Name{Local: name},
+			Text:    b.Text,
+		})
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(&buf, "\n"); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package htmlextract
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestProcessFile(t *testing.T) {
+	result := ProcessFile("testdata/article.html")
+	if result.Err != nil {
+		t.Fatalf("got %v, want nil", result.Err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("got %v, want success", result.Status)
+	}
+	if want := "A Study of Things"; result.Title != want {
+		t.Fatalf("got %v, want %v", result.Title, want)
+	}
+	if want := "en"; result.Lang != want {
+		t.Fatalf("got %v, want %v", result.Lang, want)
+	}
+	want := []Block{
+		{Heading: true, Text: "A Study of Things"},
+		{Text: "This paper studies things in great detail, with methods that are described below."},
+		{Heading: true, Text: "Methods"},
+		{Text: "We looked at things from various angles and took careful notes on each of them."},
+	}
+	if diff := cmp.Diff(want, result.Blocks); diff != "" {
+		t.Fatalf("blocks mismatch (-want +got):\n%s", diff)
+	}
+	for _, s := range []string{"tracking", "color: red", "Home", "Copyright"} {
+		if strings.Contains(result.Text(), s) {
+			t.Fatalf("boilerplate %q found in text", s)
+		}
+	}
+}
+
+func TestProcessBlobEmpty(t *testing.T) {
+	result := ProcessBlob([]byte("<html><body><nav>Home</nav></body></html>"))
+	if result.Status != "empty-html" {
+		t.Fatalf("got %v, want empty-html", result.Status)
+	}
+}
+
+func TestTEI(t *testing.T) {
+	result := ProcessFile("testdata/article.html")
+	b, err := result.TEI()
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	var doc TEI
+	if err := xml.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("TEI not well-formed: %v\n%s", err, string(b))
+	}
+	if want := []string{"Doe, Jane", "Roe, Richard"}; !cmp.Equal(doc.Header.FileDesc.TitleStmt.Authors, want) {
+		t.Fatalf("got %v, want %v", doc.Header.FileDesc.TitleStmt.Authors, want)
+	}
+	if !strings.Contains(string(b), `<idno type="DOI">10.1234/example.5678</idno>`) {
+		t.Fatalf("missing DOI in TEI:\n%s", string(b))
+	}
+	if len(doc.Text.Body.Elements) != 4 {
+		t.Fatalf("got %d body elements, want 4", len(doc.Text.Body.Elements))
+	}
+}
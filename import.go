@@ -0,0 +1,335 @@
+package blobproc
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/miku/blobproc/spool"
+	"github.com/miku/blobproc/warcutil"
+)
+
+// ImportOptions configure an import of local files into a spool directory.
+type ImportOptions struct {
+	// Spool is the destination spool directory.
+	Spool string
+	// Provenance records the original location of each file as a file URL
+	// in a metadata sidecar, unless the file already has a sidecar. Members
+	// of a tarball are recorded as a fragment of the URL of the tarball,
+	// payloads of a WARC file with their URL and crawl timestamp.
+	Provenance bool
+	// MinSize and MaxSize limit the import to files of a size in bytes, a
+	// zero MaxSize means no limit.
+	MinSize int64
+	MaxSize int64
+	// MediaTypes limits the import from WARC files to payloads of these media
+	// types, all payloads are imported if empty.
+	MediaTypes []string
+}
+
+// ImportStats summarizes an import.
+type ImportStats struct {
+	Files         int `json:"files"`
+	Imported      int `json:"imported"`
+	Skipped       int `json:"skipped"` // Already in the spool.
+	SkippedBySize int `json:"skipped_by_size"`
+	SkippedByType int `json:"skipped_by_type"` // WARC payloads of other media types.
+	// SkippedByEncoding counts WARC payloads, that cannot be decoded.
+	SkippedByEncoding int   `json:"skipped_by_encoding"`
+	Bytes             int64 `json:"bytes"` // Bytes imported.
+}
+
+// Import copies the files of a directory tree, a tarball, which may be gzip
+// compressed, or the payloads of a WARC file, named .warc or .warc.gz, into a
+// spool directory, sharded by the SHA1 of their content.
+// Files already in the spool are skipped, so an interrupted import can be run
+// again. If src is "-", a stream of files is read from stdin, see
+// ImportStream. Stats are accumulated into stats, so several sources can be
+// imported with a single summary.
+func Import(ctx context.Context, src string, opts *ImportOptions, stats *ImportStats) error {
+	if src == "-" {
+		return ImportStream(ctx, os.Stdin, opts, stats)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	imp := &importer{d: &spool.Dir{Root: opts.Spool}, opts: opts, stats: stats}
+	if fi.IsDir() {
+		root, err := filepath.Abs(opts.Spool)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(abs, root); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("spool directory is within the import directory: %s", root)
+		}
+		return imp.dir(ctx, abs)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(src, ".warc") || strings.HasSuffix(src, ".warc.gz") {
+		if err := imp.warc(ctx, f, filepath.Base(src)); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		return nil
+	}
+	br, done, err := gunzipReader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	defer done()
+	err = imp.tar(ctx, br, func(name string) *Sidecar {
+		u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), Fragment: name}
+		return &Sidecar{URL: u.String()}
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return nil
+}
+
+// ImportStream imports a stream of files into a spool directory, like a
+// tarball piped from a download, without storing the stream first. The
+// stream, which may be gzip compressed, is either a WARC file, a tarball or a
+// sequence of files, each preceded by a header line with its size in bytes
+// and an optional name, separated by a space:
+//
+//	<size> [name]\n<content>
+//
+// As there is no location to point to, provenance is only recorded for files
+// named by an absolute URL and for WARC payloads.
+func ImportStream(ctx context.Context, r io.Reader, opts *ImportOptions, stats *ImportStats) error {
+	br, done, err := gunzipReader(r)
+	if err != nil {
+		return err
+	}
+	defer done()
+	var (
+		imp    = &importer{d: &spool.Dir{Root: opts.Spool}, opts: opts, stats: stats}
+		origin = func(name string) *Sidecar {
+			if u, err := url.Parse(name); err == nil && u.IsAbs() && u.Host != "" {
+				return &Sidecar{URL: name}
+			}
+			return nil
+		}
+	)
+	// A WARC file starts with the version line, a tar header carries the
+	// ustar magic at offset 257, an empty tarball consists of zero blocks
+	// only, a length prefixed stream starts with a digit.
+	b, err := br.Peek(262)
+	switch {
+	case len(b) == 0:
+		return nil
+	case bytes.HasPrefix(b, []byte("WARC/")):
+		return imp.warc(ctx, br, "")
+	case len(b) == 262 && string(b[257:]) == "ustar", b[0] == 0:
+		return imp.tar(ctx, br, origin)
+	case b[0] >= '0' && b[0] <= '9':
+		return imp.lengthPrefixed(ctx, br, origin)
+	case err != nil && err != io.EOF:
+		return err
+	default:
+		return ErrUnknownStreamFormat
+	}
+}
+
+// ErrUnknownStreamFormat is returned, if an import stream is neither a
+// tarball nor length prefixed.
+var ErrUnknownStreamFormat = errors.New("unknown stream format, want warc, tar or length prefixed")
+
+// gunzipReader returns a buffered reader for r, decompressing it, if it is
+// gzip compressed, and a function to release the decompressor.
+func gunzipReader(r io.Reader) (*bufio.Reader, func() error, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return bufio.NewReader(zr), zr.Close, nil
+	}
+	return br, func() error { return nil }, nil
+}
+
+// importer copies files into a spool directory.
+type importer struct {
+	d     *spool.Dir
+	opts  *ImportOptions
+	stats *ImportStats
+}
+
+// dir imports all regular files below root.
+func (imp *importer) dir(ctx context.Context, root string) error {
+	return filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !e.Type().IsRegular() || spool.IsAux(path) {
+			return nil
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		u := url.URL{Scheme: "file", Path: filepath.ToSlash(path)}
+		if err := imp.put(f, fi.Size(), &Sidecar{URL: u.String()}); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// tar imports all regular files of a tarball, origin returns the provenance
+// to record for a member, if any.
+func (imp *importer) tar(ctx context.Context, r io.Reader, origin func(name string) *Sidecar) error {
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := imp.put(tr, hdr.Size, origin(hdr.Name)); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// lengthPrefixed imports a sequence of files, each preceded by a header line
+// with size and optional name.
+func (imp *importer) lengthPrefixed(ctx context.Context, br *bufio.Reader, origin func(name string) *Sidecar) error {
+	for i := 1; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := br.ReadString('\n')
+		switch {
+		case err == io.EOF && line == "":
+			return nil
+		case err == io.EOF:
+			return fmt.Errorf("file %d: %w", i, io.ErrUnexpectedEOF)
+		case err != nil:
+			return err
+		}
+		sizeField, name, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		size, err := strconv.ParseInt(sizeField, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("file %d: invalid header: %q", i, line)
+		}
+		content := io.LimitReader(br, size)
+		if err := imp.put(content, size, origin(name)); err != nil {
+			return fmt.Errorf("file %d: %w", i, err)
+		}
+		// Skip the content of files not imported.
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return err
+		}
+	}
+}
+
+// warc imports the payloads of a WARC file.
+func (imp *importer) warc(ctx context.Context, r io.Reader, filename string) error {
+	e := &warcutil.Extractor{
+		Filename:       filename,
+		MediaTypes:     imp.opts.MediaTypes,
+		MinPayloadSize: imp.opts.MinSize,
+		MaxPayloadSize: imp.opts.MaxSize,
+		Processors: []warcutil.Processor{warcutil.ProcessorFunc(func(p *warcutil.Payload) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			sc := &Sidecar{URL: p.URI}
+			if !p.Date.IsZero() {
+				sc.Timestamp = p.Date.Format("20060102150405")
+			}
+			return imp.put(p.Body, p.Size, sc)
+		})},
+	}
+	stats, err := e.Extract(r)
+	if stats != nil {
+		imp.stats.Files += stats.SkippedBySize + stats.SkippedByType + stats.SkippedByEncoding
+		imp.stats.SkippedBySize += stats.SkippedBySize
+		imp.stats.SkippedByType += stats.SkippedByType
+		imp.stats.SkippedByEncoding += stats.SkippedByEncoding
+	}
+	return err
+}
+
+// put stores the content of r in the spool and records its provenance, if
+// requested and not nil. The content must have the given size, files of a
+// size out of the limits are skipped without reading them.
+func (imp *importer) put(r io.Reader, size int64, sc *Sidecar) error {
+	imp.stats.Files++
+	if size < imp.opts.MinSize || (imp.opts.MaxSize > 0 && size > imp.opts.MaxSize) {
+		imp.stats.SkippedBySize++
+		return nil
+	}
+	w, err := imp.d.Create()
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if w.Size() != size {
+		return io.ErrUnexpectedEOF
+	}
+	existed, err := w.Commit("")
+	if err != nil {
+		return err
+	}
+	if existed {
+		imp.stats.Skipped++
+	} else {
+		imp.stats.Imported++
+		imp.stats.Bytes += w.Size()
+	}
+	if !imp.opts.Provenance || sc == nil {
+		return nil
+	}
+	path, err := imp.d.Path(w.SHA1Hex(), false)
+	if err != nil {
+		return err
+	}
+	// Keep the provenance of the first copy seen, or supplied by a feeder.
+	existing, err := ReadSidecar(path)
+	if err != nil || existing != nil {
+		return err
+	}
+	return WriteSidecar(path, sc)
+}
@@ -0,0 +1,279 @@
+package blobproc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// writeTestTarball writes a gzip compressed tarball with a directory entry and
+// the given files.
+func writeTestTarball(t *testing.T, path string, files map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "papers/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newSHA1 is the sha1 of "new".
+const newSHA1 = "c2a6b03f190dfb2b4aa91f8af8d477a9bc3401dc"
+
+func TestImport(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		src     = filepath.Join(dir, "src")
+		tarball = filepath.Join(dir, "papers.tar.gz")
+		to      = filepath.Join(dir, "spool")
+	)
+	files := map[string]string{
+		"a.pdf":                     "hello",
+		filepath.Join("b", "c.pdf"): "hello",
+		filepath.Join("b", "d.pdf"): "world",
+		"e.pdf" + spool.WIPSuffix:   "partial",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestTarball(t, tarball, map[string]string{
+		"papers/world.pdf": "world",
+		"papers/new.pdf":   "new",
+	})
+	var cases = []struct {
+		about string
+		src   string
+		want  ImportStats
+	}{
+		{"directory", src, ImportStats{Files: 3, Imported: 2, Skipped: 1, Bytes: 10}},
+		{"directory again", src, ImportStats{Files: 3, Skipped: 3}},
+		{"tarball", tarball, ImportStats{Files: 2, Imported: 1, Skipped: 1, Bytes: 3}},
+	}
+	opts := &ImportOptions{Spool: to, Provenance: true}
+	for _, c := range cases {
+		var stats ImportStats
+		if err := Import(context.Background(), c.src, opts, &stats); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if stats != c.want {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, stats, c.want)
+		}
+	}
+	d := &spool.Dir{Root: to}
+	for _, id := range []string{helloSHA1, worldSHA1} {
+		if err := d.Verify(id); err != nil {
+			t.Fatalf("[%s] got %v, want nil", id, err)
+		}
+	}
+	// The world file was seen in the directory first, the new file only in
+	// the tarball.
+	var provenance = []struct {
+		sha1hex string
+		want    string
+	}{
+		{worldSHA1, "file://" + filepath.ToSlash(filepath.Join(src, "b", "d.pdf"))},
+		{newSHA1, "file://" + filepath.ToSlash(tarball) + "#papers/new.pdf"},
+	}
+	for _, c := range provenance {
+		path, err := d.Path(c.sha1hex, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := ReadSidecar(path)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.sha1hex, err)
+		}
+		if sc == nil || sc.URL != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.sha1hex, sc, c.want)
+		}
+	}
+	var stats ImportStats
+	err := Import(context.Background(), dir, opts, &stats)
+	if err == nil || !strings.Contains(err.Error(), "within the import directory") {
+		t.Fatalf("got %v, want error for spool within import directory", err)
+	}
+}
+
+func TestImportStream(t *testing.T) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	for name, content := range map[string]string{"hello.pdf": "hello", "http://example.com/world.pdf": "world"} {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte("5 a.pdf\nhello3\nnew")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var emptyTar bytes.Buffer
+	if err := tar.NewWriter(&emptyTar).Close(); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about   string
+		stream  string
+		want    ImportStats
+		err     bool
+		sha1hex string // with a sidecar expected
+		url     string
+	}{
+		{"empty", "", ImportStats{}, false, "", ""},
+		{"empty tarball", emptyTar.String(), ImportStats{}, false, "", ""},
+		{"length prefixed", "5 http://example.com/hello.pdf\nhello5 world.pdf\nworld",
+			ImportStats{Files: 2, Imported: 2, Bytes: 10}, false, helloSHA1, "http://example.com/hello.pdf"},
+		{"length prefixed, no names", "3\nnew0\n", ImportStats{Files: 2, Imported: 2, Bytes: 3}, false, "", ""},
+		{"gzip compressed", compressed.String(), ImportStats{Files: 2, Imported: 2, Bytes: 8}, false, "", ""},
+		{"tar", tarball.String(), ImportStats{Files: 2, Imported: 2, Bytes: 10}, false, worldSHA1, "http://example.com/world.pdf"},
+		{"truncated", "10 a.pdf\nhello", ImportStats{Files: 1}, true, "", ""},
+		{"truncated header", "5", ImportStats{}, true, "", ""},
+		{"invalid header", "5x a.pdf\nhello", ImportStats{}, true, "", ""},
+		{"unknown format", "%PDF-1.4", ImportStats{}, true, "", ""},
+	}
+	for _, c := range cases {
+		var (
+			to    = t.TempDir()
+			stats ImportStats
+			opts  = &ImportOptions{Spool: to, Provenance: true}
+		)
+		err := ImportStream(context.Background(), strings.NewReader(c.stream), opts, &stats)
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error %v", c.about, err, c.err)
+		}
+		if stats != c.want {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, stats, c.want)
+		}
+		d := &spool.Dir{Root: to}
+		for _, id := range []string{helloSHA1, worldSHA1, newSHA1} {
+			path, err := d.Path(id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc, err := ReadSidecar(path)
+			if err != nil {
+				t.Fatalf("[%s] got %v, want nil", c.about, err)
+			}
+			switch {
+			case id == c.sha1hex && (sc == nil || sc.URL != c.url):
+				t.Fatalf("[%s] got %v, want %v", c.about, sc, c.url)
+			case id != c.sha1hex && sc != nil:
+				t.Fatalf("[%s] got %v, want no sidecar for %s", c.about, sc, id)
+			}
+		}
+	}
+}
+
+func TestImportWARC(t *testing.T) {
+	record := func(uri, contentType, body string) string {
+		block := "HTTP/1.1 200 OK\r\nContent-Type: " + contentType + "\r\n\r\n" + body
+		return fmt.Sprintf("WARC/1.0\r\nWARC-Type: response\r\nWARC-Target-URI: %s\r\n"+
+			"WARC-Date: 2024-06-07T02:39:17Z\r\nContent-Type: application/http; msgtype=response\r\n"+
+			"Content-Length: %d\r\n\r\n%s\r\n\r\n", uri, len(block), block)
+	}
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "crawl.warc.gz")
+		buf  bytes.Buffer
+	)
+	for _, r := range []string{
+		record("http://example.com/hello.pdf", "application/pdf", "hello"),
+		record("http://example.com/world.html", "text/html", "world"),
+		record("http://example.com/large.pdf", "application/pdf", "too large"),
+	} {
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about    string
+		importFn func(opts *ImportOptions, stats *ImportStats) error
+	}{
+		{"file", func(opts *ImportOptions, stats *ImportStats) error {
+			return Import(context.Background(), path, opts, stats)
+		}},
+		{"stream", func(opts *ImportOptions, stats *ImportStats) error {
+			return ImportStream(context.Background(), bytes.NewReader(buf.Bytes()), opts, stats)
+		}},
+	}
+	for _, c := range cases {
+		var (
+			stats ImportStats
+			opts  = &ImportOptions{
+				Spool:      t.TempDir(),
+				Provenance: true,
+				MaxSize:    5,
+				MediaTypes: []string{"application/pdf"},
+			}
+		)
+		if err := c.importFn(opts, &stats); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		want := ImportStats{Files: 3, Imported: 1, SkippedBySize: 1, SkippedByType: 1, Bytes: 5}
+		if stats != want {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, stats, want)
+		}
+		p, err := (&spool.Dir{Root: opts.Spool}).Path(helloSHA1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc, err := ReadSidecar(p)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		wantSidecar := Sidecar{URL: "http://example.com/hello.pdf", Timestamp: "20240607023917"}
+		if sc == nil || *sc != wantSidecar {
+			t.Fatalf("[%s] got %v, want %v", c.about, sc, wantSidecar)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package blobproc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// InventoryEntry is a stored object, as listed in an inventory.
+type InventoryEntry struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	SHA1Hex      string    `json:"sha1hex,omitempty"` // SHA1 of the original file, if the key is a derivative key.
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// Inventory calls fn for each object in a bucket below folder, in key order,
+// or for all objects, if folder is empty. Listing stops at the first error
+// returned by fn.
+func (wrap *WrapS3) Inventory(ctx context.Context, bucket, folder string, fn func(InventoryEntry) error) error {
+	opts := minio.ListObjectsOptions{Recursive: true}
+	if folder = strings.Trim(folder, "/"); folder != "" {
+		opts.Prefix = folder + "/"
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the listing goroutine of minio
+	for object := range wrap.Client.ListObjects(ctx, bucket, opts) {
+		if object.Err != nil {
+			return object.Err
+		}
+		entry := InventoryEntry{
+			Bucket:       bucket,
+			Key:          object.Key,
+			SHA1Hex:      keySHA1(object.Key),
+			Size:         object.Size,
+			ETag:         strings.Trim(object.ETag, `"`),
+			LastModified: object.LastModified.UTC(),
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteInventory writes the inventory of a bucket below folder as JSON lines
+// to w and returns the number of entries written.
+func (wrap *WrapS3) WriteInventory(ctx context.Context, w io.Writer, bucket, folder string) (int, error) {
+	var (
+		bw  = bufio.NewWriter(w)
+		enc = json.NewEncoder(bw)
+		n   int
+	)
+	err := wrap.Inventory(ctx, bucket, folder, func(entry InventoryEntry) error {
+		n++
+		return enc.Encode(entry)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ReadInventory calls fn for each entry of an inventory, which may be gzip
+// compressed.
+func ReadInventory(r io.Reader, fn func(InventoryEntry) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	dec := json.NewDecoder(br)
+	for i := 1; ; i++ {
+		var entry InventoryEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("inventory entry %d: %w", i, err)
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// keySHA1 returns the SHA1 of the original file for a derivative key, like
+// "text/4e/12/4e12...9f83.txt", or the empty string.
+func keySHA1(key string) string {
+	sha1hex, _, _ := strings.Cut(path.Base(key), ".")
+	if !isSHA1Hex(sha1hex) || !strings.HasSuffix(path.Dir(key), sha1hex[0:2]+"/"+sha1hex[2:4]) {
+		return ""
+	}
+	return sha1hex
+}
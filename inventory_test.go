@@ -0,0 +1,111 @@
+package blobproc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestInventory(t *testing.T) {
+	var (
+		fake = &fakeS3{
+			buckets: map[string]bool{"sandcrawler": true},
+			objects: map[string]int{
+				"sandcrawler/grobid/4e/12/" + fakeSHA1Hex + ".tei.xml": 10,
+				"sandcrawler/grobid/notes.txt":                         20,
+				"sandcrawler/text/4e/12/" + fakeSHA1Hex + ".txt":       30,
+			},
+			requests: make(map[string]int),
+			pageSize: 1,
+		}
+		srv = httptest.NewServer(fake)
+	)
+	defer srv.Close()
+	client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("key", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wrap = &WrapS3{Client: client}
+		buf  bytes.Buffer
+		zw   = gzip.NewWriter(&buf)
+	)
+	n, err := wrap.WriteInventory(context.Background(), zw, "sandcrawler", "grobid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %v, want %v", n, 2)
+	}
+	var entries []InventoryEntry
+	if err := ReadInventory(&buf, func(entry InventoryEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		key     string
+		sha1hex string
+		size    int64
+	}{
+		{"grobid/4e/12/" + fakeSHA1Hex + ".tei.xml", fakeSHA1Hex, 10},
+		{"grobid/notes.txt", "", 20},
+	}
+	if len(entries) != len(cases) {
+		t.Fatalf("got %v, want %v entries", entries, len(cases))
+	}
+	for i, c := range cases {
+		e := entries[i]
+		if e.Key != c.key || e.SHA1Hex != c.sha1hex || e.Size != c.size || e.Bucket != "sandcrawler" {
+			t.Fatalf("[%s] got %v, want %v", c.key, e, c)
+		}
+		if e.ETag != "d41d8cd98f00b204e9800998ecf8427e" || e.LastModified.IsZero() {
+			t.Fatalf("[%s] got etag %q, time %v", c.key, e.ETag, e.LastModified)
+		}
+	}
+}
+
+func TestReadInventoryPlain(t *testing.T) {
+	input := `{"bucket":"b","key":"k","size":1,"etag":"e","last_modified":"2026-10-12T10:00:00Z"}` + "\n" + `{"bucket":`
+	var n int
+	err := ReadInventory(strings.NewReader(input), func(InventoryEntry) error {
+		n++
+		return nil
+	})
+	if n != 1 || err == nil {
+		t.Fatalf("got %v, %v, want 1 entry and an error", n, err)
+	}
+}
+
+func TestKeySHA1(t *testing.T) {
+	var cases = []struct {
+		key    string
+		result string
+	}{
+		{"text/4e/12/" + fakeSHA1Hex + ".txt", fakeSHA1Hex},
+		{"dev-grobid/4e/12/" + fakeSHA1Hex + ".tei.xml", fakeSHA1Hex},
+		{"4e/12/" + fakeSHA1Hex, fakeSHA1Hex},
+		{"text/aa/12/" + fakeSHA1Hex + ".txt", ""},
+		{"text/" + fakeSHA1Hex + ".txt", ""},
+		{"text/notes.txt", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if result := keySHA1(c.key); result != c.result {
+			t.Fatalf("[%s] got %v, want %v", c.key, result, c.result)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package blobproc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// ErrLeased is returned, if a file is claimed by another instance.
+var ErrLeased = errors.New("leased by another instance")
+
+// Leaser claims spool files, so several blobproc instances can share a spool,
+// e.g. on a network filesystem, without processing the same file twice. A
+// lease is a file next to the claimed file, created exclusively, containing
+// the owner. Leases, that have not been renewed within TTL, are considered
+// abandoned, e.g. after a crash, and are taken over.
+type Leaser struct {
+	// Owner identifies this instance, e.g. host and pid.
+	Owner string
+	TTL   time.Duration
+
+	mu     sync.Mutex
+	leases map[string]bool // paths of held leases
+}
+
+// DefaultLeaseOwner returns an owner identifying this process.
+func DefaultLeaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// leasePath returns the path of the lease for a file.
+func leasePath(path string) string {
+	return path + spool.LeaseSuffix
+}
+
+// Acquire claims a file. Returns ErrLeased, if another instance holds a
+// valid lease.
+func (l *Leaser) Acquire(path string) error {
+	lp := leasePath(path)
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(lp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(l.Owner + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lp)
+				return err
+			}
+			l.mu.Lock()
+			if l.leases == nil {
+				l.leases = make(map[string]bool)
+			}
+			l.leases[path] = true
+			l.mu.Unlock()
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		if i > 0 {
+			break
+		}
+		if err := l.takeOver(lp); err != nil {
+			return err
+		}
+	}
+	return ErrLeased
+}
+
+// takeOver removes an abandoned lease. Returns ErrLeased, if the lease is
+// still valid. The lease is moved away first, so only one instance can take
+// over a lease.
+func (l *Leaser) takeOver(lp string) error {
+	if !l.stale(lp) {
+		return ErrLeased
+	}
+	moved := fmt.Sprintf("%s.%d%s", lp, time.Now().UnixNano(), spool.LeaseSuffix)
+	if err := os.Rename(lp, moved); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // released or taken over meanwhile
+		}
+		return err
+	}
+	if !l.stale(moved) {
+		// Renewed or replaced, since we looked, put it back.
+		err := os.Link(moved, lp)
+		os.Remove(moved)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		return ErrLeased
+	}
+	var owner string
+	if b, err := os.ReadFile(moved); err == nil {
+		owner = strings.TrimSpace(string(b))
+	}
+	slog.Warn("taking over abandoned lease", "path", lp, "owner", owner)
+	return os.Remove(moved)
+}
+
+// stale returns true, if a lease has not been renewed within TTL.
+func (l *Leaser) stale(lp string) bool {
+	fi, err := os.Stat(lp)
+	return err == nil && time.Since(fi.ModTime()) > l.TTL
+}
+
+// Release gives up the claim on a file.
+func (l *Leaser) Release(path string) error {
+	l.mu.Lock()
+	delete(l.leases, path)
+	l.mu.Unlock()
+	if err := os.Remove(leasePath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Renew extends all held leases. Leases should be renewed well within TTL,
+// e.g. every third of it.
+func (l *Leaser) Renew() error {
+	l.mu.Lock()
+	paths := make([]string, 0, len(l.leases))
+	for path := range l.leases {
+		paths = append(paths, path)
+	}
+	l.mu.Unlock()
+	var (
+		now  = time.Now()
+		errs []error
+	)
+	for _, path := range paths {
+		if err := os.Chtimes(leasePath(path), now, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
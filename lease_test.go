@@ -0,0 +1,55 @@
+package blobproc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLeaser(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "file")
+		a    = &Leaser{Owner: "a", TTL: time.Hour}
+		b    = &Leaser{Owner: "b", TTL: time.Hour}
+	)
+	if err := a.Acquire(path); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if err := b.Acquire(path); !errors.Is(err, ErrLeased) {
+		t.Fatalf("got %v, want %v", err, ErrLeased)
+	}
+	if err := a.Renew(); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if err := a.Release(path); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if err := b.Acquire(path); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	// An abandoned lease is taken over.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(leasePath(path), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Acquire(path); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	owner, err := os.ReadFile(leasePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(owner) != "a\n" {
+		t.Fatalf("got %q, want %q", owner, "a\n")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %v entries, want only the lease", len(entries))
+	}
+}
@@ -0,0 +1,315 @@
+package blobproc
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// MigrateOptions configure a spool migration.
+type MigrateOptions struct {
+	// From is the source directory, in any layout. Files named by their
+	// SHA1, like in a spool, are checked against their content.
+	From string
+	// To is the destination spool directory or the URL of a blobprocd
+	// instance, e.g. http://localhost:8000.
+	To string
+	// Remove removes files from the source, once they are stored at the
+	// destination.
+	Remove bool
+	// Source is sent as source header to blobprocd, if set.
+	Source string
+	// Client is used for requests to blobprocd, defaults to a client with a
+	// one minute timeout.
+	Client *http.Client
+	// MaxRetries is the number of times a file is sent again, if blobprocd
+	// asks to retry later, e.g. because of a backlog.
+	MaxRetries int
+}
+
+// MigrateStats summarizes a spool migration.
+type MigrateStats struct {
+	Files   int   `json:"files"`
+	Copied  int   `json:"copied"`
+	Skipped int   `json:"skipped"` // Already stored at the destination.
+	Failed  int   `json:"failed"`
+	Bytes   int64 `json:"bytes"` // Bytes copied.
+}
+
+// migrateTarget is the destination of a migration.
+type migrateTarget interface {
+	// has returns true, if a file is already stored.
+	has(ctx context.Context, sha1hex string, size int64) (bool, error)
+	// put stores a file, verifying its SHA1, if given, and reports whether
+	// the file had already been stored.
+	put(ctx context.Context, path, sha1hex string) (existed bool, err error)
+}
+
+// MigrateSpool copies all files from one spool directory to another spool
+// directory, sharding them by the SHA1 of their content, or sends them to a
+// blobprocd instance. Files already stored at the destination are skipped, so
+// an interrupted migration can be run again. Files, whose name does not match
+// their content, are not migrated and counted as failed.
+func MigrateSpool(ctx context.Context, opts *MigrateOptions) (*MigrateStats, error) {
+	var target migrateTarget
+	if strings.HasPrefix(opts.To, "http://") || strings.HasPrefix(opts.To, "https://") {
+		client := opts.Client
+		if client == nil {
+			client = &http.Client{Timeout: time.Minute}
+		}
+		target = &remoteTarget{
+			base:       strings.TrimSuffix(opts.To, "/"),
+			source:     opts.Source,
+			client:     client,
+			maxRetries: opts.MaxRetries,
+		}
+	} else {
+		from, err := filepath.Abs(opts.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := filepath.Abs(opts.To)
+		if err != nil {
+			return nil, err
+		}
+		if from == to {
+			return nil, fmt.Errorf("source and destination are the same: %s", from)
+		}
+		target = &dirTarget{d: &spool.Dir{Root: opts.To}}
+	}
+	stats := new(MigrateStats)
+	err := walkSpool(ctx, opts.From, false, nil, func(payload Payload) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stats.Files++
+		var (
+			path    = payload.Path
+			size    = payload.FileInfo.Size()
+			sha1hex = migrateName(opts.From, path)
+		)
+		if sha1hex != "" {
+			ok, err := target.has(ctx, sha1hex, size)
+			if err != nil {
+				return err
+			}
+			if ok {
+				stats.Skipped++
+				return removeMigrated(path, opts.Remove)
+			}
+		}
+		existed, err := target.put(ctx, path, sha1hex)
+		switch {
+		case errors.Is(err, spool.ErrChecksumMismatch):
+			slog.Warn("name does not match content, skipping", "path", path, "err", err)
+			stats.Failed++
+			return nil
+		case err != nil:
+			return fmt.Errorf("%s: %w", path, err)
+		case existed:
+			stats.Skipped++
+		default:
+			stats.Copied++
+			stats.Bytes += size
+		}
+		return removeMigrated(path, opts.Remove)
+	})
+	return stats, err
+}
+
+// migrateName returns the SHA1 a file is named after, either as part of a
+// sharded path or as its basename, or the empty string.
+func migrateName(root, path string) string {
+	name := filepath.Base(path)
+	if rel, err := filepath.Rel(root, path); err == nil {
+		if id := spool.ID(rel); id != "" {
+			name = id
+		}
+	}
+	name = strings.ToLower(name)
+	if len(name) != 40 {
+		return ""
+	}
+	if _, err := hex.DecodeString(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+// removeMigrated removes a migrated file from the source, if requested.
+func removeMigrated(path string, remove bool) error {
+	if !remove {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// dirTarget migrates files into a spool directory.
+type dirTarget struct {
+	d *spool.Dir
+}
+
+func (t *dirTarget) has(_ context.Context, sha1hex string, size int64) (bool, error) {
+	fi, err := t.d.Stat(sha1hex)
+	switch {
+	case err == nil:
+		return fi.Size() == size, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (t *dirTarget) put(_ context.Context, path, sha1hex string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	w, err := t.d.Create()
+	if err != nil {
+		return false, err
+	}
+	defer w.Abort()
+	if _, err := io.Copy(w, f); err != nil {
+		return false, err
+	}
+	return w.Commit(sha1hex)
+}
+
+// remoteTarget migrates files to a blobprocd instance.
+type remoteTarget struct {
+	base       string
+	source     string
+	client     *http.Client
+	maxRetries int
+}
+
+// has returns true, if blobprocd knows about the file and it has not failed,
+// so it would not be processed again.
+func (t *remoteTarget) has(ctx context.Context, sha1hex string, _ int64) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", t.base+"/status/"+sha1hex, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("status: got HTTP %d", resp.StatusCode)
+	}
+	var st statusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return false, err
+	}
+	switch st.State {
+	case StateSpooled, StateProcessing, StateDone:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+func (t *remoteTarget) put(ctx context.Context, path, sha1hex string) (bool, error) {
+	// Check the content first, so corrupted files are not sent.
+	got, err := fileSHA1(path)
+	if err != nil {
+		return false, err
+	}
+	if sha1hex != "" && got != sha1hex {
+		return false, fmt.Errorf("%w: got %s, want %s", spool.ErrChecksumMismatch, got, sha1hex)
+	}
+	for i := 0; ; i++ {
+		busy, retry, err := t.send(ctx, path)
+		if err != nil || !busy {
+			return false, err
+		}
+		if i >= t.maxRetries {
+			return false, fmt.Errorf("blobprocd still busy after %d retries", t.maxRetries)
+		}
+		slog.Info("blobprocd busy, waiting", "retry_after", retry)
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+// send posts a file to blobprocd and returns true and the time to wait before
+// trying again, if blobprocd is busy.
+func (t *remoteTarget) send(ctx context.Context, path string) (busy bool, retry time.Duration, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.base+"/spool", f)
+	if err != nil {
+		return false, 0, err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("User-Agent", UserAgent())
+	if t.source != "" {
+		req.Header.Set(DefaultSourceHttpHeader, t.source)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return false, 0, nil
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || seconds < 0 {
+			seconds = 10
+		}
+		return true, time.Duration(seconds) * time.Second, nil
+	default:
+		return false, 0, fmt.Errorf("spool: got HTTP %d", resp.StatusCode)
+	}
+}
+
+// fileSHA1 returns the SHA1 of the content of a file.
+func fileSHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
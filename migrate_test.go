@@ -0,0 +1,121 @@
+package blobproc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/miku/blobproc/spool"
+)
+
+// sha1 of "hello" and "world"
+const (
+	helloSHA1 = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	worldSHA1 = "7c211433f02071597741e6ff5a8ea34789abbf43"
+)
+
+// createMigrateSource writes files in different layouts: sharded, flat,
+// without a SHA1 name and with a name not matching the content.
+func createMigrateSource(t *testing.T, dir string) {
+	files := map[string]string{
+		filepath.Join("aa", "f4", helloSHA1[4:]): "hello",
+		worldSHA1:                                "world",
+		"notes.pdf":                              "notes",
+		strings.Repeat("0", 40):                  "corrupt",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateSpool(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		from = filepath.Join(dir, "from")
+		to   = filepath.Join(dir, "to")
+	)
+	createMigrateSource(t, from)
+	var cases = []struct {
+		about  string
+		remove bool
+		want   MigrateStats
+	}{
+		{"first run", false, MigrateStats{Files: 4, Copied: 3, Failed: 1, Bytes: 15}},
+		{"resumed", false, MigrateStats{Files: 4, Skipped: 3, Failed: 1}},
+		{"resumed with remove", true, MigrateStats{Files: 4, Skipped: 3, Failed: 1}},
+		{"only corrupt file left", true, MigrateStats{Files: 1, Failed: 1}},
+	}
+	for _, c := range cases {
+		stats, err := MigrateSpool(context.Background(), &MigrateOptions{From: from, To: to, Remove: c.remove})
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if *stats != c.want {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, *stats, c.want)
+		}
+	}
+	d := &spool.Dir{Root: to}
+	for _, id := range []string{helloSHA1, worldSHA1} {
+		if err := d.Verify(id); err != nil {
+			t.Fatalf("[%s] got %v, want nil", id, err)
+		}
+	}
+	if _, err := MigrateSpool(context.Background(), &MigrateOptions{From: to, To: to}); err == nil {
+		t.Fatalf("got nil, want error for same source and destination")
+	}
+}
+
+func TestMigrateSpoolRemote(t *testing.T) {
+	var (
+		dir        = t.TempDir()
+		from       = filepath.Join(dir, "from")
+		svc        = &WebSpoolService{Dir: filepath.Join(dir, "spool")}
+		busy int64 = 1 // number of uploads to reject with 429
+		r          = mux.NewRouter()
+	)
+	createMigrateSource(t, from)
+	r.HandleFunc("/spool", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&busy, -1) >= 0 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		svc.BlobHandler(w, r)
+	}).Methods("POST")
+	r.HandleFunc("/status/{id}", svc.StatusHandler).Methods("GET")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	var cases = []struct {
+		about string
+		want  MigrateStats
+	}{
+		{"first run", MigrateStats{Files: 4, Copied: 3, Failed: 1, Bytes: 15}},
+		{"resumed", MigrateStats{Files: 4, Skipped: 2, Copied: 1, Failed: 1, Bytes: 5}},
+	}
+	for _, c := range cases {
+		stats, err := MigrateSpool(context.Background(), &MigrateOptions{From: from, To: ts.URL, MaxRetries: 1})
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if *stats != c.want {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, *stats, c.want)
+		}
+	}
+	for _, id := range []string{helloSHA1, worldSHA1} {
+		if ok, _ := svc.spool().Exists(id); !ok {
+			t.Fatalf("[%s] got %v, want spooled", id, ok)
+		}
+	}
+}
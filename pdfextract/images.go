@@ -0,0 +1,113 @@
+package pdfextract
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/miku/blobproc/procutil"
+)
+
+// ImageOptions control which embedded images are extracted.
+type ImageOptions struct {
+	MinSize   int64 // Minimum size in bytes.
+	MinWidth  int   // Minimum width in pixels, only checked for JPEG and PNG.
+	MinHeight int   // Minimum height in pixels, only checked for JPEG and PNG.
+	MaxImages int   // Maximum number of images to return, zero means no limit.
+	// TempDir is the directory for temporary files, if empty, the default
+	// directory for temporary files is used.
+	TempDir string
+}
+
+// Image is an image extracted from a PDF.
+type Image struct {
+	Index  int    // Index of the image in the document, as reported by pdfimages.
+	Ext    string // File extension, e.g. "jpg" or "png".
+	Width  int    // Width in pixels, if known.
+	Height int    // Height in pixels, if known.
+	Data   []byte
+}
+
+// ExtractImages runs pdfimages to extract embedded images in their native
+// format and returns all images passing the thresholds given in the options.
+func ExtractImages(ctx context.Context, filename string, opts *ImageOptions) (_ []Image, err error) {
+	if _, err := exec.LookPath("pdfimages"); err != nil {
+		return nil, fmt.Errorf("missing pdfimages executable")
+	}
+	ctx, done := traceTool(ctx, "pdfimages")
+	defer func() { done(err) }()
+	dir, err := os.MkdirTemp(opts.TempDir, "blobproc-images-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	var stderr bytes.Buffer
+	cmd := procutil.Command(ctx, "pdfimages", "-all", filename, filepath.Join(dir, "img"))
+	cmd.Stderr = &stderr
+	if err := procutil.Run(cmd); err != nil {
+		return nil, fmt.Errorf("pdfimages failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, e := range entries {
+		img, ok, err := readImage(filepath.Join(dir, e.Name()), opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			images = append(images, img)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Index < images[j].Index })
+	if opts.MaxImages > 0 && len(images) > opts.MaxImages {
+		images = images[:opts.MaxImages]
+	}
+	return images, nil
+}
+
+// readImage reads a single pdfimages output file, named like "img-012.jpg",
+// and returns false, if the image does not pass the thresholds.
+func readImage(path string, opts *ImageOptions) (Image, bool, error) {
+	var (
+		name  = filepath.Base(path)
+		ext   = strings.TrimPrefix(filepath.Ext(name), ".")
+		index int
+	)
+	if _, err := fmt.Sscanf(strings.TrimSuffix(name, filepath.Ext(name)), "img-%d", &index); err != nil {
+		return Image{}, false, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Image{}, false, err
+	}
+	if fi.Size() < opts.MinSize {
+		return Image{}, false, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Image{}, false, err
+	}
+	img := Image{Index: index, Ext: ext, Data: b}
+	if ext == "jpg" || ext == "png" {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			return Image{}, false, nil
+		}
+		if cfg.Width < opts.MinWidth || cfg.Height < opts.MinHeight {
+			return Image{}, false, nil
+		}
+		img.Width, img.Height = cfg.Width, cfg.Height
+	}
+	return img, true, nil
+}
@@ -0,0 +1,69 @@
+package pdfextract
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadImage(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		write = func(name string, w, h int) string {
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			p := filepath.Join(dir, name)
+			if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			return p
+		}
+		opts = &ImageOptions{MinWidth: 50, MinHeight: 50}
+	)
+	var cases = []struct {
+		about string
+		path  string
+		ok    bool
+		index int
+	}{
+		{about: "large enough", path: write("img-003.png", 100, 60), ok: true, index: 3},
+		{about: "too small", path: write("img-004.png", 100, 10), ok: false},
+		{about: "unexpected name", path: write("other.png", 100, 100), ok: false},
+	}
+	for _, c := range cases {
+		img, ok, err := readImage(c.path, opts)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if ok != c.ok {
+			t.Fatalf("[%s] got %v, want %v", c.about, ok, c.ok)
+		}
+		if ok && (img.Index != c.index || img.Ext != "png") {
+			t.Fatalf("[%s] got index %d, ext %s", c.about, img.Index, img.Ext)
+		}
+	}
+}
+
+func TestExtractImages(t *testing.T) {
+	if _, err := exec.LookPath("pdfimages"); err != nil {
+		t.Skip("pdfimages not installed")
+	}
+	images, err := ExtractImages(context.Background(), "../testdata/pdf/1906.11964.pdf", &ImageOptions{
+		MinSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	for _, img := range images {
+		if int64(len(img.Data)) < 1024 {
+			t.Fatalf("got image smaller than threshold: %d", len(img.Data))
+		}
+	}
+}
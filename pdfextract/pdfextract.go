@@ -14,16 +14,92 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"slices"
-	"sort"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/miku/blobproc/pdfinfo"
-	"mvdan.cc/xurls/v2"
+	"github.com/miku/blobproc/procutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var ErrNoData = errors.New("no data")
+var (
+	ErrNoData = errors.New("no data")
+	// ErrToolMissing is returned, if an external tool is not installed.
+	ErrToolMissing = errors.New("missing executable")
+	// ErrEncrypted is returned, if a PDF cannot be read without a password.
+	ErrEncrypted = errors.New("pdf is encrypted")
+)
+
+// Status is the overall outcome of an extraction. The values are kept
+// compatible with the previously used free form strings.
+type Status string
+
+const (
+	StatusSuccess    Status = "success"
+	StatusError      Status = "error"       // Reading the file failed.
+	StatusNotPDF     Status = "not-pdf"     // File is not a PDF.
+	StatusBadPDF     Status = "bad-pdf"     // PDF known to cause problems.
+	StatusParseError Status = "parse-error" // A tool failed on the PDF.
+	StatusEmptyPDF   Status = "empty-pdf"   // PDF without text.
+	// Statuses for documents exceeding a limit, which are not processed.
+	StatusTooLarge     Status = "too-large"      // File too large.
+	StatusTooManyPages Status = "too-many-pages" // Too many pages.
+	StatusPageTooLarge Status = "page-too-large" // Page too wide or too high.
+)
+
+// ErrorCode is a machine readable reason for a failed extraction, suitable
+// for aggregation. It is empty for successful extractions.
+type ErrorCode string
+
+const (
+	CodeToolMissing ErrorCode = "tool-missing" // An external tool is not installed.
+	CodeTimeout     ErrorCode = "timeout"      // Processing took too long.
+	CodeNotPDF      ErrorCode = "not-pdf"      // File is not a PDF.
+	CodeEncrypted   ErrorCode = "encrypted"    // PDF requires a password.
+	CodeBadPDF      ErrorCode = "bad-pdf"      // PDF known to cause problems.
+	CodeEmptyText   ErrorCode = "empty-text"   // No text could be extracted.
+	CodeToolFailed  ErrorCode = "tool-failed"  // A tool failed for other reasons.
+	CodeIO          ErrorCode = "io-error"     // Reading or writing files failed.
+	CodeLimit       ErrorCode = "limit"        // Document exceeds a configured limit.
+)
+
+// errorCode classifies a tool error.
+func errorCode(ctx context.Context, err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrToolMissing), errors.Is(err, exec.ErrNotFound):
+		return CodeToolMissing
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return CodeTimeout
+	case errors.Is(err, ErrEncrypted):
+		return CodeEncrypted
+	default:
+		return CodeToolFailed
+	}
+}
+
+// tracer for subprocess invocations, noop unless a tracer provider has been
+// configured by the application.
+var tracer = otel.Tracer("github.com/miku/blobproc/pdfextract")
+
+// traceTool starts a span for an external tool invocation. The returned
+// function ends the span and records the error, if any.
+func traceTool(ctx context.Context, tool string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, tool, trace.WithAttributes(attribute.String("tool", tool)))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
 
 // FileInfo groups checksum and size for a file. The checksums should all be
 // lowercase hex digests.
@@ -37,30 +113,72 @@ type FileInfo struct {
 
 // FromBytes creates a FileInfo object from bytes.
 func (fi *FileInfo) FromBytes(p []byte) {
-	var hasher = []hash.Hash{
-		0: md5.New(),
-		1: sha1.New(),
-		2: sha256.New(),
+	*fi = FileInfo{}
+	fi.Complete(p)
+}
+
+// Complete computes the checksums and the mimetype missing in fi from p, so
+// values known from a previous step, like the SHA1 computed when a file was
+// received, are not computed again. The size is always taken from p.
+func (fi *FileInfo) Complete(p []byte) {
+	var (
+		hashers []hash.Hash
+		fields  []*string
+	)
+	for _, f := range []struct {
+		field  *string
+		hasher func() hash.Hash
+	}{
+		{&fi.MD5Hex, md5.New},
+		{&fi.SHA1Hex, sha1.New},
+		{&fi.SHA256Hex, sha256.New},
+	} {
+		if *f.field == "" {
+			hashers = append(hashers, f.hasher())
+			fields = append(fields, f.field)
+		}
 	}
-	for _, h := range hasher {
+	for _, h := range hashers {
 		_, _ = h.Write(p)
 	}
-	*fi = FileInfo{
-		Size:      int64(len(p)),
-		MD5Hex:    hex.EncodeToString(hasher[0].Sum(nil)),
-		SHA1Hex:   hex.EncodeToString(hasher[1].Sum(nil)),
-		SHA256Hex: hex.EncodeToString(hasher[2].Sum(nil)),
-		Mimetype:  mimetype.Detect(p).String(),
+	for i, h := range hashers {
+		*fields[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	fi.Size = int64(len(p))
+	if fi.Mimetype == "" {
+		fi.Mimetype = mimetype.Detect(p).String()
 	}
 }
 
-// FromReader creates file info fields from metadata.
+// sniffLen is the number of bytes looked at to detect the mimetype, the
+// default read limit of the mimetype package.
+const sniffLen = 3072
+
+// FromReader creates file info fields from a reader in a single pass, without
+// keeping the content in memory.
 func (fi *FileInfo) FromReader(r io.Reader) error {
-	b, err := io.ReadAll(r)
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+	var (
+		md5h, sha1h, sha256h = md5.New(), sha1.New(), sha256.New()
+		w                    = io.MultiWriter(md5h, sha1h, sha256h)
+	)
+	_, _ = w.Write(head)
+	size, err := io.Copy(w, r)
 	if err != nil {
 		return err
 	}
-	fi.FromBytes(b)
+	*fi = FileInfo{
+		Size:      int64(n) + size,
+		MD5Hex:    hex.EncodeToString(md5h.Sum(nil)),
+		SHA1Hex:   hex.EncodeToString(sha1h.Sum(nil)),
+		SHA256Hex: hex.EncodeToString(sha256h.Sum(nil)),
+		Mimetype:  mimetype.Detect(head).String(),
+	}
 	return nil
 }
 
@@ -80,8 +198,10 @@ func (fi *FileInfo) FromFile(filename string) error {
 // recorded in Err.
 type Result struct {
 	SHA1Hex        string            `json:"sha1hex,omitempty"`        // The SHA1 of the PDF, used later as key.
-	Status         string            `json:"status,omitempty"`         // A free form status string.
-	Err            error             `json:"err,omitempty"`            // Any error we encountered.
+	Status         Status            `json:"status,omitempty"`         // Overall outcome.
+	Code           ErrorCode         `json:"code,omitempty"`           // Reason for failure, empty on success.
+	Err            error             `json:"-"`                        // Any error we encountered.
+	Error          string            `json:"error,omitempty"`          // Err as string, set when serialized.
 	FileInfo       *FileInfo         `json:"fileinfo,omitempty"`       // Size and checksums.
 	Text           string            `json:"text,omitempty"`           // Fulltext as parsed with a tool, e.g. pdftotext.
 	Page0Thumbnail []byte            `json:"page0thumbnail,omitempty"` // Thumbnail image, jpg format.
@@ -90,23 +210,64 @@ type Result struct {
 	PDFExtra       *pdfinfo.PDFExtra `json:"pdfextra,omitempty"`       // pdfextra, as provided by sandcrawler
 	Source         json.RawMessage   `json:"source,omitempty"`         // Unassigned.
 	Weblinks       []string          `json:"weblinks,omitempty"`       // Extracted link candidates from fulltext.
+	DOIs           []string          `json:"dois,omitempty"`           // DOIs of weblinks to a DOI resolver.
+	Provenance     *Provenance       `json:"provenance,omitempty"`     // Producer and tool versions.
 }
 
-// HasPage0Thumbnail is a derived property.
-func (result *Result) HasPage0Thumbnail() bool {
-	return len(result.Page0Thumbnail) > 50
+// Provenance records the software that produced a result, so derivatives can
+// be traced, when extraction logic changes.
+type Provenance struct {
+	Version string            `json:"version,omitempty"` // Version of the producing program.
+	Commit  string            `json:"commit,omitempty"`  // VCS revision of the build.
+	Tools   map[string]string `json:"tools,omitempty"`   // Versions of external tools.
+}
+
+// versionTools are the external tools and the arguments to print their
+// version.
+var versionTools = map[string][]string{
+	"pdftotext": {"-v"},
+	"pdftoppm":  {"-v"},
+	"pdfinfo":   {"-v"},
+	"pdfcpu":    {"version"},
 }
 
-func extractWeblinks(s string) (links []string) {
-	rx := xurls.Strict()
-	for _, u := range rx.FindAllString(s, -1) {
-		u = strings.TrimSpace(u)
-		u = strings.Replace(u, "\u200b", "", -1)
-		links = append(links, u)
+// ToolVersions returns the versions of the external tools used, like
+// "22.02.0" for pdftotext. Missing tools are omitted. The versions are
+// determined once and cached.
+var ToolVersions = sync.OnceValue(func() map[string]string {
+	versions := make(map[string]string)
+	for name, args := range versionTools {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		// Poppler tools print the version to stderr.
+		out, _ := exec.CommandContext(ctx, path, args...).CombinedOutput()
+		cancel()
+		if v := rxVersion.FindString(string(out)); v != "" {
+			versions[name] = v
+		}
 	}
-	sort.Strings(links)
-	links = slices.Compact(links)
-	return
+	return versions
+})
+
+// rxVersion matches the first version number in tool output.
+var rxVersion = regexp.MustCompile(`v?[0-9]+\.[0-9]+(\.[0-9]+)?`)
+
+// MarshalJSON includes the error message, since an error value has no useful
+// JSON representation.
+func (result Result) MarshalJSON() ([]byte, error) {
+	type plain Result // without methods, to avoid recursion
+	if result.Err != nil && result.Error == "" {
+		result.Error = result.Err.Error()
+	}
+	return json.Marshal(plain(result))
+}
+
+// HasPage0Thumbnail is a derived property.
+func (result *Result) HasPage0Thumbnail() bool {
+	return len(result.Page0Thumbnail) > 50
 }
 
 // Dim in pixels, for thumbnail size.
@@ -119,53 +280,120 @@ type Dim struct {
 type Options struct {
 	Dim       Dim
 	ThumbType string
+	// TempDir is the directory for temporary files created during
+	// processing; if empty, the default directory for temporary files is used.
+	TempDir string
+	// ThumbStdout reads the thumbnail from the stdout of pdftoppm, instead of
+	// an intermediate file.
+	ThumbStdout bool
+	// SkipThumbnail does not render a thumbnail, e.g. if it has been stored
+	// already.
+	SkipThumbnail bool
+	// SkipWeblinks does not look for links in the fulltext.
+	SkipWeblinks bool
+	// Provenance is recorded in results, if set.
+	Provenance *Provenance
+	// Limits skip pathological documents before any text or thumbnail is
+	// extracted.
+	Limits Limits
+	// PDFCPU is one of PDFCPUAlways, the default, PDFCPUFallback or
+	// PDFCPUNever.
+	PDFCPU string
+	// FileInfo, if set, holds checksums known already, which are not
+	// computed again. It is not modified.
+	FileInfo *FileInfo
+}
+
+// When to run pdfcpu, which mostly duplicates the output of pdfinfo, for the
+// metadata of a PDF.
+const (
+	PDFCPUAlways   = "always"   // Run pdfcpu for every file.
+	PDFCPUFallback = "fallback" // Only run pdfcpu, if pdfinfo fails.
+	PDFCPUNever    = "never"    // Only run pdfinfo.
+)
+
+// PDFCPUModes are the values for Options.PDFCPU.
+var PDFCPUModes = []string{PDFCPUAlways, PDFCPUFallback, PDFCPUNever}
+
+// Limits guard against pathological documents, like PDFs with a million
+// pages or plotter sized pages, which take a long time or a lot of memory to
+// process, especially when rendering a thumbnail. A zero value disables a
+// limit.
+type Limits struct {
+	MaxFileSize int64   // Maximum file size in bytes.
+	MaxPages    int     // Maximum number of pages.
+	MaxPageSize float64 // Maximum width or height of the first page in pts.
+}
+
+// NeedInfo returns true, if checking the limits requires pdfinfo.
+func (l Limits) NeedInfo() bool {
+	return l.MaxPages > 0 || l.MaxPageSize > 0
+}
+
+// Check returns the status for a document exceeding a limit and an error
+// describing it, or the empty status, if all limits are met. Info is only
+// used, if page limits are set.
+func (l Limits) Check(size int64, info *pdfinfo.Info) (Status, error) {
+	if l.MaxFileSize > 0 && size > l.MaxFileSize {
+		return StatusTooLarge, fmt.Errorf("file size %d exceeds limit of %d", size, l.MaxFileSize)
+	}
+	if info == nil {
+		return "", nil
+	}
+	if l.MaxPages > 0 && info.Pages > l.MaxPages {
+		return StatusTooManyPages, fmt.Errorf("%d pages exceed limit of %d", info.Pages, l.MaxPages)
+	}
+	if dim := info.PageDim(); l.MaxPageSize > 0 && max(dim.Width, dim.Height) > l.MaxPageSize {
+		return StatusPageTooLarge, fmt.Errorf("page size %s exceeds limit of %v pts", info.PageSize, l.MaxPageSize)
+	}
+	return "", nil
 }
 
 // extractTextFromPDF returns the text of the PDF, uses pdftotext.
-func extractTextFromPDF(ctx context.Context, filename string) ([]byte, error) {
+func extractTextFromPDF(ctx context.Context, filename string) (_ []byte, err error) {
+	ctx, done := traceTool(ctx, "pdftotext")
+	defer func() { done(err) }()
 	if _, err := exec.LookPath("pdftotext"); err != nil {
-		return nil, fmt.Errorf("missing pdftotext executable")
+		return nil, fmt.Errorf("%w: pdftotext", ErrToolMissing)
 	}
-	var buf bytes.Buffer
-	cmd := exec.CommandContext(ctx, "pdftotext", "-layout", filename, "-")
+	var buf, stderr bytes.Buffer
+	cmd := procutil.Command(ctx, "pdftotext", "-layout", filename, "-")
 	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
+	cmd.Stderr = &stderr
+	if err := procutil.Run(cmd); err != nil {
+		if bytes.Contains(stderr.Bytes(), []byte("Incorrect password")) {
+			return nil, ErrEncrypted
+		}
 		return nil, err
 	}
 	// Extract lightweight additional structured information from the fulltext, e.g. weblinks.
 	return buf.Bytes(), nil
 }
 
-// extractThumbnailFromPDF runs pdftoppm to render page0 of the PDF into an image.
-func extractThumbnailFromPDF(ctx context.Context, filename string, dim Dim, thumbType string) ([]byte, error) {
+// extractThumbnailFromPDF runs pdftoppm to render page0 of the PDF into an
+// image. The image is written to a private temporary directory in tempDir, or
+// read from stdout, if stdout is true, so concurrent runs do not collide.
+func extractThumbnailFromPDF(ctx context.Context, filename string, dim Dim, thumbType, tempDir string, stdout bool) (_ []byte, err error) {
 	if dim.W < 0 && dim.H < 0 {
 		return nil, nil
 	}
+	ctx, done := traceTool(ctx, "pdftoppm")
+	defer func() { done(err) }()
 	if _, err := exec.LookPath("pdftoppm"); err != nil {
-		return nil, fmt.Errorf("missing pdftoppm executable")
+		return nil, fmt.Errorf("%w: pdftoppm", ErrToolMissing)
 	}
-	var (
-		prefix          = filename + ".page0.wip"
-		formatFlag, dst string
-	)
+	var formatFlag, ext string
 	switch thumbType {
 	case "jpg", "jpeg", "JPEG":
-		formatFlag = "-jpeg"
-		dst = prefix + ".jpg"
+		formatFlag, ext = "-jpeg", ".jpg"
 	case "png", "PNG":
-		formatFlag = "-png"
-		dst = prefix + ".png"
+		formatFlag, ext = "-png", ".png"
 	case "tiff", "TIFF":
-		formatFlag = "-tiff"
-		dst = prefix + ".tiff"
+		formatFlag, ext = "-tiff", ".tiff"
 	default:
-		formatFlag = "-jpeg"
-		dst = prefix + ".jpg"
+		formatFlag, ext = "-jpeg", ".jpg"
 	}
-	defer func() {
-		_ = os.Remove(dst)
-	}()
-	cmd := exec.CommandContext(ctx, "pdftoppm",
+	args := []string{
 		formatFlag,
 		"-f", "1",
 		"-l", "1",
@@ -173,31 +401,74 @@ func extractThumbnailFromPDF(ctx context.Context, filename string, dim Dim, thum
 		"-scale-to-x", fmt.Sprintf("%d", dim.W),
 		"-scale-to-y", fmt.Sprintf("%d", dim.H),
 		filename,
-		prefix)
-	if err := cmd.Run(); err != nil {
+	}
+	if stdout {
+		// Without an output root, pdftoppm writes the image to stdout.
+		var buf bytes.Buffer
+		cmd := procutil.Command(ctx, "pdftoppm", args...)
+		cmd.Stdout = &buf
+		if err := procutil.Run(cmd); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	dir, err := os.MkdirTemp(tempDir, "blobproc-thumb-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "page0")
+	cmd := procutil.Command(ctx, "pdftoppm", append(args, prefix)...)
+	if err := procutil.Run(cmd); err != nil {
 		return nil, err
 	}
-	return os.ReadFile(dst)
+	return os.ReadFile(prefix + ext)
 }
 
-// extractPDFMetadata extracts the PDF info via pdfcpu as raw JSON bytes.
-func extractPDFMetadata(ctx context.Context, filename string) (*pdfinfo.Metadata, error) {
-	return pdfinfo.ParseFile(ctx, filename)
+// extractPDFInfo runs pdfinfo, to check limits before further processing.
+func extractPDFInfo(ctx context.Context, filename string) (_ *pdfinfo.Info, err error) {
+	ctx, done := traceTool(ctx, "pdfinfo")
+	defer func() { done(err) }()
+	return pdfinfo.RunInfo(ctx, filename)
 }
 
-// ProcessFile turns a PDF file to a structured output.
-func ProcessFile(ctx context.Context, filename string, opts *Options) *Result {
-	f, err := os.Open(filename)
-	if err != nil {
-		return &Result{
-			Err: err,
+// extractPDFCPU runs pdfcpu for additional metadata.
+func extractPDFCPU(ctx context.Context, filename string) (_ *pdfinfo.PDFCPU, err error) {
+	ctx, done := traceTool(ctx, "pdfcpu")
+	defer func() { done(err) }()
+	return pdfinfo.RunPDFCPU(ctx, filename)
+}
+
+// extractPDFMetadata extracts the PDF info via pdfinfo, unless info has been
+// extracted before, and pdfcpu, depending on mode. Each tool gets its own span.
+func extractPDFMetadata(ctx context.Context, filename string, info *pdfinfo.Info, mode string) (*pdfinfo.Metadata, error) {
+	var (
+		metadata = &pdfinfo.Metadata{PDFInfo: info}
+		err      error
+	)
+	if info == nil {
+		if metadata.PDFInfo, err = extractPDFInfo(ctx, filename); err != nil && mode != PDFCPUFallback {
+			return nil, err
 		}
 	}
-	defer f.Close()
-	b, err := io.ReadAll(f)
+	if mode == PDFCPUNever || mode == PDFCPUFallback && err == nil {
+		return metadata, nil
+	}
+	if metadata.PDFCPU, err = extractPDFCPU(ctx, filename); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// ProcessFile turns a PDF file to a structured output.
+func ProcessFile(ctx context.Context, filename string, opts *Options) *Result {
+	b, err := os.ReadFile(filename)
 	if err != nil {
 		return &Result{
-			Err: err,
+			Status:     StatusError,
+			Code:       CodeIO,
+			Err:        err,
+			Provenance: opts.Provenance,
 		}
 	}
 	return ProcessBlob(ctx, b, opts)
@@ -208,14 +479,34 @@ func ProcessFile(ctx context.Context, filename string, opts *Options) *Result {
 // TODO(martin): we take a blob from memory only to persist it and run the cli
 // tools over it, we should not require that much memory.
 func ProcessBlob(ctx context.Context, blob []byte, opts *Options) *Result {
+	result := processBlob(ctx, blob, opts)
+	result.Provenance = opts.Provenance
+	return result
+}
+
+func processBlob(ctx context.Context, blob []byte, opts *Options) *Result {
 	var fi = new(FileInfo)
-	fi.FromBytes(blob)
+	if opts.FileInfo != nil {
+		*fi = *opts.FileInfo
+	}
+	fi.Complete(blob)
+	if status, err := opts.Limits.Check(fi.Size, nil); err != nil {
+		return &Result{
+			SHA1Hex:  fi.SHA1Hex,
+			Status:   status,
+			Code:     CodeLimit,
+			Err:      err,
+			FileInfo: fi,
+		}
+	}
 	// Save PDF blob to a temporary file to run various cli tools over it.
 	// Strangely, pdfcpu wants a file with a .pdf extension (-1).
-	tf, err := os.CreateTemp("", "blobproc-pdf-*.pdf")
+	tf, err := os.CreateTemp(opts.TempDir, "blobproc-pdf-*.pdf")
 	if err != nil {
 		return &Result{
 			SHA1Hex:  fi.SHA1Hex,
+			Status:   StatusError,
+			Code:     CodeIO,
 			Err:      err,
 			FileInfo: fi,
 		}
@@ -228,6 +519,8 @@ func ProcessBlob(ctx context.Context, blob []byte, opts *Options) *Result {
 	if err != nil {
 		return &Result{
 			SHA1Hex:  fi.SHA1Hex,
+			Status:   StatusError,
+			Code:     CodeIO,
 			Err:      err,
 			FileInfo: fi,
 		}
@@ -237,41 +530,74 @@ func ProcessBlob(ctx context.Context, blob []byte, opts *Options) *Result {
 	case fi.Mimetype != "application/pdf":
 		return &Result{
 			SHA1Hex:  fi.SHA1Hex,
-			Status:   "not-pdf",
+			Status:   StatusNotPDF,
+			Code:     CodeNotPDF,
 			Err:      fmt.Errorf("mimetype is %v", fi.Mimetype),
 			FileInfo: fi,
 		}
 	case slices.Contains(BAD_PDF_SHA1HEX, fi.SHA1Hex):
 		return &Result{
 			SHA1Hex:  fi.SHA1Hex,
-			Status:   "bad-pdf",
+			Status:   StatusBadPDF,
+			Code:     CodeBadPDF,
 			Err:      fmt.Errorf("PDF known to cause processing issues"),
 			FileInfo: fi,
 		}
 	}
+	// Check page limits, before running any expensive tool. The pdfinfo
+	// output is reused for the metadata.
+	var info *pdfinfo.Info
+	if opts.Limits.NeedInfo() {
+		info, err = extractPDFInfo(ctx, tf.Name())
+		if err != nil {
+			return &Result{
+				SHA1Hex:  fi.SHA1Hex,
+				Status:   StatusParseError,
+				Code:     errorCode(ctx, err),
+				Err:      fmt.Errorf("pdf info extraction failed with: %w", err),
+				FileInfo: fi,
+			}
+		}
+		if status, err := opts.Limits.Check(fi.Size, info); err != nil {
+			return &Result{
+				SHA1Hex:  fi.SHA1Hex,
+				Status:   status,
+				Code:     CodeLimit,
+				Err:      err,
+				FileInfo: fi,
+			}
+		}
+	}
 	// Extract the fulltext.
 	text, err := extractTextFromPDF(ctx, tf.Name())
 	switch {
 	case err != nil:
 		return &Result{
 			SHA1Hex: fi.SHA1Hex,
-			Status:  "parse-error",
+			Status:  StatusParseError,
+			Code:    errorCode(ctx, err),
 			Err:     fmt.Errorf("text extraction failed: %w", err),
 		}
 	case len(text) == 0:
 		return &Result{
 			SHA1Hex: fi.SHA1Hex,
-			Status:  "empty-pdf",
+			Status:  StatusEmptyPDF,
+			Code:    CodeEmptyText,
 			Err:     fmt.Errorf("zero length text"),
 		}
 	}
 	// Extract the thumbnail.
-	page0Thumbail, err := extractThumbnailFromPDF(ctx, tf.Name(), opts.Dim, opts.ThumbType)
+	var page0Thumbail []byte
+	if !opts.SkipThumbnail {
+		page0Thumbail, err = extractThumbnailFromPDF(ctx, tf.Name(), opts.Dim, opts.ThumbType, opts.TempDir, opts.ThumbStdout)
+	}
 	switch {
+	case opts.SkipThumbnail:
 	case err != nil:
 		return &Result{
 			SHA1Hex: fi.SHA1Hex,
-			Status:  "parse-error",
+			Status:  StatusParseError,
+			Code:    errorCode(ctx, err),
 			Err:     fmt.Errorf("thumbnail extraction failed with: %w", err),
 		}
 	case len(page0Thumbail) < 50:
@@ -279,19 +605,23 @@ func ProcessBlob(ctx context.Context, blob []byte, opts *Options) *Result {
 		page0Thumbail = nil
 	}
 	// Extract additional pdf info.
-	metadata, err := extractPDFMetadata(ctx, tf.Name())
+	metadata, err := extractPDFMetadata(ctx, tf.Name(), info, opts.PDFCPU)
 	switch {
 	case err != nil:
 		return &Result{
 			SHA1Hex: fi.SHA1Hex,
-			Status:  "parse-error",
+			Status:  StatusParseError,
+			Code:    errorCode(ctx, err),
 			Err:     fmt.Errorf("pdf info extraction failed with: %w", err),
 		}
 	}
-	weblinks := extractWeblinks(string(text))
+	var weblinks, dois []string
+	if !opts.SkipWeblinks {
+		weblinks, dois = extractWeblinks(string(text))
+	}
 	return &Result{
 		SHA1Hex:        fi.SHA1Hex,
-		Status:         "success",
+		Status:         StatusSuccess,
 		Err:            nil,
 		FileInfo:       fi,
 		Text:           string(text),
@@ -299,6 +629,7 @@ func ProcessBlob(ctx context.Context, blob []byte, opts *Options) *Result {
 		Metadata:       metadata,
 		PDFExtra:       metadata.LegacyPDFExtra(),
 		Weblinks:       weblinks,
+		DOIs:           dois,
 	}
 }
 
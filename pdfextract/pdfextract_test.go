@@ -1,15 +1,28 @@
 package pdfextract
 
 import (
+	"bytes"
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/miku/blobproc/pdfinfo"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TestPdfExtract uses a snapshot style test. If the expected JSON files are
@@ -21,7 +34,7 @@ func TestPdfExtract(t *testing.T) {
 	var cases = []struct {
 		filename string
 		dim      Dim
-		status   string
+		status   Status
 		snapshot string
 		links    []string
 	}{
@@ -38,13 +51,11 @@ func TestPdfExtract(t *testing.T) {
 			status:   "success",
 			snapshot: "../testdata/extract/1906.11632.json",
 			links: []string{
-				"http://arXiv",
-				"http://arxiv",
 				"http://arxiv.org/abs/1607.07539",
 				"http://arxiv.org/abs/1805.06725",
 				"http://dblp.uni-trier.de/db/journals/",
 				"http://kdd.ics.uci.edu/",
-				"http://papers.nips.cc/paper/",
+				"http://papers.nips.cc/paper/5423-generative-adversarial-nets.pdf",
 				"http://yann.lecun.com/exdb/",
 				"https://www.tensorflow.org/",
 			},
@@ -195,6 +206,58 @@ func TestPdfExtract(t *testing.T) {
 //go:embed testdata/pdf/1906.02444.pdf
 var testdataPdf1 []byte
 
+// TestSnapshotWeblinks checks, that the snapshots used by TestPdfExtract
+// agree with the current link extraction, also where pdftotext is missing.
+func TestSnapshotWeblinks(t *testing.T) {
+	snapshots, err := filepath.Glob("../testdata/extract/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snapshot := range snapshots {
+		b, err := os.ReadFile(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r Result
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("snapshot broken: %v", err)
+		}
+		links, dois := extractWeblinks(string(r.Text))
+		if !cmp.Equal(r.Weblinks, links, cmpopts.EquateEmpty()) {
+			t.Fatalf("[%s] diff: %v", snapshot, cmp.Diff(r.Weblinks, links, cmpopts.EquateEmpty()))
+		}
+		if !cmp.Equal(r.DOIs, dois, cmpopts.EquateEmpty()) {
+			t.Fatalf("[%s] diff: %v", snapshot, cmp.Diff(r.DOIs, dois, cmpopts.EquateEmpty()))
+		}
+	}
+}
+
+// TestSnapshotDates checks, that the pdfinfo dates in the snapshots used by
+// TestPdfExtract agree with the current date parsing.
+func TestSnapshotDates(t *testing.T) {
+	snapshots, err := filepath.Glob("../testdata/extract/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snapshot := range snapshots {
+		b, err := os.ReadFile(snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r Result
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("snapshot broken: %v", err)
+		}
+		var (
+			got  = r.Metadata.PDFInfo
+			want = pdfinfo.ParseInfo("CreationDate: " + got.CreationDate + "\nModDate: " + got.ModDate)
+		)
+		if !cmp.Equal(got.Created, want.Created) || !cmp.Equal(got.Modified, want.Modified) {
+			t.Fatalf("[%s] got %v, %v, want %v, %v", snapshot, got.Created, got.Modified, want.Created, want.Modified)
+		}
+	}
+}
+
 func TestGenerateFileInfo(t *testing.T) {
 	var cases = []struct {
 		data   []byte
@@ -238,3 +301,269 @@ func BenchmarkPdfExtract(b *testing.B) {
 		})
 	}
 }
+
+func TestErrorCode(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	var cases = []struct {
+		about string
+		ctx   context.Context
+		err   error
+		code  ErrorCode
+	}{
+		{"missing tool", context.Background(), fmt.Errorf("%w: pdftotext", ErrToolMissing), CodeToolMissing},
+		{"not in path", context.Background(), &exec.Error{Name: "pdfinfo", Err: exec.ErrNotFound}, CodeToolMissing},
+		{"timeout", expired, errors.New("signal: killed"), CodeTimeout},
+		{"encrypted", context.Background(), fmt.Errorf("text extraction failed: %w", ErrEncrypted), CodeEncrypted},
+		{"other", context.Background(), errors.New("exit status 1"), CodeToolFailed},
+	}
+	for _, c := range cases {
+		if code := errorCode(c.ctx, c.err); code != c.code {
+			t.Fatalf("[%s] got %v, want %v", c.about, code, c.code)
+		}
+	}
+}
+
+func TestResultStatusJSON(t *testing.T) {
+	result := ProcessFile(context.Background(), "../testdata/misc/wordle.py", &Options{})
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Status string `json:"status"`
+		Code   string `json:"code"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != "not-pdf" || v.Code != "not-pdf" {
+		t.Fatalf("got %v, %v, want not-pdf, not-pdf", v.Status, v.Code)
+	}
+}
+
+func TestResultErrorJSON(t *testing.T) {
+	var cases = []struct {
+		about  string
+		result Result
+		want   string
+	}{
+		{"no error", Result{Status: StatusSuccess}, `{"status":"success"}`},
+		{"error", Result{Status: StatusError, Code: CodeIO, Err: errors.New("disk full")}, `{"status":"error","code":"io-error","error":"disk full"}`},
+		{"error string only", Result{Status: StatusError, Error: "decoded"}, `{"status":"error","error":"decoded"}`},
+	}
+	for _, c := range cases {
+		b, err := json.Marshal(c.result)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if string(b) != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.about, string(b), c.want)
+		}
+	}
+}
+
+// fakePdftoppm installs a pdftoppm stand-in, which writes the output root it
+// was given, or "stdout", as the image.
+func fakePdftoppm(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for last; do :; done
+case "$last" in
+*.pdf) printf stdout ;;
+*) printf "%s" "$last" > "$last.jpg" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "pdftoppm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestExtractThumbnailFromPDF(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	fakePdftoppm(t)
+	tempDir := t.TempDir()
+	var (
+		wg      sync.WaitGroup
+		results = make([][]byte, 4)
+		errs    = make([]error, 4)
+	)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = extractThumbnailFromPDF(context.Background(), "doc.pdf", Dim{180, 300}, "jpg", tempDir, false)
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for i, b := range results {
+		if errs[i] != nil {
+			t.Fatalf("got %v, want nil", errs[i])
+		}
+		if !strings.HasPrefix(string(b), tempDir) || seen[string(b)] {
+			t.Fatalf("got %v, want a private output root in %v", string(b), tempDir)
+		}
+		seen[string(b)] = true
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Fatalf("got %v leftover files, want 0", len(entries))
+	}
+	b, err := extractThumbnailFromPDF(context.Background(), "doc.pdf", Dim{180, 300}, "jpg", tempDir, true)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if string(b) != "stdout" {
+		t.Fatalf("got %v, want %v", string(b), "stdout")
+	}
+}
+
+func TestProcessBlobProvenance(t *testing.T) {
+	provenance := &Provenance{Version: "1.0.0", Commit: "abc123"}
+	result := ProcessBlob(context.Background(), []byte("not a pdf"), &Options{Provenance: provenance})
+	if result.Provenance != provenance {
+		t.Fatalf("got %v, want %v", result.Provenance, provenance)
+	}
+	if result := ProcessBlob(context.Background(), []byte("not a pdf"), &Options{}); result.Provenance != nil {
+		t.Fatalf("got %v, want nil", result.Provenance)
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	var (
+		info = pdfinfo.ParseInfo("Pages:           12\nPage size:       595 x 842 pts (A4)\n")
+		huge = pdfinfo.ParseInfo("Pages:           1\nPage size:       2592 x 129600 pts\n")
+	)
+	var cases = []struct {
+		about  string
+		limits Limits
+		size   int64
+		info   *pdfinfo.Info
+		status Status
+	}{
+		{"no limits", Limits{}, 1 << 30, huge, ""},
+		{"file size", Limits{MaxFileSize: 100}, 101, nil, StatusTooLarge},
+		{"file size ok", Limits{MaxFileSize: 100}, 100, nil, ""},
+		{"pages", Limits{MaxPages: 10}, 1, info, StatusTooManyPages},
+		{"pages ok", Limits{MaxPages: 12}, 1, info, ""},
+		{"page size", Limits{MaxPageSize: 14400}, 1, huge, StatusPageTooLarge},
+		{"page size ok", Limits{MaxPageSize: 14400}, 1, info, ""},
+		{"without info", Limits{MaxPages: 1}, 1, nil, ""},
+	}
+	for _, c := range cases {
+		status, err := c.limits.Check(c.size, c.info)
+		if status != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, status, c.status)
+		}
+		if (err != nil) != (c.status != "") {
+			t.Fatalf("[%s] got error %v for status %q", c.about, err, status)
+		}
+	}
+}
+
+func TestProcessBlobTooLarge(t *testing.T) {
+	result := ProcessBlob(context.Background(), []byte("%PDF-1.4 too large"), &Options{Limits: Limits{MaxFileSize: 8}})
+	if result.Status != StatusTooLarge || result.Code != CodeLimit {
+		t.Fatalf("got %v (%v), want %v", result.Status, result.Code, StatusTooLarge)
+	}
+}
+
+func TestExtractPDFMetadataReuse(t *testing.T) {
+	info := &pdfinfo.Info{Pages: 3}
+	for _, mode := range []string{PDFCPUFallback, PDFCPUNever} {
+		// No tool runs, so the file need not exist.
+		metadata, err := extractPDFMetadata(context.Background(), "/nonexistent.pdf", info, mode)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", mode, err)
+		}
+		if metadata.PDFInfo != info || metadata.PDFCPU != nil {
+			t.Fatalf("[%s] got %v, want reused pdfinfo output only", mode, metadata)
+		}
+	}
+}
+
+func TestExtractPDFMetadataSpans(t *testing.T) {
+	defer func(t trace.Tracer) { tracer = t }(tracer)
+	var cases = []struct {
+		about string
+		info  *pdfinfo.Info
+		mode  string
+		spans []string
+	}{
+		{"reuse pdfinfo", &pdfinfo.Info{Pages: 3}, PDFCPUAlways, []string{"pdfcpu"}},
+		{"fallback", nil, PDFCPUFallback, []string{"pdfinfo", "pdfcpu"}},
+	}
+	for _, c := range cases {
+		sr := tracetest.NewSpanRecorder()
+		tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+		// Both tools fail on a missing file, each failure ends up in its own span.
+		_, _ = extractPDFMetadata(context.Background(), "/nonexistent.pdf", c.info, c.mode)
+		var names []string
+		for _, span := range sr.Ended() {
+			if span.Status().Code != codes.Error {
+				t.Fatalf("[%s] got %v, want error status for %s", c.about, span.Status(), span.Name())
+			}
+			names = append(names, span.Name())
+		}
+		if !reflect.DeepEqual(names, c.spans) {
+			t.Fatalf("[%s] got %v, want %v", c.about, names, c.spans)
+		}
+	}
+}
+
+func TestFileInfoComplete(t *testing.T) {
+	var want FileInfo
+	want.FromBytes(testdataPdf1)
+	var cases = []struct {
+		about string
+		known FileInfo
+		want  FileInfo
+	}{
+		{"nothing known", FileInfo{}, want},
+		{"all known", want, want},
+		{
+			"sha1 known",
+			FileInfo{SHA1Hex: "trusted"},
+			FileInfo{Size: want.Size, MD5Hex: want.MD5Hex, SHA1Hex: "trusted", SHA256Hex: want.SHA256Hex, Mimetype: want.Mimetype},
+		},
+		{
+			"size is not trusted",
+			FileInfo{Size: 1, Mimetype: "application/x-custom"},
+			FileInfo{Size: want.Size, MD5Hex: want.MD5Hex, SHA1Hex: want.SHA1Hex, SHA256Hex: want.SHA256Hex, Mimetype: "application/x-custom"},
+		},
+	}
+	for _, c := range cases {
+		fi := c.known
+		fi.Complete(testdataPdf1)
+		if fi != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.about, fi, c.want)
+		}
+	}
+}
+
+func TestProcessBlobFileInfo(t *testing.T) {
+	known := &FileInfo{SHA1Hex: "0123456789abcdef0123456789abcdef01234567"}
+	result := ProcessBlob(context.Background(), []byte("not a pdf"), &Options{FileInfo: known})
+	if result.SHA1Hex != known.SHA1Hex {
+		t.Fatalf("got %v, want %v", result.SHA1Hex, known.SHA1Hex)
+	}
+	if known.MD5Hex != "" {
+		t.Fatalf("got %v, want options unchanged", known)
+	}
+}
+
+func TestFileInfoFromReader(t *testing.T) {
+	for _, data := range [][]byte{{}, []byte("hello"), testdataPdf1} {
+		var want, got FileInfo
+		want.FromBytes(data)
+		if err := got.FromReader(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
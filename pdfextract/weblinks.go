@@ -0,0 +1,160 @@
+package pdfextract
+
+import (
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// extractWeblinks returns the normalized and deduplicated links found in the
+// text, and the DOIs of links to a DOI resolver, lowercased, as DOIs are case
+// insensitive.
+func extractWeblinks(s string) (links, dois []string) {
+	var (
+		rx   = xurls.Strict()
+		seen = make(map[string]bool)
+	)
+	for _, loc := range rx.FindAllStringIndex(s, -1) {
+		u := joinLineBreak(s[loc[0]:loc[1]], s[loc[1]:])
+		u, ok := normalizeLink(u)
+		if !ok {
+			continue
+		}
+		links = append(links, u)
+	}
+	sort.Strings(links)
+	// Deduplicate case insensitively, keeping the first variant in sort
+	// order.
+	var i int
+	for _, u := range links {
+		key := strings.ToLower(u)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		links[i] = u
+		i++
+		if doi := linkDOI(u); doi != "" {
+			dois = append(dois, doi)
+		}
+	}
+	links = links[:i]
+	sort.Strings(dois)
+	return links, slices.Compact(dois)
+}
+
+// joinLineBreak rejoins a link, that has been broken at a hyphen or slash at
+// the end of a line, with the first word of the next line in rest, if that
+// word looks like the continuation of a link. With pdftotext -layout, the
+// next line may start with the text of another column.
+func joinLineBreak(u, rest string) string {
+	if !strings.HasSuffix(u, "-") && !strings.HasSuffix(u, "/") {
+		return u
+	}
+	rest, ok := strings.CutPrefix(rest, "\n")
+	if !ok {
+		return u
+	}
+	rest = strings.TrimLeft(rest, " \t")
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		rest = rest[:i]
+	}
+	if rest == "" || strings.Contains(rest, "://") || strings.IndexFunc(rest, isNotLinkRune) >= 0 {
+		return u
+	}
+	// A link rarely ends with a hyphen, but often with a slash, so after a
+	// slash, a plain word is more likely the text of the other column.
+	if strings.HasSuffix(u, "/") && !strings.ContainsAny(rest, "0123456789./-_=?#%") {
+		return u
+	}
+	return u + rest
+}
+
+// isNotLinkRune returns true for characters, that do not appear in the path
+// of a link, as typeset in a paper.
+func isNotLinkRune(r rune) bool {
+	if r > unicode.MaxASCII {
+		return true
+	}
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-._~/?#=&%+:@;,()", r)
+}
+
+// normalizeLink strips trailing punctuation and unbalanced closing brackets,
+// lowercases scheme and host and returns false for artifacts, like
+// "http://arXiv", that do not have a plausible host.
+func normalizeLink(s string) (string, bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), "\u200b", "")
+	for {
+		t := strings.TrimRight(s, ".,;:!?'\"")
+		switch {
+		case strings.HasSuffix(t, ")") && strings.Count(t, "(") < strings.Count(t, ")"):
+			t = t[:len(t)-1]
+		case strings.HasSuffix(t, "]") && strings.Count(t, "[") < strings.Count(t, "]"):
+			t = t[:len(t)-1]
+		}
+		if t == s {
+			break
+		}
+		s = t
+	}
+	if !strings.Contains(s, "://") {
+		// E.g. mailto:
+		return s, true
+	}
+	u, err := url.Parse(s)
+	if err != nil || !plausibleHost(u.Hostname()) {
+		return "", false
+	}
+	scheme, rest, _ := strings.Cut(s, "://")
+	i := strings.IndexAny(rest, "/?#")
+	if i < 0 {
+		i = len(rest)
+	}
+	return strings.ToLower(scheme) + "://" + strings.ToLower(rest[:i]) + rest[i:], true
+}
+
+// plausibleHost returns true for IP addresses and domain names with a top
+// level domain of at least two letters.
+func plausibleHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	i := strings.LastIndex(host, ".")
+	if i < 1 {
+		return false
+	}
+	tld := host[i+1:]
+	if len(tld) < 2 {
+		return false
+	}
+	for _, r := range tld {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// linkDOI returns the lowercased DOI of a link to a DOI resolver, like
+// https://doi.org/10.1038/sdata.2016.18, or the empty string.
+func linkDOI(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	switch strings.TrimPrefix(u.Hostname(), "www.") {
+	case "doi.org", "dx.doi.org":
+	default:
+		return ""
+	}
+	doi := strings.ToLower(strings.TrimPrefix(u.Path, "/"))
+	if !strings.HasPrefix(doi, "10.") || !strings.Contains(doi, "/") {
+		return ""
+	}
+	return doi
+}
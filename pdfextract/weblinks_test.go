@@ -0,0 +1,40 @@
+package pdfextract
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExtractWeblinks(t *testing.T) {
+	var cases = []struct {
+		about string
+		text  string
+		links []string
+		dois  []string
+	}{
+		{about: "empty", text: ""},
+		{about: "trailing punctuation", text: "See https://example.org/a. And (https://example.org/b).", links: []string{"https://example.org/a", "https://example.org/b"}},
+		{about: "balanced parentheses", text: "https://en.wikipedia.org/wiki/Sandbox_(software_development).", links: []string{"https://en.wikipedia.org/wiki/Sandbox_(software_development)"}},
+		{about: "artifact", text: "preprint at http://arXiv and http://e.g", links: nil},
+		{about: "case insensitive duplicates", text: "HTTPS://Example.org/Path and https://example.org/Path", links: []string{"https://example.org/Path"}},
+		{about: "hyphenated line break", text: "at https://example.org/grants-\n    awarded/123 we", links: []string{"https://example.org/grants-awarded/123"}},
+		{about: "slash line break", text: "URL http://papers.nips.cc/paper/\n  5423-gan.pdf.", links: []string{"http://papers.nips.cc/paper/5423-gan.pdf"}},
+		{about: "slash line break, other column", text: "URL http://yann.lecun.com/exdb/\nand implementation", links: []string{"http://yann.lecun.com/exdb/"}},
+		{
+			about: "dois",
+			text:  "https://doi.org/10.3233/DS-190016 http://dx.doi.org/10.3233/ds-190016 https://doi.org/about",
+			links: []string{"http://dx.doi.org/10.3233/ds-190016", "https://doi.org/10.3233/DS-190016", "https://doi.org/about"},
+			dois:  []string{"10.3233/ds-190016"},
+		},
+		{about: "mailto", text: "mailto:info@example.org", links: []string{"mailto:info@example.org"}},
+	}
+	for _, c := range cases {
+		links, dois := extractWeblinks(c.text)
+		if !slices.Equal(links, c.links) {
+			t.Fatalf("[%s] got %v, want %v", c.about, links, c.links)
+		}
+		if !slices.Equal(dois, c.dois) {
+			t.Fatalf("[%s] got %v, want %v", c.about, dois, c.dois)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package pdfinfo
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zoneOffsets are the offsets in seconds of timezone abbreviations, which
+// poppler prints in the timezone of the machine running pdfinfo. Abbreviations
+// are ambiguous, the common meaning is used, e.g. US central time for CST.
+var zoneOffsets = map[string]int{
+	"UTC": 0, "GMT": 0, "Z": 0, "WET": 0,
+	"WEST": 1 * 3600, "BST": 1 * 3600, "CET": 1 * 3600, "MET": 1 * 3600,
+	"CEST": 2 * 3600, "MEST": 2 * 3600, "EET": 2 * 3600,
+	"EEST": 3 * 3600, "MSK": 3 * 3600,
+	"IST": 5*3600 + 1800,
+	"JST": 9 * 3600, "KST": 9 * 3600,
+	"AEST": 10 * 3600, "AEDT": 11 * 3600,
+	"EST": -5 * 3600, "EDT": -4 * 3600,
+	"CST": -6 * 3600, "CDT": -5 * 3600,
+	"MST": -7 * 3600, "MDT": -6 * 3600,
+	"PST": -8 * 3600, "PDT": -7 * 3600,
+	"AKST": -9 * 3600, "AKDT": -8 * 3600,
+	"HST": -10 * 3600,
+}
+
+// isoLayouts are the layouts of dates printed with pdfinfo -isodates.
+var isoLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02T15:04:05",
+}
+
+// parseDate parses a date as printed by pdfinfo, which depends on the poppler
+// version and flags: "Fri Jun  7 02:39:17 2019 CEST", the same without a
+// timezone, ISO 8601 with -isodates or a raw PDF date like
+// "D:20190607023917+02'00'" with -rawdates. Dates without a known timezone
+// are taken as UTC.
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return time.Time{}, false
+	case strings.HasPrefix(s, "D:"):
+		return parseRawDate(s)
+	case s[0] >= '0' && s[0] <= '9':
+		for _, layout := range isoLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+		// Raw dates without prefix.
+		return parseRawDate(s)
+	}
+	fields := strings.Fields(s)
+	if len(fields) < 5 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[:5], " "))
+	if err != nil {
+		return time.Time{}, false
+	}
+	if len(fields) > 5 {
+		if offset, ok := zoneOffsets[fields[5]]; ok {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone(fields[5], offset))
+		}
+	}
+	return t, true
+}
+
+// parseRawDate parses a PDF date, D:YYYYMMDDHHmmSSOHH'mm', where all parts
+// after the year are optional. Some producers omit the apostrophes or the
+// minutes of the offset.
+func parseRawDate(s string) (time.Time, bool) {
+	s = strings.TrimPrefix(s, "D:")
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	digits, zone := s[:i], strings.ReplaceAll(s[i:], "'", "")
+	if len(digits) < 4 || len(digits) > 14 || len(digits)%2 != 0 {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102150405"[:len(digits)], digits)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if zone == "" || zone[0] == 'Z' {
+		return t, true
+	}
+	if zone[0] != '+' && zone[0] != '-' || len(zone) < 3 {
+		return time.Time{}, false
+	}
+	hours, err := strconv.Atoi(zone[1:3])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var minutes int
+	if len(zone) >= 5 {
+		if minutes, err = strconv.Atoi(zone[3:5]); err != nil {
+			return time.Time{}, false
+		}
+	}
+	offset := hours*3600 + minutes*60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone("", offset)), true
+}
@@ -0,0 +1,51 @@
+package pdfinfo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	var cases = []struct {
+		s    string
+		ok   bool
+		want string // RFC3339
+	}{
+		{"", false, ""},
+		{"garbage", false, ""},
+		{"Fri Jun  7 02:39:17 2019 CEST", true, "2019-06-07T02:39:17+02:00"},
+		{"Mon Nov 24 23:24:37 2008 CET", true, "2008-11-24T23:24:37+01:00"},
+		{"Tue Mar  3 08:01:02 2015 EST", true, "2015-03-03T08:01:02-05:00"},
+		{"Tue Mar  3 08:01:02 2015", true, "2015-03-03T08:01:02Z"},
+		{"Tue Mar  3 08:01:02 2015 XYZT", true, "2015-03-03T08:01:02Z"},
+		{"2019-06-07T02:39:17+02", true, "2019-06-07T02:39:17+02:00"},
+		{"2019-06-07T02:39:17+02:00", true, "2019-06-07T02:39:17+02:00"},
+		{"2019-06-07T02:39:17Z", true, "2019-06-07T02:39:17Z"},
+		{"D:20190607023917+02'00'", true, "2019-06-07T02:39:17+02:00"},
+		{"D:20190607023917-05'30", true, "2019-06-07T02:39:17-05:30"},
+		{"D:20190607023917Z00'00'", true, "2019-06-07T02:39:17Z"},
+		{"D:20190607023917+02", true, "2019-06-07T02:39:17+02:00"},
+		{"D:201906", true, "2019-06-01T00:00:00Z"},
+		{"D:2019", true, "2019-01-01T00:00:00Z"},
+		{"20190607023917", true, "2019-06-07T02:39:17Z"},
+		{"D:191000607023917", false, ""},
+		{"D:20191307023917", false, ""},
+		{"D:20190607023917X", false, ""},
+	}
+	for _, c := range cases {
+		got, ok := parseDate(c.s)
+		if ok != c.ok {
+			t.Fatalf("[%s] got %v, want %v", c.s, ok, c.ok)
+		}
+		if !ok {
+			continue
+		}
+		want, err := time.Parse(time.RFC3339, c.want)
+		if err != nil {
+			t.Fatalf("[%s] invalid test case: %v", c.s, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("[%s] got %v, want %v", c.s, got, want)
+		}
+	}
+}
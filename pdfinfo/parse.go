@@ -5,11 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/miku/blobproc/procutil"
 )
 
 // Metadata groups output of various tools into a single struct.
@@ -20,7 +22,20 @@ type Metadata struct {
 
 // LegacyPDFExtra returns a struct that looks like the pdfextra dict from the
 // sandcrawler. Here for compatibilty.
+// Without pdfinfo output, the values are taken from pdfcpu, if available.
 func (metadata Metadata) LegacyPDFExtra() *PDFExtra {
+	if metadata.PDFInfo == nil {
+		extra := &PDFExtra{}
+		if metadata.PDFCPU == nil || len(metadata.PDFCPU.Infos) == 0 {
+			return extra
+		}
+		info := metadata.PDFCPU.Infos[0]
+		extra.PageCount, extra.PDFVersion = int(info.PageCount), info.Version
+		if len(info.PageSizes) > 0 {
+			extra.Page0Height, extra.Page0Width = info.PageSizes[0].Height, info.PageSizes[0].Width
+		}
+		return extra
+	}
 	return &PDFExtra{
 		Page0Height: metadata.PDFInfo.PageDim().Height,
 		Page0Width:  metadata.PDFInfo.PageDim().Width,
@@ -118,6 +133,55 @@ type Info struct {
 	Subtitle       string `json:"subtitle,omitempty"`
 	Standard       string `json:"standard,omitempty"`
 	Conformance    string `json:"conformance,omitempty"`
+	// Created and Modified are CreationDate and ModDate, if they could be
+	// parsed.
+	Created  *time.Time `json:"created,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	// Permissions are the restrictions of an encrypted file.
+	Permissions *Permissions `json:"permissions,omitempty"`
+	// Extra collects fields not known to this package, e.g. from newer
+	// poppler versions.
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+// Permissions of an encrypted PDF, as reported by pdfinfo, like "yes
+// (print:yes copy:no change:no addNotes:no algorithm:AES-256)".
+type Permissions struct {
+	Print     bool   `json:"print"`
+	Copy      bool   `json:"copy"`
+	Change    bool   `json:"change"`
+	AddNotes  bool   `json:"add_notes"`
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// parseEncrypted parses the value of the Encrypted field, which lists the
+// permissions in parentheses for encrypted files.
+func parseEncrypted(s string) (bool, *Permissions) {
+	value, detail, _ := strings.Cut(s, "(")
+	if !parseBool(strings.TrimSpace(value)) {
+		return false, nil
+	}
+	detail = strings.TrimSuffix(strings.TrimSpace(detail), ")")
+	if detail == "" {
+		return true, nil
+	}
+	var perm Permissions
+	for _, f := range strings.Fields(detail) {
+		k, v, _ := strings.Cut(f, ":")
+		switch k {
+		case "print":
+			perm.Print = parseBool(v)
+		case "copy":
+			perm.Copy = parseBool(v)
+		case "change":
+			perm.Change = parseBool(v)
+		case "addNotes":
+			perm.AddNotes = parseBool(v)
+		case "algorithm":
+			perm.Algorithm = v
+		}
+	}
+	return true, &perm
 }
 
 // Dim groups width and height of a page.
@@ -157,38 +221,42 @@ func (info *Info) PageDim() Dim {
 
 // ParseFile a filename into a structured metadata object. Requires pdfinfo and
 // pdfcpu to be installed. The filename must have .pdf extension, otherwise
-// pdfcpu will fail.
+// pdfcpu will fail. The tools are killed, once the context is done.
 func ParseFile(ctx context.Context, filename string) (*Metadata, error) {
-	if !strings.HasSuffix(filename, ".pdf") {
-		return nil, fmt.Errorf("pdfcpu requires an explicit .pdf filename")
-	}
-	if _, err := exec.LookPath("pdfcpu"); err != nil {
-		return nil, fmt.Errorf("missing pdfcpu executable")
-	}
-	if _, err := exec.LookPath("pdfinfo"); err != nil {
-		return nil, fmt.Errorf("missing pdfinfo executable")
-	}
-	var metadata = new(Metadata)
-	info, err := runPdfInfo(ctx, filename)
+	info, err := RunInfo(ctx, filename)
 	if err != nil {
 		return nil, err
 	}
-	metadata.PDFInfo = info
-	pdfcpu, err := runPdfCpu(ctx, filename)
+	// Do not start another tool, if the context is done already.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pdfcpu, err := RunPDFCPU(ctx, filename)
 	if err != nil {
 		return nil, err
 	}
-	metadata.PDFCPU = pdfcpu
-	return metadata, nil
+	return &Metadata{PDFInfo: info, PDFCPU: pdfcpu}, nil
+}
+
+// RunPDFCPU runs pdfcpu only, e.g. if pdfinfo output is available already.
+// The filename must have a .pdf extension.
+func RunPDFCPU(ctx context.Context, filename string) (*PDFCPU, error) {
+	if !strings.HasSuffix(filename, ".pdf") {
+		return nil, fmt.Errorf("pdfcpu requires an explicit .pdf filename")
+	}
+	if _, err := exec.LookPath("pdfcpu"); err != nil {
+		return nil, fmt.Errorf("missing pdfcpu executable: %w", err)
+	}
+	return runPdfCpu(ctx, filename)
 }
 
 // runPdfCpu parses a pdf file. Requires pdfcpu executable to be installed.
 // The filename must have .pdf extension, otherwise pdfcpu will fail.
 func runPdfCpu(ctx context.Context, filename string) (*PDFCPU, error) {
 	var buf bytes.Buffer
-	cmd := exec.CommandContext(ctx, "pdfcpu", "info", "-j", filename)
+	cmd := procutil.Command(ctx, "pdfcpu", "info", "-j", filename)
 	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
+	if err := procutil.Run(cmd); err != nil {
 		return nil, err
 	}
 	var pdfcpu PDFCPU
@@ -198,12 +266,21 @@ func runPdfCpu(ctx context.Context, filename string) (*PDFCPU, error) {
 	return &pdfcpu, nil
 }
 
+// RunInfo runs pdfinfo only, which is much cheaper than ParseFile and is
+// sufficient to look at page count and page size before further processing.
+func RunInfo(ctx context.Context, filename string) (*Info, error) {
+	if _, err := exec.LookPath("pdfinfo"); err != nil {
+		return nil, fmt.Errorf("missing pdfinfo executable: %w", err)
+	}
+	return runPdfInfo(ctx, filename)
+}
+
 // runPdfInfo parses a pdf file. Requires pdfinfo executable to be installed.
 func runPdfInfo(ctx context.Context, filename string) (*Info, error) {
 	var buf bytes.Buffer
-	cmd := exec.CommandContext(ctx, "pdfinfo", filename)
+	cmd := procutil.Command(ctx, "pdfinfo", filename)
 	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
+	if err := procutil.Run(cmd); err != nil {
 		return nil, err
 	}
 	return ParseInfo(buf.String()), nil
@@ -238,8 +315,14 @@ func ParseInfo(s string) *Info {
 			info.Producer = fields[1]
 		case "CreationDate":
 			info.CreationDate = fields[1]
+			if t, ok := parseDate(fields[1]); ok {
+				info.Created = &t
+			}
 		case "ModDate":
 			info.ModDate = fields[1]
+			if t, ok := parseDate(fields[1]); ok {
+				info.Modified = &t
+			}
 		case "Custom Metadata":
 			info.CustomMetadata = parseBool(fields[1])
 		case "Metadata Stream":
@@ -257,7 +340,7 @@ func ParseInfo(s string) *Info {
 		case "Pages":
 			info.Pages = parseInt(fields[1])
 		case "Encrypted":
-			info.Encrypted = parseBool(fields[1])
+			info.Encrypted, info.Permissions = parseEncrypted(fields[1])
 		case "Page size":
 			info.PageSize = fields[1]
 		case "Page rot":
@@ -279,7 +362,10 @@ func ParseInfo(s string) *Info {
 		case "Conformance":
 			info.Conformance = fields[1]
 		default:
-			log.Printf("ignoring pdfinfo field: %v", fields[0])
+			if info.Extra == nil {
+				info.Extra = make(map[string]string)
+			}
+			info.Extra[fields[0]] = fields[1]
 		}
 	}
 	return &info
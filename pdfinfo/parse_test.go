@@ -2,11 +2,23 @@ package pdfinfo
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
 
+func mustTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return &t
+}
+
 func TestParsePageSize(t *testing.T) {
 	var cases = []struct {
 		info *Info
@@ -87,6 +99,8 @@ func TestParseFile(t *testing.T) {
 				Producer:       "pdfTeX-1.40.17",
 				CreationDate:   "Fri Jun  7 02:39:17 2019 CEST",
 				ModDate:        "Fri Jun  7 02:39:17 2019 CEST",
+				Created:        mustTime("2019-06-07T02:39:17+02:00"),
+				Modified:       mustTime("2019-06-07T02:39:17+02:00"),
 				CustomMetadata: true,
 				Form:           "none",
 				Pages:          8,
@@ -144,6 +158,8 @@ func TestParse(t *testing.T) {
 				Producer:       "pdfTeX-1.40.17",
 				CreationDate:   "Fri Jun  7 02:39:17 2019 CEST",
 				ModDate:        "Fri Jun  7 02:39:17 2019 CEST",
+				Created:        mustTime("2019-06-07T02:39:17+02:00"),
+				Modified:       mustTime("2019-06-07T02:39:17+02:00"),
 				CustomMetadata: true,
 				Form:           "none",
 				Pages:          8,
@@ -186,6 +202,8 @@ func TestParse(t *testing.T) {
 				Producer:       "Mac OS X 10.5.5 Quartz PDFContext",
 				CreationDate:   "Mon Nov 24 23:24:37 2008 CET",
 				ModDate:        "Sat Apr 18 16:57:15 2009 CEST",
+				Created:        mustTime("2008-11-24T23:24:37+01:00"),
+				Modified:       mustTime("2009-04-18T16:57:15+02:00"),
 				CustomMetadata: true,
 				MetadataStream: true,
 				Form:           "none",
@@ -197,6 +215,27 @@ func TestParse(t *testing.T) {
 				PDFVersion:     "1.3",
 			},
 		},
+		{
+			s: `
+			Producer:        Acrobat Distiller 9.0.0 (Windows)
+			CreationDate:    2010-03-01T10:00:00+01
+			Pages:           2
+			Encrypted:       yes (print:yes copy:no change:no addNotes:no algorithm:AES-256)
+			JavaScript:      no
+			PDF version:     1.6
+			Fancy Field:     new in poppler 99
+			`,
+			info: &Info{
+				Producer:     "Acrobat Distiller 9.0.0 (Windows)",
+				CreationDate: "2010-03-01T10:00:00+01",
+				Created:      mustTime("2010-03-01T10:00:00+01:00"),
+				Pages:        2,
+				Encrypted:    true,
+				Permissions:  &Permissions{Print: true, Algorithm: "AES-256"},
+				PDFVersion:   "1.6",
+				Extra:        map[string]string{"Fancy Field": "new in poppler 99"},
+			},
+		},
 	}
 	for _, c := range cases {
 		info := ParseInfo(c.s)
@@ -205,3 +244,47 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestLegacyPDFExtra(t *testing.T) {
+	var pdfcpu PDFCPU
+	if err := json.Unmarshal([]byte(`{"infos": [{"pageCount": 8, "version": "1.5",
+		"pageSizes": [{"width": 595.276, "height": 841.89}]}]}`), &pdfcpu); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about    string
+		metadata Metadata
+		extra    *PDFExtra
+	}{
+		{"empty", Metadata{}, &PDFExtra{}},
+		{
+			"pdfinfo",
+			Metadata{PDFInfo: &Info{Pages: 8, PDFVersion: "1.5", PageSize: "595.276 x 841.89 pts (A4)"}},
+			&PDFExtra{Page0Height: 841.89, Page0Width: 595.276, PageCount: 8, PDFVersion: "1.5"},
+		},
+		{
+			"pdfcpu only",
+			Metadata{PDFCPU: &pdfcpu},
+			&PDFExtra{Page0Height: 841.89, Page0Width: 595.276, PageCount: 8, PDFVersion: "1.5"},
+		},
+	}
+	for _, c := range cases {
+		if extra := c.metadata.LegacyPDFExtra(); !cmp.Equal(extra, c.extra) {
+			t.Fatalf("[%s] got %v, want %v", c.about, extra, c.extra)
+		}
+	}
+}
+
+func TestMissingTool(t *testing.T) {
+	t.Setenv("PATH", "")
+	ctx := context.Background()
+	if _, err := RunInfo(ctx, "doc.pdf"); !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("got %v, want %v", err, exec.ErrNotFound)
+	}
+	if _, err := RunPDFCPU(ctx, "doc.pdf"); !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("got %v, want %v", err, exec.ErrNotFound)
+	}
+	if _, err := ParseFile(ctx, "doc.pdf"); !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("got %v, want %v", err, exec.ErrNotFound)
+	}
+}
@@ -0,0 +1,68 @@
+package blobproc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked is returned, if another process holds the pidfile lock.
+var ErrLocked = errors.New("locked by another process")
+
+// Pidfile is an exclusively locked file containing the process id of the
+// running process. It is used to prevent overlapping runs, e.g. from cron,
+// from processing and deleting the same spool files. The lock is held on the
+// open file, so it is released by the operating system, if the process dies;
+// a stale pidfile does not block later runs.
+type Pidfile struct {
+	f *os.File
+}
+
+// LockPidfile creates or opens the pidfile at path, locks it and writes the
+// current process id into it. If another process holds the lock, an error
+// wrapping ErrLocked is returned, which includes the pid of that process, if
+// it can be read.
+func LockPidfile(path string) (*Pidfile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, ErrLocked) {
+			if b, rerr := os.ReadFile(path); rerr == nil {
+				if pid := strings.TrimSpace(string(b)); pid != "" {
+					return nil, fmt.Errorf("%s: %w (pid %s)", path, ErrLocked, pid)
+				}
+			}
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Pidfile{f: f}, nil
+}
+
+// Release empties the pidfile and releases the lock. The file itself is kept,
+// since removing it could let two processes lock different files at the same
+// path.
+func (p *Pidfile) Release() error {
+	if p == nil || p.f == nil {
+		return nil
+	}
+	defer func() { p.f = nil }()
+	if err := p.f.Truncate(0); err != nil {
+		p.f.Close()
+		return err
+	}
+	return p.f.Close()
+}
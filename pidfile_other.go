@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package blobproc
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is not supported on this platform.
+func lockFile(f *os.File) error {
+	return errors.New("file locking not supported on this platform")
+}
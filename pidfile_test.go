@@ -0,0 +1,41 @@
+//go:build linux || darwin
+
+package blobproc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLockPidfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blobproc.pid")
+	p, err := LockPidfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), strconv.Itoa(os.Getpid()); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Locks are per open file, so a second lock from the same process fails.
+	if _, err := LockPidfile(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("got %v, want %v", err, ErrLocked)
+	}
+	if err := p.Release(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = LockPidfile(path)
+	if err != nil {
+		t.Fatalf("got %v, want lock after release", err)
+	}
+	if err := p.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,914 @@
+package blobproc
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miku/blobproc/frontmatter"
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/spool"
+	"github.com/miku/blobproc/textquality"
+	"github.com/miku/grobidclient"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Pipeline runs a single PDF through all processing steps: local extraction
+// of text and thumbnail, storing these derivatives in S3, then structured
+// metadata extraction via GROBID and storing the TEI-XML in S3. HTML files
+// are detected and only get their main text extracted and stored as TEI-XML,
+// XML files are checked for well-formedness and stored as is. Files of any
+// other type are rejected early, without running any extraction.
+// It is shared by the sequential and the parallel spool walker.
+//
+// Each stage can be replaced by setting the corresponding hook, e.g. in tests,
+// to run the pipeline without external tools or services. If a hook is nil,
+// the default implementation is used.
+type Pipeline struct {
+	Grobid *grobidclient.Grobid
+	S3     *WrapS3
+	// GrobidMaxFileSize is the maximum file size in bytes to send to GROBID,
+	// zero means no limit.
+	GrobidMaxFileSize int64
+	// ReferencesOnly uses the GROBID processReferences service instead of
+	// processFulltextDocument and stores the structured citations only, in
+	// the "grobid_refs" folder.
+	ReferencesOnly bool
+	// GrobidOptions are sent with each GROBID request, defaults to
+	// DefaultGrobidOptions.
+	GrobidOptions *GrobidOptions
+	// RawBucket, if set, is the bucket to store the original PDF in, keyed
+	// by SHA1, so reprocessing never depends on the spool.
+	RawBucket string
+	// RawFolder is the folder for original PDF files, defaults to "pdf".
+	RawFolder string
+
+	// ExtractFunc runs local extraction, defaults to pdfextract.ProcessFile.
+	ExtractFunc func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result
+	// GrobidFunc sends a file to GROBID, defaults to a fulltext request
+	// using the configured GROBID client.
+	GrobidFunc func(ctx context.Context, path string) (*grobidclient.Result, error)
+	// PutFunc stores a derivative, defaults to a put with the configured S3
+	// wrapper.
+	PutFunc func(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error)
+	// ExistsFunc checks whether a derivative is already stored, defaults to
+	// a lookup with the configured S3 wrapper. Only used in dry runs.
+	ExistsFunc func(ctx context.Context, req *BlobRequestOptions) (bool, error)
+	// Stages are run in order for each file, after the built-in stages.
+	Stages []Stage
+	// Profiles adjust processing for files from some spool subdirectories
+	// or sources.
+	Profiles []Profile
+	// URLMap, if set, is used to record the source URL and source of a file
+	// in the metadata of its derivatives and to record the processing state
+	// of each file.
+	URLMap *URLMap
+	// Cache skips files, that have been processed successfully with the
+	// same ResultVersion and configuration before, as recorded in the URL
+	// map, so re-runs are cheap. Files are processed again, once the
+	// versions change, or stages, the profile of a file or GROBID settings.
+	Cache bool
+	// MinTextQuality flags files, whose extracted text scores lower, as
+	// suspicious in the result, the processing state and the metadata of the
+	// text derivative, so they can be reviewed or sent to OCR. Zero disables
+	// flagging, the score is recorded in any case.
+	MinTextQuality float64
+	// FirstPage stores the text of the first page and the title and abstract
+	// guessed from it, before GROBID runs, as a cheap metadata signal, also
+	// for files, that are not sent to GROBID.
+	FirstPage bool
+	// Limits reject pathological documents, like PDFs with a huge number of
+	// pages or plotter sized pages, before any text or thumbnail is
+	// extracted. They are not sent to GROBID either.
+	Limits pdfextract.Limits
+	// PDFCPU controls, when pdfcpu runs in addition to pdfinfo, one of the
+	// pdfextract.PDFCPUModes, defaults to always.
+	PDFCPU string
+	// TrustSpoolNames takes the SHA1 of a spool file from its name, as
+	// computed by blobprocd when the file was received, instead of hashing
+	// the file again. Only enable this, if files are added to the spool by
+	// blobprocd or blobproc spool migrate.
+	TrustSpoolNames bool
+	// StoreResult stores the extraction result as JSON "metadata"
+	// derivative, with status, checksums, PDF metadata, text, links and the
+	// source of the file, so consumers need not run extraction again. Only
+	// the thumbnail is left out, as it is binary and stored separately.
+	StoreResult bool
+
+	mu sync.RWMutex // guards Grobid and GrobidOptions, which may be replaced while running
+}
+
+// SetGrobid replaces the GROBID client, e.g. after a config reload. Files
+// already sent to GROBID are not affected.
+func (p *Pipeline) SetGrobid(g *grobidclient.Grobid) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Grobid = g
+}
+
+// SetGrobidOptions replaces the options sent with GROBID requests, e.g.
+// after a config reload.
+func (p *Pipeline) SetGrobidOptions(opts GrobidOptions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.GrobidOptions = &opts
+}
+
+// grobidOptions returns the options to send with GROBID requests.
+func (p *Pipeline) grobidOptions() GrobidOptions {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.GrobidOptions == nil {
+		return DefaultGrobidOptions()
+	}
+	return *p.GrobidOptions
+}
+
+func (p *Pipeline) grobidClient() *grobidclient.Grobid {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Grobid
+}
+
+// ProcessResult summarizes the processing of a single file.
+type ProcessResult struct {
+	Path          string
+	SHA1Hex       string
+	Status        string              // Status of local extraction.
+	Stored        []*PutBlobResponse  // Derivatives successfully stored.
+	GrobidSkipped bool                // File was too large for GROBID.
+	Mimetype      string              // Sniffed mimetype, empty if unknown.
+	Rejected      string              // Reason for rejection, if the file type is not supported or exceeds a limit.
+	Profile       string              // Name of the processing profile, empty for the default.
+	Source        *Sidecar            // Metadata supplied by the feeder, if any.
+	Cached        bool                // Processed before with the same versions, nothing done.
+	TextQuality   *textquality.Report // Quality of the extracted text, if any.
+	LowQuality    bool                // Text quality below MinTextQuality.
+	Errors        []error             // All errors encountered.
+	Elapsed       time.Duration
+
+	metadata    map[string]string // stored with each derivative
+	prior       []string          // kinds of derivatives stored by a previous attempt
+	profile     *Profile          // processing profile, nil for the default
+	skipped     []string          // kinds of derivatives not produced with the profile
+	storedKinds []string          // kinds of stored derivatives
+	failedKinds []string          // kinds of derivatives, that could not be stored
+}
+
+// OK returns true, if all stages finished without errors and GROBID has been
+// run on the file.
+func (r *ProcessResult) OK() bool {
+	return len(r.Errors) == 0 && !r.GrobidSkipped && r.Rejected == ""
+}
+
+// requirableKinds are the kinds of derivatives stored by the pipeline itself,
+// which can be required to be stored, before a file is removed from the spool.
+var requirableKinds = []string{"header", "raw", "refs", "tei", "text", "thumbnail"}
+
+// ParseRequire parses a comma separated list of kinds of derivatives, that
+// must be stored, like "text,tei".
+func ParseRequire(s string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(s, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" || slices.Contains(kinds, kind) {
+			continue
+		}
+		if !slices.Contains(requirableKinds, kind) {
+			return nil, fmt.Errorf("cannot require derivative: %q, use one of %s", kind, strings.Join(requirableKinds, ", "))
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// Missing returns the kinds of derivatives, that could not be stored, and
+// the kinds in require, that have not been stored, so the file should be
+// processed again. Required kinds only apply to PDF files, HTML and XML files
+// yield a single derivative of their own, and not to kinds, that are not
+// produced with the profile of the file.
+func (r *ProcessResult) Missing(require []string) []string {
+	if r.Cached {
+		return nil
+	}
+	missing := slices.Clone(r.failedKinds)
+	switch r.Mimetype {
+	case "text/html", "text/xml":
+		return missing
+	}
+	for _, kind := range require {
+		if slices.Contains(r.skipped, kind) {
+			continue
+		}
+		if !slices.Contains(r.storedKinds, kind) && !slices.Contains(missing, kind) {
+			missing = append(missing, kind)
+		}
+	}
+	return missing
+}
+
+// Err returns an error summarizing all errors, or nil.
+func (r *ProcessResult) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d errors, first: %w", len(r.Errors), r.Errors[0])
+}
+
+// Check verifies, that the pipeline has all it needs to run.
+func (p *Pipeline) Check() error {
+	if p.grobidClient() == nil && p.GrobidFunc == nil {
+		return fmt.Errorf("pipeline needs grobid setup")
+	}
+	if p.S3 == nil && p.PutFunc == nil {
+		return fmt.Errorf("pipeline needs S3")
+	}
+	return nil
+}
+
+func (p *Pipeline) extract(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+	if p.ExtractFunc != nil {
+		return p.ExtractFunc(ctx, path, opts)
+	}
+	return pdfextract.ProcessFile(ctx, path, opts)
+}
+
+// grobid sends a file to GROBID, using the service and options of a
+// profile, which may be nil.
+func (p *Pipeline) grobid(ctx context.Context, path string, profile *Profile) (*grobidclient.Result, error) {
+	if p.GrobidFunc != nil {
+		return p.GrobidFunc(ctx, path)
+	}
+	options := p.grobidOptions()
+	if profile != nil && profile.GrobidOptions != nil {
+		options = *profile.GrobidOptions
+	}
+	var (
+		service = "processFulltextDocument"
+		opts    = options.ClientOptions()
+	)
+	switch p.grobidMode(profile) {
+	case GrobidReferences:
+		service = "processReferences"
+		opts = &grobidclient.Options{
+			ConsolidateCitations: options.ConsolidateCitations,
+			IncludeRawCitations:  options.IncludeRawCitations,
+		}
+	case GrobidHeader:
+		service = "processHeaderDocument"
+		opts = &grobidclient.Options{
+			ConsolidateHeader:      options.ConsolidateHeader,
+			IncluseRawAffiliations: options.IncludeRawAffiliations,
+		}
+	}
+	ctx, span := startSpan(ctx, "grobid."+service)
+	gres, err := p.grobidClient().ProcessPDFContext(ctx, path, service, opts)
+	switch {
+	case err != nil:
+	case gres.Err != nil:
+		err = gres.Err
+	case gres.StatusCode != http.StatusOK:
+		err = fmt.Errorf("grobid responded with HTTP %d", gres.StatusCode)
+	}
+	endSpan(span, err)
+	return gres, err
+}
+
+func (p *Pipeline) put(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+	switch {
+	case p.PutFunc != nil:
+		return p.PutFunc(ctx, req)
+	case req.Path != "" && req.Blob == nil:
+		return p.S3.PutFile(ctx, req)
+	default:
+		return p.S3.PutBlob(ctx, req)
+	}
+}
+
+// Process runs a file through the pipeline. Partial success is accepted, all
+// errors are collected in the result. Temporary files are created in tempDir,
+// or in the default temp directory, if tempDir is empty.
+func (p *Pipeline) Process(ctx context.Context, payload Payload, tempDir string) *ProcessResult {
+	started := time.Now()
+	ctx, span := startSpan(ctx, "process",
+		attribute.String("path", payload.Path),
+		attribute.Int64("size", payload.FileInfo.Size()),
+	)
+	id := spool.ID(payload.Path)
+	if pr := p.cachedResult(payload.Path); pr != nil {
+		endSpan(span, nil)
+		return pr
+	}
+	prior := p.storedBefore(id)
+	p.setState(id, StateProcessing, "")
+	pr, doc := p.processLocal(ctx, payload, tempDir, prior)
+	if doc != nil {
+		p.processRemote(ctx, payload, pr, doc)
+	}
+	pr.Elapsed = time.Since(started)
+	p.recordOutcome(id, pr)
+	span.SetAttributes(
+		attribute.String("sha1", pr.SHA1Hex),
+		attribute.String("mimetype", pr.Mimetype),
+	)
+	endSpan(span, pr.Err())
+	return pr
+}
+
+// knownChecksums returns the SHA1 of a spool file, along with the other
+// checksums recorded in the URL map when the file was received, if the size
+// matches.
+func (p *Pipeline) knownChecksums(sha1hex string, size int64) *pdfextract.FileInfo {
+	fi := &pdfextract.FileInfo{SHA1Hex: sha1hex}
+	if p.URLMap == nil {
+		return fi
+	}
+	c, err := p.URLMap.Checksums(sha1hex)
+	switch {
+	case err != nil:
+		slog.Warn("could not read checksums", "err", err, "sha1", sha1hex)
+	case c != nil && c.Size == size:
+		fi.MD5Hex, fi.SHA256Hex = c.MD5, c.SHA256
+	}
+	return fi
+}
+
+// isSHA1Hex returns true for a lowercase hex encoded SHA1 digest.
+func isSHA1Hex(s string) bool {
+	return len(s) == 40 && isHex(s)
+}
+
+// isHex returns true, if s consists of lowercase hex digits only.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// setState records the processing state of a file, if there is an URL map
+// and the identifier is a SHA1.
+func (p *Pipeline) setState(sha1hex, state, reason string) {
+	if p.URLMap == nil || len(sha1hex) != 40 {
+		return
+	}
+	if err := p.URLMap.SetState(sha1hex, state, reason); err != nil {
+		slog.Warn("could not record processing state", "err", err, "sha1", sha1hex, "state", state)
+	}
+}
+
+// recordOutcome records the final processing state of a file, identified by
+// the SHA1 of the result or by its spool identifier, and the versions it has
+// been processed with, if it has been processed successfully.
+func (p *Pipeline) recordOutcome(id string, pr *ProcessResult) {
+	if pr.SHA1Hex != "" {
+		id = pr.SHA1Hex
+	}
+	switch {
+	case pr.Rejected != "":
+		p.setState(id, StateRejected, pr.Rejected)
+	case len(pr.Errors) > 0:
+		p.setState(id, StateFailed, pr.Err().Error())
+	case pr.GrobidSkipped:
+		p.setState(id, StateDone, "too large for grobid")
+		p.recordResult(pr)
+	case pr.LowQuality:
+		p.setState(id, StateDone, "low text quality")
+		p.recordResult(pr)
+	default:
+		p.setState(id, StateDone, "")
+		p.recordResult(pr)
+	}
+}
+
+// resultVersion returns the ResultVersion along with a digest of the
+// configuration, that determines the derivatives produced for files with the
+// given profile, which may be nil, like "0.3.26 pdftotext=22.02.0
+// config=4e1243bd22c6". Enabling stages, changing the profile of a file or
+// GROBID settings thus invalidates previous results.
+func (p *Pipeline) resultVersion(profile *Profile) string {
+	var (
+		stages  []string
+		host    string
+		options = p.grobidOptions()
+		name    string
+		skip    []string
+	)
+	for _, stage := range p.Stages {
+		stages = append(stages, stage.Name())
+	}
+	if g := p.grobidClient(); g != nil {
+		host = g.Server
+	}
+	if profile != nil {
+		name = profile.Name
+		if profile.GrobidOptions != nil {
+			options = *profile.GrobidOptions
+		}
+		if profile.SkipThumbnail {
+			skip = append(skip, "thumbnail")
+		}
+		if profile.SkipWeblinks {
+			skip = append(skip, "weblinks")
+		}
+	}
+	config := struct {
+		Stages      []string
+		Profile     string
+		Skip        []string
+		GrobidMode  string
+		GrobidHost  string
+		Options     GrobidOptions
+		FirstPage   bool
+		StoreResult bool
+		RawBucket   string
+		RawFolder   string
+	}{
+		Stages:      stages,
+		Profile:     name,
+		Skip:        skip,
+		GrobidMode:  p.grobidMode(profile),
+		GrobidHost:  host,
+		Options:     options,
+		FirstPage:   p.FirstPage,
+		StoreResult: p.StoreResult,
+		RawBucket:   p.RawBucket,
+		RawFolder:   p.RawFolder,
+	}
+	b, _ := json.Marshal(config) // plain values only, cannot fail
+	h := sha1.Sum(b)
+	return fmt.Sprintf("%s config=%x", ResultVersion(), h[:6])
+}
+
+// cachedResult returns a result for a file, that has been processed with the
+// current versions and configuration before, nil if the file needs to be
+// processed.
+func (p *Pipeline) cachedResult(path string) *ProcessResult {
+	id := spool.ID(path)
+	if !p.Cache || p.URLMap == nil || len(id) != 40 {
+		return nil
+	}
+	version, err := p.URLMap.ResultVersion(id)
+	switch {
+	case err != nil:
+		slog.Warn("could not read result version", "err", err, "sha1", id)
+		return nil
+	case version == "":
+		return nil
+	case version != p.resultVersion(p.profile(path)):
+		slog.Debug("processed with other versions before, processing again", "path", path, "version", version)
+		return nil
+	}
+	slog.Debug("processed with the same versions before, skipping", "path", path, "version", version)
+	return &ProcessResult{Path: path, SHA1Hex: id, Cached: true}
+}
+
+// recordResult records the versions a file has been processed with, if there
+// is an URL map and all derivatives have been stored.
+func (p *Pipeline) recordResult(pr *ProcessResult) {
+	if p.URLMap == nil || pr.Cached || len(pr.SHA1Hex) != 40 {
+		return
+	}
+	if len(pr.Errors) > 0 || pr.Rejected != "" {
+		return
+	}
+	if err := p.URLMap.SetResultVersion(pr.SHA1Hex, p.resultVersion(pr.profile)); err != nil {
+		slog.Warn("could not record result version", "err", err, "sha1", pr.SHA1Hex)
+	}
+}
+
+// storedBefore returns the kinds of derivatives of a file, that have been
+// stored by a previous, failed attempt to process it, if there is an URL map.
+// These are not extracted and stored again. Otherwise, the records of
+// previous attempts are cleared, so a file added to the spool again is
+// processed in full.
+func (p *Pipeline) storedBefore(sha1hex string) []string {
+	if p.URLMap == nil || len(sha1hex) != 40 {
+		return nil
+	}
+	st, err := p.URLMap.State(sha1hex)
+	switch {
+	case err != nil:
+		slog.Warn("could not read processing state", "err", err, "sha1", sha1hex)
+		return nil
+	case st == nil:
+		return nil
+	case st.State == StateFailed:
+		kinds, err := p.URLMap.Stored(sha1hex)
+		if err != nil {
+			slog.Warn("could not read stored derivatives", "err", err, "sha1", sha1hex)
+		}
+		return kinds
+	}
+	if err := p.URLMap.ClearStored(sha1hex); err != nil {
+		slog.Warn("could not clear stored derivatives", "err", err, "sha1", sha1hex)
+	}
+	return nil
+}
+
+// store puts a single derivative and records the outcome in the result.
+// Derivatives stored by a previous attempt are skipped.
+func (p *Pipeline) store(ctx context.Context, pr *ProcessResult, kind string, req *BlobRequestOptions) {
+	if slices.Contains(pr.prior, kind) {
+		slog.Debug("stored by previous attempt, skipping", "kind", kind, "path", pr.Path)
+		pr.storedKinds = append(pr.storedKinds, kind)
+		return
+	}
+	if req.Bucket == "" && req.Folder == "" {
+		d, err := LookupDerivative(kind)
+		if err != nil {
+			pr.Errors = append(pr.Errors, err)
+			return
+		}
+		req.Bucket, req.Folder, req.Ext = d.Bucket, d.Folder, d.Ext
+	}
+	if req.Metadata == nil {
+		req.Metadata = pr.metadata
+	}
+	resp, err := p.put(ctx, req)
+	if err != nil {
+		slog.Error(fmt.Sprintf("s3 failed (%s)", kind), "err", err, "sha1", req.SHA1Hex, "path", pr.Path)
+		pr.Errors = append(pr.Errors, fmt.Errorf("s3 failed (%s): %v: %w", kind, req.SHA1Hex, err))
+		pr.failedKinds = append(pr.failedKinds, kind)
+		return
+	}
+	slog.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
+	pr.Stored = append(pr.Stored, resp)
+	pr.storedKinds = append(pr.storedKinds, kind)
+	if p.URLMap != nil && len(req.SHA1Hex) == 40 {
+		if err := p.URLMap.SetStored(req.SHA1Hex, kind); err != nil {
+			slog.Warn("could not record stored derivative", "err", err, "sha1", req.SHA1Hex, "kind", kind)
+		}
+	}
+}
+
+// documentType returns how a file with the given sniffed mimetype is
+// processed: as "html", "xml" or "pdf", or the empty string, if the type is
+// not supported. Files of unknown type are treated as PDF, extraction reports
+// any problem.
+func documentType(mimetype string) string {
+	switch mimetype {
+	case "text/html":
+		return "html"
+	case "text/xml":
+		return "xml"
+	case "application/pdf", "":
+		return "pdf"
+	default:
+		return ""
+	}
+}
+
+// processLocal runs all processing steps, that only involve local tools,
+// which are usually cheap. If the file needs to be sent to GROBID, a
+// document is returned, that can be passed to processRemote, otherwise the
+// document is nil and processing is complete. Kinds of derivatives in prior
+// have been stored by a previous attempt and are skipped.
+func (p *Pipeline) processLocal(ctx context.Context, payload Payload, tempDir string, prior []string) (*ProcessResult, *Document) {
+	var (
+		path   = payload.Path
+		pr     = &ProcessResult{Path: path, prior: prior, profile: p.profile(path)}
+		logger = slog.With("path", path)
+		store  = func(kind string, req *BlobRequestOptions) { p.store(ctx, pr, kind, req) }
+	)
+	if pr.profile != nil {
+		pr.Profile = pr.profile.Name
+		logger = logger.With("profile", pr.Profile)
+	}
+	if sidecar, err := ReadSidecar(path); err != nil {
+		logger.Warn("could not read sidecar", "err", err)
+	} else {
+		pr.Source = sidecar
+	}
+	// HTML and XML are handled separately and do not go to GROBID. If the
+	// file cannot be read, the PDF extraction will report the error.
+	pr.Mimetype = sniffMimetype(path)
+	switch documentType(pr.Mimetype) {
+	case "html":
+		p.processHTML(ctx, path, pr, store)
+		return pr, nil
+	case "xml":
+		p.processXML(ctx, path, pr, store)
+		return pr, nil
+	case "pdf":
+	default:
+		pr.Status = "unsupported-mimetype"
+		pr.Rejected = fmt.Sprintf("unsupported mimetype: %s", pr.Mimetype)
+		logger.Warn("rejecting file", "mimetype", pr.Mimetype)
+		return pr, nil
+	}
+	// Checksums known already are not computed again.
+	var known *pdfextract.FileInfo
+	if id := spool.ID(path); p.TrustSpoolNames && isSHA1Hex(id) {
+		known = p.knownChecksums(id, payload.FileInfo.Size())
+	}
+	if p.RawBucket != "" {
+		known = p.archiveRaw(ctx, pr, store, known)
+	}
+	// Derivatives not produced with the profile of the file.
+	skipThumbnail := pr.profile != nil && pr.profile.SkipThumbnail
+	if skipThumbnail {
+		pr.skipped = append(pr.skipped, "thumbnail")
+	}
+	for _, kind := range []string{"tei", "refs", "header"} {
+		if kind != p.teiKind(pr.profile) {
+			pr.skipped = append(pr.skipped, kind)
+		}
+	}
+	// Fulltext and thumbail via local command line tools
+	// --------------------------------------------------
+	result := p.extract(ctx, path, &pdfextract.Options{
+		Dim:           pdfextract.Dim{W: 180, H: 300},
+		ThumbType:     "JPEG",
+		TempDir:       tempDir,
+		SkipThumbnail: skipThumbnail || slices.Contains(prior, "thumbnail"),
+		SkipWeblinks:  pr.profile != nil && pr.profile.SkipWeblinks,
+		Provenance:    Provenance(),
+		Limits:        p.Limits,
+		PDFCPU:        p.PDFCPU,
+		FileInfo:      known,
+	})
+	pr.SHA1Hex, pr.Status = result.SHA1Hex, string(result.Status)
+	if result.Code == pdfextract.CodeLimit {
+		pr.Rejected = fmt.Sprintf("%s: %v", result.Status, result.Err)
+		logger.Warn("rejecting file", "status", result.Status, "err", result.Err)
+		return pr, nil
+	}
+	if result.FileInfo != nil {
+		pr.metadata = p.objectMetadata(result.FileInfo, pr.Source)
+	}
+	if src := p.sourceInfo(result.SHA1Hex, pr.Source); src != nil {
+		if b, err := json.Marshal(src); err != nil {
+			logger.Warn("could not encode source", "err", err)
+		} else {
+			result.Source = b
+		}
+	}
+	var fm *frontmatter.Frontmatter
+	switch {
+	case result.Status != pdfextract.StatusSuccess:
+		logger.Warn("pdfextract failed", "status", result.Status, "code", result.Code, "err", result.Err)
+		pr.Errors = append(pr.Errors, fmt.Errorf("pdfextract failed with status %q: %w", result.Status, result.Err))
+	case len(result.SHA1Hex) != 40:
+		logger.Warn("invalid sha1 in response", "sha1", result.SHA1Hex)
+		pr.Errors = append(pr.Errors, fmt.Errorf("invalid SHA1 in response: %v", result.SHA1Hex))
+	default:
+		// If we have a thumbnail, save it.
+		if result.HasPage0Thumbnail() && !skipThumbnail {
+			store("thumbnail", &BlobRequestOptions{
+				Blob:    result.Page0Thumbnail,
+				SHA1Hex: result.SHA1Hex,
+			})
+		}
+		// If we have some text, save it, along with its quality.
+		if len(result.Text) > 0 {
+			store("text", &BlobRequestOptions{
+				Blob:     []byte(result.Text),
+				SHA1Hex:  result.SHA1Hex,
+				Metadata: p.assessText(pr, logger, result.Text),
+			})
+		}
+		if p.FirstPage && len(result.Text) > 0 {
+			fm = p.storeFirstPage(pr, store, result)
+		}
+	}
+	// The result is stored for failed extractions as well, as it records
+	// status and error.
+	if p.StoreResult && len(result.SHA1Hex) == 40 {
+		p.storeResult(pr, store, result)
+	}
+	return pr, &Document{
+		Path:        path,
+		SHA1Hex:     result.SHA1Hex,
+		Result:      result,
+		TextQuality: pr.TextQuality,
+		Frontmatter: fm,
+		TempDir:     tempDir,
+		put: func(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+			if req.Metadata == nil {
+				req.Metadata = pr.metadata
+			}
+			return p.put(ctx, req)
+		},
+	}
+}
+
+// storeFirstPage stores the text of the first page and the title and
+// abstract guessed from it, which are returned.
+func (p *Pipeline) storeFirstPage(pr *ProcessResult, store func(string, *BlobRequestOptions), result *pdfextract.Result) *frontmatter.Frontmatter {
+	page := frontmatter.FirstPage(result.Text)
+	if strings.TrimSpace(page) == "" {
+		return nil
+	}
+	store("first_page", &BlobRequestOptions{
+		Blob:    []byte(page),
+		SHA1Hex: result.SHA1Hex,
+	})
+	fm := frontmatter.Parse(page)
+	b, err := json.Marshal(fm)
+	if err != nil {
+		pr.Errors = append(pr.Errors, err)
+		return fm
+	}
+	store("frontmatter", &BlobRequestOptions{
+		Blob:    b,
+		SHA1Hex: result.SHA1Hex,
+	})
+	return fm
+}
+
+// assessText records the quality of the extracted text in the result and
+// returns the metadata for the text derivative, which includes the score.
+func (p *Pipeline) assessText(pr *ProcessResult, logger *slog.Logger, text string) map[string]string {
+	q := textquality.Assess(text)
+	pr.TextQuality = q
+	md := maps.Clone(pr.metadata)
+	if md == nil {
+		md = make(map[string]string)
+	}
+	md["text-quality"] = strconv.FormatFloat(q.Score, 'f', 2, 64)
+	if q.Score < p.MinTextQuality {
+		pr.LowQuality = true
+		md["text-quality-flags"] = strings.Join(q.Flags, ",")
+		logger.Warn("low text quality", "score", q.Score, "flags", q.Flags)
+	}
+	return md
+}
+
+// SourceInfo describes where a file came from, as embedded in the extraction
+// result.
+type SourceInfo struct {
+	Sidecar *Sidecar     `json:"sidecar,omitempty"` // Supplied by the feeder.
+	URLMap  *URLMapEntry `json:"urlmap,omitempty"`  // Most recent URL map entry.
+}
+
+// sourceInfo returns the source of a file from its sidecar and the URL map,
+// nil if nothing is known.
+func (p *Pipeline) sourceInfo(sha1hex string, sidecar *Sidecar) *SourceInfo {
+	src := &SourceInfo{Sidecar: sidecar}
+	if p.URLMap != nil && len(sha1hex) == 40 {
+		entry, err := p.URLMap.Lookup(sha1hex)
+		if err != nil {
+			slog.Warn("urlmap lookup failed", "err", err, "sha1", sha1hex)
+		}
+		src.URLMap = entry
+	}
+	if src.Sidecar == nil && src.URLMap == nil {
+		return nil
+	}
+	return src
+}
+
+// storeResult stores the extraction result as JSON, without the thumbnail.
+func (p *Pipeline) storeResult(pr *ProcessResult, store func(string, *BlobRequestOptions), result *pdfextract.Result) {
+	r := *result
+	r.Page0Thumbnail = nil
+	b, err := json.Marshal(r)
+	if err != nil {
+		pr.Errors = append(pr.Errors, fmt.Errorf("result serialization failed: %w", err))
+		return
+	}
+	store("metadata", &BlobRequestOptions{
+		Blob:    b,
+		SHA1Hex: result.SHA1Hex,
+	})
+}
+
+// objectMetadata returns metadata describing the original file of
+// derivatives: checksums, processing time and the URL and source the file was
+// received from, as recorded in the URL map or given in a sidecar. The URL
+// map takes precedence.
+func (p *Pipeline) objectMetadata(fi *pdfextract.FileInfo, sidecar *Sidecar) map[string]string {
+	md := map[string]string{
+		"sha256":    fi.SHA256Hex,
+		"md5":       fi.MD5Hex,
+		"processed": time.Now().UTC().Format(time.RFC3339),
+	}
+	if sidecar != nil {
+		if sidecar.URL != "" {
+			md["source-url"] = sidecar.URL
+		}
+		if sidecar.Timestamp != "" {
+			md["crawl-timestamp"] = sidecar.Timestamp
+		}
+	}
+	if p.URLMap == nil {
+		return md
+	}
+	entry, err := p.URLMap.Lookup(fi.SHA1Hex)
+	switch {
+	case err != nil:
+		slog.Warn("urlmap lookup failed", "err", err, "sha1", fi.SHA1Hex)
+	case entry != nil:
+		md["source-url"] = entry.URL
+		if entry.Source != "" {
+			md["source"] = entry.Source
+		}
+	}
+	return md
+}
+
+// archiveRaw stores the original file, streamed from disk, and returns its
+// checksums, nil if the file could not be read. Checksums are only computed,
+// if not all of them are known.
+func (p *Pipeline) archiveRaw(ctx context.Context, pr *ProcessResult, store func(string, *BlobRequestOptions), known *pdfextract.FileInfo) *pdfextract.FileInfo {
+	fi := known
+	if fi == nil || fi.MD5Hex == "" || fi.SHA1Hex == "" || fi.SHA256Hex == "" {
+		_, span := startSpan(ctx, "archive")
+		fi = new(pdfextract.FileInfo)
+		err := fi.FromFile(pr.Path)
+		endSpan(span, err)
+		if err != nil {
+			pr.Errors = append(pr.Errors, fmt.Errorf("could not read file for archival: %w", err))
+			return nil
+		}
+	}
+	folder := p.RawFolder
+	if folder == "" {
+		folder = "pdf"
+	}
+	store("raw", &BlobRequestOptions{
+		Bucket:   p.RawBucket,
+		Folder:   folder,
+		Path:     pr.Path,
+		SHA1Hex:  fi.SHA1Hex,
+		Ext:      "pdf",
+		Prefix:   "",
+		Metadata: p.objectMetadata(fi, pr.Source),
+	})
+	return fi
+}
+
+// teiKind returns the kind of derivative GROBID results are stored as for a
+// profile, which may be nil, or the empty string, if GROBID is not used.
+func (p *Pipeline) teiKind(profile *Profile) string {
+	switch p.grobidMode(profile) {
+	case GrobidReferences:
+		return "refs"
+	case GrobidHeader:
+		return "header"
+	case GrobidNone:
+		return ""
+	default:
+		return "tei"
+	}
+}
+
+// processRemote sends a file to GROBID, stores the TEI-XML and runs all
+// additional stages, which may depend on the GROBID result.
+func (p *Pipeline) processRemote(ctx context.Context, payload Payload, pr *ProcessResult, doc *Document) {
+	var (
+		path   = payload.Path
+		logger = slog.With("path", path)
+		store  = func(kind string, req *BlobRequestOptions) { p.store(ctx, pr, kind, req) }
+	)
+	teiKind := p.teiKind(pr.profile)
+	switch {
+	case teiKind == "":
+		logger.Debug("profile without grobid, skipping grobid")
+	case p.GrobidMaxFileSize > 0 && payload.FileInfo.Size() > p.GrobidMaxFileSize:
+		logger.Warn("skipping too large file", "size", payload.FileInfo.Size())
+		pr.GrobidSkipped = true
+	case len(p.Stages) == 0 && slices.Contains(pr.prior, teiKind):
+		// Stages may need the TEI, otherwise there is no need to ask
+		// GROBID again.
+		logger.Debug("tei stored by previous attempt, skipping grobid")
+		pr.storedKinds = append(pr.storedKinds, teiKind)
+	default:
+		// Structured metadata from PDF via grobid
+		// ---------------------------------------
+		gres, err := p.grobid(ctx, path, pr.profile)
+		if err != nil {
+			logger.Warn("grobid failed", "err", err)
+			pr.Errors = append(pr.Errors, fmt.Errorf("grobid failed: %w", err))
+			break
+		}
+		doc.TEI = gres.Body
+		store(teiKind, &BlobRequestOptions{
+			Blob:    gres.Body,
+			SHA1Hex: gres.SHA1Hex,
+		})
+	}
+	// Additional, user defined stages
+	// -------------------------------
+	for _, stage := range p.Stages {
+		sctx, sspan := startSpan(ctx, "stage."+stage.Name())
+		err := stage.Run(sctx, doc)
+		endSpan(sspan, err)
+		if err != nil {
+			logger.Warn("stage failed", "stage", stage.Name(), "err", err)
+			pr.Errors = append(pr.Errors, fmt.Errorf("stage %s failed: %w", stage.Name(), err))
+		}
+	}
+}
@@ -0,0 +1,901 @@
+package blobproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/grobidclient"
+)
+
+// fakeStore records put requests.
+type fakeStore struct {
+	mu       sync.Mutex
+	folders  []string
+	metadata []map[string]string
+	err      error
+}
+
+func (s *fakeStore) put(_ context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.folders = append(s.folders, req.Folder)
+	s.metadata = append(s.metadata, req.Metadata)
+	return &PutBlobResponse{Bucket: req.Bucket, ObjectPath: blobPath(req.Folder, req.SHA1Hex, req.Ext, req.Prefix)}, nil
+}
+
+const fakeSHA1Hex = "4e1243bd22c66e76c2ba9eddc1f91394e57f9f83"
+
+// fakeExtract returns an extraction function yielding a result with a given status.
+func fakeExtract(status pdfextract.Status) func(context.Context, string, *pdfextract.Options) *pdfextract.Result {
+	return func(context.Context, string, *pdfextract.Options) *pdfextract.Result {
+		if status != "success" {
+			return &pdfextract.Result{SHA1Hex: fakeSHA1Hex, Status: status, Err: errors.New("failed")}
+		}
+		return &pdfextract.Result{
+			SHA1Hex:        fakeSHA1Hex,
+			Status:         status,
+			Text:           "hello",
+			Page0Thumbnail: bytes.Repeat([]byte("x"), 100),
+		}
+	}
+}
+
+func fakeGrobidOK(context.Context, string) (*grobidclient.Result, error) {
+	return &grobidclient.Result{SHA1Hex: fakeSHA1Hex, StatusCode: 200, Body: []byte("<TEI/>")}, nil
+}
+
+func fakeGrobidFailed(context.Context, string) (*grobidclient.Result, error) {
+	return nil, errors.New("grobid down")
+}
+
+func TestPipelineProcess(t *testing.T) {
+	var cases = []struct {
+		about         string
+		extract       func(context.Context, string, *pdfextract.Options) *pdfextract.Result
+		grobid        func(context.Context, string) (*grobidclient.Result, error)
+		putErr        error
+		size          int64
+		maxSize       int64
+		ok            bool
+		grobidSkipped bool
+		folders       []string
+	}{
+		{
+			about:   "all stages succeed",
+			extract: fakeExtract("success"),
+			grobid:  fakeGrobidOK,
+			size:    100,
+			ok:      true,
+			folders: []string{"pdf", "text", "grobid"},
+		},
+		{
+			about:   "extraction fails, grobid still runs",
+			extract: fakeExtract("parse-error"),
+			grobid:  fakeGrobidOK,
+			size:    100,
+			ok:      false,
+			folders: []string{"grobid"},
+		},
+		{
+			about:         "too large for grobid",
+			extract:       fakeExtract("success"),
+			grobid:        fakeGrobidOK,
+			size:          100,
+			maxSize:       10,
+			ok:            false,
+			grobidSkipped: true,
+			folders:       []string{"pdf", "text"},
+		},
+		{
+			about:   "grobid fails",
+			extract: fakeExtract("success"),
+			grobid:  fakeGrobidFailed,
+			size:    100,
+			ok:      false,
+			folders: []string{"pdf", "text"},
+		},
+		{
+			about:   "s3 fails",
+			extract: fakeExtract("success"),
+			grobid:  fakeGrobidOK,
+			putErr:  errors.New("s3 down"),
+			size:    100,
+			ok:      false,
+			folders: nil,
+		},
+	}
+	for _, c := range cases {
+		store := &fakeStore{err: c.putErr}
+		p := &Pipeline{
+			GrobidMaxFileSize: c.maxSize,
+			ExtractFunc:       c.extract,
+			GrobidFunc:        c.grobid,
+			PutFunc:           store.put,
+		}
+		if err := p.Check(); err != nil {
+			t.Fatalf("[%s] check: got %v, want nil", c.about, err)
+		}
+		pr := p.Process(context.Background(), Payload{
+			Path:     "x.pdf",
+			FileInfo: fakeFileInfo{size: c.size},
+		}, "")
+		if pr.OK() != c.ok {
+			t.Fatalf("[%s] got %v, want %v (%v)", c.about, pr.OK(), c.ok, pr.Errors)
+		}
+		if pr.GrobidSkipped != c.grobidSkipped {
+			t.Fatalf("[%s] got %v, want %v", c.about, pr.GrobidSkipped, c.grobidSkipped)
+		}
+		if !slices.Equal(store.folders, c.folders) {
+			t.Fatalf("[%s] got %v, want %v", c.about, store.folders, c.folders)
+		}
+	}
+}
+
+func TestPipelineCheck(t *testing.T) {
+	var p Pipeline
+	if err := p.Check(); err == nil {
+		t.Fatalf("got nil, want error")
+	}
+}
+
+func TestPipelineProcessHTML(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			ExtractFunc: func(context.Context, string, *pdfextract.Options) *pdfextract.Result {
+				t.Fatalf("pdf extraction should not run for HTML")
+				return nil
+			},
+			GrobidFunc: fakeGrobidOK,
+			PutFunc:    store.put,
+		}
+		path = "htmlextract/testdata/article.html"
+	)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fi}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want ok", pr.Errors)
+	}
+	if want := []string{"html_body"}; !slices.Equal(store.folders, want) {
+		t.Fatalf("got %v, want %v", store.folders, want)
+	}
+}
+
+func TestPipelineProcessReferencesOnly(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			ReferencesOnly: true,
+			ExtractFunc:    fakeExtract("success"),
+			GrobidFunc:     fakeGrobidOK,
+			PutFunc:        store.put,
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: "x.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want ok", pr.Errors)
+	}
+	if want := []string{"pdf", "text", "grobid_refs"}; !slices.Equal(store.folders, want) {
+		t.Fatalf("got %v, want %v", store.folders, want)
+	}
+}
+
+func TestPipelineProcessArchiveRaw(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			RawBucket:   "raw",
+			RawFolder:   "original",
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc:  fakeGrobidOK,
+			PutFunc:     store.put,
+		}
+		path = "testdata/pdf/1906.02444.pdf"
+	)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fi}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want ok", pr.Errors)
+	}
+	if want := []string{"original", "pdf", "text", "grobid"}; !slices.Equal(store.folders, want) {
+		t.Fatalf("got %v, want %v", store.folders, want)
+	}
+	if got := pr.Stored[0].Bucket; got != "raw" {
+		t.Fatalf("got %v, want %v", got, "raw")
+	}
+}
+
+func TestPipelineProcessMetadata(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := urlMap.InsertSource("https://example.org/a.pdf", fakeSHA1Hex, "crawl-1"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			ExtractFunc: func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				result := fakeExtract("success")(ctx, path, opts)
+				result.FileInfo = &pdfextract.FileInfo{SHA1Hex: fakeSHA1Hex, SHA256Hex: "sha256", MD5Hex: "md5"}
+				return result
+			},
+			GrobidFunc: fakeGrobidOK,
+			PutFunc:    store.put,
+			URLMap:     urlMap,
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: "x.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want ok", pr.Errors)
+	}
+	if len(store.metadata) != 3 {
+		t.Fatalf("got %v, want %v", len(store.metadata), 3)
+	}
+	var cases = []struct {
+		key   string
+		value string
+	}{
+		{"source-url", "https://example.org/a.pdf"},
+		{"source", "crawl-1"},
+		{"sha256", "sha256"},
+		{"md5", "md5"},
+	}
+	for i, md := range store.metadata {
+		for _, c := range cases {
+			if md[c.key] != c.value {
+				t.Fatalf("[%s] got %v, want %v (derivative %d)", c.key, md[c.key], c.value, i)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, md["processed"]); err != nil {
+			t.Fatalf("got %v, want RFC3339 timestamp", md["processed"])
+		}
+	}
+	st, err := urlMap.State(fakeSHA1Hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || st.State != StateDone {
+		t.Fatalf("got %v, want state %v", st, StateDone)
+	}
+}
+
+func TestProcessResultMissing(t *testing.T) {
+	var cases = []struct {
+		about   string
+		pr      *ProcessResult
+		require []string
+		missing []string
+	}{
+		{
+			about: "all stored",
+			pr:    &ProcessResult{storedKinds: []string{"thumbnail", "text", "tei"}},
+		},
+		{
+			about:   "store failed",
+			pr:      &ProcessResult{storedKinds: []string{"thumbnail"}, failedKinds: []string{"text", "tei"}},
+			missing: []string{"text", "tei"},
+		},
+		{
+			about:   "required kind missing",
+			pr:      &ProcessResult{storedKinds: []string{"thumbnail", "text"}},
+			require: []string{"text", "tei"},
+			missing: []string{"tei"},
+		},
+		{
+			about:   "required kind failed",
+			pr:      &ProcessResult{storedKinds: []string{"thumbnail"}, failedKinds: []string{"text"}},
+			require: []string{"text"},
+			missing: []string{"text"},
+		},
+		{
+			about:   "html ignores required kinds",
+			pr:      &ProcessResult{Mimetype: "text/html", storedKinds: []string{"html_body"}},
+			require: []string{"text", "tei"},
+		},
+	}
+	for _, c := range cases {
+		if got := c.pr.Missing(c.require); !slices.Equal(got, c.missing) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.missing)
+		}
+	}
+}
+
+func TestParseRequire(t *testing.T) {
+	var cases = []struct {
+		s     string
+		kinds []string
+		err   bool
+	}{
+		{"", nil, false},
+		{"text", []string{"text"}, false},
+		{"text, tei,text", []string{"text", "tei"}, false},
+		{"text,weblinks", nil, true},
+	}
+	for _, c := range cases {
+		kinds, err := ParseRequire(c.s)
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error %v", c.s, err, c.err)
+		}
+		if !slices.Equal(kinds, c.kinds) {
+			t.Fatalf("[%s] got %v, want %v", c.s, kinds, c.kinds)
+		}
+	}
+}
+
+func TestPipelineProcessRetry(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	var (
+		skipThumbnail bool
+		path          = filepath.Join("spool", fakeSHA1Hex[:2], fakeSHA1Hex[2:4], fakeSHA1Hex[4:])
+		extract       = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+			skipThumbnail = opts.SkipThumbnail
+			return fakeExtract("success")(ctx, path, opts)
+		}
+	)
+	var cases = []struct {
+		about         string
+		grobid        func(context.Context, string) (*grobidclient.Result, error)
+		ok            bool
+		skipThumbnail bool
+		folders       []string
+	}{
+		{"grobid fails", fakeGrobidFailed, false, false, []string{"pdf", "text"}},
+		{"retry only grobid", fakeGrobidOK, true, true, []string{"grobid"}},
+		{"processed again in full", fakeGrobidOK, true, false, []string{"pdf", "text", "grobid"}},
+	}
+	for _, c := range cases {
+		var (
+			store = &fakeStore{}
+			p     = &Pipeline{
+				ExtractFunc: extract,
+				GrobidFunc:  c.grobid,
+				PutFunc:     store.put,
+				URLMap:      urlMap,
+			}
+		)
+		pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fakeFileInfo{size: 1}}, "")
+		if pr.OK() != c.ok {
+			t.Fatalf("[%s] got %v, want %v (%v)", c.about, pr.OK(), c.ok, pr.Errors)
+		}
+		if skipThumbnail != c.skipThumbnail {
+			t.Fatalf("[%s] got %v, want %v", c.about, skipThumbnail, c.skipThumbnail)
+		}
+		if !slices.Equal(store.folders, c.folders) {
+			t.Fatalf("[%s] got %v, want %v", c.about, store.folders, c.folders)
+		}
+		if missing := pr.Missing([]string{"text", "tei"}); c.ok && len(missing) > 0 {
+			t.Fatalf("[%s] got %v, want nothing missing", c.about, missing)
+		}
+	}
+}
+
+func TestPipelineGrobidOptions(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		fields map[string][]string
+		srv    = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			fields = r.MultipartForm.Value
+			mu.Unlock()
+			w.Write([]byte("<TEI/>"))
+		}))
+	)
+	defer srv.Close()
+	var cases = []struct {
+		about          string
+		opts           *GrobidOptions
+		referencesOnly bool
+		want           []string
+	}{
+		{
+			about: "defaults",
+			want:  []string{"consolidateHeader", "generateIDs", "includeRawAffiliations", "includeRawCitations", "segmentSentences", "teiCoordinates"},
+		},
+		{
+			about: "consolidate citations only",
+			opts:  &GrobidOptions{ConsolidateCitations: true},
+			want:  []string{"consolidateCitations"},
+		},
+		{
+			about:          "references only",
+			opts:           &GrobidOptions{ConsolidateHeader: true, ConsolidateCitations: true, SegmentSentences: true},
+			referencesOnly: true,
+			want:           []string{"consolidateCitations"},
+		},
+	}
+	for _, c := range cases {
+		p := &Pipeline{
+			Grobid:         NewGrobid(srv.URL),
+			GrobidOptions:  c.opts,
+			ReferencesOnly: c.referencesOnly,
+		}
+		if _, err := p.grobid(context.Background(), "testdata/pdf/1906.02444.pdf", nil); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		mu.Lock()
+		var got []string
+		for k := range fields {
+			got = append(got, k)
+		}
+		mu.Unlock()
+		slices.Sort(got)
+		if !slices.Equal(got, c.want) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.want)
+		}
+	}
+}
+
+func TestPipelineProfile(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := urlMap.InsertSource("https://example.com/a.pdf", fakeSHA1Hex, "thesis-crawl"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		shard    = filepath.Join(fakeSHA1Hex[:2], fakeSHA1Hex[2:4], fakeSHA1Hex[4:])
+		profiles = []Profile{
+			{Name: "cheap", Dir: "cheap", SkipThumbnail: true, SkipWeblinks: true, Grobid: GrobidNone},
+			{Name: "thesis", Sources: []string{"thesis-crawl"}, SkipThumbnail: true, Grobid: GrobidHeader},
+		}
+	)
+	var (
+		skipWeblinks bool
+		extract      = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+			skipWeblinks = opts.SkipWeblinks
+			return fakeExtract("success")(ctx, path, opts)
+		}
+	)
+	var cases = []struct {
+		about        string
+		path         string
+		urlMap       *URLMap
+		profile      string
+		folders      []string
+		skipWeblinks bool
+	}{
+		{"default", filepath.Join("spool", shard), nil, "", []string{"pdf", "text", "grobid"}, false},
+		{"dir", filepath.Join("spool", "cheap", shard), urlMap, "cheap", []string{"text"}, true},
+		{"source", filepath.Join("spool", shard), urlMap, "thesis", []string{"text", "grobid_header"}, false},
+	}
+	for _, c := range cases {
+		var (
+			store = &fakeStore{}
+			p     = &Pipeline{
+				ExtractFunc: extract,
+				GrobidFunc:  fakeGrobidOK,
+				PutFunc:     store.put,
+				URLMap:      c.urlMap,
+				Profiles:    profiles,
+			}
+		)
+		pr := p.Process(context.Background(), Payload{Path: c.path, FileInfo: fakeFileInfo{size: 1}}, "")
+		if !pr.OK() {
+			t.Fatalf("[%s] got %v, want no errors", c.about, pr.Errors)
+		}
+		if pr.Profile != c.profile {
+			t.Fatalf("[%s] got %v, want %v", c.about, pr.Profile, c.profile)
+		}
+		if !slices.Equal(store.folders, c.folders) {
+			t.Fatalf("[%s] got %v, want %v", c.about, store.folders, c.folders)
+		}
+		if skipWeblinks != c.skipWeblinks {
+			t.Fatalf("[%s] got %v, want %v", c.about, skipWeblinks, c.skipWeblinks)
+		}
+		// Kinds not produced with a profile are never missing.
+		if missing := pr.Missing([]string{"text", "tei", "thumbnail"}); c.profile != "" && len(missing) > 0 {
+			t.Fatalf("[%s] got %v, want nothing missing", c.about, missing)
+		}
+	}
+}
+
+func TestProfileDir(t *testing.T) {
+	var cases = []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"ab/cd/ef", ""},
+		{"/spool/ab/cd/ef", "spool"},
+		{"/spool/thesis/ab/cd/ef", "thesis"},
+	}
+	for _, c := range cases {
+		if got := profileDir(c.path); got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+// noopStage does nothing, but changes the configuration of a pipeline.
+var noopStage = StageFunc{StageName: "noop", F: func(context.Context, *Document) error { return nil }}
+
+func TestPipelineCache(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	path := filepath.Join("spool", fakeSHA1Hex[:2], fakeSHA1Hex[2:4], fakeSHA1Hex[4:])
+	var cases = []struct {
+		about   string
+		grobid  func(context.Context, string) (*grobidclient.Result, error)
+		version string // recorded version to set before processing, if any
+		stages  []Stage
+		refs    bool // references only
+		cached  bool
+	}{
+		{about: "not processed yet", grobid: fakeGrobidFailed},
+		{about: "previous attempt failed", grobid: fakeGrobidOK},
+		{about: "same versions", grobid: fakeGrobidOK, cached: true},
+		{about: "version changed", grobid: fakeGrobidOK, version: "0.0.1"},
+		{about: "same versions again", grobid: fakeGrobidOK, cached: true},
+		{about: "stage enabled", grobid: fakeGrobidOK, stages: []Stage{noopStage}},
+		{about: "same stages", grobid: fakeGrobidOK, stages: []Stage{noopStage}, cached: true},
+		{about: "references only", grobid: fakeGrobidOK, stages: []Stage{noopStage}, refs: true},
+		{about: "same grobid mode", grobid: fakeGrobidOK, stages: []Stage{noopStage}, refs: true, cached: true},
+	}
+	for _, c := range cases {
+		if c.version != "" {
+			if err := urlMap.SetResultVersion(fakeSHA1Hex, c.version); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var (
+			store = &fakeStore{}
+			p     = &Pipeline{
+				ExtractFunc:    fakeExtract("success"),
+				GrobidFunc:     c.grobid,
+				PutFunc:        store.put,
+				URLMap:         urlMap,
+				Cache:          true,
+				Stages:         c.stages,
+				ReferencesOnly: c.refs,
+			}
+		)
+		pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fakeFileInfo{size: 1}}, "")
+		if pr.Cached != c.cached {
+			t.Fatalf("[%s] got %v, want %v", c.about, pr.Cached, c.cached)
+		}
+		if got := len(store.folders) == 0; got != c.cached {
+			t.Fatalf("[%s] got %v, want nothing stored for cached results", c.about, store.folders)
+		}
+		if missing := pr.Missing([]string{"text", "tei"}); c.cached && len(missing) > 0 {
+			t.Fatalf("[%s] got %v, want nothing missing", c.about, missing)
+		}
+	}
+}
+
+func TestPipelineTextQuality(t *testing.T) {
+	var cases = []struct {
+		about   string
+		text    string
+		min     float64
+		low     bool
+		quality string
+	}{
+		{"plausible", "Hello world.", 0.5, false, "1.00"},
+		{"garbled", strings.Repeat("�� text ", 20), 0.5, true, "0.00"},
+		{"flagging disabled", strings.Repeat("�� text ", 20), 0, false, "0.00"},
+	}
+	for _, c := range cases {
+		var (
+			store   = &fakeStore{}
+			extract = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				result := fakeExtract("success")(ctx, path, opts)
+				result.Text = c.text
+				return result
+			}
+			p = &Pipeline{
+				ExtractFunc:    extract,
+				GrobidFunc:     fakeGrobidOK,
+				PutFunc:        store.put,
+				MinTextQuality: c.min,
+			}
+		)
+		pr := p.Process(context.Background(), Payload{Path: "doc.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+		if pr.LowQuality != c.low {
+			t.Fatalf("[%s] got %v, want %v", c.about, pr.LowQuality, c.low)
+		}
+		i := slices.Index(store.folders, "text")
+		if i < 0 {
+			t.Fatalf("[%s] got %v, want text stored", c.about, store.folders)
+		}
+		if got := store.metadata[i]["text-quality"]; got != c.quality {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.quality)
+		}
+		if _, ok := store.metadata[i]["text-quality-flags"]; ok != c.low {
+			t.Fatalf("[%s] got %v, want %v", c.about, ok, c.low)
+		}
+	}
+}
+
+func TestPipelineFirstPage(t *testing.T) {
+	var (
+		store   = &fakeStore{}
+		extract = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+			result := fakeExtract("success")(ctx, path, opts)
+			result.Text = "A Study of Things\n\nAbstract\nWe study things.\n\fSecond page"
+			return result
+		}
+		stage = StageFunc{StageName: "check", F: func(ctx context.Context, doc *Document) error {
+			if doc.Frontmatter == nil || doc.Frontmatter.Title != "A Study of Things" {
+				return fmt.Errorf("got %v, want frontmatter", doc.Frontmatter)
+			}
+			return nil
+		}}
+		p = &Pipeline{
+			ExtractFunc: extract,
+			GrobidFunc:  fakeGrobidOK,
+			PutFunc:     store.put,
+			FirstPage:   true,
+			Stages:      []Stage{stage},
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: "doc.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+	if !pr.OK() {
+		t.Fatalf("got %v, want no errors", pr.Errors)
+	}
+	want := []string{"pdf", "text", "first_page", "frontmatter", "grobid"}
+	if !slices.Equal(store.folders, want) {
+		t.Fatalf("got %v, want %v", store.folders, want)
+	}
+}
+
+func TestPipelineLimits(t *testing.T) {
+	var (
+		store   = &fakeStore{}
+		limits  = pdfextract.Limits{MaxPages: 1000}
+		extract = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+			if opts.Limits != limits {
+				return fakeExtract("success")(ctx, path, opts)
+			}
+			return &pdfextract.Result{
+				SHA1Hex: fakeSHA1Hex,
+				Status:  pdfextract.StatusTooManyPages,
+				Code:    pdfextract.CodeLimit,
+				Err:     errors.New("1000000 pages exceed limit of 1000"),
+			}
+		}
+		grobid = func(context.Context, string) (*grobidclient.Result, error) {
+			return nil, errors.New("unexpected grobid request")
+		}
+		p = &Pipeline{
+			ExtractFunc: extract,
+			GrobidFunc:  grobid,
+			PutFunc:     store.put,
+			Limits:      limits,
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: "doc.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+	if !strings.HasPrefix(pr.Rejected, "too-many-pages") {
+		t.Fatalf("got %q, want rejection", pr.Rejected)
+	}
+	if len(pr.Errors) > 0 || len(store.folders) > 0 {
+		t.Fatalf("got %v, %v, want no errors and nothing stored", pr.Errors, store.folders)
+	}
+	if pr.Status != string(pdfextract.StatusTooManyPages) {
+		t.Fatalf("got %v, want %v", pr.Status, pdfextract.StatusTooManyPages)
+	}
+}
+
+func TestPipelineKnownFileInfo(t *testing.T) {
+	var cases = []struct {
+		about   string
+		path    string
+		raw     bool
+		trust   bool
+		sha1hex string
+	}{
+		{"nothing known", "ab/cd/" + fakeSHA1Hex[4:], false, false, ""},
+		{"untrusted spool name", "4e/6c/" + fakeSHA1Hex[4:], false, false, ""},
+		{"trusted spool name", "4e/6c/" + fakeSHA1Hex[4:], false, true, "4e6c" + fakeSHA1Hex[4:]},
+		{"no spool name", "doc.pdf", false, true, ""},
+		{"invalid spool name", "4e/6c/" + strings.Repeat("x", 36), false, true, ""},
+		{"raw archive", "testdata/pdf/1906.02444.pdf", true, false, "4e6ca8dfc787a8b33e92773df3674fadf4d4cdb6"},
+	}
+	for _, c := range cases {
+		var (
+			got     string
+			extract = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				if opts.FileInfo != nil {
+					got = opts.FileInfo.SHA1Hex
+				}
+				return fakeExtract("success")(ctx, path, opts)
+			}
+			p = &Pipeline{
+				ExtractFunc:     extract,
+				GrobidFunc:      fakeGrobidOK,
+				PutFunc:         (&fakeStore{}).put,
+				TrustSpoolNames: c.trust,
+			}
+		)
+		if c.raw {
+			p.RawBucket = "raw"
+		}
+		p.Process(context.Background(), Payload{Path: c.path, FileInfo: fakeFileInfo{size: 1}}, "")
+		if got != c.sha1hex {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.sha1hex)
+		}
+	}
+}
+
+func TestPipelineRecordedChecksums(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := urlMap.SetChecksums(Checksums{SHA1: fakeSHA1Hex, MD5: "md5", SHA256: "sha256", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	path := fakeSHA1Hex[:2] + "/" + fakeSHA1Hex[2:4] + "/" + fakeSHA1Hex[4:]
+	var cases = []struct {
+		about string
+		size  int64
+		want  pdfextract.FileInfo
+	}{
+		{"recorded", 10, pdfextract.FileInfo{SHA1Hex: fakeSHA1Hex, MD5Hex: "md5", SHA256Hex: "sha256"}},
+		{"size mismatch", 11, pdfextract.FileInfo{SHA1Hex: fakeSHA1Hex}},
+	}
+	for _, c := range cases {
+		var (
+			got     pdfextract.FileInfo
+			extract = func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				got = *opts.FileInfo
+				return fakeExtract("success")(ctx, path, opts)
+			}
+			p = &Pipeline{
+				ExtractFunc:     extract,
+				GrobidFunc:      fakeGrobidOK,
+				PutFunc:         (&fakeStore{}).put,
+				URLMap:          urlMap,
+				TrustSpoolNames: true,
+			}
+		)
+		p.Process(context.Background(), Payload{Path: path, FileInfo: fakeFileInfo{size: c.size}}, "")
+		if got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.want)
+		}
+	}
+}
+
+func TestPipelineSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "4e", "12", fakeSHA1Hex[4:])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &Sidecar{URL: "https://example.org/a.pdf", Timestamp: "20240607023917", CDX: "org,example)/a.pdf"}
+	if err := WriteSidecar(path, sidecar); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		store = &fakeStore{}
+		p     = &Pipeline{
+			ExtractFunc: func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				result := fakeExtract("success")(ctx, path, opts)
+				result.FileInfo = &pdfextract.FileInfo{SHA1Hex: fakeSHA1Hex}
+				return result
+			},
+			GrobidFunc: fakeGrobidOK,
+			PutFunc:    store.put,
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: path, FileInfo: fakeFileInfo{size: 1}}, "")
+	if pr.Source == nil || *pr.Source != *sidecar {
+		t.Fatalf("got %v, want %v", pr.Source, sidecar)
+	}
+	for i, md := range store.metadata {
+		if md["source-url"] != sidecar.URL || md["crawl-timestamp"] != sidecar.Timestamp {
+			t.Fatalf("got %v, want sidecar values (derivative %d)", md, i)
+		}
+	}
+}
+
+func TestPipelineStoreResult(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := urlMap.InsertSource("https://example.org/a.pdf", fakeSHA1Hex, "crawl-1"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "4e", "12", fakeSHA1Hex[4:])
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSidecar(path, &Sidecar{CDX: "org,example)/a.pdf"}); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about  string
+		status pdfextract.Status
+		store  bool
+		stored bool
+	}{
+		{"disabled", "success", false, false},
+		{"enabled", "success", true, true},
+		{"failed extraction", "parse-error", true, true},
+	}
+	for _, c := range cases {
+		var (
+			blob []byte
+			p    = &Pipeline{
+				ExtractFunc: fakeExtract(c.status),
+				GrobidFunc:  fakeGrobidOK,
+				PutFunc: func(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+					if req.Folder == "metadata" {
+						blob = req.Blob
+					}
+					return (&fakeStore{}).put(ctx, req)
+				},
+				URLMap:      urlMap,
+				StoreResult: c.store,
+			}
+		)
+		p.Process(context.Background(), Payload{Path: path, FileInfo: fakeFileInfo{size: 1}}, "")
+		if got := blob != nil; got != c.stored {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.stored)
+		}
+		if blob == nil {
+			continue
+		}
+		var result struct {
+			SHA1Hex        string     `json:"sha1hex"`
+			Status         string     `json:"status"`
+			Text           string     `json:"text"`
+			Page0Thumbnail []byte     `json:"page0thumbnail"`
+			Source         SourceInfo `json:"source"`
+		}
+		if err := json.Unmarshal(blob, &result); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case result.SHA1Hex != fakeSHA1Hex:
+			t.Fatalf("[%s] got %v, want %v", c.about, result.SHA1Hex, fakeSHA1Hex)
+		case result.Status != string(c.status):
+			t.Fatalf("[%s] got %v, want %v", c.about, result.Status, c.status)
+		case result.Page0Thumbnail != nil:
+			t.Fatalf("[%s] got thumbnail in result", c.about)
+		case result.Source.Sidecar == nil || result.Source.Sidecar.CDX != "org,example)/a.pdf":
+			t.Fatalf("[%s] got %v, want sidecar", c.about, result.Source.Sidecar)
+		case result.Source.URLMap == nil || result.Source.URLMap.Source != "crawl-1":
+			t.Fatalf("[%s] got %v, want urlmap entry", c.about, result.Source.URLMap)
+		}
+	}
+}
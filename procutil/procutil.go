@@ -0,0 +1,111 @@
+// Package procutil runs external tools, like poppler utilities, so that they
+// do not outlive their deadline. Each tool runs in its own process group and
+// the whole group is killed on cancellation, as some tools spawn helpers.
+package procutil
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Limits are resource ceilings for external tools, zero values mean no limit.
+type Limits struct {
+	// Memory is the maximum virtual memory in bytes.
+	Memory int64
+	// CPU is the maximum CPU time, rounded up to full seconds.
+	CPU time.Duration
+}
+
+// IsZero returns true, if no limit is set.
+func (l Limits) IsZero() bool { return l.Memory <= 0 && l.CPU <= 0 }
+
+// script returns a shell snippet setting the limits with ulimit and running
+// the tool, given as positional parameters.
+func (l Limits) script() string {
+	var cmds []string
+	if l.Memory > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -v %d", (l.Memory+1023)/1024))
+	}
+	if l.CPU > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -t %d", int64((l.CPU+time.Second-1)/time.Second)))
+	}
+	return strings.Join(append(cmds, `exec "$0" "$@"`), " && ")
+}
+
+var (
+	// WaitDelay is the time to wait for a killed process group to exit and
+	// to close its output, before Wait returns anyway.
+	WaitDelay = 5 * time.Second
+	// StuckAfter is the runtime after which Run reports a tool as stuck,
+	// zero disables the watchdog.
+	StuckAfter = 5 * time.Minute
+	// DefaultLimits are applied to all commands, so pathological input
+	// cannot exhaust the memory of the host. Limits are set with ulimit in a
+	// shell wrapper and are only supported on unix.
+	DefaultLimits Limits
+)
+
+// Command is like exec.CommandContext, but runs the command in its own
+// process group and kills the whole group, when the context is done.
+// DefaultLimits are enforced, if set.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if limits := DefaultLimits; limits.IsZero() || !supportsLimits {
+		cmd = exec.CommandContext(ctx, name, args...)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", append([]string{"-c", limits.script(), name}, args...)...)
+	}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+	cmd.WaitDelay = WaitDelay
+	return cmd
+}
+
+// Run runs a command and logs a warning, if it is still running after
+// StuckAfter and every StuckAfter thereafter, so hanging tools get noticed,
+// even if no deadline is set.
+func Run(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if StuckAfter > 0 {
+		var (
+			started = time.Now()
+			ticker  = time.NewTicker(StuckAfter)
+			done    = make(chan struct{})
+		)
+		defer close(done)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					tool, args := toolArgs(cmd)
+					slog.Warn("external tool still running",
+						"tool", tool,
+						"pid", cmd.Process.Pid,
+						"elapsed", time.Since(started).Round(time.Second).String(),
+						"args", args)
+				}
+			}
+		}()
+	}
+	return cmd.Wait()
+}
+
+// toolArgs returns the name and arguments of the tool run by a command, also
+// if it is wrapped to set limits.
+func toolArgs(cmd *exec.Cmd) (string, []string) {
+	args := cmd.Args
+	if len(args) > 3 && args[1] == "-c" && strings.HasPrefix(args[2], "ulimit") {
+		args = args[3:]
+	}
+	return filepath.Base(args[0]), args[1:]
+}
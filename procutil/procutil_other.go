@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package procutil
+
+import "os/exec"
+
+// supportsLimits is true, if limits can be set with a shell wrapper.
+const supportsLimits = false
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the command, process groups are not supported.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,95 @@
+//go:build linux || darwin
+
+package procutil
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCommandKillsProcessGroup(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	// The shell starts a helper, which would keep running, if only the
+	// shell was killed.
+	cmd := Command(ctx, "sh", "-c", "sleep 30 & echo $! > "+pidfile+"; wait")
+	started := time.Now()
+	if err := Run(cmd); err == nil {
+		t.Fatalf("got nil, want error")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("got %v, want command to return after the deadline", elapsed)
+	}
+	b, err := os.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !exited(pid) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !exited(pid) {
+		t.Fatalf("got helper %d running, want it killed", pid)
+	}
+}
+
+// exited returns true, if a process is gone or a zombie, waiting to be reaped.
+func exited(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(b))
+	return len(fields) > 2 && fields[2] == "Z"
+}
+
+func TestRunWatchdog(t *testing.T) {
+	saved := StuckAfter
+	defer func() { StuckAfter = saved }()
+	StuckAfter = 10 * time.Millisecond
+	if err := Run(Command(context.Background(), "sleep", "0.05")); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+func TestCommandLimits(t *testing.T) {
+	saved := DefaultLimits
+	defer func() { DefaultLimits = saved }()
+	var cases = []struct {
+		about  string
+		limits Limits
+		want   string
+	}{
+		{"no limits", Limits{}, "unlimited unlimited"},
+		{"memory", Limits{Memory: 512 << 20}, "524288 unlimited"},
+		{"memory and cpu", Limits{Memory: 1 << 30, CPU: 1500 * time.Millisecond}, "1048576 2"},
+	}
+	for _, c := range cases {
+		DefaultLimits = c.limits
+		cmd := Command(context.Background(), "sh", "-c", `echo $(ulimit -v) $(ulimit -t)`)
+		b, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if got := strings.TrimSpace(string(b)); got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.want)
+		}
+		if tool, _ := toolArgs(cmd); tool != "sh" {
+			t.Fatalf("[%s] got %v, want %v", c.about, tool, "sh")
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package procutil
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// supportsLimits is true, if limits can be set with a shell wrapper.
+const supportsLimits = true
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group led by the command.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
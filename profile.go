@@ -0,0 +1,120 @@
+package blobproc
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// GROBID modes of a profile, determining the GROBID service a file is sent
+// to, if any.
+const (
+	GrobidFulltext   = "fulltext"   // Full TEI document, the default.
+	GrobidHeader     = "header"     // Header metadata only, much cheaper.
+	GrobidReferences = "references" // Structured citations only.
+	GrobidNone       = "none"       // No GROBID request at all.
+)
+
+var grobidModes = []string{GrobidFulltext, GrobidHeader, GrobidReferences, GrobidNone}
+
+// Profile adjusts processing for an ingestion stream, so one deployment can
+// serve several streams with different cost profiles. Files are assigned to
+// a profile by the spool subdirectory they are in or by the source they were
+// received from, as recorded in the URL map.
+type Profile struct {
+	Name string `yaml:"name"`
+	// Dir matches files in a subdirectory of the spool, e.g. "thesis" for
+	// files like spool/thesis/ab/cd/ef...
+	Dir string `yaml:"dir"`
+	// Sources match the source a file was received from, e.g. as given in
+	// the source header of blobprocd.
+	Sources       []string `yaml:"sources"`
+	SkipThumbnail bool     `yaml:"skip_thumbnail"`
+	// SkipWeblinks does not extract links from the fulltext, so the
+	// weblinks stage stores nothing.
+	SkipWeblinks bool `yaml:"skip_weblinks"`
+	// Grobid is one of fulltext, header, references or none, defaults to
+	// fulltext, or references with references only processing.
+	Grobid string `yaml:"grobid"`
+	// GrobidOptions, if set, replace grobid.options for this profile.
+	GrobidOptions *GrobidOptions `yaml:"grobid_options"`
+}
+
+// Validate checks a profile for a missing name or selector and unknown
+// values.
+func (pr *Profile) Validate() error {
+	switch {
+	case pr.Name == "":
+		return fmt.Errorf("profile name required")
+	case pr.Dir == "" && len(pr.Sources) == 0:
+		return fmt.Errorf("profile %s: dir or sources required", pr.Name)
+	case strings.ContainsAny(pr.Dir, `/\`) || strings.HasPrefix(pr.Dir, "."):
+		return fmt.Errorf("profile %s: dir must be a single directory name, got %q", pr.Name, pr.Dir)
+	case pr.Grobid != "" && !slices.Contains(grobidModes, pr.Grobid):
+		return fmt.Errorf("profile %s: unknown grobid mode %q, use one of %s", pr.Name, pr.Grobid, strings.Join(grobidModes, ", "))
+	}
+	return nil
+}
+
+// profileDir returns the spool subdirectory of a file, i.e. the directory
+// above its shard directories, or the empty string.
+func profileDir(path string) string {
+	if spool.ID(path) == "" {
+		return ""
+	}
+	dir := filepath.Dir(filepath.Dir(filepath.Dir(path)))
+	if dir == "." || dir == string(filepath.Separator) {
+		return ""
+	}
+	return filepath.Base(dir)
+}
+
+// profile returns the profile for a file, nil for default processing. A
+// profile matching the spool subdirectory takes precedence over one matching
+// the source, which requires an URL map.
+func (p *Pipeline) profile(path string) *Profile {
+	if len(p.Profiles) == 0 {
+		return nil
+	}
+	if dir := profileDir(path); dir != "" {
+		for i := range p.Profiles {
+			if p.Profiles[i].Dir == dir {
+				return &p.Profiles[i]
+			}
+		}
+	}
+	id := spool.ID(path)
+	if p.URLMap == nil || len(id) != 40 {
+		return nil
+	}
+	entry, err := p.URLMap.Lookup(id)
+	if err != nil {
+		slog.Warn("urlmap lookup failed", "err", err, "sha1", id)
+		return nil
+	}
+	if entry == nil || entry.Source == "" {
+		return nil
+	}
+	for i := range p.Profiles {
+		if slices.Contains(p.Profiles[i].Sources, entry.Source) {
+			return &p.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// grobidMode returns the GROBID mode for a profile, which may be nil.
+func (p *Pipeline) grobidMode(profile *Profile) string {
+	switch {
+	case profile != nil && profile.Grobid != "":
+		return profile.Grobid
+	case p.ReferencesOnly:
+		return GrobidReferences
+	default:
+		return GrobidFulltext
+	}
+}
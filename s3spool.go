@@ -0,0 +1,116 @@
+package blobproc
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3Spool is a spool in an S3 bucket, e.g. for files uploaded directly to a
+// bucket, so a number of blobproc instances can share a spool without a
+// shared filesystem. Objects are downloaded before they are processed and
+// removed from the bucket afterwards, unless the walker keeps the spool.
+type S3Spool struct {
+	S3     *WrapS3
+	Bucket string
+	Prefix string
+	// Shard and NumShards partition the objects between instances, so each
+	// object is processed by a single instance only. Objects are assigned to
+	// shards by a hash of their key. Zero NumShards means a single instance.
+	Shard     int
+	NumShards int
+}
+
+// ParseS3Spool parses a spool location given as "bucket" or "bucket/prefix".
+func ParseS3Spool(s string) (bucket, prefix string, err error) {
+	bucket, prefix, _ = strings.Cut(strings.TrimPrefix(s, "s3://"), "/")
+	if len(bucket) < 3 {
+		return "", "", fmt.Errorf("invalid S3 spool: %q, want bucket[/prefix]", s)
+	}
+	return bucket, prefix, nil
+}
+
+// ParseShard parses a shard given as "i/n", e.g. "0/4" for the first of four
+// instances.
+func ParseShard(s string) (shard, numShards int, err error) {
+	a, b, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid shard: %q, want i/n", s)
+	}
+	if shard, err = strconv.Atoi(a); err != nil {
+		return 0, 0, fmt.Errorf("invalid shard: %q, want i/n", s)
+	}
+	if numShards, err = strconv.Atoi(b); err != nil {
+		return 0, 0, fmt.Errorf("invalid shard: %q, want i/n", s)
+	}
+	if numShards < 1 || shard < 0 || shard >= numShards {
+		return 0, 0, fmt.Errorf("invalid shard: %q, want 0 <= i < n", s)
+	}
+	return shard, numShards, nil
+}
+
+// owns returns true, if an object belongs to the shard of this instance.
+func (s *S3Spool) owns(key string) bool {
+	if s.NumShards <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32()%uint32(s.NumShards)) == s.Shard
+}
+
+// walk downloads each non-empty object of the shard into dir, keeping the
+// path of the object below the prefix, and calls fn with the downloaded file.
+// Objects, that cannot be downloaded, are skipped.
+func (s *S3Spool) walk(ctx context.Context, dir string, fn func(Payload) error) error {
+	objects := s.S3.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{
+		Prefix:    s.Prefix,
+		Recursive: true,
+	})
+	for obj := range objects {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if strings.HasSuffix(obj.Key, "/") || !s.owns(obj.Key) {
+			continue
+		}
+		if obj.Size == 0 {
+			slog.Warn("skipping empty object", "bucket", s.Bucket, "key", obj.Key)
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(obj.Key, s.Prefix), "/")
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			slog.Warn("skipping object with invalid key", "bucket", s.Bucket, "key", obj.Key)
+			continue
+		}
+		if err := s.S3.Client.FGetObject(ctx, s.Bucket, obj.Key, path, minio.GetObjectOptions{}); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Warn("could not download object, skipping", "err", err, "bucket", s.Bucket, "key", obj.Key)
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := fn(Payload{Path: path, FileInfo: fi, key: obj.Key}); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// remove deletes a processed object from the bucket.
+func (s *S3Spool) remove(ctx context.Context, key string) error {
+	return s.S3.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,218 @@
+package blobproc
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// memS3 is a single bucket in memory, supporting listing, reading and
+// deleting objects.
+type memS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func (s *memS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if key == "" && r.Method == "GET" {
+		type content struct {
+			Key          string
+			Size         int
+			LastModified string
+			ETag         string
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Name     string
+			Prefix   string
+			KeyCount int
+			Contents []content
+		}
+		result.Name, result.Prefix = s.bucket, r.URL.Query().Get("prefix")
+		for k, v := range s.objects {
+			if strings.HasPrefix(k, result.Prefix) {
+				result.Contents = append(result.Contents, content{
+					Key:          k,
+					Size:         len(v),
+					LastModified: "2026-10-12T10:00:00.000Z",
+					ETag:         `"x"`,
+				})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		result.KeyCount = len(result.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+		return
+	}
+	b, ok := s.objects[key]
+	if !ok {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != "HEAD" {
+			fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+		}
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "HEAD", "GET":
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Header().Set("Last-Modified", "Mon, 12 Oct 2026 10:00:00 GMT")
+		w.Header().Set("ETag", `"x"`)
+		if r.Method == "GET" {
+			w.Write(b)
+		}
+	}
+}
+
+// keys returns the stored keys, sorted.
+func (s *memS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestWalkFastS3Spool(t *testing.T) {
+	var cases = []struct {
+		about     string
+		keepSpool bool
+		processed int
+		left      []string
+	}{
+		{"objects removed", false, 3, []string{"other/d.pdf"}},
+		{"objects kept", true, 3, []string{"in/a.pdf", "in/b/b.pdf", "in/c.pdf", "other/d.pdf"}},
+	}
+	pdf, err := os.ReadFile("testdata/pdf/1906.02444.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		mem := &memS3{bucket: "spool", objects: map[string][]byte{
+			"in/a.pdf":    pdf,
+			"in/b/b.pdf":  pdf,
+			"in/c.pdf":    pdf,
+			"other/d.pdf": pdf,
+		}}
+		srv := httptest.NewServer(mem)
+		client, err := minio.New(strings.TrimPrefix(srv.URL, "http://"), &minio.Options{
+			Creds:  credentials.NewStaticV4("key", "secret", ""),
+			Region: "us-east-1",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &WalkFast{
+			NumWorkers: 2,
+			KeepSpool:  c.keepSpool,
+			ScratchDir: filepath.Join(t.TempDir(), "scratch"),
+			Timeout:    time.Minute,
+			S3Spool:    &S3Spool{S3: &WrapS3{Client: client}, Bucket: "spool", Prefix: "in/"},
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc:  fakeGrobidOK,
+				PutFunc:     (&fakeStore{}).put,
+			},
+		}
+		err = w.Run(context.Background())
+		srv.Close()
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if int(w.stats.OK) != c.processed {
+			t.Fatalf("[%s] got %v, want %v", c.about, w.stats.OK, c.processed)
+		}
+		if got := mem.keys(); !slices.Equal(got, c.left) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.left)
+		}
+		if _, err := os.Stat(filepath.Join(w.ScratchDir, "s3spool")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("[%s] got %v, want downloads removed", c.about, err)
+		}
+	}
+}
+
+func TestS3SpoolShards(t *testing.T) {
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("spool/%03d.pdf", i))
+	}
+	const n = 4
+	owners := make(map[string]int)
+	for i := 0; i < n; i++ {
+		shard, numShards, err := ParseShard(fmt.Sprintf("%d/%d", i, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &S3Spool{Shard: shard, NumShards: numShards}
+		var owned int
+		for _, k := range keys {
+			if s.owns(k) {
+				owners[k]++
+				owned++
+			}
+		}
+		if owned == 0 {
+			t.Fatalf("[%d/%d] got no keys", i, n)
+		}
+	}
+	for _, k := range keys {
+		if owners[k] != 1 {
+			t.Fatalf("[%s] got %v owners, want 1", k, owners[k])
+		}
+	}
+	for _, s := range []string{"", "1", "4/4", "-1/4", "a/b", "0/0"} {
+		if _, _, err := ParseShard(s); err == nil {
+			t.Fatalf("[%s] got nil, want error", s)
+		}
+	}
+}
+
+func TestParseS3Spool(t *testing.T) {
+	var cases = []struct {
+		s      string
+		bucket string
+		prefix string
+		err    bool
+	}{
+		{"spool", "spool", "", false},
+		{"spool/in/", "spool", "in/", false},
+		{"s3://spool/in", "spool", "in", false},
+		{"ab", "", "", true},
+	}
+	for _, c := range cases {
+		bucket, prefix, err := ParseS3Spool(c.s)
+		if bucket != c.bucket || prefix != c.prefix || (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, %v, %v, want %v, %v, %v", c.s, bucket, prefix, err, c.bucket, c.prefix, c.err)
+		}
+	}
+}
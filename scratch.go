@@ -0,0 +1,86 @@
+package blobproc
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TempFilePatterns are the glob patterns of temporary files and directories
+// created by blobproc and blobprocd in the default temp directory.
+var TempFilePatterns = []string{"blobproc-*", "blobprocd-*"}
+
+// SweepTempFiles removes files and directories matching any of the given glob
+// patterns in dir, if nothing in them has been modified for at least maxAge.
+// This is meant to run at startup to remove leftovers from crashed processes.
+// If dir is empty, the default directory for temporary files is used. Returns
+// the number of removed entries.
+func SweepTempFiles(dir string, patterns []string, maxAge time.Duration) (int, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	var (
+		n    int
+		errs []error
+	)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return n, err
+		}
+		for _, match := range matches {
+			t, err := newestModTime(match)
+			if err != nil {
+				continue
+			}
+			if time.Since(t) < maxAge {
+				continue
+			}
+			if err := os.RemoveAll(match); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			slog.Debug("removed stale temporary file", "path", match)
+			n++
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// newestModTime returns the most recent modification time of a file or of any
+// entry in a directory tree.
+func newestModTime(path string) (time.Time, error) {
+	var newest time.Time
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+		return nil
+	})
+	return newest, err
+}
+
+// cleanDir removes all entries in dir, but keeps dir itself.
+func cleanDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
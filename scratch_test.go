@@ -0,0 +1,79 @@
+package blobproc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepTempFiles(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		old   = time.Now().Add(-2 * time.Hour)
+		files = []struct {
+			name  string
+			stale bool
+		}{
+			{name: "blobproc-pdf-123.pdf", stale: true},
+			{name: "blobprocd-456", stale: true},
+			{name: "blobprocd-789", stale: false},
+			{name: "other-123", stale: true},
+		}
+	)
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if f.stale {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatalf("chtimes failed: %v", err)
+			}
+		}
+	}
+	// A directory with an old mtime, but with a recently modified file in
+	// it, is still in use.
+	scratch := filepath.Join(dir, "blobproc-scratch-1")
+	if err := os.MkdirAll(filepath.Join(scratch, "worker-00"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(scratch, "worker-00", "x"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := os.Chtimes(scratch, old, old); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+	n, err := SweepTempFiles(dir, TempFilePatterns, time.Hour)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if n != 2 {
+		t.Fatalf("got %v, want 2", n)
+	}
+	for _, name := range []string{"blobprocd-789", "other-123", "blobproc-scratch-1"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestCleanDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.pdf"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := cleanDir(dir); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("dir should still exist: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %d entries, want 0", len(entries))
+	}
+}
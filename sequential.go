@@ -0,0 +1,131 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// Walker processes the files in a spool directory one after another, in walk
+// order. It skips the same files and directories as WalkFast, so files still
+// being written by blobprocd are never touched.
+type Walker struct {
+	Dir       string
+	KeepSpool bool
+	// ScratchDir is passed to the pipeline for temporary files. If it is
+	// located within the spool directory, it is excluded from the walk.
+	ScratchDir string
+	// RejectedDir, Require, FailedDir and Trash work like in WalkFast.
+	RejectedDir string
+	Require     []string
+	FailedDir   string
+	Trash       *Trash
+	// Checkpoint, if set, records progress, so an interrupted walk can be
+	// resumed.
+	Checkpoint *Checkpoint
+	Timeout    time.Duration
+	Pipeline   *Pipeline
+}
+
+// Run processes all files in the spool directory and returns the number of
+// files processed and the number of files processed without errors.
+func (w *Walker) Run(ctx context.Context) (*WalkStats, error) {
+	stats := new(WalkStats)
+	skipDir, err := w.skipDir()
+	if err != nil {
+		return nil, err
+	}
+	if w.Trash != nil {
+		n, err := w.Trash.Purge()
+		if err != nil {
+			slog.Warn("could not purge trash", "err", err, "dir", w.Trash.Dir)
+		}
+		if n > 0 {
+			slog.Info("purged files from trash", "n", n, "retention", w.Trash.Retention)
+		}
+	}
+	err = walkSpool(ctx, w.Dir, false, skipDir, func(payload Payload) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stats.Processed++
+		if w.process(payload) {
+			stats.OK++
+		}
+		return nil
+	})
+	if w.Checkpoint != nil {
+		if cerr := w.Checkpoint.Finish(err == nil); cerr != nil {
+			slog.Warn("could not finish checkpoint", "err", cerr)
+		}
+	}
+	return stats, err
+}
+
+// skipDir returns a function, that skips directories not to be walked:
+// scratch space, rejected and failed files and the trash, if located within
+// the spool, and shards done according to the checkpoint.
+func (w *Walker) skipDir() (func(string) bool, error) {
+	var dirs []string
+	for _, dir := range []string{w.ScratchDir, w.RejectedDir, w.FailedDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, abs)
+	}
+	if w.Trash != nil {
+		abs, err := filepath.Abs(w.Trash.Dir)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, abs)
+	}
+	return spoolSkipDir(w.Checkpoint, dirs...), nil
+}
+
+// process runs the pipeline for a single file and removes it from the spool,
+// unless derivatives are missing, like WalkFast. Returns true, if processing
+// succeeded.
+func (w *Walker) process(payload Payload) bool {
+	path := payload.Path
+	slog.Debug("processing", "path", path)
+	if w.Checkpoint != nil {
+		w.Checkpoint.Add(path)
+		defer w.Checkpoint.Done(path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	pr := w.Pipeline.Process(ctx, payload, w.ScratchDir)
+	d := &disposal{
+		dir:         w.Dir,
+		keepSpool:   w.KeepSpool,
+		rejectedDir: w.RejectedDir,
+		require:     w.Require,
+		failedDir:   w.FailedDir,
+		trash:       w.Trash,
+	}
+	switch {
+	case pr.Rejected != "":
+		slog.Warn("file rejected", "path", path, "reason", pr.Rejected)
+	case pr.OK():
+		slog.Debug("processing finished successfully", "path", path)
+	default:
+		slog.Warn("processing finished with some errors", "path", path, "num_errors", len(pr.Errors))
+	}
+	d.settle(slog.Default(), path, pr)
+	// Like WalkFast, clean scratch space after each file, since extraction
+	// tools may leave files behind.
+	if w.ScratchDir != "" {
+		if err := cleanDir(w.ScratchDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("could not clean scratch directory", "err", err, "dir", w.ScratchDir)
+		}
+	}
+	return pr.Rejected == "" && pr.OK()
+}
@@ -0,0 +1,181 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/fileutils"
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/spool"
+)
+
+func TestWalkerSkipsAux(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		spoolDir = filepath.Join(dir, "spool")
+		path     = filepath.Join(spoolDir, "ab", "cd", "doc.pdf")
+		wip      = filepath.Join(spoolDir, "ab", "cd", "upload"+spool.WIPSuffix)
+		scratch  = filepath.Join(spoolDir, "scratch", "tmp.pdf")
+		rejected = filepath.Join(spoolDir, "rejected", "old.pdf")
+	)
+	for _, dst := range []string{path, wip, scratch, rejected} {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &fakeStore{}
+	w := &Walker{
+		Dir:         spoolDir,
+		ScratchDir:  filepath.Dir(scratch),
+		RejectedDir: filepath.Dir(rejected),
+		Timeout:     time.Minute,
+		Pipeline: &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc:  fakeGrobidOK,
+			PutFunc:     store.put,
+		},
+	}
+	stats, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if stats.Processed != 1 || stats.OK != 1 {
+		t.Fatalf("got %+v, want a single file processed", stats)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want processed file removed from spool", err)
+	}
+	// Uploads in progress and excluded directories are left alone, scratch
+	// space is cleaned after each file.
+	if _, err := os.Stat(scratch); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want scratch directory cleaned", err)
+	}
+	for _, p := range []string{wip, rejected} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("got %v, want %s untouched", err, p)
+		}
+	}
+}
+
+func TestWalkerSidecars(t *testing.T) {
+	var cases = []struct {
+		about     string
+		putErr    error
+		keepSpool bool
+		removed   bool // file and sidecar removed from spool
+	}{
+		{about: "processed", removed: true},
+		{about: "keep spool", keepSpool: true},
+		{about: "derivatives missing", putErr: errors.New("s3 down")},
+	}
+	for _, c := range cases {
+		var (
+			spoolDir = t.TempDir()
+			path     = filepath.Join(spoolDir, "ab", "cd", "doc.pdf")
+		)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(path, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteSidecar(path, &Sidecar{URL: "https://example.org/doc.pdf"}); err != nil {
+			t.Fatal(err)
+		}
+		w := &Walker{
+			Dir:       spoolDir,
+			KeepSpool: c.keepSpool,
+			Timeout:   time.Minute,
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc:  fakeGrobidOK,
+				PutFunc:     (&fakeStore{err: c.putErr}).put,
+			},
+		}
+		stats, err := w.Run(context.Background())
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		// The sidecar is not processed as a file of its own.
+		if stats.Processed != 1 {
+			t.Fatalf("[%s] got %v, want 1", c.about, stats.Processed)
+		}
+		for _, p := range []string{path, SidecarPath(path)} {
+			_, err := os.Stat(p)
+			if got := os.IsNotExist(err); got != c.removed {
+				t.Fatalf("[%s] got %v, want %v for %s", c.about, got, c.removed, p)
+			}
+		}
+	}
+}
+
+func TestWalkerCleansScratch(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		spoolDir = filepath.Join(dir, "spool")
+		scratch  = filepath.Join(dir, "scratch")
+		leftover []string
+	)
+	for _, name := range []string{"1906.02444.pdf", "1906.11632.pdf"} {
+		dst := filepath.Join(spoolDir, "ab", "cd", name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, filepath.Join("testdata/pdf", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		t.Fatal(err)
+	}
+	extract := fakeExtract("success")
+	w := &Walker{
+		Dir:        spoolDir,
+		ScratchDir: scratch,
+		Timeout:    time.Minute,
+		Pipeline: &Pipeline{
+			// Leaves a file behind in scratch space, like a crashing tool.
+			ExtractFunc: func(ctx context.Context, path string, opts *pdfextract.Options) *pdfextract.Result {
+				entries, err := os.ReadDir(opts.TempDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, e := range entries {
+					leftover = append(leftover, e.Name())
+				}
+				f, err := os.CreateTemp(opts.TempDir, "tool-*")
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+				return extract(ctx, path, opts)
+			},
+			GrobidFunc: fakeGrobidOK,
+			PutFunc:    (&fakeStore{}).put,
+		},
+	}
+	stats, err := w.Run(context.Background())
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if stats.Processed != 2 {
+		t.Fatalf("got %v, want %v", stats.Processed, 2)
+	}
+	if len(leftover) != 0 {
+		t.Fatalf("got %v, want empty scratch space for each file", leftover)
+	}
+	entries, err := os.ReadDir(scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %v entries, want empty scratch directory", len(entries))
+	}
+}
@@ -1,29 +1,40 @@
 package blobproc
 
 import (
-	"crypto/sha1"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"os"
-	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/spool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 const (
 	tempFilePattern         = "blobprocd-*"
 	DefaultURLMapHttpHeader = "X-BLOBPROC-URL"
+	DefaultSourceHttpHeader = "X-BLOBPROC-SOURCE"
+	// SizeHttpHeader carries the size of a spooled file in bytes, as
+	// Content-Length describes the response.
+	SizeHttpHeader = "X-BLOBPROC-SIZE"
 )
 
-var errShortName = errors.New("short name")
+var errShortName = spool.ErrShortName
 
 // WebSpoolService saves web payload to a configured directory. TODO: add limit
 // in size (e.g. 80% of disk or absolute value)
@@ -38,8 +49,227 @@ type WebSpoolService struct {
 	// to provide a simple interface that can be easily fulfilled by different
 	// backend.
 	URLMap *URLMap
-	// The HTTP header to look for a URL associated with a pdf blob payload.
+	// The HTTP header to look for a URL associated with a pdf blob payload,
+	// DefaultURLMapHttpHeader if empty.
 	URLMapHttpHeader string
+	// The HTTP header identifying the source of a payload, e.g. a crawler
+	// instance. If the header is missing, the client IP is used.
+	SourceHttpHeader string
+	// Quota is the maximum number of bytes accepted per source and day,
+	// zero means no limit. Requires an URLMap to keep track of usage.
+	Quota int64
+	// MaxBacklog, if positive, turns away uploads with HTTP 429, while the
+	// GROBID backlog reported by blobproc exceeds this number of files.
+	// Requires an URLMap shared with blobproc.
+	MaxBacklog int64
+	// MinFreeSpace is the number of bytes, that must remain free on the
+	// filesystem of the spool, and of the temporary directory for
+	// ProcessHandler, after accepting a file. Uploads are rejected with HTTP
+	// 507 otherwise, zero disables the check.
+	MinFreeSpace int64
+	// IsProcessed, if set, is consulted for each upload. Files that have
+	// already been processed are not spooled again.
+	IsProcessed func(ctx context.Context, sha1hex string) (bool, error)
+	// Derivatives, if set, lists the stored derivatives of a file, for the
+	// status handler, usually WrapS3.ListForSHA1.
+	Derivatives func(ctx context.Context, sha1hex string) ([]DerivativeInfo, error)
+	// SyncMaxFileSize enables synchronous processing with ProcessHandler for
+	// files up to this size in bytes, zero disables it.
+	SyncMaxFileSize int64
+	// OpenDerivative, if set, opens stored derivatives for DerivativeHandler,
+	// usually WrapS3.OpenDerivative.
+	OpenDerivative func(ctx context.Context, sha1hex, kind string) (*DerivativeReader, error)
+	// ExtractFunc replaces local extraction in ProcessHandler, e.g. in tests.
+	ExtractFunc func(ctx context.Context, blob []byte, opts *pdfextract.Options) *pdfextract.Result
+	// Dashboard, if set, records recent uploads.
+	Dashboard *Dashboard
+
+	inflight digestLocks // serializes concurrent uploads of the same file
+}
+
+// digestLocks are locks per SHA1, so concurrent uploads of the same content
+// do not race on checking for and moving the file into the spool. The second
+// upload waits and then finds the file in the spool. The zero value is ready
+// to use.
+type digestLocks struct {
+	mu    sync.Mutex
+	locks map[string]*digestLock
+}
+
+type digestLock struct {
+	mu      sync.Mutex
+	waiters int // holders and waiters, the lock is removed at zero
+}
+
+// lock locks a digest and returns a function to unlock it.
+func (l *digestLocks) lock(digest string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*digestLock)
+	}
+	dl, ok := l.locks[digest]
+	if !ok {
+		dl = &digestLock{}
+		l.locks[digest] = dl
+	}
+	dl.waiters++
+	l.mu.Unlock()
+	dl.mu.Lock()
+	return func() {
+		dl.mu.Unlock()
+		l.mu.Lock()
+		if dl.waiters--; dl.waiters == 0 {
+			delete(l.locks, digest)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// blobResponse is returned for uploads that are not spooled.
+type blobResponse struct {
+	Status  string `json:"status"`
+	SHA1Hex string `json:"sha1hex"`
+}
+
+// ProcessedInS3 returns a function, that reports a file as processed, if its
+// GROBID TEI-XML is stored in S3.
+func ProcessedInS3(wrap *WrapS3) func(ctx context.Context, sha1hex string) (bool, error) {
+	return func(ctx context.Context, sha1hex string) (bool, error) {
+		d, err := LookupDerivative("tei")
+		if err != nil {
+			return false, err
+		}
+		return wrap.Exists(ctx, d.Request(sha1hex, nil))
+	}
+}
+
+// source returns the source of a request, taken from the configured header
+// or the client IP.
+func (svc *WebSpoolService) source(r *http.Request) string {
+	if svc.SourceHttpHeader != "" {
+		if v := strings.TrimSpace(r.Header.Get(svc.SourceHttpHeader)); v != "" {
+			return v
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// overQuota returns true, if accepting a number of bytes from a source would
+// exceed the daily quota.
+func (svc *WebSpoolService) overQuota(source, day string, n int64) (bool, error) {
+	if svc.Quota == 0 || svc.URLMap == nil {
+		return false, nil
+	}
+	used, err := svc.URLMap.Usage(source, day)
+	if err != nil {
+		return false, err
+	}
+	return used+n > svc.Quota, nil
+}
+
+// secondsUntilTomorrow returns the number of seconds until the next day in UTC
+// starts, when quotas are reset.
+func secondsUntilTomorrow(t time.Time) int {
+	t = t.UTC()
+	tomorrow := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	return int(tomorrow.Sub(t).Seconds()) + 1
+}
+
+// backlogMaxAge is the age, after which a reported backlog is ignored, e.g.
+// because blobproc is not running.
+const backlogMaxAge = time.Minute
+
+// backlogRetryAfter is the number of seconds clients are asked to wait, if
+// the backlog is too large.
+const backlogRetryAfter = 30
+
+// backlog returns the GROBID backlog reported by blobproc, nil if there is
+// none or the report is too old.
+func (svc *WebSpoolService) backlog(now time.Time) (*Gauge, error) {
+	if svc.URLMap == nil {
+		return nil, nil
+	}
+	g, err := svc.URLMap.Gauge(GaugeGrobidBacklog)
+	if err != nil || g == nil {
+		return nil, err
+	}
+	if now.Sub(g.Updated) > backlogMaxAge {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// overBacklog returns true, if the GROBID backlog exceeds MaxBacklog.
+func (svc *WebSpoolService) overBacklog(now time.Time) (bool, error) {
+	if svc.MaxBacklog <= 0 {
+		return false, nil
+	}
+	g, err := svc.backlog(now)
+	if err != nil || g == nil {
+		return false, err
+	}
+	return g.Value > svc.MaxBacklog, nil
+}
+
+// diskFullRetryAfter is the number of seconds clients are asked to wait, if
+// there is not enough free disk space.
+const diskFullRetryAfter = 60
+
+// diskUsageFunc determines free disk space, replaced in tests.
+var diskUsageFunc = diskUsage
+
+// lowDiskSpace returns true, if storing n more bytes in dir would leave less
+// than MinFreeSpace bytes free. If free space cannot be determined, the check
+// is skipped.
+func (svc *WebSpoolService) lowDiskSpace(dir string, n int64) bool {
+	if svc.MinFreeSpace <= 0 {
+		return false
+	}
+	free, _, err := diskUsageFunc(dir)
+	if err != nil {
+		slog.Warn("could not determine free disk space", "err", err, "dir", dir)
+		return false
+	}
+	return int64(free)-max(n, 0) < svc.MinFreeSpace
+}
+
+// rejectLowDiskSpace responds with HTTP 507 and a Retry-After header.
+func rejectLowDiskSpace(w http.ResponseWriter, dir string) {
+	slog.Warn("low disk space, rejecting upload", "dir", dir)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", diskFullRetryAfter))
+	w.WriteHeader(http.StatusInsufficientStorage)
+}
+
+// backlogResponse reports the GROBID backlog.
+type backlogResponse struct {
+	Backlog    int64     `json:"backlog"`
+	Updated    time.Time `json:"updated"`
+	MaxBacklog int64     `json:"max_backlog,omitempty"`
+}
+
+// BacklogHandler returns the number of files waiting for or being processed
+// by GROBID, as last reported by blobproc. Returns HTTP 404, if there is no
+// recent report.
+func (svc *WebSpoolService) BacklogHandler(w http.ResponseWriter, r *http.Request) {
+	g, err := svc.backlog(time.Now())
+	if err != nil {
+		slog.Error("could not get backlog", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if g == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := backlogResponse{Backlog: g.Value, Updated: g.Updated, MaxBacklog: svc.MaxBacklog}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Warn("could not write backlog", "err", err)
+	}
 }
 
 // spoolListEntry collects basic information about a spooled file.
@@ -50,47 +280,21 @@ type spoolListEntry struct {
 	URL     string `json:"url"`
 }
 
+// spool returns the content addressed store for the spool directory.
+func (svc *WebSpoolService) spool() *spool.Dir {
+	return &spool.Dir{Root: svc.Dir, TempPattern: tempFilePattern}
+}
+
 // shardedPath takes a filename (without path) and returns the full path
 // including shards. If create is true, also create subdirectories, if
 // necessary.
 func (svc *WebSpoolService) shardedPath(filename string, create bool) (string, error) {
-	if len(filename) < 8 {
-		return "", errShortName
-	}
-	var (
-		s0, s1 = filename[0:2], filename[2:4]
-		dstDir = path.Join(svc.Dir, s0, s1)
-	)
-	if create {
-		if _, err := os.Stat(dstDir); os.IsNotExist(err) {
-			if err := os.MkdirAll(dstDir, 0755); err != nil {
-				return "", err
-			}
-		}
-	}
-	return path.Join(dstDir, filename[4:]), nil
+	return svc.spool().Path(filename, create)
 }
 
 // shardedPathExists returns true, if the sharded path for a given filename exists.
 func (svc *WebSpoolService) shardedPathExists(filename string) (bool, error) {
-	dst, err := svc.shardedPath(filename, false)
-	if err != nil {
-		return false, err
-	}
-	if _, err := os.Stat(dst); err == nil {
-		return true, nil
-	}
-	return false, nil
-}
-
-// shardedPathToIdentifier return the SHA1, given a sharded path.
-func shardedPathToIdentifier(path string) string {
-	parts := strings.Split(path, "/")
-	if len(parts) < 3 {
-		return ""
-	}
-	n := len(parts)
-	return parts[n-3] + parts[n-2] + parts[n-1]
+	return svc.spool().Exists(filename)
 }
 
 // SpoolListHandler returns a single, long jsonlines response with information
@@ -100,19 +304,7 @@ func (svc *WebSpoolService) SpoolListHandler(w http.ResponseWriter, r *http.Requ
 		entry spoolListEntry
 		enc   = json.NewEncoder(w)
 	)
-	err := filepath.Walk(svc.Dir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		id := shardedPathToIdentifier(path)
-		if len(id) == 0 {
-			slog.Error("zero length id")
-			w.WriteHeader(http.StatusInternalServerError)
-			return fmt.Errorf("zero length id")
-		}
+	err := svc.spool().Walk(r.Context(), func(id string, info fs.FileInfo) error {
 		entry = spoolListEntry{
 			Name:    id,
 			Size:    info.Size(),
@@ -133,123 +325,555 @@ func (svc *WebSpoolService) SpoolListHandler(w http.ResponseWriter, r *http.Requ
 }
 
 // SpoolStatusHandler returns HTTP 200, if a given file is in the spool
-// directory and HTTP 404, if the file is not in the spool directory.
+// directory and HTTP 404, if the file is not in the spool directory. The SHA1
+// is sent as ETag, along with modification time and size of the file, so
+// clients can check a file with HEAD requests and If-None-Match.
 func (svc *WebSpoolService) SpoolStatusHandler(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(mux.Vars(r)["id"])
+	if !isSHA1Hex(digest) {
+		slog.Debug("invalid id", "id", digest)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fi, err := svc.spool().Stat(digest)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("could not stat spooled file", "err", err, "sha1", digest)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	etag := `"` + digest + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set(SizeHttpHeader, strconv.FormatInt(fi.Size(), 10))
+	if match := r.Header.Get("If-None-Match"); match == "*" || strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// SpoolContentHandler serves the content of a spooled file. Range requests
+// and conditional requests with If-None-Match, the SHA1 being the ETag, or
+// If-Modified-Since are supported.
+func (svc *WebSpoolService) SpoolContentHandler(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(mux.Vars(r)["id"])
+	if !isSHA1Hex(digest) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f, err := svc.spool().Open(digest)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("could not open spooled file", "err", err, "sha1", digest)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// DerivativeHandler serves a stored derivative of a file, given its kind and
+// the SHA1 of the file, with support for range and conditional requests. The
+// ETag is the one of the stored object, so it changes on reprocessing.
+func (svc *WebSpoolService) DerivativeHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		vars   = mux.Vars(r)
-		digest = vars["id"]
+		digest = strings.ToLower(vars["id"])
+		kind   = vars["kind"]
 	)
-	if len(digest) != 40 {
-		slog.Debug("invalid id", "id", digest)
+	if !isSHA1Hex(digest) {
 		w.WriteHeader(http.StatusBadRequest)
-	} else {
-		ok, err := svc.shardedPathExists(digest)
-		switch {
-		case err != nil:
-			w.WriteHeader(http.StatusInternalServerError)
-		case ok:
-			w.WriteHeader(http.StatusOK)
-		default:
-			w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if svc.OpenDerivative == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rd, err := svc.OpenDerivative(r.Context(), digest, kind)
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, ErrUnknownDerivative):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("could not open derivative", "err", err, "sha1", digest, "kind", kind)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer rd.Close()
+	if rd.ETag != "" {
+		w.Header().Set("ETag", `"`+strings.Trim(rd.ETag, `"`)+`"`)
+	}
+	if rd.ContentType != "" {
+		w.Header().Set("Content-Type", rd.ContentType)
+	}
+	http.ServeContent(w, r, "", rd.Info.LastModified, rd)
+}
+
+// statusResponse describes what is known about a file.
+type statusResponse struct {
+	SHA1Hex     string           `json:"sha1hex"`
+	State       string           `json:"state"`
+	Reason      string           `json:"reason,omitempty"`
+	Updated     string           `json:"updated,omitempty"`
+	Spooled     bool             `json:"spooled"`
+	Derivatives []DerivativeInfo `json:"derivatives"`
+}
+
+// states returns the recorded processing states of files, if there is an
+// URL map.
+func (svc *WebSpoolService) states(digests []string) (map[string]*ProcessingState, error) {
+	if svc.URLMap == nil {
+		return nil, nil
+	}
+	return svc.URLMap.States(digests)
+}
+
+// status combines the spool, the recorded processing state, which may be nil,
+// and the derivatives in S3, if available and requested, into the status of
+// a file. The state is "unknown", if nothing is known about the file.
+func (svc *WebSpoolService) status(ctx context.Context, digest string, st *ProcessingState, derivatives bool) (*statusResponse, error) {
+	var (
+		resp = &statusResponse{SHA1Hex: digest}
+		err  error
+	)
+	if resp.Spooled, err = svc.shardedPathExists(digest); err != nil {
+		return nil, err
+	}
+	if st != nil {
+		resp.State, resp.Reason, resp.Updated = st.State, st.Reason, st.Updated
+	}
+	if derivatives && svc.Derivatives != nil {
+		if resp.Derivatives, err = svc.Derivatives(ctx, digest); err != nil {
+			return nil, err
 		}
 	}
+	switch {
+	case resp.State != "":
+	case resp.Spooled:
+		resp.State = StateSpooled
+	case len(resp.Derivatives) > 0:
+		resp.State = StateDone
+	default:
+		resp.State = "unknown"
+	}
+	return resp, nil
 }
 
-// BlobHandler receives binary blobs and saves them on disk. This handler
-// returns as soon as the file has been written into the spool directory of the
-// service, using a sharded SHA1 as path.
-func (svc *WebSpoolService) BlobHandler(w http.ResponseWriter, r *http.Request) {
-	started := time.Now()
-	tmpf, err := os.CreateTemp("", tempFilePattern)
+// StatusHandler returns the status of a file as JSON: whether it is spooled,
+// being processed, done or failed, with a reason, and the derivatives
+// stored, if S3 is configured. Returns HTTP 404, if nothing is known about the
+// file.
+func (svc *WebSpoolService) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(mux.Vars(r)["id"])
+	if !isSHA1Hex(digest) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	states, err := svc.states([]string{digest})
 	if err != nil {
-		slog.Error("failed to create temporary file", "err", err)
+		slog.Error("could not get processing state", "err", err, "sha1", digest)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	defer os.Remove(tmpf.Name())
-	var (
-		h  = sha1.New()
-		mw = io.MultiWriter(h, tmpf)
-	)
-	n, err := io.Copy(mw, r.Body)
+	resp, err := svc.status(r.Context(), digest, states[digest], true)
 	if err != nil {
-		slog.Error("failed to drain response body", "err", err)
+		slog.Error("could not get status", "err", err, "sha1", digest)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if err := tmpf.Close(); err != nil {
-		slog.Error("failed to close temporary file", "err", err)
+	w.Header().Set("Content-Type", "application/json")
+	if resp.State == "unknown" {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Warn("could not write status", "err", err)
+	}
+}
+
+// ProcessHandler runs local extraction on the request body and returns the
+// result as JSON, including the status of the extraction, without spooling
+// the file or storing any derivatives. Meant for small files, interactive
+// tools and tests; files larger than SyncMaxFileSize are rejected with HTTP
+// 413, files that would exhaust the temporary directory with HTTP 507.
+func (svc *WebSpoolService) ProcessHandler(w http.ResponseWriter, r *http.Request) {
+	if svc.SyncMaxFileSize <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.ContentLength > svc.SyncMaxFileSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if dir := os.TempDir(); svc.lowDiskSpace(dir, r.ContentLength) {
+		rejectLowDiskSpace(w, dir)
+		return
+	}
+	blob, err := io.ReadAll(io.LimitReader(r.Body, svc.SyncMaxFileSize+1))
+	switch {
+	case err != nil:
+		slog.Error("failed to read request body", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
+	case int64(len(blob)) > svc.SyncMaxFileSize:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
 	}
-	if n != r.ContentLength {
-		slog.Error("content length mismatch", "n", n, "length", r.ContentLength)
+	tempDir, err := os.MkdirTemp("", tempFilePattern)
+	if err != nil {
+		slog.Error("failed to create temporary directory", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer os.RemoveAll(tempDir)
+	extract := svc.ExtractFunc
+	if extract == nil {
+		extract = pdfextract.ProcessBlob
+	}
+	ctx, span := startSpan(r.Context(), "ProcessHandler", attribute.Int("size", len(blob)))
+	result := extract(ctx, blob, &pdfextract.Options{
+		Dim:        pdfextract.Dim{W: 180, H: 300},
+		ThumbType:  "JPEG",
+		TempDir:    tempDir,
+		Provenance: Provenance(),
+	})
+	endSpan(span, result.Err)
+	slog.Debug("processed synchronously", "sha1", result.SHA1Hex, "status", result.Status)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Warn("could not write result", "err", err)
+	}
+}
+
+// MaxStatusBatch is the maximum number of SHA1 accepted in a single batch
+// status request.
+const MaxStatusBatch = 10000
+
+// BatchStatusHandler accepts a JSON array of SHA1 and returns a JSON array
+// with the status of each file, in request order. Derivatives in S3 are only
+// listed with "derivatives=true" as query parameter, as this requires a
+// number of S3 requests per file. Invalid SHA1 get an "invalid" state.
+func (svc *WebSpoolService) BatchStatusHandler(w http.ResponseWriter, r *http.Request) {
 	var (
-		digest   = fmt.Sprintf("%x", h.Sum(nil))
-		spoolURL = fmt.Sprintf("http://%v/spool/%v", svc.ListenAddr, digest)
+		digests []string
+		body    = http.MaxBytesReader(w, r.Body, MaxStatusBatch*64)
 	)
-	dst, err := svc.shardedPath(digest, true)
-	if err != nil {
-		slog.Error("could not determine sharded path", "err", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := json.NewDecoder(body).Decode(&digests); err != nil {
+		slog.Debug("invalid batch status request", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	ok, err := svc.shardedPathExists(digest)
+	if len(digests) > MaxStatusBatch {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	for i, digest := range digests {
+		digests[i] = strings.ToLower(digest)
+	}
+	states, err := svc.states(digests)
 	if err != nil {
-		slog.Error("could not determine sharded path", "err", err)
+		slog.Error("could not get processing states", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if ok {
-		f, err := os.Open(dst)
-		if err != nil {
-			slog.Error("already uploaded, but file not readable", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	var (
+		derivatives = r.URL.Query().Get("derivatives") == "true"
+		result      = make([]*statusResponse, 0, len(digests))
+	)
+	for _, digest := range digests {
+		if !isSHA1Hex(digest) {
+			result = append(result, &statusResponse{SHA1Hex: digest, State: "invalid"})
+			continue
 		}
-		defer f.Close()
-		fi, err := f.Stat()
+		resp, err := svc.status(r.Context(), digest, states[digest], derivatives)
 		if err != nil {
-			slog.Error("failed to stat file", "err", err)
+			slog.Error("could not get status", "err", err, "sha1", digest)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if r.ContentLength == fi.Size() {
-			slog.Debug("found existing file in spool dir, skipping", "url", spoolURL)
-			w.Header().Add("Location", spoolURL)
-			w.WriteHeader(http.StatusAccepted)
+		result = append(result, resp)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Warn("could not write status", "err", err)
+	}
+}
+
+// BlobHandler receives binary blobs and saves them on disk. This handler
+// returns as soon as the file has been written into the spool directory of the
+// service, using a sharded SHA1 as path.
+func (svc *WebSpoolService) BlobHandler(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := startSpan(ctx, "BlobHandler", attribute.Int64("content_length", r.ContentLength))
+	defer span.End()
+	var (
+		source = svc.source(r)
+		day    = started.UTC().Format("2006-01-02")
+	)
+	over, err := svc.overQuota(source, day, r.ContentLength)
+	if err != nil {
+		slog.Error("could not check quota", "err", err, "source", source)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if over {
+		slog.Warn("source exceeded quota", "source", source, "quota", svc.Quota)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", secondsUntilTomorrow(started)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	over, err = svc.overBacklog(started)
+	if err != nil {
+		// Not fatal, accept the file.
+		slog.Warn("could not check backlog", "err", err)
+	}
+	if over {
+		slog.Warn("grobid backlog too large, rejecting upload", "max_backlog", svc.MaxBacklog)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", backlogRetryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if svc.lowDiskSpace(svc.Dir, r.ContentLength) {
+		rejectLowDiskSpace(w, svc.Dir)
+		return
+	}
+	sw, err := svc.spool().Create()
+	if err != nil {
+		slog.Error("failed to create temporary file", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer sw.Abort()
+	n, sidecar, err := receive(r, sw)
+	switch {
+	case errors.Is(err, errBadUpload):
+		slog.Warn("invalid upload", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("failed to drain response body", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Account for all bytes received, even if the file is already spooled.
+	if svc.URLMap != nil {
+		if err := svc.URLMap.AddUsage(source, day, n); err != nil {
+			slog.Warn("could not update usage", "err", err, "source", source)
+		}
+	}
+	var (
+		digest   = sw.SHA1Hex()
+		spoolURL = fmt.Sprintf("http://%v/spool/%v", svc.ListenAddr, digest)
+	)
+	span.SetAttributes(attribute.String("sha1", digest))
+	// Echo the SHA1 with every response, so clients can verify the upload.
+	w.Header().Set("ETag", `"`+digest+`"`)
+	// Hold the lock for the digest, until the file and its state are
+	// recorded, so a concurrent upload of the same file gets the response
+	// for an existing file.
+	unlock := svc.inflight.lock(digest)
+	defer unlock()
+	// Record where the file comes from in any case, also for files already
+	// spooled or processed, which may have been crawled from another URL.
+	curi := svc.recordURL(r, digest, source, sidecar)
+	if svc.IsProcessed != nil {
+		processed, err := svc.IsProcessed(ctx, digest)
+		switch {
+		case err != nil:
+			// Not fatal, we just spool the file again.
+			slog.Warn("could not check processing state", "err", err, "sha1", digest)
+		case processed:
+			slog.Debug("already processed, not spooling", "sha1", digest)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(w).Encode(blobResponse{Status: "already-processed", SHA1Hex: digest}); err != nil {
+				slog.Warn("could not write response", "err", err)
+			}
 			return
 		}
-		slog.Debug("warning: found existing file, but size differ, overwriting")
 	}
-	if err := os.Rename(tmpf.Name(), dst); err != nil {
-		slog.Error("failed to rename", "err", err)
+	existed, err := sw.Commit("")
+	if err != nil {
+		slog.Error("failed to move file into spool", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// Optional: persist the URL/SHA1 pair in an sqlite3 database. If no header
-	// is found or no URLMap database initialized, nothing will happen.
-	curi := r.Header.Get("X-BLOBPROC-URL")
+	// Record all checksums, so processing need not compute them again.
+	if svc.URLMap != nil {
+		c := Checksums{SHA1: digest, MD5: sw.MD5Hex(), SHA256: sw.SHA256Hex(), Size: n}
+		if err := svc.URLMap.SetChecksums(c); err != nil {
+			slog.Warn("could not record checksums", "err", err, "sha1", digest)
+		}
+	}
+	dst, _ := svc.shardedPath(digest, false)
+	if sidecar != nil {
+		if err := WriteSidecar(dst, sidecar); err != nil {
+			slog.Warn("could not write sidecar", "err", err, "sha1", digest)
+		}
+	}
+	if existed {
+		slog.Debug("found existing file in spool dir, skipping", "url", spoolURL)
+		w.Header().Add("Location", spoolURL)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if svc.URLMap != nil {
+		if err := svc.URLMap.SetState(digest, StateSpooled, ""); err != nil {
+			slog.Warn("could not record processing state", "err", err, "sha1", digest)
+		}
+	}
+	slog.Debug("spooled file", "file", dst, "url", spoolURL, "t", time.Since(started), "curi", curi)
+	if svc.Dashboard != nil {
+		svc.Dashboard.RecordUpload(UploadEvent{
+			Time:    time.Now(),
+			SHA1Hex: digest,
+			Size:    n,
+			Source:  source,
+		})
+	}
+	w.Header().Add("Location", spoolURL)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// recordURL persists the URL a file has been crawled from, along with its
+// SHA1 and source, in the URL map, if there is one, and returns the URL. The
+// URL is taken from the request headers or else from the sidecar, since the
+// sidecar is not kept for files, that are not spooled again.
+func (svc *WebSpoolService) recordURL(r *http.Request, digest, source string, sidecar *Sidecar) string {
+	header := svc.URLMapHttpHeader
+	if header == "" {
+		header = DefaultURLMapHttpHeader
+	}
+	curi := r.Header.Get(header)
 	if curi == "" {
 		// TODO: Heritrix is the only client that uses this header; move
 		// heritrix towards the new header.
 		curi = r.Header.Get("X-Heritrix-CURI")
 	}
-	if curi != "" {
-		slog.Debug("spooled file", "file", dst, "url", spoolURL, "t", time.Since(started), "curi", curi)
-		// If we have a URLMap configured, try to record the url, sha1 pair.
-		if svc.URLMap != nil {
-			err := svc.URLMap.Insert(curi, digest)
-			if err != nil {
-				slog.Warn("could not update urlmap", "err", err, "url", curi, "sha1", digest)
+	if curi == "" && sidecar != nil {
+		curi = sidecar.URL
+	}
+	if curi == "" || svc.URLMap == nil {
+		return curi
+	}
+	if err := svc.URLMap.InsertSource(curi, digest, source); err != nil {
+		slog.Warn("could not update urlmap", "err", err, "url", curi, "sha1", digest)
+	}
+	return curi
+}
+
+// errBadUpload is returned for malformed uploads.
+var errBadUpload = errors.New("bad upload")
+
+// receive copies an uploaded file to w and returns its size, along with a
+// metadata sidecar, if any. The file is either the request body or, for
+// multipart uploads, the part named "file", with an optional sidecar in a
+// part named "meta".
+func receive(r *http.Request, w io.Writer) (int64, *Sidecar, error) {
+	if mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediatype != "multipart/form-data" {
+		n, err := io.Copy(w, r.Body)
+		if err != nil {
+			return n, nil, err
+		}
+		if n != r.ContentLength {
+			return n, nil, fmt.Errorf("content length mismatch: got %d, want %d", n, r.ContentLength)
+		}
+		return n, nil, nil
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errBadUpload, err)
+	}
+	var (
+		n       int64
+		sidecar *Sidecar
+		found   bool
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, nil, fmt.Errorf("%w: %v", errBadUpload, err)
+		}
+		switch part.FormName() {
+		case "file":
+			if found {
+				return n, nil, fmt.Errorf("%w: more than one file", errBadUpload)
+			}
+			found = true
+			if n, err = io.Copy(w, part); err != nil {
+				return n, nil, err
+			}
+		case "meta":
+			if sidecar, err = ParseSidecar(part); err != nil {
+				return n, nil, fmt.Errorf("%w: %v", errBadUpload, err)
 			}
 		}
-	} else {
-		slog.Debug("spooled file", "file", dst, "url", spoolURL, "t", time.Since(started))
 	}
-	w.Header().Add("Location", spoolURL)
-	w.WriteHeader(http.StatusAccepted)
+	if !found {
+		return n, nil, fmt.Errorf("%w: missing file part", errBadUpload)
+	}
+	return n, sidecar, nil
+}
+
+// SpoolMetaHandler stores a metadata sidecar for a spooled file, replacing an
+// existing one. Returns HTTP 404, if the file is not in the spool (anymore).
+func (svc *WebSpoolService) SpoolMetaHandler(w http.ResponseWriter, r *http.Request) {
+	digest := strings.ToLower(mux.Vars(r)["id"])
+	if !isSHA1Hex(digest) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sidecar, err := ParseSidecar(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := svc.shardedPath(digest, false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	unlock := svc.inflight.lock(digest)
+	defer unlock()
+	_, err = os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case err != nil:
+		slog.Error("could not stat spooled file", "err", err, "sha1", digest)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := WriteSidecar(path, sidecar); err != nil {
+		slog.Error("could not write sidecar", "err", err, "sha1", digest)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The file may have been processed meanwhile, do not leave the sidecar
+	// behind.
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := removeSidecar(path); err != nil {
+			slog.Warn("could not remove sidecar", "err", err, "sha1", digest)
+		}
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -1,9 +1,27 @@
 package blobproc
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/miku/blobproc/pdfextract"
 )
 
 func TestShardedPath(t *testing.T) {
@@ -68,3 +86,741 @@ func TestShardedPath(t *testing.T) {
 		}
 	}
 }
+
+func TestBlobHandlerQuota(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		u   = &URLMap{Path: filepath.Join(dir, "urlmap.db")}
+	)
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	svc := &WebSpoolService{
+		Dir:              filepath.Join(dir, "spool"),
+		URLMap:           u,
+		SourceHttpHeader: DefaultSourceHttpHeader,
+		Quota:            10,
+	}
+	var cases = []struct {
+		about  string
+		source string
+		body   string
+		status int
+	}{
+		{"within quota", "a", "12345", http.StatusAccepted},
+		{"still within quota", "a", "67890", http.StatusAccepted},
+		{"quota exceeded", "a", "x", http.StatusTooManyRequests},
+		{"other source", "b", "1234567890", http.StatusAccepted},
+		{"client ip", "", "123456", http.StatusAccepted},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/spool", strings.NewReader(c.body))
+		if c.source != "" {
+			req.Header.Set(DefaultSourceHttpHeader, c.source)
+		}
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("[%s] got no Retry-After header", c.about)
+		}
+	}
+	day := time.Now().UTC().Format("2006-01-02")
+	used, err := u.Usage("a", day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 10 {
+		t.Fatalf("got %v, want %v", used, 10)
+	}
+}
+
+func TestSecondsUntilTomorrow(t *testing.T) {
+	var cases = []struct {
+		t      time.Time
+		result int
+	}{
+		{time.Date(2024, 8, 1, 23, 59, 0, 0, time.UTC), 61},
+		{time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC), 86401},
+	}
+	for _, c := range cases {
+		if result := secondsUntilTomorrow(c.t); result != c.result {
+			t.Fatalf("[%v] got %v, want %v", c.t, result, c.result)
+		}
+	}
+}
+
+func TestBlobHandlerDedupe(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	dir := t.TempDir()
+	svc := &WebSpoolService{
+		Dir:    dir,
+		URLMap: urlMap,
+		IsProcessed: func(_ context.Context, sha1hex string) (bool, error) {
+			// SHA1 of "seen"
+			return sha1hex == "229670d592315de8609bb627afda71beeb667181", nil
+		},
+	}
+	var cases = []struct {
+		about  string
+		body   string
+		url    string
+		status int
+		result string
+	}{
+		{"new file", "new", "https://example.org/new.pdf", http.StatusAccepted, ""},
+		{"new file, spooled already", "new", "https://mirror.example.org/new.pdf", http.StatusAccepted, ""},
+		{"already processed", "seen", "https://example.org/seen.pdf", http.StatusOK, "already-processed"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/spool", strings.NewReader(c.body))
+		req.Header.Set("X-BLOBPROC-URL", c.url)
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		var resp blobResponse
+		if c.result != "" {
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if resp.Status != c.result {
+			t.Fatalf("[%s] got %v, want %v", c.about, resp.Status, c.result)
+		}
+		// The URL is recorded, even if the file is not spooled again.
+		entry, err := urlMap.Lookup(fmt.Sprintf("%x", sha1.Sum([]byte(c.body))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil || entry.URL != c.url {
+			t.Fatalf("[%s] got %v, want %v", c.about, entry, c.url)
+		}
+	}
+	ok, err := svc.shardedPathExists("229670d592315de8609bb627afda71beeb667181")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("got %v, want processed file not spooled", ok)
+	}
+}
+
+func TestBlobHandlerURLMapHeader(t *testing.T) {
+	var cases = []struct {
+		about      string
+		configured string // URLMapHttpHeader
+		header     string // header sent
+		url        string // url recorded
+	}{
+		{"default", "", DefaultURLMapHttpHeader, "https://example.org/a.pdf"},
+		{"configured", "X-Crawl-URL", "X-Crawl-URL", "https://example.org/a.pdf"},
+		{"configured, default sent", "X-Crawl-URL", DefaultURLMapHttpHeader, ""},
+	}
+	for _, c := range cases {
+		urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+		if err := urlMap.EnsureDB(); err != nil {
+			t.Fatal(err)
+		}
+		svc := &WebSpoolService{
+			Dir:              t.TempDir(),
+			URLMap:           urlMap,
+			URLMapHttpHeader: c.configured,
+		}
+		req := httptest.NewRequest("POST", "/spool", strings.NewReader("hello"))
+		req.Header.Set(c.header, "https://example.org/a.pdf")
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, http.StatusAccepted)
+		}
+		entry, err := urlMap.Lookup("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if entry != nil {
+			got = entry.URL
+		}
+		if got != c.url {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.url)
+		}
+		urlMap.Close()
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	svc := &WebSpoolService{
+		Dir:    t.TempDir(),
+		URLMap: urlMap,
+		Derivatives: func(_ context.Context, sha1hex string) ([]DerivativeInfo, error) {
+			if sha1hex != fakeSHA1Hex {
+				return nil, nil
+			}
+			return []DerivativeInfo{{Kind: "text", Bucket: "sandcrawler", Size: 10}}, nil
+		},
+	}
+	req := httptest.NewRequest("POST", "/spool", strings.NewReader("new"))
+	svc.BlobHandler(httptest.NewRecorder(), req)
+	var (
+		spooled = fmt.Sprintf("%x", sha1.Sum([]byte("new")))
+		failed  = "229670d592315de8609bb627afda71beeb667181"
+	)
+	if err := urlMap.SetState(failed, StateFailed, "grobid down"); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		id     string
+		status int
+		state  string
+		reason string
+		n      int
+	}{
+		{fakeSHA1Hex, http.StatusOK, StateDone, "", 1},
+		{strings.ToUpper(fakeSHA1Hex), http.StatusOK, StateDone, "", 1},
+		{"6b6ae0f5a7ff1ecc37e0cd9e4a5e11d4b32e3e2b", http.StatusNotFound, "unknown", "", 0},
+		{failed, http.StatusOK, StateFailed, "grobid down", 0},
+		{spooled, http.StatusOK, StateSpooled, "", 0},
+		{"123", http.StatusBadRequest, "", "", 0},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/status/"+c.id, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": c.id})
+		rec := httptest.NewRecorder()
+		svc.StatusHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.id, rec.Code, c.status)
+		}
+		if c.status == http.StatusBadRequest {
+			continue
+		}
+		var resp statusResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.State != c.state || resp.Reason != c.reason {
+			t.Fatalf("[%s] got %v %v, want %v %v", c.id, resp.State, resp.Reason, c.state, c.reason)
+		}
+		if len(resp.Derivatives) != c.n {
+			t.Fatalf("[%s] got %v, want %v", c.id, len(resp.Derivatives), c.n)
+		}
+	}
+}
+
+func TestBatchStatusHandler(t *testing.T) {
+	urlMap := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	svc := &WebSpoolService{
+		Dir:    t.TempDir(),
+		URLMap: urlMap,
+		Derivatives: func(context.Context, string) ([]DerivativeInfo, error) {
+			t.Fatalf("derivatives should not be listed by default")
+			return nil, nil
+		},
+	}
+	if err := urlMap.SetState(fakeSHA1Hex, StateDone, ""); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about  string
+		body   string
+		status int
+		states []string
+	}{
+		{"empty", `[]`, http.StatusOK, nil},
+		{
+			about:  "mixed",
+			body:   `["` + strings.ToUpper(fakeSHA1Hex) + `", "229670d592315de8609bb627afda71beeb667181", "123"]`,
+			status: http.StatusOK,
+			states: []string{StateDone, "unknown", "invalid"},
+		},
+		{"not json", `x`, http.StatusBadRequest, nil},
+		{"too many", `[` + strings.Repeat(`"x",`, MaxStatusBatch) + `"x"]`, http.StatusRequestEntityTooLarge, nil},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/status", strings.NewReader(c.body))
+		rec := httptest.NewRecorder()
+		svc.BatchStatusHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var result []statusResponse
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		var states []string
+		for _, r := range result {
+			states = append(states, r.State)
+		}
+		if !slices.Equal(states, c.states) {
+			t.Fatalf("[%s] got %v, want %v", c.about, states, c.states)
+		}
+	}
+}
+
+func TestProcessHandler(t *testing.T) {
+	svc := &WebSpoolService{
+		Dir:             t.TempDir(),
+		SyncMaxFileSize: 10,
+		ExtractFunc: func(_ context.Context, blob []byte, opts *pdfextract.Options) *pdfextract.Result {
+			if opts.TempDir == "" {
+				t.Fatalf("got empty temp dir, want private temp dir")
+			}
+			return &pdfextract.Result{SHA1Hex: fakeSHA1Hex, Status: pdfextract.StatusSuccess, Text: string(blob)}
+		},
+	}
+	var cases = []struct {
+		about  string
+		body   string
+		max    int64
+		status int
+	}{
+		{"small file", "hello", 10, http.StatusOK},
+		{"too large", "hello, world", 10, http.StatusRequestEntityTooLarge},
+		{"disabled", "hello", 0, http.StatusNotFound},
+	}
+	for _, c := range cases {
+		svc.SyncMaxFileSize = c.max
+		req := httptest.NewRequest("POST", "/process", strings.NewReader(c.body))
+		rec := httptest.NewRecorder()
+		svc.ProcessHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var result pdfextract.Result
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Text != c.body || result.Status != pdfextract.StatusSuccess {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.body)
+		}
+	}
+	// Nothing gets spooled.
+	err := svc.spool().Walk(context.Background(), func(id string, _ fs.FileInfo) error {
+		t.Fatalf("got %v, want empty spool", id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nopSeekCloser turns a bytes.Reader into an io.ReadSeekCloser.
+type nopSeekCloser struct{ *bytes.Reader }
+
+func (nopSeekCloser) Close() error { return nil }
+
+func TestContentHandlers(t *testing.T) {
+	var (
+		base = t.TempDir()
+		// evil resolves to a file outside the spool directory.
+		evil = ".." + "ab" + strings.Repeat("c", 36)
+	)
+	if err := os.MkdirAll(filepath.Join(base, "ab"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "ab", evil[4:]), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	svc := &WebSpoolService{
+		Dir: filepath.Join(base, "spool"),
+		OpenDerivative: func(_ context.Context, sha1hex, kind string) (*DerivativeReader, error) {
+			if sha1hex != fakeSHA1Hex || kind != "text" {
+				return nil, fs.ErrNotExist
+			}
+			return &DerivativeReader{
+				ReadSeekCloser: nopSeekCloser{bytes.NewReader([]byte("some text"))},
+				ETag:           "abc",
+				ContentType:    "text/plain",
+			}, nil
+		},
+	}
+	svc.BlobHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/spool", strings.NewReader("hello, world")))
+	spooled := fmt.Sprintf("%x", sha1.Sum([]byte("hello, world")))
+	var cases = []struct {
+		about   string
+		handler http.HandlerFunc
+		vars    map[string]string
+		header  map[string]string
+		status  int
+		body    string
+	}{
+		{"spooled", svc.SpoolContentHandler, map[string]string{"id": spooled}, nil, http.StatusOK, "hello, world"},
+		{"spooled range", svc.SpoolContentHandler, map[string]string{"id": spooled}, map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "world"},
+		{"spooled etag", svc.SpoolContentHandler, map[string]string{"id": spooled}, map[string]string{"If-None-Match": `"` + spooled + `"`}, http.StatusNotModified, ""},
+		{"not spooled", svc.SpoolContentHandler, map[string]string{"id": fakeSHA1Hex}, nil, http.StatusNotFound, ""},
+		{"derivative", svc.DerivativeHandler, map[string]string{"id": fakeSHA1Hex, "kind": "text"}, nil, http.StatusOK, "some text"},
+		{"derivative range", svc.DerivativeHandler, map[string]string{"id": fakeSHA1Hex, "kind": "text"}, map[string]string{"Range": "bytes=0-3"}, http.StatusPartialContent, "some"},
+		{"derivative etag", svc.DerivativeHandler, map[string]string{"id": fakeSHA1Hex, "kind": "text"}, map[string]string{"If-None-Match": `"abc"`}, http.StatusNotModified, ""},
+		{"derivative missing", svc.DerivativeHandler, map[string]string{"id": fakeSHA1Hex, "kind": "tei"}, nil, http.StatusNotFound, ""},
+		{"spooled outside", svc.SpoolContentHandler, map[string]string{"id": evil}, nil, http.StatusBadRequest, ""},
+		{"spool status outside", svc.SpoolStatusHandler, map[string]string{"id": evil}, nil, http.StatusBadRequest, ""},
+		{"derivative outside", svc.DerivativeHandler, map[string]string{"id": evil, "kind": "text"}, nil, http.StatusBadRequest, ""},
+		{"status outside", svc.StatusHandler, map[string]string{"id": evil}, nil, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), c.vars)
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c.handler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.body != "" && rec.Body.String() != c.body {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Body.String(), c.body)
+		}
+	}
+}
+
+func TestBlobHandlerBacklog(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		u   = &URLMap{Path: filepath.Join(dir, "urlmap.db")}
+	)
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	svc := &WebSpoolService{
+		Dir:        filepath.Join(dir, "spool"),
+		URLMap:     u,
+		MaxBacklog: 10,
+	}
+	var cases = []struct {
+		about   string
+		backlog int64
+		age     time.Duration
+		status  int
+	}{
+		{"below threshold", 10, 0, http.StatusAccepted},
+		{"above threshold", 11, 0, http.StatusTooManyRequests},
+		{"stale report", 100, 2 * time.Minute, http.StatusAccepted},
+	}
+	for i, c := range cases {
+		if err := u.SetGauge(GaugeGrobidBacklog, c.backlog); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := u.db.Exec(`update gauge set updated = ?`, time.Now().Add(-c.age).Unix()); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/spool", strings.NewReader(fmt.Sprintf("file-%d", i)))
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("[%s] got no Retry-After header", c.about)
+		}
+		rec = httptest.NewRecorder()
+		svc.BacklogHandler(rec, httptest.NewRequest("GET", "/backlog", nil))
+		wantStatus := http.StatusOK
+		if c.age > 0 {
+			wantStatus = http.StatusNotFound
+		}
+		if rec.Code != wantStatus {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, wantStatus)
+		}
+	}
+}
+
+func TestBlobHandlerLowDiskSpace(t *testing.T) {
+	defer func(f func(string) (uint64, uint64, error)) { diskUsageFunc = f }(diskUsageFunc)
+	diskUsageFunc = func(string) (uint64, uint64, error) { return 100, 1000, nil }
+	var cases = []struct {
+		about  string
+		min    int64
+		body   string
+		status int
+	}{
+		{"check disabled", 0, "hello", http.StatusAccepted},
+		{"enough space", 90, "hello", http.StatusAccepted},
+		{"upload would exceed headroom", 96, "hello", http.StatusInsufficientStorage},
+		{"below headroom", 200, "hello", http.StatusInsufficientStorage},
+	}
+	for _, c := range cases {
+		svc := &WebSpoolService{Dir: t.TempDir(), MinFreeSpace: c.min}
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, httptest.NewRequest("POST", "/spool", strings.NewReader(c.body)))
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status == http.StatusInsufficientStorage && rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("[%s] got no Retry-After header", c.about)
+		}
+	}
+}
+
+func TestBlobHandlerChecksums(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		u   = &URLMap{Path: filepath.Join(dir, "urlmap.db")}
+	)
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	svc := &WebSpoolService{Dir: filepath.Join(dir, "spool"), URLMap: u}
+	rec := httptest.NewRecorder()
+	svc.BlobHandler(rec, httptest.NewRequest("POST", "/spool", strings.NewReader("hello")))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got %v, want %v", rec.Code, http.StatusAccepted)
+	}
+	got, err := u.Checksums("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Checksums{
+		SHA1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		MD5:    "5d41402abc4b2a76b9719d911017c592",
+		SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Size:   5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDigestLocks(t *testing.T) {
+	var (
+		locks  digestLocks
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		active = make(map[string]int)
+		most   int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(digest string) {
+			defer wg.Done()
+			unlock := locks.lock(digest)
+			mu.Lock()
+			active[digest]++
+			if active[digest] > most {
+				most = active[digest]
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active[digest]--
+			mu.Unlock()
+			unlock()
+		}(fmt.Sprintf("%d", i%2))
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Fatalf("got %d concurrent holders, want 1", most)
+	}
+	if len(locks.locks) != 0 {
+		t.Fatalf("got %v, want no locks left", locks.locks)
+	}
+}
+
+func TestBlobHandlerConcurrentDuplicates(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		svc = &WebSpoolService{Dir: filepath.Join(dir, "spool")}
+		wg  sync.WaitGroup
+	)
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			svc.BlobHandler(rec, httptest.NewRequest("POST", "/spool", strings.NewReader("hello")))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusAccepted {
+			t.Fatalf("[%d] got %v, want %v", i, code, http.StatusAccepted)
+		}
+	}
+	ok, err := svc.shardedPathExists("aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d")
+	if err != nil || !ok {
+		t.Fatalf("got %v, %v, want file in spool", ok, err)
+	}
+}
+
+func TestSpoolStatusHandler(t *testing.T) {
+	svc := &WebSpoolService{Dir: t.TempDir()}
+	rec := httptest.NewRecorder()
+	svc.BlobHandler(rec, httptest.NewRequest("POST", "/spool", strings.NewReader("hello, world")))
+	spooled := fmt.Sprintf("%x", sha1.Sum([]byte("hello, world")))
+	if got, want := rec.Header().Get("ETag"), `"`+spooled+`"`; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	var cases = []struct {
+		about  string
+		method string
+		id     string
+		header map[string]string
+		status int
+		size   string
+	}{
+		{"get", "GET", spooled, nil, http.StatusOK, "12"},
+		{"head", "HEAD", spooled, nil, http.StatusOK, "12"},
+		{"uppercase", "HEAD", strings.ToUpper(spooled), nil, http.StatusOK, "12"},
+		{"not modified", "HEAD", spooled, map[string]string{"If-None-Match": `"` + spooled + `"`}, http.StatusNotModified, "12"},
+		{"other etag", "HEAD", spooled, map[string]string{"If-None-Match": `"abc"`}, http.StatusOK, "12"},
+		{"not spooled", "HEAD", fakeSHA1Hex, nil, http.StatusNotFound, ""},
+		{"invalid", "GET", "abc", nil, http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		req := mux.SetURLVars(httptest.NewRequest(c.method, "/", nil), map[string]string{"id": c.id})
+		for k, v := range c.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		svc.SpoolStatusHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if got := rec.Header().Get(SizeHttpHeader); got != c.size {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.size)
+		}
+		if c.size != "" && rec.Header().Get("Last-Modified") == "" {
+			t.Fatalf("[%s] got no Last-Modified header", c.about)
+		}
+	}
+}
+
+// multipartUpload returns a multipart request with the given parts.
+func multipartUpload(t *testing.T, parts map[string]string) *http.Request {
+	var (
+		buf bytes.Buffer
+		mw  = multipart.NewWriter(&buf)
+	)
+	for name, value := range parts {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/spool", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestBlobHandlerMultipart(t *testing.T) {
+	const helloSHA1 = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	var cases = []struct {
+		about   string
+		parts   map[string]string
+		status  int
+		sidecar *Sidecar
+	}{
+		{"file only", map[string]string{"file": "hello"}, http.StatusAccepted, nil},
+		{"file and meta", map[string]string{"file": "hello", "meta": `{"url": "https://example.org/a.pdf"}`},
+			http.StatusAccepted, &Sidecar{URL: "https://example.org/a.pdf"}},
+		{"invalid meta", map[string]string{"file": "hello", "meta": `{"url"`}, http.StatusBadRequest, nil},
+		{"missing file", map[string]string{"meta": `{"url": "u"}`}, http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		svc := &WebSpoolService{Dir: t.TempDir()}
+		rec := httptest.NewRecorder()
+		svc.BlobHandler(rec, multipartUpload(t, c.parts))
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+		if c.status != http.StatusAccepted {
+			continue
+		}
+		path, err := svc.shardedPath(helloSHA1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := os.ReadFile(path); err != nil || string(b) != "hello" {
+			t.Fatalf("[%s] got %q, %v, want hello", c.about, b, err)
+		}
+		sidecar, err := ReadSidecar(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sidecar, c.sidecar) {
+			t.Fatalf("[%s] got %v, want %v", c.about, sidecar, c.sidecar)
+		}
+	}
+}
+
+func TestSpoolMetaHandler(t *testing.T) {
+	var (
+		base = t.TempDir()
+		// evil resolves to a file outside the spool directory.
+		evil    = ".." + "ab" + strings.Repeat("c", 36)
+		outside = filepath.Join(base, "ab", evil[4:])
+	)
+	if err := os.MkdirAll(filepath.Dir(outside), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	svc := &WebSpoolService{Dir: filepath.Join(base, "spool")}
+	rec := httptest.NewRecorder()
+	svc.BlobHandler(rec, httptest.NewRequest("POST", "/spool", strings.NewReader("hello")))
+	spooled := "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	var cases = []struct {
+		about  string
+		id     string
+		body   string
+		status int
+	}{
+		{"spooled", spooled, `{"url": "https://example.org/a.pdf"}`, http.StatusNoContent},
+		{"replace", spooled, `{"url": "https://example.org/b.pdf", "timestamp": "20240607023917"}`, http.StatusNoContent},
+		{"not spooled", fakeSHA1Hex, `{"url": "u"}`, http.StatusNotFound},
+		{"invalid id", "abc", `{"url": "u"}`, http.StatusBadRequest},
+		{"outside spool", evil, `{"url": "u"}`, http.StatusBadRequest},
+		{"invalid sidecar", spooled, `{"x": 1}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := mux.SetURLVars(httptest.NewRequest("POST", "/", strings.NewReader(c.body)), map[string]string{"id": c.id})
+		rec := httptest.NewRecorder()
+		svc.SpoolMetaHandler(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, rec.Code, c.status)
+		}
+	}
+	path, err := svc.shardedPath(spooled, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar, err := ReadSidecar(path)
+	want := &Sidecar{URL: "https://example.org/b.pdf", Timestamp: "20240607023917"}
+	if err != nil || sidecar == nil || *sidecar != *want {
+		t.Fatalf("got %v, %v, want %v", sidecar, err, want)
+	}
+	if _, err := os.Stat(SidecarPath(filepath.Join(svc.Dir, "4e", "12", fakeSHA1Hex[4:]))); err == nil {
+		t.Fatalf("got sidecar for a file not in the spool")
+	}
+	if _, err := os.Stat(SidecarPath(outside)); err == nil {
+		t.Fatalf("got sidecar for a file outside the spool")
+	}
+}
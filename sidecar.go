@@ -0,0 +1,99 @@
+package blobproc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// MaxSidecarSize is the maximum size of a metadata sidecar in bytes.
+const MaxSidecarSize = 64 << 10
+
+// Sidecar is metadata about a file, supplied by a feeder along with or after
+// the upload, like the URL the file was crawled from. It is stored next to the
+// file in the spool and passed on to the processing result.
+type Sidecar struct {
+	URL       string `json:"url,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"` // Crawl timestamp, e.g. 20240607023917.
+	CDX       string `json:"cdx,omitempty"`       // CDX line of the capture.
+}
+
+// ParseSidecar decodes a sidecar from JSON. Unknown fields, empty sidecars and
+// sidecars larger than MaxSidecarSize are rejected.
+func ParseSidecar(r io.Reader) (*Sidecar, error) {
+	b, err := io.ReadAll(io.LimitReader(r, MaxSidecarSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxSidecarSize {
+		return nil, fmt.Errorf("sidecar exceeds %d bytes", MaxSidecarSize)
+	}
+	var (
+		sc  Sidecar
+		dec = json.NewDecoder(bytes.NewReader(b))
+	)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sc); err != nil {
+		return nil, fmt.Errorf("invalid sidecar: %w", err)
+	}
+	if sc == (Sidecar{}) {
+		return nil, fmt.Errorf("empty sidecar")
+	}
+	return &sc, nil
+}
+
+// SidecarPath returns the path of the sidecar of a spool file.
+func SidecarPath(path string) string {
+	return path + spool.MetaSuffix
+}
+
+// WriteSidecar writes the sidecar of a spool file, replacing an existing one.
+// The sidecar is written to a temporary file first, so readers never see a
+// partial sidecar.
+func WriteSidecar(path string, sc *Sidecar) error {
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "sidecar-*"+spool.WIPSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), SidecarPath(path))
+}
+
+// ReadSidecar reads the sidecar of a spool file, nil if there is none.
+func ReadSidecar(path string) (*Sidecar, error) {
+	f, err := os.Open(SidecarPath(path))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSidecar(f)
+}
+
+// removeSidecar removes the sidecar of a spool file, if any.
+func removeSidecar(path string) error {
+	if err := os.Remove(SidecarPath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
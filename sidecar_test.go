@@ -0,0 +1,66 @@
+package blobproc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSidecar(t *testing.T) {
+	var cases = []struct {
+		about  string
+		input  string
+		result *Sidecar
+		err    bool
+	}{
+		{"url", `{"url": "https://example.org/a.pdf"}`, &Sidecar{URL: "https://example.org/a.pdf"}, false},
+		{"all", `{"url": "u", "timestamp": "20240607023917", "cdx": "org,example)/a.pdf 20240607023917"}`,
+			&Sidecar{URL: "u", Timestamp: "20240607023917", CDX: "org,example)/a.pdf 20240607023917"}, false},
+		{"empty", `{}`, nil, true},
+		{"unknown field", `{"url": "u", "x": 1}`, nil, true},
+		{"invalid", `{"url"`, nil, true},
+		{"too large", `{"cdx": "` + strings.Repeat("x", MaxSidecarSize) + `"}`, nil, true},
+	}
+	for _, c := range cases {
+		result, err := ParseSidecar(strings.NewReader(c.input))
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error %v", c.about, err, c.err)
+		}
+		if c.result != nil && (result == nil || *result != *c.result) {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+		}
+	}
+}
+
+func TestSidecarReadWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), fakeSHA1Hex[4:])
+	sc, err := ReadSidecar(path)
+	if sc != nil || err != nil {
+		t.Fatalf("got %v, %v, want nil, nil", sc, err)
+	}
+	want := &Sidecar{URL: "https://example.org/a.pdf", Timestamp: "20240607023917"}
+	if err := WriteSidecar(path, want); err != nil {
+		t.Fatal(err)
+	}
+	sc, err = ReadSidecar(path)
+	if err != nil || sc == nil || *sc != *want {
+		t.Fatalf("got %v, %v, want %v", sc, err, want)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %v, want only the sidecar", entries)
+	}
+	if err := removeSidecar(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeSidecar(path); err != nil {
+		t.Fatal(err)
+	}
+	if sc, err := ReadSidecar(path); sc != nil || err != nil {
+		t.Fatalf("got %v, %v, want nil, nil", sc, err)
+	}
+}
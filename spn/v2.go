@@ -1,13 +1,46 @@
+// Package spn implements a client for the Save Page Now 2 (SPN2) API, which
+// asks the Wayback Machine to capture a URL.
 package spn
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
-var ErrMissingAuth = errors.New("missing auth")
+const (
+	// DefaultEndpoint is the SPN2 API endpoint.
+	DefaultEndpoint = "https://web.archive.org/save"
+	// DefaultPollCount is the number of status requests, before a capture
+	// job is considered timed out.
+	DefaultPollCount = 60
+	// DefaultPollSeconds is the time between status requests.
+	DefaultPollSeconds = 3 * time.Second
+)
+
+var (
+	ErrMissingAuth = errors.New("missing auth")
+	// ErrBackoff is returned, if SPN2 asks us to slow down. Callers should
+	// wait before submitting more requests.
+	ErrBackoff = errors.New("spn2 backoff")
+)
+
+// DefaultSimpleDomains are domains, where a simple GET works better than a
+// full browser capture, e.g. because they serve PDF directly.
+var DefaultSimpleDomains = []string{
+	"://arxiv.org/pdf/",
+	"://europepmc.org/backend/",
+	"://pdfs.semanticscholar.org/",
+	"://res.mdpi.com/",
+	"://zenodo.org/",
+	"://www.zenodo.org/",
+}
 
 type Result struct {
 	Success          bool
@@ -38,10 +71,80 @@ type Client struct {
 	PollCount      int
 	PollSeconds    time.Duration
 	SPNCDXRetrySec time.Duration
-	SimpleDomains  []string
+	// SimpleDomains are URL fragments, e.g. "://arxiv.org/pdf/", for which
+	// a simple GET is requested instead of a browser capture.
+	SimpleDomains []string
+	// UserAgent is sent with each request, if set.
+	UserAgent string
+}
+
+// submitResponse is the response to a capture request.
+type submitResponse struct {
+	URL       string `json:"url"`
+	JobID     string `json:"job_id"`
+	Status    string `json:"status"`
+	StatusExt string `json:"status_ext"`
+	Message   string `json:"message"`
+}
+
+// statusResponse is the response to a job status request.
+type statusResponse struct {
+	Status      string   `json:"status"`
+	StatusExt   string   `json:"status_ext"`
+	Message     string   `json:"message"`
+	OriginalURL string   `json:"original_url"`
+	Timestamp   string   `json:"timestamp"`
+	Resources   []string `json:"resources"`
+}
+
+func (c *Client) endpoint() string {
+	if c.Endpoint != "" {
+		return strings.TrimSuffix(c.Endpoint, "/")
+	}
+	return DefaultEndpoint
+}
+
+func (c *Client) doer() Doer {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) pollCount() int {
+	if c.PollCount > 0 {
+		return c.PollCount
+	}
+	return DefaultPollCount
+}
+
+func (c *Client) pollSeconds() time.Duration {
+	if c.PollSeconds > 0 {
+		return c.PollSeconds
+	}
+	return DefaultPollSeconds
+}
+
+// isSimple returns true, if a link matches any of the simple get domains.
+func (c *Client) isSimple(link string) bool {
+	domains := c.SimpleDomains
+	if domains == nil {
+		domains = DefaultSimpleDomains
+	}
+	for _, d := range domains {
+		if strings.Contains(link, d) {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Client) Save(link string, opts *SaveOpts) (*Result, error) {
+// Save submits a capture request for a link and polls the job status until
+// the capture is done, failed or the poll count is exhausted. Failed captures
+// are reported with Success set to false and a status like "spn2-error"; an
+// error is only returned, if SPN2 could not be reached or asked us to back
+// off.
+func (c *Client) Save(ctx context.Context, link string, opts *SaveOpts) (*Result, error) {
 	if c.AccessKey == "" || c.SecretKey == "" {
 		return nil, ErrMissingAuth
 	}
@@ -52,5 +155,112 @@ func (c *Client) Save(link string, opts *SaveOpts) (*Result, error) {
 			RequestURL: link,
 		}, nil
 	}
-	return nil, nil
+	if opts == nil {
+		opts = &SaveOpts{}
+	}
+	form := url.Values{}
+	form.Set("url", link)
+	form.Set("capture_all", "1")
+	form.Set("capture_screenshot", "0")
+	form.Set("if_not_archived_within", "1d")
+	form.Set("skip_first_archive", "1")
+	form.Set("force_get", boolString(opts.ForceSimpleGet || c.isSimple(link)))
+	form.Set("capture_outlinks", boolString(opts.CaptureOutlinks))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var submit submitResponse
+	if err := c.doJSON(req, &submit); err != nil {
+		return nil, err
+	}
+	if submit.Status == "error" || submit.JobID == "" {
+		return &Result{
+			Success:    false,
+			Status:     statusOrDefault(submit.StatusExt, "spn2-error"),
+			RequestURL: link,
+		}, nil
+	}
+	for i := 0; i < c.pollCount(); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.pollSeconds()):
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint()+"/status/"+url.PathEscape(submit.JobID), nil)
+		if err != nil {
+			return nil, err
+		}
+		var status statusResponse
+		if err := c.doJSON(req, &status); err != nil {
+			return nil, err
+		}
+		switch status.Status {
+		case "pending":
+			continue
+		case "success":
+			return &Result{
+				Success:          true,
+				Status:           "success",
+				JobID:            submit.JobID,
+				RequestURL:       link,
+				TerminalURL:      status.OriginalURL,
+				TerminalDateTime: status.Timestamp,
+				Resources:        status.Resources,
+			}, nil
+		default:
+			return &Result{
+				Success:    false,
+				Status:     statusOrDefault(status.StatusExt, "spn2-error"),
+				JobID:      submit.JobID,
+				RequestURL: link,
+			}, nil
+		}
+	}
+	return &Result{
+		Success:    false,
+		Status:     "spn2-timeout",
+		JobID:      submit.JobID,
+		RequestURL: link,
+	}, nil
+}
+
+// doJSON sends an authenticated request and decodes the JSON response.
+func (c *Client) doJSON(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("LOW %s:%s", c.AccessKey, c.SecretKey))
+	resp, err := c.doer().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return ErrBackoff
+	case resp.StatusCode >= 400:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("spn2: %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("spn2: decode response: %w", err)
+	}
+	return nil
+}
+
+func boolString(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+func statusOrDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
 }
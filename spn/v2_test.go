@@ -0,0 +1,105 @@
+package spn
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeSPN simulates the SPN2 API, jobs complete after a number of polls.
+func fakeSPN(pending int, final map[string]any) *httptest.Server {
+	var polls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /save", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "LOW a:s" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Form.Get("url") {
+		case "https://example.com/slow":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "https://example.com/blocked":
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": "error", "status_ext": "error:blocked-url"})
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"url":    r.Form.Get("url"),
+				"job_id": "job-" + r.Form.Get("force_get"),
+			})
+		}
+	})
+	mux.HandleFunc("GET /save/status/{id}", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls <= pending {
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": "pending"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(final)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestSave(t *testing.T) {
+	success := map[string]any{
+		"status":       "success",
+		"original_url": "https://example.com/a.pdf",
+		"timestamp":    "20240101120000",
+		"resources":    []string{"https://example.com/a.pdf"},
+	}
+	var cases = []struct {
+		about     string
+		link      string
+		pending   int
+		pollCount int
+		final     map[string]any
+		status    string
+		jobID     string
+		err       error
+	}{
+		{about: "ftp", link: "ftp://example.com/a.pdf", status: "spn2-no-ftp"},
+		{about: "success", link: "https://example.com/a.pdf", pending: 2, final: success, status: "success", jobID: "job-0"},
+		{about: "simple get", link: "https://arxiv.org/pdf/1234", final: success, status: "success", jobID: "job-1"},
+		{about: "job failed", link: "https://example.com/a.pdf", final: map[string]any{"status": "error", "status_ext": "error:not-found"}, status: "error:not-found", jobID: "job-0"},
+		{about: "submit failed", link: "https://example.com/blocked", status: "error:blocked-url"},
+		{about: "timeout", link: "https://example.com/a.pdf", pending: 5, pollCount: 3, final: success, status: "spn2-timeout", jobID: "job-0"},
+		{about: "backoff", link: "https://example.com/slow", err: ErrBackoff},
+	}
+	for _, c := range cases {
+		srv := fakeSPN(c.pending, c.final)
+		client := &Client{
+			Endpoint:    srv.URL + "/save",
+			AccessKey:   "a",
+			SecretKey:   "s",
+			PollCount:   c.pollCount,
+			PollSeconds: time.Millisecond,
+		}
+		result, err := client.Save(context.Background(), c.link, nil)
+		srv.Close()
+		if !errors.Is(err, c.err) {
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
+		if result.Status != c.status || result.JobID != c.jobID {
+			t.Fatalf("[%s] got %v, %v, want %v, %v", c.about, result.Status, result.JobID, c.status, c.jobID)
+		}
+		if result.Success != (c.status == "success") {
+			t.Fatalf("[%s] got %v, want success %v", c.about, result.Success, c.status == "success")
+		}
+	}
+}
+
+func TestSaveMissingAuth(t *testing.T) {
+	client := &Client{}
+	if _, err := client.Save(context.Background(), "https://example.com", nil); err != ErrMissingAuth {
+		t.Fatalf("got %v, want %v", err, ErrMissingAuth)
+	}
+}
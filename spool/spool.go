@@ -0,0 +1,358 @@
+// Package spool implements a content addressed directory of files, keyed by
+// the SHA1 of their content. Files are sharded into two levels of
+// subdirectories, so the file with SHA1 "34fc7a11cb..." is stored as
+// "34/fc/7a11cb...". Files are written to a temporary file with a ".wip"
+// suffix first, synced to disk and then moved into place, so a file in the
+// spool is always complete, even after a power loss.
+package spool
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WIPSuffix is the suffix of files, that are still being written. These files
+// are not part of the spool.
+const WIPSuffix = ".wip"
+
+// LeaseSuffix is the suffix of files, that claim the file they are named
+// after for processing. These files are not part of the spool.
+const LeaseSuffix = ".lease"
+
+// MetaSuffix is the suffix of metadata sidecars, that are stored next to the
+// file they are named after. These files are not part of the spool.
+const MetaSuffix = ".meta.json"
+
+// TrashDir is the directory below the spool root, processed files are kept
+// in for a while. It is not part of the spool.
+const TrashDir = ".trash"
+
+// IsWIP returns true, if path is a file still being written.
+func IsWIP(path string) bool {
+	return strings.HasSuffix(path, WIPSuffix)
+}
+
+// IsAux returns true, if path is not part of the spool, but a file still being
+// written, a lease or a metadata sidecar.
+func IsAux(path string) bool {
+	return IsWIP(path) || strings.HasSuffix(path, LeaseSuffix) || strings.HasSuffix(path, MetaSuffix)
+}
+
+var (
+	// ErrShortName is returned for identifiers too short to be sharded.
+	ErrShortName = errors.New("short name")
+	// ErrChecksumMismatch is returned, if content does not match the
+	// expected SHA1.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Spool is a content addressed file store.
+type Spool interface {
+	// Put stores the content read from r and returns its SHA1.
+	Put(r io.Reader) (sha1hex string, err error)
+	// Exists returns true, if a file with the given SHA1 is stored.
+	Exists(sha1hex string) (bool, error)
+	// Open opens a stored file for reading.
+	Open(sha1hex string) (*os.File, error)
+	// Remove removes a stored file.
+	Remove(sha1hex string) error
+	// Walk calls fn for each stored file.
+	Walk(ctx context.Context, fn func(sha1hex string, fi fs.FileInfo) error) error
+}
+
+var _ Spool = (*Dir)(nil)
+
+// Dir is a spool backed by a local directory.
+type Dir struct {
+	Root string
+	// TempDir is the directory for temporary files, the spool root, if empty.
+	// Files can only be moved into place atomically, if the temporary
+	// directory is on the same device.
+	TempDir string
+	// TempPattern is the pattern for temporary file names, as used by
+	// os.CreateTemp, defaults to "spool-*". WIPSuffix is always appended.
+	TempPattern string
+}
+
+// Path returns the path for a file with a given identifier, which usually is
+// a SHA1, but may include an extension. If create is true, also create
+// subdirectories, if necessary.
+func (d *Dir) Path(id string, create bool) (string, error) {
+	if len(id) < 8 {
+		return "", ErrShortName
+	}
+	dir := filepath.Join(d.Root, id[0:2], id[2:4])
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, id[4:]), nil
+}
+
+// ID returns the identifier for a sharded path, or the empty string, if the
+// path is not sharded.
+func ID(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	n := len(parts)
+	return parts[n-3] + parts[n-2] + parts[n-1]
+}
+
+// Exists returns true, if a file with the given identifier exists.
+func (d *Dir) Exists(id string) (bool, error) {
+	_, err := d.Stat(id)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Stat returns file information for a stored file.
+func (d *Dir) Stat(id string) (fs.FileInfo, error) {
+	path, err := d.Path(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+// Open opens a stored file for reading.
+func (d *Dir) Open(id string) (*os.File, error) {
+	path, err := d.Path(id, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Remove removes a stored file.
+func (d *Dir) Remove(id string) error {
+	path, err := d.Path(id, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Put stores the content read from r and returns its SHA1. If a file with the
+// same content is already stored, it is left untouched.
+func (d *Dir) Put(r io.Reader) (string, error) {
+	w, err := d.Create()
+	if err != nil {
+		return "", err
+	}
+	defer w.Abort()
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if _, err := w.Commit(""); err != nil {
+		return "", err
+	}
+	return w.SHA1Hex(), nil
+}
+
+// Walk calls fn for each stored file, in lexical order.
+func (d *Dir) Walk(ctx context.Context, fn func(id string, fi fs.FileInfo) error) error {
+	return filepath.Walk(d.Root, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fi.IsDir() && path == filepath.Join(d.Root, TrashDir) {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() || !fi.Mode().IsRegular() || IsAux(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, path)
+		if err != nil {
+			return err
+		}
+		id := ID(rel)
+		if id == "" {
+			return nil // not a spool file
+		}
+		return fn(id, fi)
+	})
+}
+
+// Sweep removes files still being written, that have not been modified for
+// at least maxAge, e.g. left behind by a crash. Returns the number of removed
+// files.
+func (d *Dir) Sweep(maxAge time.Duration) (int, error) {
+	var n int
+	err := filepath.Walk(d.Root, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || !IsWIP(path) || time.Since(fi.ModTime()) < maxAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Verify checks, that the content of a stored file matches its SHA1.
+func (d *Dir) Verify(sha1hex string) error {
+	f, err := d.Open(sha1hex)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha1hex {
+		return fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, got, sha1hex)
+	}
+	return nil
+}
+
+// Writer writes content to a temporary file, computing its SHA1. The content
+// is moved into the spool with Commit.
+type Writer struct {
+	d      *Dir
+	f      *os.File
+	h      hash.Hash
+	md5    hash.Hash
+	sha256 hash.Hash
+	n      int64
+	done   bool
+}
+
+// Create returns a writer for a new file.
+func (d *Dir) Create() (*Writer, error) {
+	pattern := d.TempPattern
+	if pattern == "" {
+		pattern = "spool-*"
+	}
+	dir := d.TempDir
+	if dir == "" {
+		dir = d.Root
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(dir, pattern+WIPSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{d: d, f: f, h: sha1.New(), md5: md5.New(), sha256: sha256.New()}, nil
+}
+
+// Write writes content.
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	w.md5.Write(p[:n])
+	w.sha256.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written.
+func (w *Writer) Size() int64 { return w.n }
+
+// SHA1Hex returns the SHA1 of the content written so far.
+func (w *Writer) SHA1Hex() string { return hex.EncodeToString(w.h.Sum(nil)) }
+
+// MD5Hex returns the MD5 of the content written so far, so the content need
+// not be read again to compute it.
+func (w *Writer) MD5Hex() string { return hex.EncodeToString(w.md5.Sum(nil)) }
+
+// SHA256Hex returns the SHA256 of the content written so far.
+func (w *Writer) SHA256Hex() string { return hex.EncodeToString(w.sha256.Sum(nil)) }
+
+// Commit syncs the content to disk, moves it into the spool and returns true,
+// if a file with the same SHA1 and size had already been stored, in which case
+// it is left untouched. If want is not empty, the content must have this SHA1.
+func (w *Writer) Commit(want string) (existed bool, err error) {
+	if w.done {
+		return false, fmt.Errorf("writer already closed")
+	}
+	defer w.Abort()
+	sha1hex := w.SHA1Hex()
+	if want != "" && want != sha1hex {
+		return false, fmt.Errorf("%w: got %s, want %s", ErrChecksumMismatch, sha1hex, want)
+	}
+	if err := w.f.Sync(); err != nil {
+		return false, err
+	}
+	if err := w.f.Close(); err != nil {
+		return false, err
+	}
+	if fi, err := w.d.Stat(sha1hex); err == nil && fi.Size() == w.n {
+		return true, nil
+	}
+	dst, err := w.d.Path(sha1hex, true)
+	if err != nil {
+		return false, err
+	}
+	if err := os.Rename(w.f.Name(), dst); err != nil {
+		return false, err
+	}
+	// Persist the new directory entries, including shards just created.
+	for dir := filepath.Dir(dst); ; dir = filepath.Dir(dir) {
+		if err := syncDir(dir); err != nil {
+			return false, err
+		}
+		if rel, err := filepath.Rel(w.d.Root, dir); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			break
+		}
+	}
+	return false, nil
+}
+
+// syncDir flushes a directory, so entries added to it survive a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Abort discards the content, if it has not been committed. It is safe to
+// call Abort after Commit.
+func (w *Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	_ = w.f.Close()
+	if err := os.Remove(w.f.Name()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
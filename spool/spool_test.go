@@ -0,0 +1,248 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha1 of "hello"
+const helloSHA1 = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+
+func TestPath(t *testing.T) {
+	d := &Dir{Root: "/spool"}
+	var cases = []struct {
+		id     string
+		result string
+		err    error
+	}{
+		{"", "", ErrShortName},
+		{"1234567", "", ErrShortName},
+		{helloSHA1, "/spool/aa/f4/c61ddcc5e8a2dabede0f3b482cd9aea9434d", nil},
+		{helloSHA1 + ".tei.xml", "/spool/aa/f4/c61ddcc5e8a2dabede0f3b482cd9aea9434d.tei.xml", nil},
+	}
+	for _, c := range cases {
+		result, err := d.Path(c.id, false)
+		if result != c.result || err != c.err {
+			t.Fatalf("[%s] got %v, %v, want %v, %v", c.id, result, err, c.result, c.err)
+		}
+		if err == nil && ID(result) != c.id {
+			t.Fatalf("[%s] got %v, want %v", c.id, ID(result), c.id)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	var (
+		ctx = context.Background()
+		d   = &Dir{Root: t.TempDir(), TempDir: t.TempDir()}
+	)
+	id, err := d.Put(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != helloSHA1 {
+		t.Fatalf("got %v, want %v", id, helloSHA1)
+	}
+	if ok, err := d.Exists(id); !ok || err != nil {
+		t.Fatalf("got %v, %v, want true, nil", ok, err)
+	}
+	if err := d.Verify(id); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v, want hello", b, err)
+	}
+	// Put the same content again, file is left untouched.
+	w, err := d.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	existed, err := w.Commit(helloSHA1)
+	if err != nil || !existed {
+		t.Fatalf("got %v, %v, want true, nil", existed, err)
+	}
+	// A sidecar is not part of the spool.
+	meta, err := d.Path(id+MetaSuffix, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(meta, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	if err := d.Walk(ctx, func(id string, _ fs.FileInfo) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{helloSHA1}) {
+		t.Fatalf("got %v, want %v", ids, []string{helloSHA1})
+	}
+	if err := d.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := d.Exists(id); ok || err != nil {
+		t.Fatalf("got %v, %v, want false, nil", ok, err)
+	}
+	// No temporary files left behind.
+	entries, err := os.ReadDir(d.TempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %v, want no temporary files", entries)
+	}
+}
+
+func TestWriterChecksumMismatch(t *testing.T) {
+	d := &Dir{Root: t.TempDir(), TempDir: t.TempDir()}
+	w, err := d.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello!"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Commit(helloSHA1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if ok, _ := d.Exists(helloSHA1); ok {
+		t.Fatalf("got %v, want file not stored", ok)
+	}
+	// Verify detects corrupted files.
+	if _, err := d.Put(strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := d.Path(helloSHA1, false)
+	if err := os.WriteFile(path, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Verify(helloSHA1); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, err := os.Stat(filepath.Join(d.Root, "aa")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriterWIP(t *testing.T) {
+	d := &Dir{Root: t.TempDir()}
+	w, err := d.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	// Files being written are kept in the spool root, but not listed.
+	wips, err := filepath.Glob(filepath.Join(d.Root, "*"+WIPSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wips) != 1 {
+		t.Fatalf("got %v, want one file in progress", wips)
+	}
+	var n int
+	if err := d.Walk(context.Background(), func(string, fs.FileInfo) error { n++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("got %v, want %v", n, 0)
+	}
+	if _, err := w.Commit(helloSHA1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wips[0]); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want %v", err, fs.ErrNotExist)
+	}
+	if ok, _ := d.Exists(helloSHA1); !ok {
+		t.Fatalf("got %v, want file stored", ok)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	d := &Dir{Root: t.TempDir()}
+	if _, err := d.Put(strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		stale = filepath.Join(d.Root, "aa", "spool-1"+WIPSuffix)
+		fresh = filepath.Join(d.Root, "spool-2"+WIPSuffix)
+		old   = time.Now().Add(-2 * time.Hour)
+	)
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	n, err := d.Sweep(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %v, want %v", n, 1)
+	}
+	var cases = []struct {
+		path   string
+		exists bool
+	}{
+		{stale, false},
+		{fresh, true},
+	}
+	for _, c := range cases {
+		_, err := os.Stat(c.path)
+		if exists := err == nil; exists != c.exists {
+			t.Fatalf("[%s] got %v, want %v", c.path, exists, c.exists)
+		}
+	}
+	if ok, _ := d.Exists(helloSHA1); !ok {
+		t.Fatalf("got %v, want file kept", ok)
+	}
+}
+
+func TestWriterChecksums(t *testing.T) {
+	d := &Dir{Root: t.TempDir()}
+	w, err := d.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Abort()
+	if _, err := io.WriteString(w, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about string
+		got   string
+		want  string
+	}{
+		{"sha1", w.SHA1Hex(), helloSHA1},
+		{"md5", w.MD5Hex(), "5d41402abc4b2a76b9719d911017c592"},
+		{"sha256", w.SHA256Hex(), "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.about, c.got, c.want)
+		}
+	}
+}
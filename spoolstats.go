@@ -0,0 +1,112 @@
+package blobproc
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AgeBuckets are the upper bounds of the file age histogram in spool
+// statistics. Files older than the last bound are counted in an extra bucket.
+var AgeBuckets = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+}
+
+// ShardStats are the number of files and bytes in a single shard.
+type ShardStats struct {
+	Shard    string `json:"shard"`
+	NumFiles int64  `json:"num_files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// AgeBucket is a single bucket of the age histogram.
+type AgeBucket struct {
+	Label    string `json:"label"` // e.g. "<1h", "1d-7d" or ">=30d"
+	NumFiles int64  `json:"num_files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// SpoolStats summarizes the contents of a spool directory.
+type SpoolStats struct {
+	Dir        string       `json:"dir"`
+	NumFiles   int64        `json:"num_files"`
+	TotalBytes int64        `json:"total_bytes"`
+	Oldest     time.Time    `json:"oldest,omitempty"`
+	Newest     time.Time    `json:"newest,omitempty"`
+	Shards     []ShardStats `json:"shards"` // First level shards, in lexical order.
+	Ages       []AgeBucket  `json:"ages"`
+}
+
+// ComputeSpoolStats walks a spool directory and collects file counts, sizes
+// per first level shard and an age histogram, relative to now.
+func ComputeSpoolStats(ctx context.Context, dir string, now time.Time) (*SpoolStats, error) {
+	stats := &SpoolStats{Dir: dir}
+	for i, b := range AgeBuckets {
+		label := "<" + formatAge(b)
+		if i > 0 {
+			label = formatAge(AgeBuckets[i-1]) + "-" + formatAge(b)
+		}
+		stats.Ages = append(stats.Ages, AgeBucket{Label: label})
+	}
+	stats.Ages = append(stats.Ages, AgeBucket{Label: ">=" + formatAge(AgeBuckets[len(AgeBuckets)-1])})
+	index := make(map[string]int) // shard to index into stats.Shards
+	err := walkSpool(ctx, dir, false, nil, func(payload Payload) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			size    = payload.FileInfo.Size()
+			modTime = payload.FileInfo.ModTime()
+			shard   = "."
+		)
+		stats.NumFiles++
+		stats.TotalBytes += size
+		if stats.Oldest.IsZero() || modTime.Before(stats.Oldest) {
+			stats.Oldest = modTime
+		}
+		if modTime.After(stats.Newest) {
+			stats.Newest = modTime
+		}
+		if rel, err := filepath.Rel(dir, payload.Path); err == nil {
+			if parts := strings.Split(filepath.ToSlash(rel), "/"); len(parts) > 1 {
+				shard = parts[0]
+			}
+		}
+		i, ok := index[shard]
+		if !ok {
+			i = len(stats.Shards)
+			index[shard] = i
+			stats.Shards = append(stats.Shards, ShardStats{Shard: shard})
+		}
+		stats.Shards[i].NumFiles++
+		stats.Shards[i].Bytes += size
+		age := now.Sub(modTime)
+		j := len(AgeBuckets)
+		for k, b := range AgeBuckets {
+			if age < b {
+				j = k
+				break
+			}
+		}
+		stats.Ages[j].NumFiles++
+		stats.Ages[j].Bytes += size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// formatAge formats a duration in full days or hours.
+func formatAge(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return fmt.Sprintf("%dh", d/time.Hour)
+}
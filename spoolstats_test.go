@@ -0,0 +1,73 @@
+package blobproc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestComputeSpoolStats(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		now = time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	)
+	var files = []struct {
+		path string
+		size int
+		age  time.Duration
+	}{
+		{"ab/cd/1", 10, time.Minute},
+		{"ab/ef/2", 20, 2 * time.Hour},
+		{"cd/ef/3", 30, 3 * 24 * time.Hour},
+		{"cd/ef/4", 40, 90 * 24 * time.Hour},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-f.age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := ComputeSpoolStats(context.Background(), dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.NumFiles != 4 || stats.TotalBytes != 100 {
+		t.Fatalf("got %v files, %v bytes, want 4 files, 100 bytes", stats.NumFiles, stats.TotalBytes)
+	}
+	if !stats.Oldest.Equal(now.Add(-90 * 24 * time.Hour)) {
+		t.Fatalf("got %v, want %v", stats.Oldest, now.Add(-90*24*time.Hour))
+	}
+	var shards = []ShardStats{
+		{Shard: "ab", NumFiles: 2, Bytes: 30},
+		{Shard: "cd", NumFiles: 2, Bytes: 70},
+	}
+	if len(stats.Shards) != len(shards) {
+		t.Fatalf("got %v, want %v", stats.Shards, shards)
+	}
+	for i, s := range shards {
+		if stats.Shards[i] != s {
+			t.Fatalf("got %v, want %v", stats.Shards[i], s)
+		}
+	}
+	var ages = []AgeBucket{
+		{Label: "<1h", NumFiles: 1, Bytes: 10},
+		{Label: "1h-1d", NumFiles: 1, Bytes: 20},
+		{Label: "1d-7d", NumFiles: 1, Bytes: 30},
+		{Label: "7d-30d"},
+		{Label: ">=30d", NumFiles: 1, Bytes: 40},
+	}
+	for i, a := range ages {
+		if stats.Ages[i] != a {
+			t.Fatalf("got %v, want %v", stats.Ages[i], a)
+		}
+	}
+}
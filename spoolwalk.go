@@ -0,0 +1,114 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// walkSpool calls fn for each non-empty regular file found in dir, except for
+// files still being written by blobprocd and leases. The trash directory of
+// the spool and directories for which skipDir returns true are not descended
+// into. If parallel is true,
+// each top level directory, i.e. each first level shard of a spool, is walked
+// in a separate goroutine and fn must be safe for concurrent use. The walk
+// stops at the first error returned from fn or encountered while walking.
+func walkSpool(ctx context.Context, dir string, parallel bool, skipDir func(string) bool, fn func(Payload) error) error {
+	trashDir := filepath.Join(dir, spool.TrashDir)
+	visit := func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path != dir {
+				// Removed while walking, e.g. by another instance.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == trashDir || (skipDir != nil && skipDir(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || spool.IsAux(path) {
+			return nil
+		}
+		if info.Size() == 0 {
+			slog.Warn("skipping empty file", "path", path)
+			return nil
+		}
+		return fn(Payload{Path: path, FileInfo: info})
+	}
+	if !parallel {
+		return filepath.Walk(dir, visit)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		fail     = func(err error) {
+			once.Do(func() {
+				firstErr = err
+				cancel()
+			})
+		}
+	)
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !e.IsDir() {
+			info, err := e.Info()
+			if err == nil {
+				err = visit(path, info, nil)
+			}
+			if err != nil {
+				fail(err)
+				break
+			}
+			continue
+		}
+		if path == trashDir || (skipDir != nil && skipDir(path)) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := filepath.Walk(path, func(path string, info fs.FileInfo, err error) error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return visit(path, info, err)
+			})
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// spoolSkipDir returns a function for walkSpool, that skips shards done
+// according to a checkpoint and the given absolute directories, e.g. for
+// scratch space or rejected files, if they are located within the spool.
+// Empty directories are ignored.
+func spoolSkipDir(checkpoint *Checkpoint, dirs ...string) func(string) bool {
+	return func(path string) bool {
+		if checkpoint != nil && checkpoint.SkipDir(path) {
+			return true
+		}
+		abs, err := filepath.Abs(path)
+		return err == nil && slices.Contains(dirs, abs)
+	}
+}
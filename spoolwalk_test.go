@@ -0,0 +1,105 @@
+package blobproc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// createSpool creates a two level sharded spool with n files per second
+// level shard.
+func createSpool(t testing.TB, dir string, shards, n int) []string {
+	var paths []string
+	for i := 0; i < shards; i++ {
+		for j := 0; j < shards; j++ {
+			d := filepath.Join(dir, fmt.Sprintf("%02x", i), fmt.Sprintf("%02x", j))
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatalf("mkdir failed: %v", err)
+			}
+			for k := 0; k < n; k++ {
+				p := filepath.Join(d, fmt.Sprintf("%036x", k))
+				if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+					t.Fatalf("write failed: %v", err)
+				}
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+func TestWalkSpool(t *testing.T) {
+	dir := t.TempDir()
+	want := createSpool(t, dir, 4, 3)
+	// Empty files, files being written and skipped directories are not
+	// reported.
+	if err := os.WriteFile(filepath.Join(dir, "00", "00", "empty"), nil, 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blobprocd-1.wip"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	skipped := filepath.Join(dir, "scratch")
+	if err := os.MkdirAll(skipped, 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(skipped, "tmp"), []byte("x"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, parallel := range []bool{false, true} {
+		var (
+			mu  sync.Mutex
+			got []string
+		)
+		err := walkSpool(context.Background(), dir, parallel,
+			func(path string) bool { return path == skipped },
+			func(payload Payload) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, payload.Path)
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("[parallel=%v] got %v, want nil", parallel, err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Fatalf("[parallel=%v] got %d paths, want %d", parallel, len(got), len(want))
+		}
+	}
+}
+
+func TestWalkSpoolError(t *testing.T) {
+	dir := t.TempDir()
+	createSpool(t, dir, 4, 3)
+	for _, parallel := range []bool{false, true} {
+		errStop := fmt.Errorf("stop")
+		err := walkSpool(context.Background(), dir, parallel, nil, func(Payload) error {
+			return errStop
+		})
+		if err != errStop {
+			t.Fatalf("[parallel=%v] got %v, want %v", parallel, err, errStop)
+		}
+	}
+}
+
+func BenchmarkWalkSpool(b *testing.B) {
+	dir := b.TempDir()
+	createSpool(b, dir, 16, 4)
+	for _, parallel := range []bool{false, true} {
+		b.Run(fmt.Sprintf("parallel=%v", parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := walkSpool(context.Background(), dir, parallel, nil, func(Payload) error {
+					return nil
+				})
+				if err != nil {
+					b.Fatalf("walk failed: %v", err)
+				}
+			}
+		})
+	}
+}
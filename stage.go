@@ -0,0 +1,213 @@
+package blobproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miku/blobproc/frontmatter"
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/textquality"
+	"github.com/miku/blobproc/textseg"
+)
+
+// Document is passed to each additional stage and contains everything known
+// about a file after the built-in stages ran. Depending on the outcome of
+// previous stages, some fields may be empty.
+type Document struct {
+	Path    string             // Path to the file in the spool.
+	SHA1Hex string             // SHA1 of the file, if extraction succeeded.
+	Result  *pdfextract.Result // Result of local extraction.
+	TEI     []byte             // GROBID TEI-XML, references only in references-only mode.
+	// TextQuality of the extracted text, e.g. for a stage to send files with
+	// garbled text to OCR.
+	TextQuality *textquality.Report
+	// Frontmatter guessed from the first page, if enabled.
+	Frontmatter *frontmatter.Frontmatter
+	TempDir     string // Directory for temporary files, may be empty.
+	put         func(context.Context, *BlobRequestOptions) (*PutBlobResponse, error)
+}
+
+// Put stores a derivative with the storage configured for the pipeline.
+func (doc *Document) Put(ctx context.Context, req *BlobRequestOptions) (*PutBlobResponse, error) {
+	if doc.put == nil {
+		return nil, fmt.Errorf("no storage configured")
+	}
+	return doc.put(ctx, req)
+}
+
+// Stage is an additional processing step, run for each processed file. An
+// error will be recorded, but does not stop other stages from running.
+type Stage interface {
+	Name() string
+	Run(ctx context.Context, doc *Document) error
+}
+
+// StageFunc adapts a function to a named stage.
+type StageFunc struct {
+	StageName string
+	F         func(ctx context.Context, doc *Document) error
+}
+
+// Name of the stage.
+func (s StageFunc) Name() string { return s.StageName }
+
+// Run the stage.
+func (s StageFunc) Run(ctx context.Context, doc *Document) error { return s.F(ctx, doc) }
+
+var (
+	stagesMu sync.RWMutex
+	stages   = make(map[string]Stage)
+)
+
+// RegisterStage makes a stage available by name, e.g. so it can be enabled
+// from the command line. Panics, if a stage with the same name is already
+// registered. Typically called from an init function.
+func RegisterStage(stage Stage) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	name := stage.Name()
+	if _, ok := stages[name]; ok {
+		panic("blobproc: RegisterStage called twice for stage " + name)
+	}
+	stages[name] = stage
+}
+
+// RegisteredStages returns the sorted names of all registered stages.
+func RegisteredStages() []string {
+	stagesMu.RLock()
+	defer stagesMu.RUnlock()
+	var names []string
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupStages returns the registered stages for a comma separated list of
+// names, in the given order.
+func LookupStages(s string) ([]Stage, error) {
+	stagesMu.RLock()
+	defer stagesMu.RUnlock()
+	var (
+		result []Stage
+		seen   []string
+	)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(seen, name) {
+			continue
+		}
+		stage, ok := stages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stage: %q", name)
+		}
+		seen = append(seen, name)
+		result = append(result, stage)
+	}
+	return result, nil
+}
+
+func init() {
+	RegisterStage(StageFunc{StageName: "weblinks", F: storeWeblinks})
+	RegisterStage(StageFunc{StageName: "sentences", F: storeSentences})
+	RegisterStage(&FiguresStage{
+		Options: pdfextract.ImageOptions{
+			MinSize:   8 * 1024,
+			MinWidth:  100,
+			MinHeight: 100,
+			MaxImages: 100,
+		},
+	})
+}
+
+// storeWeblinks stores links found in the fulltext as a JSON array.
+func storeWeblinks(ctx context.Context, doc *Document) error {
+	if doc.Result == nil || len(doc.Result.Weblinks) == 0 || len(doc.SHA1Hex) != 40 {
+		return nil
+	}
+	b, err := json.Marshal(doc.Result.Weblinks)
+	if err != nil {
+		return err
+	}
+	d, err := LookupDerivative("weblinks")
+	if err != nil {
+		return err
+	}
+	_, err = doc.Put(ctx, d.Request(doc.SHA1Hex, b))
+	return err
+}
+
+// storeSentences segments the fulltext into sentences and stores them as JSON
+// lines, including page, paragraph and character offsets into the text.
+func storeSentences(ctx context.Context, doc *Document) error {
+	if doc.Result == nil || len(doc.Result.Text) == 0 || len(doc.SHA1Hex) != 40 {
+		return nil
+	}
+	var (
+		buf bytes.Buffer
+		enc = json.NewEncoder(&buf)
+	)
+	for _, s := range textseg.Segments(doc.Result.Text) {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	d, err := LookupDerivative("sentences")
+	if err != nil {
+		return err
+	}
+	_, err = doc.Put(ctx, d.Request(doc.SHA1Hex, buf.Bytes()))
+	return err
+}
+
+// FiguresStage extracts embedded images from PDF files and stores them in
+// the "figures" folder, keyed by the SHA1 of the PDF and the image index.
+type FiguresStage struct {
+	Bucket  string // Bucket, defaults to "sandcrawler".
+	Options pdfextract.ImageOptions
+}
+
+// Name of the stage.
+func (s *FiguresStage) Name() string { return "figures" }
+
+// Run extracts and stores figures.
+func (s *FiguresStage) Run(ctx context.Context, doc *Document) error {
+	if doc.Result == nil || doc.Result.Status != "success" || len(doc.SHA1Hex) != 40 {
+		return nil
+	}
+	opts := s.Options
+	if opts.TempDir == "" {
+		opts.TempDir = doc.TempDir
+	}
+	images, err := pdfextract.ExtractImages(ctx, doc.Path, &opts)
+	if err != nil {
+		return err
+	}
+	bucket := s.Bucket
+	if bucket == "" {
+		bucket = "sandcrawler"
+	}
+	for _, img := range images {
+		_, err := doc.Put(ctx, &BlobRequestOptions{
+			Bucket:  bucket,
+			Folder:  "figures",
+			Blob:    img.Data,
+			SHA1Hex: doc.SHA1Hex,
+			Ext:     fmt.Sprintf("%04d.%s", img.Index, img.Ext),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLookupStages(t *testing.T) {
+	var cases = []struct {
+		about string
+		s     string
+		names []string
+		err   bool
+	}{
+		{about: "empty", s: "", names: nil},
+		{about: "builtin", s: "weblinks", names: []string{"weblinks"}},
+		{about: "duplicates", s: "weblinks, weblinks", names: []string{"weblinks"}},
+		{about: "multiple", s: "sentences,weblinks", names: []string{"sentences", "weblinks"}},
+		{about: "unknown", s: "weblinks,xxx", err: true},
+	}
+	for _, c := range cases {
+		stages, err := LookupStages(c.s)
+		if (err != nil) != c.err {
+			t.Fatalf("[%s] got %v, want error: %v", c.about, err, c.err)
+		}
+		if len(stages) != len(c.names) {
+			t.Fatalf("[%s] got %d stages, want %d", c.about, len(stages), len(c.names))
+		}
+		for i, stage := range stages {
+			if stage.Name() != c.names[i] {
+				t.Fatalf("[%s] got %v, want %v", c.about, stage.Name(), c.names[i])
+			}
+		}
+	}
+}
+
+func TestPipelineStages(t *testing.T) {
+	var (
+		store = &fakeStore{}
+		seen  []string
+		p     = &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc:  fakeGrobidOK,
+			PutFunc:     store.put,
+			Stages: []Stage{
+				StageFunc{StageName: "a", F: func(_ context.Context, doc *Document) error {
+					seen = append(seen, "a:"+string(doc.TEI))
+					return nil
+				}},
+				StageFunc{StageName: "b", F: func(context.Context, *Document) error {
+					return errors.New("b failed")
+				}},
+			},
+		}
+	)
+	pr := p.Process(context.Background(), Payload{Path: "x.pdf", FileInfo: fakeFileInfo{size: 1}}, "")
+	if len(seen) != 1 || seen[0] != "a:<TEI/>" {
+		t.Fatalf("got %v, want [a:<TEI/>]", seen)
+	}
+	if pr.OK() || len(pr.Errors) != 1 {
+		t.Fatalf("expected a single stage error, got %v", pr.Errors)
+	}
+}
@@ -0,0 +1,170 @@
+// Package textquality scores text extracted from PDF files with cheap
+// heuristics, to find the output of broken font encodings, scanned pages with
+// a poor text layer and similar garbage, which is better sent to OCR or
+// reviewed, than indexed as is. The heuristics are: the ratio of replacement
+// and control characters, the ratio of ligature and private use characters,
+// which show up for glyphs without a unicode mapping, the average word length
+// and the share of common stopwords of the most likely language.
+package textquality
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Flags describing suspicious text.
+const (
+	FlagEmpty       = "empty"       // No text at all.
+	FlagReplacement = "replacement" // Many replacement or control characters.
+	FlagLigature    = "ligature"    // Many ligature or private use characters.
+	FlagWordLength  = "word-length" // Words too short or too long, e.g. letter spaced text.
+	FlagNoLanguage  = "no-language" // Few stopwords of any known language.
+)
+
+const (
+	maxSampleRunes  = 1 << 20 // Only the start of long texts is looked at.
+	minLanguageWord = 50      // Minimum number of words to guess a language.
+)
+
+// Report describes the quality of a text.
+type Report struct {
+	Score              float64  `json:"score"`               // Between 0 for garbage and 1 for plausible text.
+	Chars              int      `json:"chars"`               // Non-whitespace characters looked at.
+	Words              int      `json:"words"`               // Words looked at.
+	ReplacementRatio   float64  `json:"replacement_ratio"`   // Replacement and control characters per character.
+	LigatureRatio      float64  `json:"ligature_ratio"`      // Ligature and private use characters per character.
+	AvgWordLength      float64  `json:"avg_word_length"`     // Average number of characters per word.
+	Language           string   `json:"language,omitempty"`  // Most likely language, if any.
+	LanguageConfidence float64  `json:"language_confidence"` // Between 0 and 1.
+	Flags              []string `json:"flags,omitempty"`     // Reasons for a lower score.
+}
+
+// stopwords are frequent words of some languages. In running text, roughly a
+// third to a half of all words are stopwords. Single letter words are left
+// out, as they are common in letter spaced garbage.
+var stopwords = map[string][]string{
+	"en": {"the", "of", "and", "to", "in", "is", "that", "for", "with", "as", "on", "by", "are", "this", "be", "from", "we", "an", "at", "which", "it", "or", "not"},
+	"de": {"der", "die", "und", "in", "den", "von", "zu", "das", "mit", "sich", "des", "auf", "für", "ist", "im", "dem", "nicht", "ein", "eine", "als", "auch", "es", "an", "wird"},
+	"fr": {"de", "la", "le", "et", "les", "des", "en", "un", "du", "une", "que", "est", "pour", "qui", "dans", "par", "sur", "au", "pas", "plus", "ce", "avec"},
+	"es": {"de", "la", "que", "el", "en", "los", "del", "se", "las", "por", "un", "para", "con", "no", "una", "su", "al", "es", "lo", "como", "más"},
+	"it": {"di", "il", "la", "che", "in", "per", "un", "del", "della", "non", "una", "sono", "le", "con", "si", "da", "dei", "al", "nel", "è"},
+	"pt": {"de", "que", "do", "da", "em", "um", "para", "com", "não", "uma", "os", "ao", "no", "se", "na", "por", "mais", "as", "dos"},
+	"nl": {"de", "van", "het", "een", "en", "in", "is", "dat", "op", "te", "zijn", "voor", "met", "die", "niet", "aan", "er", "om", "ook", "als"},
+}
+
+// stopwordShare is the share of stopwords, above which a language is
+// considered certain.
+const stopwordShare = 0.25
+
+// Assess computes a quality report for text.
+func Assess(text string) *Report {
+	var (
+		r           = &Report{}
+		replacement int
+		ligature    int
+		latin       int
+		letters     int
+		wordRunes   int
+		counts      = make(map[string]int)
+		n           int
+	)
+	for _, c := range text {
+		if n++; n > maxSampleRunes {
+			break
+		}
+		switch {
+		case unicode.IsSpace(c):
+			continue
+		case c == unicode.ReplacementChar, unicode.IsControl(c):
+			replacement++
+		case isLigature(c), unicode.In(c, unicode.Co):
+			ligature++
+		case unicode.IsLetter(c):
+			letters++
+			if unicode.In(c, unicode.Latin) {
+				latin++
+			}
+		}
+		r.Chars++
+	}
+	if r.Chars == 0 {
+		r.Flags = []string{FlagEmpty}
+		return r
+	}
+	for _, w := range strings.Fields(text) {
+		w = strings.TrimFunc(w, func(c rune) bool { return !unicode.IsLetter(c) && !unicode.IsDigit(c) })
+		if w == "" || !strings.ContainsFunc(w, unicode.IsLetter) {
+			continue
+		}
+		r.Words++
+		wordRunes += len([]rune(w))
+		counts[strings.ToLower(w)]++
+		if wordRunes > maxSampleRunes {
+			break
+		}
+	}
+	r.ReplacementRatio = float64(replacement) / float64(r.Chars)
+	r.LigatureRatio = float64(ligature) / float64(r.Chars)
+	if r.Words > 0 {
+		r.AvgWordLength = float64(wordRunes) / float64(r.Words)
+	}
+	score := 1.0
+	if r.ReplacementRatio > 0.01 {
+		r.Flags = append(r.Flags, FlagReplacement)
+	}
+	score *= 1 - min(1, 20*r.ReplacementRatio)
+	if r.LigatureRatio > 0.01 {
+		r.Flags = append(r.Flags, FlagLigature)
+	}
+	score *= 1 - min(1, 20*r.LigatureRatio)
+	switch {
+	case r.Words == 0:
+		r.Flags = append(r.Flags, FlagWordLength)
+		score = 0
+	case r.AvgWordLength < 3:
+		r.Flags = append(r.Flags, FlagWordLength)
+		score *= (r.AvgWordLength / 3) * (r.AvgWordLength / 3)
+	case r.AvgWordLength > 9:
+		r.Flags = append(r.Flags, FlagWordLength)
+		score *= (9 / r.AvgWordLength) * (9 / r.AvgWordLength)
+	}
+	// Stopwords only help with text in latin script and enough words.
+	if r.Words >= minLanguageWord && letters > 0 && float64(latin)/float64(letters) > 0.5 {
+		r.Language, r.LanguageConfidence = guessLanguage(counts, r.Words)
+		if r.LanguageConfidence < 0.3 {
+			r.Flags = append(r.Flags, FlagNoLanguage)
+		}
+		score *= 0.5 + 0.5*r.LanguageConfidence
+	}
+	r.Score = score
+	return r
+}
+
+// guessLanguage returns the language with the largest share of stopwords and
+// a confidence between 0 and 1.
+func guessLanguage(counts map[string]int, words int) (string, float64) {
+	var (
+		best      string
+		bestCount int
+	)
+	for _, lang := range []string{"en", "de", "fr", "es", "it", "pt", "nl"} {
+		var n int
+		for _, w := range stopwords[lang] {
+			n += counts[w]
+		}
+		if n > bestCount {
+			best, bestCount = lang, n
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	return best, min(1, float64(bestCount)/float64(words)/stopwordShare)
+}
+
+// isLigature returns true for latin ligatures in the alphabetic presentation
+// forms block, like U+FB01 for "fi", which pdftotext emits, if a font lacks a
+// proper mapping.
+func isLigature(c rune) bool {
+	return c >= 0xFB00 && c <= 0xFB06
+}
@@ -0,0 +1,66 @@
+package textquality
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const sample = `Sparse attention has been proposed as a way to reduce the cost of
+transformer models on long documents. In this paper we study the effect of
+several attention patterns on the quality of summaries, which are produced for
+scientific articles from a number of domains. We find that a simple local
+window, combined with a few global tokens, is competitive with more complex
+approaches and that the choice of pattern is less important than the length
+of the input. The code and the data are available for further research.`
+
+func TestAssess(t *testing.T) {
+	var cases = []struct {
+		about    string
+		text     string
+		low      bool // score below 0.5
+		flags    []string
+		language string
+	}{
+		{about: "empty", text: " \n\f ", low: true, flags: []string{FlagEmpty}},
+		{about: "english", text: sample, language: "en"},
+		{about: "short", text: "Hello world."},
+		{
+			about: "replacement characters",
+			text:  strings.Repeat("�� text ", 100),
+			low:   true,
+			flags: []string{FlagReplacement, FlagNoLanguage},
+		},
+		{
+			about:    "private use glyphs",
+			text:     strings.ReplaceAll(sample, "e", ""),
+			low:      true,
+			flags:    []string{FlagLigature},
+			language: "en",
+		},
+		{
+			about: "letter spaced",
+			text:  strings.Join(strings.Split(strings.ReplaceAll(sample, " ", ""), ""), " "),
+			low:   true,
+			flags: []string{FlagWordLength, FlagNoLanguage},
+		},
+		{
+			about: "missing spaces",
+			text:  strings.Repeat(strings.ReplaceAll(sample, " ", "")+" ", 10),
+			low:   true,
+			flags: []string{FlagWordLength, FlagNoLanguage},
+		},
+	}
+	for _, c := range cases {
+		r := Assess(c.text)
+		if got := r.Score < 0.5; got != c.low {
+			t.Fatalf("[%s] got %v, want %v (score %v)", c.about, got, c.low, r.Score)
+		}
+		if !slices.Equal(r.Flags, c.flags) {
+			t.Fatalf("[%s] got %v, want %v", c.about, r.Flags, c.flags)
+		}
+		if r.Language != c.language {
+			t.Fatalf("[%s] got %v, want %v", c.about, r.Language, c.language)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package textseg splits plain text, as extracted from PDF files, into
+// paragraphs and sentences. The tokenizer is simple and rule based: pages are
+// separated by form feeds, paragraphs by empty lines and sentences end with
+// a terminal punctuation mark followed by whitespace and an uppercase letter,
+// a digit or an opening quote or bracket, unless the word before the mark is a
+// known abbreviation or a single letter initial.
+package textseg
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Segment is a single sentence. Offsets are in Unicode code points into the
+// original text, end exclusive, so they can be used directly for slicing in
+// most languages other than Go.
+type Segment struct {
+	Page      int    `json:"page"`      // Page number, starting at 1.
+	Paragraph int    `json:"paragraph"` // Paragraph number in the document, starting at 0.
+	Sentence  int    `json:"sentence"`  // Sentence number in the document, starting at 0.
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	Text      string `json:"text"` // Sentence text with whitespace normalized.
+}
+
+// abbreviations are lowercase words, without the trailing period, that do
+// not end a sentence.
+var abbreviations = map[string]bool{
+	"al": true, "approx": true, "cf": true, "ca": true, "dr": true,
+	"e.g": true, "eq": true, "eqs": true, "et": true, "etc": true,
+	"fig": true, "figs": true, "i.e": true, "inc": true, "jr": true,
+	"mr": true, "mrs": true, "ms": true, "no": true, "nos": true,
+	"p": true, "pp": true, "prof": true, "ref": true, "refs": true,
+	"resp": true, "sec": true, "sect": true, "st": true, "vol": true,
+	"vs": true,
+}
+
+// Segments splits text into sentences.
+func Segments(text string) []Segment {
+	var (
+		runes     = []rune(text)
+		segments  []Segment
+		page      = 1
+		paragraph = 0
+		start     = -1 // start of the current sentence, -1 if none
+		sentence  = 0
+		newlines  = 0 // consecutive newlines seen
+		emit      = func(end int) {
+			if start < 0 {
+				return
+			}
+			s := strings.Join(strings.Fields(string(runes[start:end])), " ")
+			if s != "" {
+				segments = append(segments, Segment{
+					Page:      page,
+					Paragraph: paragraph,
+					Sentence:  sentence,
+					Start:     start,
+					End:       end,
+					Text:      s,
+				})
+				sentence++
+			}
+			start = -1
+		}
+	)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\f':
+			emit(trimRight(runes, i))
+			if len(segments) > 0 && segments[len(segments)-1].Paragraph == paragraph {
+				paragraph++
+			}
+			page++
+			newlines = 0
+			continue
+		case r == '\n':
+			newlines++
+			if newlines == 2 {
+				emit(trimRight(runes, i))
+				if len(segments) > 0 && segments[len(segments)-1].Paragraph == paragraph {
+					paragraph++
+				}
+			}
+			continue
+		case unicode.IsSpace(r):
+			continue
+		}
+		newlines = 0
+		if start < 0 {
+			start = i
+		}
+		if isTerminal(r) && endsSentence(runes, start, i) {
+			j := i + 1
+			// Include closing quotes and brackets.
+			for j < len(runes) && strings.ContainsRune(`"')]”’`, runes[j]) {
+				j++
+			}
+			emit(j)
+			i = j - 1
+		}
+	}
+	emit(trimRight(runes, len(runes)))
+	return segments
+}
+
+// isTerminal returns true for sentence ending punctuation.
+func isTerminal(r rune) bool {
+	return r == '.' || r == '!' || r == '?'
+}
+
+// endsSentence decides, whether the terminal mark at position i, in a
+// sentence starting at start, ends the sentence.
+func endsSentence(runes []rune, start, i int) bool {
+	j := i + 1
+	for j < len(runes) && strings.ContainsRune(`"')]”’`, runes[j]) {
+		j++
+	}
+	if j == len(runes) {
+		return true
+	}
+	if !unicode.IsSpace(runes[j]) {
+		return false // e.g. 3.14 or e.g.
+	}
+	for j < len(runes) && unicode.IsSpace(runes[j]) && runes[j] != '\f' {
+		j++
+	}
+	if j == len(runes) || runes[j] == '\f' {
+		return true
+	}
+	next := runes[j]
+	if !unicode.IsUpper(next) && !unicode.IsDigit(next) && !strings.ContainsRune(`"'([“‘`, next) {
+		return false
+	}
+	if runes[i] != '.' {
+		return true
+	}
+	// Look at the word before the period.
+	k := i
+	for k > start && !unicode.IsSpace(runes[k-1]) {
+		k--
+	}
+	word := strings.ToLower(strings.TrimLeft(string(runes[k:i]), `"'([“‘`))
+	if len([]rune(word)) == 1 && unicode.IsLetter([]rune(word)[0]) {
+		return false // initial, e.g. "J. Smith"
+	}
+	return !abbreviations[word]
+}
+
+// trimRight returns the position after the last non-space rune before end.
+func trimRight(runes []rune, end int) int {
+	for end > 0 && unicode.IsSpace(runes[end-1]) {
+		end--
+	}
+	return end
+}
@@ -0,0 +1,86 @@
+package textseg
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	var cases = []struct {
+		about  string
+		text   string
+		result []string
+	}{
+		{about: "empty", text: "", result: nil},
+		{about: "whitespace", text: " \n\n \f ", result: nil},
+		{about: "single", text: "Hello world.", result: []string{"Hello world."}},
+		{about: "no terminal", text: "Hello world", result: []string{"Hello world"}},
+		{
+			about:  "two sentences",
+			text:   "We propose a method. It works well!",
+			result: []string{"We propose a method.", "It works well!"},
+		},
+		{
+			about:  "line wrap",
+			text:   "We propose a\nmethod. It works.",
+			result: []string{"We propose a method.", "It works."},
+		},
+		{
+			about:  "abbreviations",
+			text:   "See Fig. 3 and e.g. Smith et al. 2019. Done.",
+			result: []string{"See Fig. 3 and e.g. Smith et al. 2019.", "Done."},
+		},
+		{
+			about:  "initials and numbers",
+			text:   "By J. Smith with p = 0.05 results. Next.",
+			result: []string{"By J. Smith with p = 0.05 results.", "Next."},
+		},
+		{
+			about:  "lowercase continuation",
+			text:   "The value is approx. ten. Or not.",
+			result: []string{"The value is approx. ten.", "Or not."},
+		},
+		{
+			about:  "quotes",
+			text:   `He said "it works." Then left.`,
+			result: []string{`He said "it works."`, "Then left."},
+		},
+		{
+			about:  "paragraph without terminal",
+			text:   "Introduction\n\nWe start here.",
+			result: []string{"Introduction", "We start here."},
+		},
+	}
+	for _, c := range cases {
+		var result []string
+		for _, s := range Segments(c.text) {
+			result = append(result, s.Text)
+		}
+		if !slices.Equal(result, c.result) {
+			t.Fatalf("[%s] got %q, want %q", c.about, result, c.result)
+		}
+	}
+}
+
+func TestSegmentsOffsets(t *testing.T) {
+	text := "Über alles. Zweiter Satz\nhier.\n\nNeuer Absatz.\fSeite zwei."
+	segments := Segments(text)
+	var want = []Segment{
+		{Page: 1, Paragraph: 0, Sentence: 0, Start: 0, End: 11, Text: "Über alles."},
+		{Page: 1, Paragraph: 0, Sentence: 1, Start: 12, End: 30, Text: "Zweiter Satz hier."},
+		{Page: 1, Paragraph: 1, Sentence: 2, Start: 32, End: 45, Text: "Neuer Absatz."},
+		{Page: 2, Paragraph: 2, Sentence: 3, Start: 46, End: 57, Text: "Seite zwei."},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %v, want %v", segments, want)
+	}
+	runes := []rune(text)
+	for i, s := range segments {
+		if s != want[i] {
+			t.Fatalf("got %v, want %v", s, want[i])
+		}
+		if got := string(runes[s.Start:s.End]); got == "" {
+			t.Fatalf("got empty slice for %v", s)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans replaces the package tracer with one recording all spans for
+// the duration of a test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	var (
+		sr   = tracetest.NewSpanRecorder()
+		tp   = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+		prev = tracer
+	)
+	tracer = tp.Tracer("test")
+	t.Cleanup(func() { tracer = prev })
+	return sr
+}
+
+// spanAttr returns the value of an attribute of a recorded span.
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestStartEndSpan(t *testing.T) {
+	var cases = []struct {
+		about  string
+		err    error
+		status codes.Code
+		events int
+	}{
+		{"ok", nil, codes.Unset, 0},
+		{"error", errors.New("grobid down"), codes.Error, 1},
+	}
+	for _, c := range cases {
+		sr := recordSpans(t)
+		ctx, span := startSpan(context.Background(), "grobid", attribute.String("sha1", fakeSHA1Hex))
+		if !span.SpanContext().Equal(trace.SpanContextFromContext(ctx)) {
+			t.Fatalf("[%s] got context without span", c.about)
+		}
+		endSpan(span, c.err)
+		ended := sr.Ended()
+		if len(ended) != 1 {
+			t.Fatalf("[%s] got %d spans, want 1", c.about, len(ended))
+		}
+		got := ended[0]
+		if got.Name() != "grobid" {
+			t.Fatalf("[%s] got %v, want grobid", c.about, got.Name())
+		}
+		if v, ok := spanAttr(got, "sha1"); !ok || v.AsString() != fakeSHA1Hex {
+			t.Fatalf("[%s] got %v, want %v", c.about, v.AsString(), fakeSHA1Hex)
+		}
+		if got.Status().Code != c.status {
+			t.Fatalf("[%s] got %v, want %v", c.about, got.Status().Code, c.status)
+		}
+		if c.err != nil && got.Status().Description != c.err.Error() {
+			t.Fatalf("[%s] got %v, want %v", c.about, got.Status().Description, c.err)
+		}
+		if len(got.Events()) != c.events {
+			t.Fatalf("[%s] got %d events, want %d", c.about, len(got.Events()), c.events)
+		}
+	}
+}
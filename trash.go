@@ -0,0 +1,134 @@
+package blobproc
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miku/blobproc/fileutils"
+	"github.com/miku/blobproc/spool"
+)
+
+// Trash keeps processed spool files for a while, instead of removing them
+// right away, so they can be processed again, e.g. after an S3 outage, that
+// went unnoticed for some hours. Files keep their path relative to the spool
+// and are removed for good by Purge, once the retention period is over.
+type Trash struct {
+	Dir       string
+	Retention time.Duration
+}
+
+// DefaultTrashDir returns the trash directory used for a spool, if none is
+// configured. Walks of the spool skip it.
+func DefaultTrashDir(spoolDir string) string {
+	return filepath.Join(spoolDir, spool.TrashDir)
+}
+
+// Move moves a file from the spool at root into the trash. The modification
+// time of the file is set to the current time, so the retention period starts
+// with the removal from the spool. A file outside of root is moved to the top
+// level of the trash.
+func (t *Trash) Move(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(path)
+	}
+	dst := filepath.Join(t.Dir, rel)
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(dst, now, now)
+}
+
+// Purge removes files, that have been in the trash for longer than the
+// retention period, along with directories left empty. Returns the number of
+// removed files.
+func (t *Trash) Purge() (int, error) {
+	return t.purge(time.Now().Add(-t.Retention))
+}
+
+// purge removes files trashed before a given time.
+func (t *Trash) purge(before time.Time) (int, error) {
+	var (
+		n    int
+		dirs []string
+	)
+	err := filepath.Walk(t.Dir, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if path != t.Dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !fi.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		n++
+		return nil
+	})
+	// Deepest directories first; removing non-empty directories fails,
+	// which is fine.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return n, err
+}
+
+// Restore moves files trashed since a given time back into the spool at
+// root, so they are processed again. Files, that are in the spool again
+// already, are left in the trash. Returns the number of restored files.
+func (t *Trash) Restore(root string, since time.Time) (int, error) {
+	var n int
+	err := filepath.Walk(t.Dir, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || fi.ModTime().Before(since) {
+			return nil
+		}
+		rel, err := filepath.Rel(t.Dir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(root, rel)
+		if _, err := os.Stat(dst); err == nil {
+			return nil
+		}
+		if err := moveFile(path, dst); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// moveFile moves a file, creating the parent directories of the destination.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		// Rename fails across devices, fall back to copy.
+		if err := fileutils.CopyFile(dst, src); err != nil {
+			return err
+		}
+		return os.Remove(src)
+	}
+	return nil
+}
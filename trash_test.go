@@ -0,0 +1,116 @@
+package blobproc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/fileutils"
+	"github.com/miku/grobidclient"
+)
+
+func TestTrash(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		spool = filepath.Join(dir, "spool")
+		trash = &Trash{Dir: DefaultTrashDir(spool), Retention: time.Hour}
+	)
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(spool, "ab", "cd", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := trash.Move(spool, path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("[%s] got %v, want file removed from spool", name, err)
+		}
+	}
+	// Pretend "a" was trashed two hours ago and "b" 30 minutes ago.
+	for name, age := range map[string]time.Duration{"a": 2 * time.Hour, "b": 30 * time.Minute} {
+		ts := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(trash.Dir, "ab", "cd", name), ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := trash.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %v, want %v", n, 1)
+	}
+	n, err = trash.Restore(spool, time.Now().Add(-10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("got %v, want %v", n, 1)
+	}
+	var cases = []struct {
+		path string
+		ok   bool
+	}{
+		{filepath.Join(trash.Dir, "ab", "cd", "a"), false},
+		{filepath.Join(trash.Dir, "ab", "cd", "b"), true},
+		{filepath.Join(trash.Dir, "ab", "cd", "c"), false},
+		{filepath.Join(spool, "ab", "cd", "c"), true},
+	}
+	for _, c := range cases {
+		_, err := os.Stat(c.path)
+		if got := err == nil; got != c.ok {
+			t.Fatalf("[%s] got %v, want %v", c.path, got, c.ok)
+		}
+	}
+}
+
+func TestWalkFastTrash(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		spool = filepath.Join(dir, "spool")
+		path  = filepath.Join(spool, "ab", "cd", "doc.pdf")
+		seen  int
+	)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileutils.CopyFile(path, "testdata/pdf/1906.02444.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		w := &WalkFast{
+			Dir:        spool,
+			NumWorkers: 1,
+			ScratchDir: filepath.Join(dir, "scratch"),
+			Timeout:    time.Minute,
+			Trash:      &Trash{Dir: DefaultTrashDir(spool), Retention: time.Hour},
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+					seen++
+					return fakeGrobidOK(ctx, path)
+				},
+				PutFunc: (&fakeStore{}).put,
+			},
+		}
+		if err := w.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second run must not pick up the file from the trash.
+	if seen != 1 {
+		t.Fatalf("got %v, want %v", seen, 1)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want file removed from spool", err)
+	}
+	if _, err := os.Stat(filepath.Join(DefaultTrashDir(spool), "ab", "cd", "doc.pdf")); err != nil {
+		t.Fatalf("got %v, want file in trash", err)
+	}
+}
@@ -1,7 +1,10 @@
 package blobproc
 
 import (
+	"log/slog"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
@@ -11,16 +14,89 @@ const urlmapSchema = `
 create table if not exists map (
 	url  text not null,
 	sha1 text not null,
-	timestamp datetime default CURRENT_TIMESTAMP
+	timestamp datetime default CURRENT_TIMESTAMP,
+	source text not null default ''
 );
 create index if not exists index_url_sha1 on map(url, sha1);
+create index if not exists index_sha1 on map(sha1);
+create table if not exists usage (
+	source text not null,
+	day    text not null,
+	bytes  integer not null default 0,
+	primary key (source, day)
+);
+create table if not exists state (
+	sha1    text primary key,
+	state   text not null,
+	reason  text not null default '',
+	updated datetime default CURRENT_TIMESTAMP
+);
+create table if not exists stored (
+	sha1 text not null,
+	kind text not null,
+	primary key (sha1, kind)
+);
+create table if not exists result (
+	sha1    text primary key,
+	version text not null,
+	updated datetime default CURRENT_TIMESTAMP
+);
+create table if not exists checksum (
+	sha1   text primary key,
+	md5    text not null,
+	sha256 text not null,
+	size   integer not null
+);
+create table if not exists gauge (
+	name    text primary key,
+	value   integer not null,
+	updated integer not null
+);
 `
 
-// URLMap wraps an sqlite3 database for URL and SHA1 lookups.
+// urlmapPragmas enable write-ahead logging, so readers do not block writers,
+// and wait for locks instead of failing immediately. Most pragmas only apply
+// to a single connection, so they are passed with the DSN and set on each
+// connection of the pool. The busy timeout comes first, so switching to WAL
+// waits for locks, too.
+var urlmapPragmas = []string{
+	"busy_timeout(5000)",
+	"journal_mode(wal)",
+	"synchronous(normal)",
+}
+
+// urlmapDSN returns the data source name for a database file, with pragmas.
+func urlmapDSN(path string) string {
+	return path + "?" + url.Values{"_pragma": urlmapPragmas}.Encode()
+}
+
+// URLMap wraps an sqlite3 database for URL and SHA1 lookups. It also keeps
+// track of the number of bytes ingested per source and day, of the processing
+// state of files and of gauges, like the GROBID backlog, so it is shared by
+// blobprocd and blobproc.
 type URLMap struct {
 	Path string
-	mu   sync.Mutex
-	db   *sqlx.DB
+	// BatchSize enables asynchronous, batched inserts of URL and SHA1 pairs,
+	// if greater than one. Batches are written in a single transaction, once
+	// they are full or FlushInterval has passed. Pending inserts are written
+	// on Close.
+	BatchSize     int
+	FlushInterval time.Duration // Defaults to one second.
+	// QueueSize is the number of pending inserts, before Insert blocks,
+	// defaults to ten times the batch size.
+	QueueSize int
+
+	mu    sync.Mutex
+	db    *sqlx.DB
+	queue chan urlPair
+	done  chan struct{}
+}
+
+// urlPair is a single pending insert.
+type urlPair struct {
+	url    string
+	sha1   string
+	source string
 }
 
 // EnsureDB creates a new database with schema, if it is not already set up.
@@ -30,24 +106,444 @@ func (u *URLMap) EnsureDB() error {
 	}
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	db, err := sqlx.Connect("sqlite", u.Path)
+	db, err := sqlx.Connect("sqlite", urlmapDSN(u.Path))
 	if err != nil {
 		return err
 	}
+	if err := migrateURLMap(db); err != nil {
+		return err
+	}
 	_, err = db.Exec(urlmapSchema)
 	if err != nil {
 		return err
 	}
 	u.db = db
+	if u.BatchSize > 1 {
+		queueSize := u.QueueSize
+		if queueSize <= 0 {
+			queueSize = 10 * u.BatchSize
+		}
+		u.queue = make(chan urlPair, queueSize)
+		u.done = make(chan struct{})
+		go u.batchInserts()
+	}
 	return nil
 }
 
+// migrateURLMap adds the source column to databases created before it
+// existed.
+func migrateURLMap(db *sqlx.DB) error {
+	var tables, columns int
+	if err := db.Get(&tables, `select count(*) from sqlite_master where type = 'table' and name = 'map'`); err != nil {
+		return err
+	}
+	if tables == 0 {
+		return nil
+	}
+	if err := db.Get(&columns, `select count(*) from pragma_table_info('map') where name = 'source'`); err != nil {
+		return err
+	}
+	if columns > 0 {
+		return nil
+	}
+	_, err := db.Exec(`alter table map add column source text not null default ''`)
+	return err
+}
+
+// batchInserts writes queued pairs in batches, until the queue is closed.
+func (u *URLMap) batchInserts() {
+	defer close(u.done)
+	interval := u.FlushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var (
+		ticker = time.NewTicker(interval)
+		batch  = make([]urlPair, 0, u.BatchSize)
+	)
+	defer ticker.Stop()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := u.insertBatch(batch); err != nil {
+			slog.Warn("could not write urlmap batch", "err", err, "n", len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case p, ok := <-u.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) >= u.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// insertBatch inserts pairs in a single transaction.
+func (u *URLMap) insertBatch(batch []urlPair) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	tx, err := u.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into map (url, sha1, source) values (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range batch {
+		if _, err := stmt.Exec(p.url, p.sha1, p.source); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close writes pending inserts and closes the database. Insert must not be
+// called after Close.
+func (u *URLMap) Close() error {
+	if u.queue != nil {
+		close(u.queue)
+		<-u.done
+		u.queue = nil
+	}
+	if u.db == nil {
+		return nil
+	}
+	err := u.db.Close()
+	u.db = nil
+	return err
+}
+
 // Insert inserts a new pair into the database. We lock at the application
 // level to avoid 'database is locked (5) (SQLITE_BUSY)'. This will panic, if
-// the database has not been initialized before.
+// the database has not been initialized before. With batching enabled, the
+// pair is only queued and written later.
 func (u *URLMap) Insert(url, sha1 string) error {
+	return u.InsertSource(url, sha1, "")
+}
+
+// InsertSource inserts a new pair, together with the source it was received
+// from, e.g. a crawl.
+func (u *URLMap) InsertSource(url, sha1, source string) error {
+	if u.queue != nil {
+		u.queue <- urlPair{url: url, sha1: sha1, source: source}
+		return nil
+	}
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert into map (url, sha1, source) values (?, ?, ?)`, url, sha1, source)
+	u.mu.Unlock()
+	return err
+}
+
+// Lookup returns the most recently recorded entry for a SHA1, or nil, if
+// there is none.
+func (u *URLMap) Lookup(sha1 string) (*URLMapEntry, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var entries []URLMapEntry
+	err := u.db.Select(&entries, `select url, sha1, source,
+		coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', timestamp), '') as timestamp
+		from map where sha1 = ? order by rowid desc limit 1`, sha1)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
+// Known returns true, if anything is recorded for a file: an URL, a
+// processing state or a stored derivative.
+func (u *URLMap) Known(sha1 string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ok bool
+	err := u.db.Get(&ok, `select exists (select 1 from state where sha1 = ?)
+		or exists (select 1 from stored where sha1 = ?)
+		or exists (select 1 from map where sha1 = ?)`, sha1, sha1, sha1)
+	return ok, err
+}
+
+// Processing states of a file, as recorded with SetState.
+const (
+	StateSpooled    = "spooled"
+	StateProcessing = "processing"
+	StateDone       = "done"
+	StateFailed     = "failed"
+	StateRejected   = "rejected"
+)
+
+// ProcessingState is the last recorded processing state of a file.
+type ProcessingState struct {
+	SHA1Hex string `json:"sha1hex" db:"sha1"`
+	State   string `json:"state" db:"state"`
+	Reason  string `json:"reason,omitempty" db:"reason"`
+	Updated string `json:"updated" db:"updated"`
+}
+
+// SetState records the processing state of a file, with an optional reason,
+// e.g. an error message.
+func (u *URLMap) SetState(sha1, state, reason string) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert into state (sha1, state, reason, updated) values (?, ?, ?, CURRENT_TIMESTAMP)
+		on conflict (sha1) do update set state = excluded.state, reason = excluded.reason,
+		updated = excluded.updated`, sha1, state, reason)
+	u.mu.Unlock()
+	return err
+}
+
+// State returns the processing state of a file, nil if none is recorded.
+func (u *URLMap) State(sha1 string) (*ProcessingState, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var states []ProcessingState
+	err := u.db.Select(&states, `select sha1, state, reason,
+		coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', updated), '') as updated
+		from state where sha1 = ?`, sha1)
+	if err != nil || len(states) == 0 {
+		return nil, err
+	}
+	return &states[0], nil
+}
+
+// States returns the processing states of a number of files, keyed by SHA1.
+// Files without a recorded state are missing from the result.
+func (u *URLMap) States(sha1s []string) (map[string]*ProcessingState, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make(map[string]*ProcessingState)
+	// Stay below the sqlite limit for query parameters.
+	for len(sha1s) > 0 {
+		chunk := sha1s[:min(len(sha1s), 500)]
+		sha1s = sha1s[len(chunk):]
+		query, args, err := sqlx.In(`select sha1, state, reason,
+			coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', updated), '') as updated
+			from state where sha1 in (?)`, chunk)
+		if err != nil {
+			return nil, err
+		}
+		var states []ProcessingState
+		if err := u.db.Select(&states, query, args...); err != nil {
+			return nil, err
+		}
+		for i := range states {
+			result[states[i].SHA1Hex] = &states[i]
+		}
+	}
+	return result, nil
+}
+
+// SetStored records, that a kind of derivative of a file has been stored.
+func (u *URLMap) SetStored(sha1, kind string) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert or ignore into stored (sha1, kind) values (?, ?)`, sha1, kind)
+	u.mu.Unlock()
+	return err
+}
+
+// Stored returns the sorted kinds of derivatives recorded as stored for a
+// file.
+func (u *URLMap) Stored(sha1 string) ([]string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var kinds []string
+	err := u.db.Select(&kinds, `select kind from stored where sha1 = ? order by kind`, sha1)
+	return kinds, err
+}
+
+// ClearStored forgets all derivatives recorded as stored for a file.
+func (u *URLMap) ClearStored(sha1 string) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`delete from stored where sha1 = ?`, sha1)
+	u.mu.Unlock()
+	return err
+}
+
+// SetResultVersion records the versions a file has been processed with
+// successfully, cf. ResultVersion.
+func (u *URLMap) SetResultVersion(sha1, version string) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert into result (sha1, version, updated) values (?, ?, CURRENT_TIMESTAMP)
+		on conflict (sha1) do update set version = excluded.version, updated = excluded.updated`, sha1, version)
+	u.mu.Unlock()
+	return err
+}
+
+// ResultVersion returns the versions a file has last been processed with
+// successfully, the empty string if none are recorded.
+func (u *URLMap) ResultVersion(sha1 string) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var versions []string
+	err := u.db.Select(&versions, `select version from result where sha1 = ?`, sha1)
+	if err != nil || len(versions) == 0 {
+		return "", err
+	}
+	return versions[0], nil
+}
+
+// Checksums of a file, as computed when it was received, so they need not be
+// computed again when it is processed.
+type Checksums struct {
+	SHA1   string `db:"sha1"`
+	MD5    string `db:"md5"`
+	SHA256 string `db:"sha256"`
+	Size   int64  `db:"size"`
+}
+
+// SetChecksums records the checksums of a file.
+func (u *URLMap) SetChecksums(c Checksums) error {
 	u.mu.Lock()
-	_, err := u.db.Exec(`insert into map (url, sha1) values (?, ?)`, url, sha1)
+	_, err := u.db.Exec(`insert or replace into checksum (sha1, md5, sha256, size) values (?, ?, ?, ?)`,
+		c.SHA1, c.MD5, c.SHA256, c.Size)
 	u.mu.Unlock()
 	return err
 }
+
+// Checksums returns the recorded checksums of a file, nil if there are none.
+func (u *URLMap) Checksums(sha1 string) (*Checksums, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var result []Checksums
+	err := u.db.Select(&result, `select sha1, md5, sha256, size from checksum where sha1 = ?`, sha1)
+	if err != nil || len(result) == 0 {
+		return nil, err
+	}
+	return &result[0], nil
+}
+
+// GaugeGrobidBacklog is the number of files waiting for or being processed by
+// GROBID, as reported by blobproc.
+const GaugeGrobidBacklog = "grobid_backlog"
+
+// Gauge is the last reported value of a measurement, e.g. the number of files
+// waiting for GROBID.
+type Gauge struct {
+	Name    string    `json:"name"`
+	Value   int64     `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+// SetGauge records the current value of a gauge.
+func (u *URLMap) SetGauge(name string, value int64) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert into gauge (name, value, updated) values (?, ?, ?)
+		on conflict (name) do update set value = excluded.value, updated = excluded.updated`,
+		name, value, time.Now().Unix())
+	u.mu.Unlock()
+	return err
+}
+
+// Gauge returns the last reported value of a gauge, nil if none is recorded.
+func (u *URLMap) Gauge(name string) (*Gauge, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var rows []struct {
+		Value   int64 `db:"value"`
+		Updated int64 `db:"updated"`
+	}
+	if err := u.db.Select(&rows, `select value, updated from gauge where name = ?`, name); err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return &Gauge{Name: name, Value: rows[0].Value, Updated: time.Unix(rows[0].Updated, 0).UTC()}, nil
+}
+
+// AddUsage adds a number of bytes to the usage of a source on a given day,
+// formatted as YYYY-MM-DD.
+func (u *URLMap) AddUsage(source, day string, n int64) error {
+	u.mu.Lock()
+	_, err := u.db.Exec(`insert into usage (source, day, bytes) values (?, ?, ?)
+		on conflict (source, day) do update set bytes = bytes + excluded.bytes`, source, day, n)
+	u.mu.Unlock()
+	return err
+}
+
+// Usage returns the number of bytes ingested from a source on a given day,
+// formatted as YYYY-MM-DD.
+func (u *URLMap) Usage(source, day string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var n int64
+	err := u.db.Get(&n, `select coalesce(sum(bytes), 0) from usage where source = ? and day = ?`, source, day)
+	return n, err
+}
+
+// URLMapEntry is a single URL and SHA1 pair, with the time it was recorded in
+// RFC3339 format and the source it was received from, if known.
+type URLMapEntry struct {
+	URL       string `json:"url" db:"url"`
+	SHA1      string `json:"sha1" db:"sha1"`
+	Timestamp string `json:"timestamp" db:"timestamp"`
+	Source    string `json:"source,omitempty" db:"source"`
+}
+
+// Export calls fn for each URL and SHA1 pair, in insertion order.
+func (u *URLMap) Export(fn func(URLMapEntry) error) error {
+	rows, err := u.db.Queryx(`select url, sha1, source,
+		coalesce(strftime('%Y-%m-%dT%H:%M:%SZ', timestamp), '') as timestamp
+		from map order by rowid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry URLMapEntry
+		if err := rows.StructScan(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Import inserts entries in a single transaction and returns the number of
+// entries added. Entries that are already recorded with the same timestamp
+// are skipped, so exports from several nodes can be merged. Entries without
+// timestamp get the current time.
+func (u *URLMap) Import(entries []URLMapEntry) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	tx, err := u.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into map (url, sha1, timestamp, source)
+		select ?1, ?2, coalesce(datetime(?3), CURRENT_TIMESTAMP), ?4
+		where not exists (
+			select 1 from map where url = ?1 and sha1 = ?2
+			and timestamp = coalesce(datetime(?3), CURRENT_TIMESTAMP))`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	var n int
+	for _, entry := range entries {
+		var ts any
+		if entry.Timestamp != "" {
+			ts = entry.Timestamp
+		}
+		res, err := stmt.Exec(entry.URL, entry.SHA1, ts, entry.Source)
+		if err != nil {
+			return 0, err
+		}
+		k, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n += int(k)
+	}
+	return n, tx.Commit()
+}
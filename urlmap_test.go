@@ -1,11 +1,17 @@
 package blobproc
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/miku/blobproc/dedent"
 )
 
@@ -30,6 +36,100 @@ func TestURLMap(t *testing.T) {
 	t.Log("✅\n" + s)
 }
 
+func TestURLMapBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urlmap.db")
+	u := &URLMap{Path: path, BatchSize: 10, FlushInterval: time.Hour}
+	if err := u.EnsureDB(); err != nil {
+		t.Fatalf("could not create db: %v", err)
+	}
+	var mode string
+	if err := u.db.Get(&mode, "pragma journal_mode"); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("got %v, want wal", mode)
+	}
+	for i := 0; i < 25; i++ {
+		if err := u.Insert(fmt.Sprintf("https://example.com/%d", i), "123"); err != nil {
+			t.Fatalf("could not insert into db: %v", err)
+		}
+	}
+	// Pending inserts are written on close.
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+	v := &URLMap{Path: path}
+	if err := v.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	var n int
+	if err := v.db.Get(&n, "select count(*) from map"); err != nil {
+		t.Fatal(err)
+	}
+	if n != 25 {
+		t.Fatalf("got %v, want 25", n)
+	}
+}
+
+func TestURLMapExportImport(t *testing.T) {
+	dir := t.TempDir()
+	src := &URLMap{Path: filepath.Join(dir, "src.db")}
+	if err := src.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, v := range []string{"a", "b"} {
+		if err := src.Insert("https://example.com/"+v, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export := func(u *URLMap) []URLMapEntry {
+		var result []URLMapEntry
+		if err := u.Export(func(e URLMapEntry) error {
+			result = append(result, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	exported := export(src)
+	if len(exported) != 2 || exported[0].URL != "https://example.com/a" || exported[1].SHA1 != "b" {
+		t.Fatalf("got %v, want two entries", exported)
+	}
+	if _, err := time.Parse(time.RFC3339, exported[0].Timestamp); err != nil {
+		t.Fatalf("got %v, want RFC3339 timestamp", exported[0].Timestamp)
+	}
+	dst := &URLMap{Path: filepath.Join(dir, "dst.db")}
+	if err := dst.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	var cases = []struct {
+		about   string
+		entries []URLMapEntry
+		n       int
+	}{
+		{"import", exported, 2},
+		{"import again", exported, 0},
+		{"merge", []URLMapEntry{exported[0], {URL: "https://example.com/c", SHA1: "c", Timestamp: "2024-01-01T00:00:00Z"}}, 1},
+	}
+	for _, c := range cases {
+		n, err := dst.Import(c.entries)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if n != c.n {
+			t.Fatalf("[%s] got %v, want %v", c.about, n, c.n)
+		}
+	}
+	result := export(dst)
+	if len(result) != 3 || result[0] != exported[0] || result[2].Timestamp != "2024-01-01T00:00:00Z" {
+		t.Fatalf("got %v, want imported entries", result)
+	}
+}
+
 func renderTable(path string) (string, error) {
 	if _, err := exec.LookPath("sqlite3"); err != nil {
 		return "", err
@@ -45,3 +145,151 @@ func renderTable(path string) (string, error) {
 	}
 	return string(b), nil
 }
+
+func TestURLMapLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urlmap.db")
+	// Database created before the source column existed.
+	db, err := sqlx.Connect("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`create table map (url text not null, sha1 text not null,
+		timestamp datetime default CURRENT_TIMESTAMP);
+		insert into map (url, sha1) values ('https://example.org/old.pdf', 'a')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	u := &URLMap{Path: path}
+	if err := u.EnsureDB(); err != nil {
+		t.Fatalf("could not migrate db: %v", err)
+	}
+	defer u.Close()
+	if err := u.InsertSource("https://example.org/new.pdf", "a", "crawl-1"); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		sha1   string
+		url    string
+		source string
+	}{
+		{"a", "https://example.org/new.pdf", "crawl-1"},
+		{"b", "", ""},
+	}
+	for _, c := range cases {
+		entry, err := u.Lookup(c.sha1)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.sha1, err)
+		}
+		var url, source string
+		if entry != nil {
+			url, source = entry.URL, entry.Source
+		}
+		if url != c.url || source != c.source {
+			t.Fatalf("[%s] got %v %v, want %v %v", c.sha1, url, source, c.url, c.source)
+		}
+	}
+}
+
+func TestURLMapChecksums(t *testing.T) {
+	u := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	want := Checksums{SHA1: "a", MD5: "b", SHA256: "c", Size: 5}
+	if err := u.SetChecksums(want); err != nil {
+		t.Fatal(err)
+	}
+	// Recording a file again is fine.
+	if err := u.SetChecksums(want); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		sha1 string
+		want *Checksums
+	}{
+		{"a", &want},
+		{"x", nil},
+	}
+	for _, c := range cases {
+		got, err := u.Checksums(c.sha1)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.sha1, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("[%s] got %v, want %v", c.sha1, got, c.want)
+		}
+	}
+}
+
+func TestURLMapKnown(t *testing.T) {
+	u := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if err := u.InsertSource("https://example.org/a.pdf", "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetState("b", StateDone, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SetStored("c", "text"); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		sha1 string
+		want bool
+	}{
+		{"a", true},
+		{"b", true},
+		{"c", true},
+		{"x", false},
+	}
+	for _, c := range cases {
+		got, err := u.Known(c.sha1)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.sha1, err)
+		}
+		if got != c.want {
+			t.Fatalf("[%s] got %v, want %v", c.sha1, got, c.want)
+		}
+	}
+}
+
+func TestURLMapPragmas(t *testing.T) {
+	u := &URLMap{Path: filepath.Join(t.TempDir(), "urlmap.db")}
+	if err := u.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	// Hold several connections at once, so the pool cannot hand out the same
+	// connection twice.
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		conn, err := u.db.Connx(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var cases = []struct {
+			pragma string
+			want   string
+		}{
+			{"busy_timeout", "5000"},
+			{"journal_mode", "wal"},
+			{"synchronous", "1"},
+		}
+		for _, c := range cases {
+			var got string
+			if err := conn.GetContext(ctx, &got, "pragma "+c.pragma); err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Fatalf("[%d %s] got %v, want %v", i, c.pragma, got, c.want)
+			}
+		}
+	}
+}
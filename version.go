@@ -1,4 +1,109 @@
 package blobproc
 
+import (
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/grobidclient"
+)
+
 // Version of library and cli tools.
 const Version = "0.3.26 "
+
+// Commit returns the VCS revision the binary was built from, with a "-dirty"
+// suffix for modified trees, or the empty string, if unknown, e.g. in tests.
+var Commit = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var revision, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if revision != "" && modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+})
+
+// UserAgent returns the User-Agent used for outgoing HTTP requests.
+func UserAgent() string {
+	ua := "blobproc/" + strings.TrimSpace(Version)
+	if c := Commit(); c != "" {
+		ua += " (" + c + ")"
+	}
+	return ua + " +https://github.com/miku/blobproc"
+}
+
+// Provenance returns version, commit and external tool versions, recorded
+// with results and derivatives.
+var Provenance = sync.OnceValue(func() *pdfextract.Provenance {
+	return &pdfextract.Provenance{
+		Version: strings.TrimSpace(Version),
+		Commit:  Commit(),
+		Tools:   pdfextract.ToolVersions(),
+	}
+})
+
+// ResultVersion identifies the software derivatives are produced with, the
+// blobproc version and the versions of the external tools, like
+// "0.3.26 pdftotext=22.02.0". The commit is not included, so a rebuild of the
+// same version does not invalidate previous results.
+func ResultVersion() string {
+	p := Provenance()
+	parts := []string{p.Version}
+	for name, v := range p.Tools {
+		parts = append(parts, name+"="+v)
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, " ")
+}
+
+// provenanceMetadata returns the provenance as S3 object metadata.
+func provenanceMetadata(p *pdfextract.Provenance) map[string]string {
+	md := map[string]string{"blobproc-version": p.Version}
+	if p.Commit != "" {
+		md["blobproc-commit"] = p.Commit
+	}
+	if len(p.Tools) > 0 {
+		var tools []string
+		for name, v := range p.Tools {
+			tools = append(tools, name+"="+v)
+		}
+		sort.Strings(tools)
+		md["blobproc-tools"] = strings.Join(tools, ",")
+	}
+	return md
+}
+
+// userAgentDoer sets the User-Agent header on each request.
+type userAgentDoer struct {
+	doer interface {
+		Do(*http.Request) (*http.Response, error)
+	}
+}
+
+func (d userAgentDoer) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", UserAgent())
+	return d.doer.Do(req)
+}
+
+// NewGrobid returns a GROBID client, which identifies as blobproc.
+func NewGrobid(host string) *grobidclient.Grobid {
+	g := grobidclient.New(host)
+	g.Client = userAgentDoer{doer: g.Client}
+	return g
+}
@@ -0,0 +1,62 @@
+package blobproc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miku/blobproc/pdfextract"
+)
+
+func TestProvenanceMetadata(t *testing.T) {
+	var cases = []struct {
+		about      string
+		provenance *pdfextract.Provenance
+		result     map[string]string
+	}{
+		{
+			about:      "version only",
+			provenance: &pdfextract.Provenance{Version: "0.3.26"},
+			result:     map[string]string{"blobproc-version": "0.3.26"},
+		},
+		{
+			about: "commit and tools",
+			provenance: &pdfextract.Provenance{
+				Version: "0.3.26",
+				Commit:  "abc123",
+				Tools:   map[string]string{"pdftotext": "22.02.0", "pdfcpu": "v0.8.0"},
+			},
+			result: map[string]string{
+				"blobproc-version": "0.3.26",
+				"blobproc-commit":  "abc123",
+				"blobproc-tools":   "pdfcpu=v0.8.0,pdftotext=22.02.0",
+			},
+		},
+	}
+	for _, c := range cases {
+		result := provenanceMetadata(c.provenance)
+		if len(result) != len(c.result) {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+		}
+		for k, v := range c.result {
+			if result[k] != v {
+				t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+			}
+		}
+	}
+}
+
+func TestNewGrobidUserAgent(t *testing.T) {
+	var ua string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+	if err := NewGrobid(ts.URL).Ping(); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if ua != UserAgent() || !strings.HasPrefix(ua, "blobproc/"+strings.TrimSpace(Version)) {
+		t.Fatalf("got %v, want %v", ua, UserAgent())
+	}
+}
@@ -1,24 +1,32 @@
 package blobproc
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/miku/blobproc/pdfextract"
+	"github.com/miku/blobproc/spool"
 	"github.com/miku/grobidclient"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // WalkStats are a poor mans metrics.
 type WalkStats struct {
 	Processed int64
 	OK        int64
+	// LowDiskWaits counts the times dispatching paused for lack of scratch
+	// space.
+	LowDiskWaits int64
 }
 
 // SuccessRatio calculates the ration of successful to total processed files.
@@ -35,195 +43,748 @@ func (ws *WalkStats) SuccessRatio() float64 {
 type Payload struct {
 	Path     string
 	FileInfo fs.FileInfo
+	key      string // object key, if the file is a download from an S3 spool
+}
+
+// Order determines the order in which files from the spool are dispatched to
+// workers.
+type Order string
+
+const (
+	OrderNone     Order = ""         // Walk order, files are dispatched as soon as they are found.
+	OrderOldest   Order = "oldest"   // Oldest files by modification time first.
+	OrderSmallest Order = "smallest" // Smallest files first.
+)
+
+// ParseOrder returns the Order for a given name, or an error for an unknown name.
+func ParseOrder(s string) (Order, error) {
+	switch o := Order(s); o {
+	case OrderNone, OrderOldest, OrderSmallest:
+		return o, nil
+	default:
+		return OrderNone, fmt.Errorf("unknown order: %q", s)
+	}
 }
 
 // WalkFast is a walker that runs postprocessing in parallel.
 type WalkFast struct {
-	Dir               string
-	NumWorkers        int
-	KeepSpool         bool
+	Dir        string
+	NumWorkers int
+	KeepSpool  bool
+	// Order, if set, requires the whole spool to be listed first, so files
+	// can be sorted before they are dispatched, e.g. to process small files
+	// before a large backlog of huge files.
+	Order Order
+	// ScratchDir is the base directory for per-worker scratch directories,
+	// which are cleaned after each file. If empty, a temporary directory is
+	// used. If the scratch directory is located within the spool directory, it
+	// is excluded from the walk.
+	ScratchDir string
+	// RejectedDir is the directory, files of unsupported types or files
+	// exceeding a limit are moved to, along with a file stating the reason.
+	// If empty, rejected files are removed from the spool like any other
+	// file.
+	RejectedDir string
+	// Require lists kinds of derivatives, like "text" or "tei", that must
+	// be stored, before a PDF file is removed from the spool. Files, for
+	// which a derivative could not be stored, are never removed.
+	Require []string
+	// FailedDir is the directory, files with derivatives missing are moved
+	// to, along with a file stating the reason. If empty, these files stay
+	// in the spool and are processed again by the next walk.
+	FailedDir string
+	// Trash, if set, keeps processed files for a retention period, instead
+	// of removing them from the spool right away. Files expired from the
+	// trash are purged at the start of each run. Objects from an S3 spool are
+	// not kept.
+	Trash *Trash
+	// ParallelWalk walks each top level shard of the spool directory in a
+	// separate goroutine, which speeds up listing large spools.
+	ParallelWalk bool
+	// GrobidWorkers, if positive, decouples GROBID requests from local
+	// extraction: workers only run local tools and pass files on to a
+	// bounded queue, served by this number of GROBID workers. This way, slow
+	// GROBID requests do not limit thumbnail and text extraction throughput.
+	GrobidWorkers int
+	// Checkpoint, if set, records progress, so an interrupted walk can be
+	// resumed. Cannot be combined with Order or ParallelWalk.
+	Checkpoint *Checkpoint
+	// Leaser, if set, claims each file before it is processed, so several
+	// instances can share a spool directory. Files claimed by another
+	// instance are skipped.
+	Leaser *Leaser
+	// S3Spool, if set, is processed instead of the spool directory. Objects
+	// are downloaded into the scratch directory. Cannot be combined with
+	// Order, ParallelWalk or Checkpoint.
+	S3Spool *S3Spool
+	// BacklogInterval is how often the GROBID backlog is recorded in the URL
+	// map of the pipeline, if there is one, so blobprocd can turn away
+	// uploads. Defaults to five seconds.
+	BacklogInterval time.Duration
+	// MinScratchFree is the number of bytes, that must be free in the
+	// scratch directory, before another file is dispatched, since external
+	// tools need temporary space. Zero disables the check.
+	MinScratchFree    int64
 	GrobidMaxFileSize int64
 	Timeout           time.Duration
 	Grobid            *grobidclient.Grobid
 	S3                *WrapS3
-	stats             *WalkStats
+	// Pipeline to run for each file. If nil, a pipeline is set up from the
+	// Grobid, S3 and GrobidMaxFileSize fields.
+	Pipeline    *Pipeline
+	pipeline    *Pipeline
+	stats       *WalkStats
+	grobidQueue chan grobidTask
+	backlog     int64 // files waiting for or sent to GROBID
+
+	mu      sync.Mutex
+	slots   *slots       // limits the number of files processed concurrently
+	started int          // number of local workers started
+	spawn   func() error // starts another local worker, set while running
+}
+
+// slots is a counting semaphore with an adjustable limit.
+type slots struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	limit  int
+}
+
+func newSlots(limit int) *slots {
+	s := &slots{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire waits for a free slot, or until the context is cancelled.
+func (s *slots) acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.active >= s.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.cond.Wait()
+	}
+	s.active++
+	return nil
+}
+
+func (s *slots) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.cond.Broadcast()
+}
+
+func (s *slots) setLimit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+	s.cond.Broadcast()
+}
+
+// SetWorkers changes the number of files processed concurrently by local
+// workers, also while running, e.g. after a config reload. Additional workers
+// are started as needed; when the number is reduced, surplus workers stay idle.
+func (w *WalkFast) SetWorkers(n int) error {
+	if n < 1 {
+		return fmt.Errorf("invalid number of workers: %d", n)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.NumWorkers = n
+	if w.spawn == nil {
+		return nil
+	}
+	for w.started < n {
+		if err := w.spawn(); err != nil {
+			return err
+		}
+	}
+	w.slots.setLimit(n)
+	return nil
+}
+
+// grobidTask is a file, that has been processed locally and waits for GROBID.
+type grobidTask struct {
+	payload Payload
+	pr      *ProcessResult
+	doc     *Document
+	started time.Time
 }
 
 // worker can process path from a queue in a thread. If the worker context is
-// cancelled, it will wrap up the last processing step and then tear down.
-func (w *WalkFast) worker(wctx context.Context, workerName string, queue chan Payload, wg *sync.WaitGroup) {
+// cancelled, it will wrap up the last processing step and then tear down. If
+// a GROBID queue is set up, the worker only runs local processing steps and
+// hands files over to the GROBID workers.
+func (w *WalkFast) worker(wctx context.Context, workerName, scratchDir string, queue chan Payload, wg *sync.WaitGroup) {
 	defer wg.Done()
 	logger := slog.With(
 		slog.String("worker", workerName),
 	)
+	defer func() {
+		if err := os.RemoveAll(scratchDir); err != nil {
+			logger.Warn("could not remove scratch directory", "err", err, "dir", scratchDir)
+		}
+	}()
 	for payload := range queue {
-		select {
-		case <-wctx.Done():
-			break
-		default:
-			wrapper := func() {
-				var (
-					path    = payload.Path
-					started = time.Now()
-					errors  []error
-				)
-				logger.Debug("processing", "path", path)
-				atomic.AddInt64(&w.stats.Processed, 1)
-				defer func() {
-					if !w.KeepSpool {
-						if _, err := os.Stat(path); err == nil {
-							if err := os.Remove(path); err != nil {
-								logger.Warn("error removing file from spool", "err", err, "path", path)
-							}
-						}
-					} else {
-						logger.Debug("keeping file in spool", "path", path)
-					}
-				}()
-				ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
-				defer cancel()
-				// Fulltext and thumbail via local command line tools
-				// --------------------------------------------------
-				result := pdfextract.ProcessFile(ctx, path, &pdfextract.Options{
-					Dim:       pdfextract.Dim{180, 300},
-					ThumbType: "JPEG",
-				})
-				switch {
-				case result.Status != "success":
-					logger.Warn("pdfextract failed", "status", result.Status, "err", result.Err)
-					errors = append(errors, result.Err)
-				case len(result.SHA1Hex) != 40:
-					logger.Warn("invalid sha1 in response", "sha1", result.SHA1Hex)
-					errors = append(errors, fmt.Errorf("invalid SHA1 in response: %v", result.SHA1Hex))
-				case result.Status == "success":
-					// If we have a thumbnail, save it.
-					if result.HasPage0Thumbnail() {
-						opts := BlobRequestOptions{
-							Bucket:  "thumbnail",
-							Folder:  "pdf",
-							Blob:    result.Page0Thumbnail,
-							SHA1Hex: result.SHA1Hex,
-							Ext:     "180px.jpg",
-							Prefix:  "",
-						}
-						resp, err := w.S3.PutBlob(ctx, &opts)
-						if err != nil {
-							logger.Error("s3 failed (thumbnail)", "err", err, "sha1", result.SHA1Hex)
-							errors = append(errors, fmt.Errorf("s3 failed (thumbnail): %v", result.SHA1Hex))
-						} else {
-							logger.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-						}
-					}
-					// If we have some text, save it.
-					if len(result.Text) > 0 {
-						opts := BlobRequestOptions{
-							Bucket:  "sandcrawler",
-							Folder:  "text",
-							Blob:    []byte(result.Text),
-							SHA1Hex: result.SHA1Hex,
-							Ext:     "txt",
-							Prefix:  "",
-						}
-						resp, err := w.S3.PutBlob(ctx, &opts)
-						if err != nil {
-							logger.Error("s3 failed (text)", "err", err, "sha1", result.SHA1Hex)
-							errors = append(errors, fmt.Errorf("s3 failed (text): %v", result.SHA1Hex))
-						} else {
-							logger.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-						}
-					}
-				}
-				if payload.FileInfo.Size() > w.GrobidMaxFileSize {
-					logger.Warn("skipping too large file", "path", path, "size", payload.FileInfo.Size())
-					return
-				}
-				// Structured metadata from PDF via grobid
-				// ---------------------------------------
-				gres, err := w.Grobid.ProcessPDFContext(ctx, path, "processFulltextDocument", &grobidclient.Options{
-					GenerateIDs:            true,
-					ConsolidateHeader:      true,
-					ConsolidateCitations:   false, // "too expensive for now"
-					IncludeRawCitations:    true,
-					IncluseRawAffiliations: true,
-					TEICoordinates:         []string{"ref", "figure", "persName", "formula", "biblStruct"},
-					SegmentSentences:       true,
-				})
-				switch {
-				case err != nil || gres.Err != nil:
-					logger.Warn("grobid failed", "err", err)
-					return
-				default:
-					opts := BlobRequestOptions{
-						Bucket:  "sandcrawler",
-						Folder:  "grobid",
-						Blob:    gres.Body,
-						SHA1Hex: gres.SHA1Hex,
-						Ext:     "tei.xml",
-						Prefix:  "",
-					}
-					resp, err := w.S3.PutBlob(ctx, &opts)
-					if err != nil {
-						logger.Error("s3 failed (tei)", "err", err)
-						errors = append(errors, fmt.Errorf("s3 failed (tei): %v", err))
-					} else {
-						logger.Debug("s3 put ok", "bucket", resp.Bucket, "path", resp.ObjectPath)
-					}
-				}
-				if len(errors) == 0 {
-					logger.Debug("processing finished successfully", "path", path, "t", time.Since(started), "ts", time.Since(started).Seconds())
-					atomic.AddInt64(&w.stats.OK, 1)
-				} else {
-					logger.Warn("processing finished with some errors",
-						"path", path,
-						"num_errors", len(errors),
-						"t", time.Since(started),
-						"ts", time.Since(started).Seconds(),
-					)
-				}
+		w.process(wctx, logger, payload, scratchDir)
+		w.slots.release()
+	}
+	logger.Debug("worker shutdown ok")
+}
+
+// process runs the local processing steps for a single file and either
+// finishes it or hands it over to the GROBID workers.
+func (w *WalkFast) process(wctx context.Context, logger *slog.Logger, payload Payload, scratchDir string) {
+	select {
+	case <-wctx.Done():
+		w.skip(payload.Path)
+		return
+	default:
+	}
+	if w.Leaser != nil {
+		if err := w.Leaser.Acquire(payload.Path); err != nil {
+			logger.Debug("skipping file", "path", payload.Path, "err", err)
+			w.skip(payload.Path)
+			return
+		}
+		if _, err := os.Stat(payload.Path); err != nil {
+			// Processed and removed by another instance, after we found it.
+			logger.Debug("skipping file", "path", payload.Path, "err", err)
+			w.releaseLease(logger, payload.Path)
+			w.skip(payload.Path)
+			return
+		}
+	}
+	logger.Debug("processing", "path", payload.Path)
+	atomic.AddInt64(&w.stats.Processed, 1)
+	if w.grobidQueue == nil {
+		atomic.AddInt64(&w.backlog, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+		pr := w.pipeline.Process(ctx, payload, scratchDir)
+		cancel()
+		atomic.AddInt64(&w.backlog, -1)
+		w.finish(logger, payload, pr, scratchDir)
+		return
+	}
+	if pr := w.pipeline.cachedResult(payload.Path); pr != nil {
+		w.finish(logger, payload, pr, scratchDir)
+		return
+	}
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	ctx, span := startSpan(ctx, "process.local",
+		attribute.String("path", payload.Path),
+		attribute.Int64("size", payload.FileInfo.Size()),
+	)
+	id := spool.ID(payload.Path)
+	prior := w.pipeline.storedBefore(id)
+	w.pipeline.setState(id, StateProcessing, "")
+	pr, doc := w.pipeline.processLocal(ctx, payload, scratchDir, prior)
+	endSpan(span, pr.Err())
+	cancel()
+	if doc == nil {
+		pr.Elapsed = time.Since(started)
+		w.pipeline.recordOutcome(id, pr)
+		w.finish(logger, payload, pr, scratchDir)
+		return
+	}
+	// The local extraction result is kept in memory, so scratch space can be
+	// reused right away.
+	if err := cleanDir(scratchDir); err != nil {
+		logger.Warn("could not clean scratch directory", "err", err, "dir", scratchDir)
+	}
+	atomic.AddInt64(&w.backlog, 1)
+	w.grobidQueue <- grobidTask{payload: payload, pr: pr, doc: doc, started: started}
+}
+
+// GrobidBacklog returns the number of files waiting for GROBID or currently
+// being processed by GROBID.
+func (w *WalkFast) GrobidBacklog() int64 {
+	return atomic.LoadInt64(&w.backlog)
+}
+
+// lowDiskInterval is the time between checks for free scratch space, while
+// dispatching is paused.
+var lowDiskInterval = 5 * time.Second
+
+// waitScratchSpace blocks, while less than MinScratchFree bytes are free in
+// the scratch directory, or until the context is cancelled. If free space
+// cannot be determined, it does not block.
+func (w *WalkFast) waitScratchSpace(ctx context.Context, dir string) error {
+	if w.MinScratchFree <= 0 {
+		return nil
+	}
+	for i := 0; ; i++ {
+		free, _, err := diskUsageFunc(dir)
+		if err != nil {
+			slog.Warn("could not determine free scratch space", "err", err, "dir", dir)
+			return nil
+		}
+		if int64(free) >= w.MinScratchFree {
+			if i > 0 {
+				slog.Info("scratch space available again, resuming", "dir", dir, "free", free)
 			}
-			wrapper() // for defer
+			return nil
+		}
+		if i == 0 {
+			slog.Warn("low scratch space, pausing dispatch", "dir", dir, "free", free, "min", w.MinScratchFree)
+			atomic.AddInt64(&w.stats.LowDiskWaits, 1)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lowDiskInterval):
 		}
 	}
+}
+
+// reportBacklog records the GROBID backlog in the URL map in regular
+// intervals, until done is closed.
+func (w *WalkFast) reportBacklog(urlMap *URLMap, done <-chan struct{}) {
+	interval := w.BacklogInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := urlMap.SetGauge(GaugeGrobidBacklog, w.GrobidBacklog()); err != nil {
+			slog.Warn("could not record grobid backlog", "err", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// grobidWorker sends files, that have been processed locally, to GROBID and
+// runs the remaining stages.
+func (w *WalkFast) grobidWorker(workerName, scratchDir string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger := slog.With(
+		slog.String("worker", workerName),
+	)
+	defer func() {
+		if err := os.RemoveAll(scratchDir); err != nil {
+			logger.Warn("could not remove scratch directory", "err", err, "dir", scratchDir)
+		}
+	}()
+	for task := range w.grobidQueue {
+		ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+		ctx, span := startSpan(ctx, "process.remote",
+			attribute.String("path", task.payload.Path),
+			attribute.String("sha1", task.pr.SHA1Hex),
+		)
+		task.doc.TempDir = scratchDir
+		w.pipeline.processRemote(ctx, task.payload, task.pr, task.doc)
+		endSpan(span, task.pr.Err())
+		cancel()
+		atomic.AddInt64(&w.backlog, -1)
+		task.pr.Elapsed = time.Since(task.started)
+		w.pipeline.recordOutcome(spool.ID(task.payload.Path), task.pr)
+		w.finish(logger, task.payload, task.pr, scratchDir)
+	}
 	logger.Debug("worker shutdown ok")
 }
 
+// finish records the outcome of processing a file, removes the file from the
+// spool, unless derivatives are missing, and cleans up the scratch directory.
+func (w *WalkFast) finish(logger *slog.Logger, payload Payload, pr *ProcessResult, scratchDir string) {
+	path := payload.Path
+	switch {
+	case pr.Rejected != "":
+		logger.Warn("file rejected", "path", path, "reason", pr.Rejected)
+	case pr.OK():
+		logger.Debug("processing finished successfully", "path", path, "t", pr.Elapsed, "ts", pr.Elapsed.Seconds())
+		atomic.AddInt64(&w.stats.OK, 1)
+	default:
+		logger.Warn("processing finished with some errors",
+			"path", path,
+			"num_errors", len(pr.Errors),
+			"grobid_skipped", pr.GrobidSkipped,
+			"t", pr.Elapsed,
+			"ts", pr.Elapsed.Seconds(),
+		)
+	}
+	d := w.disposal()
+	if payload.key != "" {
+		if d.release(logger, path, pr) {
+			ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+			if err := w.S3Spool.remove(ctx, payload.key); err != nil {
+				logger.Warn("error removing object from spool", "err", err, "key", payload.key)
+			}
+			cancel()
+		}
+		// Downloads from an S3 spool are removed in any case.
+		removeFile(logger, path, "", nil)
+	} else {
+		d.settle(logger, path, pr)
+	}
+	if err := cleanDir(scratchDir); err != nil {
+		logger.Warn("could not clean scratch directory", "err", err, "dir", scratchDir)
+	}
+	if w.Checkpoint != nil {
+		w.Checkpoint.Done(path)
+	}
+	if w.Leaser != nil {
+		w.releaseLease(logger, path)
+	}
+}
+
+// skip marks a dispatched file as done in the checkpoint without processing
+// it, e.g. if another instance holds its lease, so the checkpoint can still
+// advance past its shard.
+func (w *WalkFast) skip(path string) {
+	if w.Checkpoint != nil {
+		w.Checkpoint.Done(path)
+	}
+}
+
+// disposal returns how processed files leave the spool.
+func (w *WalkFast) disposal() *disposal {
+	return &disposal{
+		dir:         w.Dir,
+		keepSpool:   w.KeepSpool,
+		rejectedDir: w.RejectedDir,
+		require:     w.Require,
+		failedDir:   w.FailedDir,
+		trash:       w.Trash,
+	}
+}
+
+// disposal decides, what happens to a file in the spool after processing. It
+// is shared by the sequential and the parallel walk.
+type disposal struct {
+	dir         string
+	keepSpool   bool
+	rejectedDir string
+	require     []string
+	failedDir   string
+	trash       *Trash
+}
+
+// release moves rejected files and files with required derivatives missing
+// out of the spool, if there is a directory for them, and returns true, if
+// the file is done with and should be removed from the spool. Files with
+// derivatives missing and no directory for failed files are kept for a retry.
+func (d *disposal) release(logger *slog.Logger, path string, pr *ProcessResult) bool {
+	if d.keepSpool {
+		return false
+	}
+	if pr.Rejected != "" {
+		if d.rejectedDir != "" {
+			if err := RejectFile(path, d.rejectedDir, pr.Rejected); err != nil {
+				logger.Warn("could not move rejected file", "err", err, "path", path)
+			}
+		}
+		return true
+	}
+	missing := pr.Missing(d.require)
+	if len(missing) == 0 {
+		return true
+	}
+	inSpool, err := HoldIncomplete(path, d.failedDir, missing)
+	switch {
+	case err != nil:
+		logger.Warn("could not move incomplete file", "err", err, "path", path)
+	case inSpool:
+		logger.Warn("derivatives not stored, keeping file for retry", "path", path, "missing", missing)
+	default:
+		logger.Warn("derivatives not stored, moved file", "path", path, "missing", missing, "dir", d.failedDir)
+	}
+	return !inSpool
+}
+
+// settle releases a processed file, removes it from the spool or moves it to
+// the trash, and removes its sidecar, once the file has left the spool.
+func (d *disposal) settle(logger *slog.Logger, path string, pr *ProcessResult) {
+	if d.release(logger, path, pr) {
+		removeFile(logger, path, d.dir, d.trash)
+	} else {
+		logger.Debug("keeping file in spool", "path", path)
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := removeSidecar(path); err != nil {
+			logger.Warn("could not remove sidecar", "err", err, "path", path)
+		}
+	}
+}
+
+// removeFile moves a file from the spool in dir to the trash, if there is
+// one, or removes it, if it still exists.
+func removeFile(logger *slog.Logger, path, dir string, trash *Trash) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if trash != nil {
+		if err := trash.Move(dir, path); err != nil {
+			logger.Warn("error moving file to trash", "err", err, "path", path)
+		}
+	} else if err := os.Remove(path); err != nil {
+		logger.Warn("error removing file from spool", "err", err, "path", path)
+	}
+}
+
+// releaseLease releases the lease on a file.
+func (w *WalkFast) releaseLease(logger *slog.Logger, path string) {
+	if err := w.Leaser.Release(path); err != nil {
+		logger.Warn("could not release lease", "err", err, "path", path)
+	}
+}
+
+// renewLeases renews held leases, until done is closed.
+func (w *WalkFast) renewLeases(done <-chan struct{}) {
+	ticker := time.NewTicker(max(w.Leaser.TTL/3, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.Leaser.Renew(); err != nil {
+				slog.Warn("could not renew leases", "err", err)
+			}
+		}
+	}
+}
+
 // Run start processing files. Do some basic sanity check before setting up
 // workers as we do not have a constructor function.
 func (w *WalkFast) Run(ctx context.Context) error {
-	if w.Grobid == nil {
-		return fmt.Errorf("walker needs grobid setup")
+	w.pipeline = w.Pipeline
+	if w.pipeline == nil {
+		w.pipeline = &Pipeline{
+			Grobid:            w.Grobid,
+			S3:                w.S3,
+			GrobidMaxFileSize: w.GrobidMaxFileSize,
+		}
 	}
-	if w.S3 == nil {
-		return fmt.Errorf("walker needs S3")
+	if err := w.pipeline.Check(); err != nil {
+		return err
+	}
+	if w.Checkpoint != nil && (w.Order != OrderNone || w.ParallelWalk) {
+		return fmt.Errorf("checkpoint requires sequential walk order")
+	}
+	if w.S3Spool != nil && (w.Order != OrderNone || w.ParallelWalk || w.Checkpoint != nil) {
+		return fmt.Errorf("S3 spool cannot be combined with order, parallel walk or checkpoint")
 	}
 	w.stats = new(WalkStats)
-	var queue = make(chan Payload)
-	var wg sync.WaitGroup
-	for i := 0; i < w.NumWorkers; i++ {
-		wg.Add(1)
-		name := fmt.Sprintf("worker-%02d", i)
-		go w.worker(ctx, name, queue, &wg)
+	w.grobidQueue = nil
+	atomic.StoreInt64(&w.backlog, 0)
+	scratchBase := w.ScratchDir
+	if scratchBase == "" {
+		dir, err := os.MkdirTemp("", "blobproc-scratch-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		scratchBase = dir
 	}
-	err := filepath.Walk(w.Dir, func(path string, info fs.FileInfo, err error) error {
+	scratchBase, err := filepath.Abs(scratchBase)
+	if err != nil {
+		return err
+	}
+	var rejectedDir string
+	if w.RejectedDir != "" {
+		if rejectedDir, err = filepath.Abs(w.RejectedDir); err != nil {
+			return err
+		}
+	}
+	var failedDir string
+	if w.FailedDir != "" {
+		if failedDir, err = filepath.Abs(w.FailedDir); err != nil {
+			return err
+		}
+	}
+	var trashDir string
+	if w.Trash != nil {
+		if trashDir, err = filepath.Abs(w.Trash.Dir); err != nil {
+			return err
+		}
+		n, err := w.Trash.Purge()
 		if err != nil {
+			slog.Warn("could not purge trash", "err", err, "dir", w.Trash.Dir)
+		}
+		if n > 0 {
+			slog.Info("purged files from trash", "n", n, "retention", w.Trash.Retention)
+		}
+	}
+	var (
+		queue      = make(chan Payload)
+		wg         sync.WaitGroup // local workers
+		gwg        sync.WaitGroup // grobid workers
+		leaseDone  chan struct{}  // stops lease renewal, if leases are used
+		reportDone = make(chan struct{})
+		reported   = make(chan struct{})
+		stop       = func() {
+			w.mu.Lock()
+			w.spawn = nil // no more workers, once the queue is closed
+			w.mu.Unlock()
+			close(queue)
+			wg.Wait()
+			if w.grobidQueue != nil {
+				close(w.grobidQueue)
+				gwg.Wait()
+			}
+			close(reportDone)
+			<-reported
+			if leaseDone != nil {
+				close(leaseDone)
+			}
+		}
+	)
+	if w.Leaser != nil {
+		leaseDone = make(chan struct{})
+		go w.renewLeases(leaseDone)
+	}
+	if urlMap := w.pipeline.URLMap; urlMap != nil {
+		go func() {
+			defer close(reported)
+			w.reportBacklog(urlMap, reportDone)
+			// The walk is over, do not leave a stale backlog behind.
+			if err := urlMap.SetGauge(GaugeGrobidBacklog, 0); err != nil {
+				slog.Warn("could not record grobid backlog", "err", err)
+			}
+		}()
+	} else {
+		close(reported)
+	}
+	if w.GrobidWorkers > 0 {
+		w.grobidQueue = make(chan grobidTask, w.GrobidWorkers)
+		for i := 0; i < w.GrobidWorkers; i++ {
+			name := fmt.Sprintf("grobid-%02d", i)
+			scratchDir := filepath.Join(scratchBase, name)
+			if err := os.MkdirAll(scratchDir, 0755); err != nil {
+				stop()
+				return err
+			}
+			gwg.Add(1)
+			go w.grobidWorker(name, scratchDir, &gwg)
+		}
+	}
+	w.mu.Lock()
+	w.slots = newSlots(w.NumWorkers)
+	w.started = 0
+	w.spawn = func() error {
+		name := fmt.Sprintf("worker-%02d", w.started)
+		scratchDir := filepath.Join(scratchBase, name)
+		if err := os.MkdirAll(scratchDir, 0755); err != nil {
 			return err
 		}
-		if info.IsDir() {
-			return nil
+		w.started++
+		wg.Add(1)
+		go w.worker(ctx, name, scratchDir, queue, &wg)
+		return nil
+	}
+	for w.started < w.NumWorkers {
+		if err := w.spawn(); err != nil {
+			w.mu.Unlock()
+			stop()
+			return err
 		}
-		if info.Size() == 0 {
-			slog.Warn("skipping empty file", "path", path)
+	}
+	w.mu.Unlock()
+	var (
+		mu       sync.Mutex
+		pending  []Payload // only used, if we need to reorder files
+		dispatch = func(payload Payload) error {
+			slog.Debug("walk status", "total", atomic.LoadInt64(&w.stats.Processed))
+			if err := w.waitScratchSpace(ctx, scratchBase); err != nil {
+				return err
+			}
+			if err := w.slots.acquire(ctx); err != nil {
+				return err
+			}
+			if w.Checkpoint != nil {
+				w.Checkpoint.Add(payload.Path)
+			}
+			select {
+			case queue <- payload:
+			case <-ctx.Done():
+				w.slots.release()
+				return ctx.Err()
+			}
 			return nil
 		}
-		slog.Debug("walk status", "total", w.stats.Processed, "success", w.stats.SuccessRatio())
-		select {
-		case queue <- Payload{Path: path, FileInfo: info}:
-		case <-ctx.Done():
-			return ctx.Err()
+		skipDir = spoolSkipDir(w.Checkpoint, scratchBase, rejectedDir, failedDir, trashDir)
+	)
+	if w.S3Spool != nil {
+		downloadDir := filepath.Join(scratchBase, "s3spool")
+		defer func() {
+			if err := os.RemoveAll(downloadDir); err != nil {
+				slog.Warn("could not remove download directory", "err", err, "dir", downloadDir)
+			}
+		}()
+		err = w.S3Spool.walk(ctx, downloadDir, dispatch)
+	} else {
+		err = walkSpool(ctx, w.Dir, w.ParallelWalk, skipDir, func(payload Payload) error {
+			if w.Order != OrderNone {
+				mu.Lock()
+				pending = append(pending, payload)
+				mu.Unlock()
+				return nil
+			}
+			return dispatch(payload)
+		})
+	}
+	if err == nil && w.Order != OrderNone {
+		slog.Debug("dispatching files in order", "order", w.Order, "n", len(pending))
+		sortPayloads(pending, w.Order)
+		for _, payload := range pending {
+			if err = dispatch(payload); err != nil {
+				break
+			}
 		}
-		return nil
-	})
-	close(queue)
-	wg.Wait()
+	}
+	stop()
+	slog.Info("walk finished",
+		"processed", w.stats.Processed,
+		"ok", w.stats.OK,
+		"low_disk_waits", w.stats.LowDiskWaits,
+	)
+	if w.Checkpoint != nil {
+		if cerr := w.Checkpoint.Finish(err == nil); cerr != nil {
+			slog.Warn("could not finish checkpoint", "err", cerr)
+		}
+	}
 	return err
 }
+
+// sortPayloads sorts payloads in place according to a given order. Ties are
+// broken by path, so the dispatch order is stable across runs.
+func sortPayloads(payloads []Payload, order Order) {
+	var less func(a, b Payload) int
+	switch order {
+	case OrderOldest:
+		less = func(a, b Payload) int {
+			return a.FileInfo.ModTime().Compare(b.FileInfo.ModTime())
+		}
+	case OrderSmallest:
+		less = func(a, b Payload) int {
+			return cmp.Compare(a.FileInfo.Size(), b.FileInfo.Size())
+		}
+	default:
+		return
+	}
+	slices.SortFunc(payloads, func(a, b Payload) int {
+		if v := less(a, b); v != 0 {
+			return v
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+}
@@ -0,0 +1,581 @@
+package blobproc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/fileutils"
+	"github.com/miku/grobidclient"
+)
+
+// fakeFileInfo allows to control size and modification time.
+type fakeFileInfo struct {
+	fs.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+
+func TestSortPayloads(t *testing.T) {
+	var (
+		t0       = time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+		payloads = []Payload{
+			{Path: "a", FileInfo: fakeFileInfo{size: 300, modTime: t0.Add(2 * time.Hour)}},
+			{Path: "b", FileInfo: fakeFileInfo{size: 100, modTime: t0.Add(3 * time.Hour)}},
+			{Path: "c", FileInfo: fakeFileInfo{size: 200, modTime: t0}},
+			{Path: "d", FileInfo: fakeFileInfo{size: 100, modTime: t0}},
+		}
+	)
+	var cases = []struct {
+		about  string
+		order  Order
+		result []string
+	}{
+		{
+			about:  "walk order",
+			order:  OrderNone,
+			result: []string{"a", "b", "c", "d"},
+		},
+		{
+			about:  "oldest first, ties by path",
+			order:  OrderOldest,
+			result: []string{"c", "d", "a", "b"},
+		},
+		{
+			about:  "smallest first, ties by path",
+			order:  OrderSmallest,
+			result: []string{"b", "d", "c", "a"},
+		},
+	}
+	for _, c := range cases {
+		ps := slices.Clone(payloads)
+		sortPayloads(ps, c.order)
+		var result []string
+		for _, p := range ps {
+			result = append(result, p.Path)
+		}
+		if !slices.Equal(result, c.result) {
+			t.Fatalf("[%s] got %v, want %v", c.about, result, c.result)
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	for _, s := range []string{"", "oldest", "smallest"} {
+		if _, err := ParseOrder(s); err != nil {
+			t.Fatalf("got %v, want nil", err)
+		}
+	}
+	if _, err := ParseOrder("largest"); err == nil {
+		t.Fatalf("got nil, want error")
+	}
+}
+
+func TestWalkFastGrobidWorkers(t *testing.T) {
+	var cases = []struct {
+		about         string
+		grobidWorkers int
+	}{
+		{"inline grobid", 0},
+		{"grobid queue", 1},
+		{"grobid queue, more workers", 3},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		spool := filepath.Join(dir, "spool")
+		for i := 0; i < 8; i++ {
+			dst := filepath.Join(spool, fmt.Sprintf("%02d", i), "doc.pdf")
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var (
+			store  = &fakeStore{}
+			active int64
+			peak   int64
+		)
+		w := &WalkFast{
+			Dir:           spool,
+			NumWorkers:    4,
+			GrobidWorkers: c.grobidWorkers,
+			ScratchDir:    filepath.Join(dir, "scratch"),
+			Timeout:       time.Minute,
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+					n := atomic.AddInt64(&active, 1)
+					defer atomic.AddInt64(&active, -1)
+					for {
+						p := atomic.LoadInt64(&peak)
+						if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+							break
+						}
+					}
+					time.Sleep(5 * time.Millisecond)
+					return fakeGrobidOK(ctx, path)
+				},
+				PutFunc: store.put,
+			},
+		}
+		if err := w.Run(context.Background()); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if w.stats.OK != 8 {
+			t.Fatalf("[%s] got %v, want %v", c.about, w.stats.OK, 8)
+		}
+		if c.grobidWorkers > 0 && peak > int64(c.grobidWorkers) {
+			t.Fatalf("[%s] got %v concurrent grobid requests, want at most %v", c.about, peak, c.grobidWorkers)
+		}
+		if got := len(store.folders); got != 24 {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, 24)
+		}
+		var n int
+		if err := walkSpool(context.Background(), spool, false, nil, func(Payload) error { n++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatalf("[%s] got %v files left in spool, want 0", c.about, n)
+		}
+	}
+}
+
+func TestWalkFastSetWorkers(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	for i := 0; i < 6; i++ {
+		dst := filepath.Join(spool, fmt.Sprintf("%02d", i), "doc.pdf")
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		store  = &fakeStore{}
+		once   sync.Once
+		active int64
+		peak   int64
+		w      *WalkFast
+	)
+	w = &WalkFast{
+		Dir:        spool,
+		NumWorkers: 1,
+		ScratchDir: filepath.Join(dir, "scratch"),
+		Timeout:    time.Minute,
+		Pipeline: &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+				once.Do(func() {
+					if err := w.SetWorkers(3); err != nil {
+						t.Error(err)
+					}
+				})
+				n := atomic.AddInt64(&active, 1)
+				defer atomic.AddInt64(&active, -1)
+				for {
+					p := atomic.LoadInt64(&peak)
+					if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+						break
+					}
+				}
+				// Wait for the additional workers to pick up files.
+				deadline := time.Now().Add(2 * time.Second)
+				for atomic.LoadInt64(&peak) < 3 && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				return fakeGrobidOK(ctx, path)
+			},
+			PutFunc: store.put,
+		},
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if w.stats.OK != 6 {
+		t.Fatalf("got %v, want %v", w.stats.OK, 6)
+	}
+	if peak != 3 {
+		t.Fatalf("got %v concurrent files, want %v", peak, 3)
+	}
+	if err := w.SetWorkers(0); err == nil {
+		t.Fatalf("got nil, want error")
+	}
+}
+
+func TestSlotsAcquireCancel(t *testing.T) {
+	s := newSlots(1)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	s.setLimit(2)
+	if err := s.acquire(context.Background()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
+
+func TestWalkFastBacklog(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	for i := 0; i < 4; i++ {
+		dst := filepath.Join(spool, fmt.Sprintf("%02d", i), "doc.pdf")
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	urlMap := &URLMap{Path: filepath.Join(dir, "urlmap.db")}
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	var (
+		w        *WalkFast
+		peak     int64 // largest backlog seen by grobid
+		reported int64 // largest backlog recorded in the url map
+	)
+	w = &WalkFast{
+		Dir:             spool,
+		NumWorkers:      4,
+		GrobidWorkers:   1,
+		BacklogInterval: time.Millisecond,
+		ScratchDir:      filepath.Join(dir, "scratch"),
+		Timeout:         time.Minute,
+		Pipeline: &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+				peak = max(peak, w.GrobidBacklog())
+				time.Sleep(20 * time.Millisecond)
+				if g, err := urlMap.Gauge(GaugeGrobidBacklog); err == nil && g != nil {
+					reported = max(reported, g.Value)
+				}
+				return fakeGrobidOK(ctx, path)
+			},
+			PutFunc: (&fakeStore{}).put,
+			URLMap:  urlMap,
+		},
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if peak < 1 || reported < 1 {
+		t.Fatalf("got peak %v, reported %v, want at least 1", peak, reported)
+	}
+	g, err := urlMap.Gauge(GaugeGrobidBacklog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g == nil || g.Value != 0 {
+		t.Fatalf("got %v, want backlog 0 after walk", g)
+	}
+}
+
+func TestWaitScratchSpace(t *testing.T) {
+	defer func(f func(string) (uint64, uint64, error), d time.Duration) {
+		diskUsageFunc, lowDiskInterval = f, d
+	}(diskUsageFunc, lowDiskInterval)
+	lowDiskInterval = time.Millisecond
+	var cases = []struct {
+		about   string
+		min     int64
+		free    []uint64 // free space reported by successive checks
+		checks  int
+		waits   int64
+		timeout bool
+	}{
+		{"disabled", 0, []uint64{0}, 0, 0, false},
+		{"enough space", 100, []uint64{100}, 1, 0, false},
+		{"space freed", 100, []uint64{10, 50, 200}, 3, 1, false},
+		{"never enough", 100, []uint64{10}, -1, 1, true},
+	}
+	for _, c := range cases {
+		var checks int
+		diskUsageFunc = func(string) (uint64, uint64, error) {
+			free := c.free[min(checks, len(c.free)-1)]
+			checks++
+			return free, 1000, nil
+		}
+		w := &WalkFast{MinScratchFree: c.min, stats: new(WalkStats)}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := w.waitScratchSpace(ctx, "")
+		cancel()
+		if (err != nil) != c.timeout {
+			t.Fatalf("[%s] got %v, want timeout %v", c.about, err, c.timeout)
+		}
+		if c.checks >= 0 && checks != c.checks {
+			t.Fatalf("[%s] got %v, want %v", c.about, checks, c.checks)
+		}
+		if w.stats.LowDiskWaits != c.waits {
+			t.Fatalf("[%s] got %v, want %v", c.about, w.stats.LowDiskWaits, c.waits)
+		}
+	}
+}
+
+func TestWalkFastLeases(t *testing.T) {
+	dir := t.TempDir()
+	spool := filepath.Join(dir, "spool")
+	for i := 0; i < 16; i++ {
+		dst := filepath.Join(spool, fmt.Sprintf("%02d", i), "doc.pdf")
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		mu    sync.Mutex
+		seen  = make(map[string]int)
+		wg    sync.WaitGroup
+		owner = []string{"a", "b", "c"}
+	)
+	for i := range owner {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := &WalkFast{
+				Dir:        spool,
+				NumWorkers: 2,
+				ScratchDir: filepath.Join(dir, "scratch-"+owner[i]),
+				Timeout:    time.Minute,
+				Leaser:     &Leaser{Owner: owner[i], TTL: time.Minute},
+				Pipeline: &Pipeline{
+					ExtractFunc: fakeExtract("success"),
+					GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+						mu.Lock()
+						seen[path]++
+						mu.Unlock()
+						time.Sleep(time.Millisecond)
+						return fakeGrobidOK(ctx, path)
+					},
+					PutFunc: (&fakeStore{}).put,
+				},
+			}
+			if err := w.Run(context.Background()); err != nil {
+				t.Errorf("[%s] got %v, want nil", owner[i], err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(seen) != 16 {
+		t.Fatalf("got %v files processed, want %v", len(seen), 16)
+	}
+	for path, n := range seen {
+		if n != 1 {
+			t.Fatalf("[%s] got %v, want processed once", path, n)
+		}
+	}
+	var left []string
+	err := filepath.Walk(spool, func(path string, info fs.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			left = append(left, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("got %v, want empty spool, without leases", left)
+	}
+}
+
+func TestWalkFastLeaseCheckpoint(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		spool = filepath.Join(dir, "spool")
+		paths []string
+	)
+	for i := 0; i < 4; i++ {
+		dst := filepath.Join(spool, "00", fmt.Sprintf("%02d", i), "doc.pdf")
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(dst, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, dst)
+	}
+	// Another instance holds the first file.
+	if err := (&Leaser{Owner: "other", TTL: time.Minute}).Acquire(paths[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := OpenCheckpoint(filepath.Join(dir, "checkpoint"), spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		calls int
+		last  string // checkpoint, while the last file is processed
+	)
+	w := &WalkFast{
+		Dir:        spool,
+		NumWorkers: 1,
+		ScratchDir: filepath.Join(dir, "scratch"),
+		Timeout:    time.Minute,
+		Checkpoint: checkpoint,
+		Leaser:     &Leaser{Owner: "self", TTL: time.Minute},
+		Pipeline: &Pipeline{
+			ExtractFunc: fakeExtract("success"),
+			GrobidFunc: func(ctx context.Context, path string) (*grobidclient.Result, error) {
+				if calls++; calls == 3 {
+					last = checkpoint.Last()
+				}
+				return fakeGrobidOK(ctx, path)
+			},
+			PutFunc: (&fakeStore{}).put,
+		},
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	// The leased shard must not hold back the checkpoint.
+	if last < "00/01" {
+		t.Fatalf("got %q, want checkpoint past 00/01", last)
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Fatalf("got %v, want leased file untouched", err)
+	}
+}
+
+func TestWalkFastRequire(t *testing.T) {
+	var cases = []struct {
+		about    string
+		putErr   error
+		grobid   func(context.Context, string) (*grobidclient.Result, error)
+		require  []string
+		failed   bool // use a directory for failed files
+		inSpool  bool
+		inFailed bool
+	}{
+		{about: "all stored", grobid: fakeGrobidOK, require: []string{"text", "tei"}},
+		{about: "s3 down", putErr: errors.New("s3 down"), grobid: fakeGrobidOK, inSpool: true},
+		{about: "s3 down, failed dir", putErr: errors.New("s3 down"), grobid: fakeGrobidOK, failed: true, inFailed: true},
+		{about: "grobid down", grobid: fakeGrobidFailed},
+		{about: "grobid down, tei required", grobid: fakeGrobidFailed, require: []string{"tei"}, inSpool: true},
+	}
+	for _, c := range cases {
+		var (
+			dir       = t.TempDir()
+			spool     = filepath.Join(dir, "spool")
+			path      = filepath.Join(spool, "ab", "cd", "doc.pdf")
+			failedDir string
+		)
+		if c.failed {
+			failedDir = filepath.Join(dir, "failed")
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileutils.CopyFile(path, "testdata/pdf/1906.02444.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		w := &WalkFast{
+			Dir:        spool,
+			NumWorkers: 1,
+			ScratchDir: filepath.Join(dir, "scratch"),
+			Timeout:    time.Minute,
+			Require:    c.require,
+			FailedDir:  failedDir,
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc:  c.grobid,
+				PutFunc:     (&fakeStore{err: c.putErr}).put,
+			},
+		}
+		if err := w.Run(context.Background()); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		_, err := os.Stat(path)
+		if got := err == nil; got != c.inSpool {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.inSpool)
+		}
+		if failedDir == "" {
+			continue
+		}
+		_, err = os.Stat(filepath.Join(failedDir, "doc.pdf.reason"))
+		if got := err == nil; got != c.inFailed {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.inFailed)
+		}
+	}
+}
+
+func TestWalkFastGrobidWorkersState(t *testing.T) {
+	var (
+		dir    = t.TempDir()
+		spool  = filepath.Join(dir, "spool")
+		path   = filepath.Join(spool, fakeSHA1Hex[:2], fakeSHA1Hex[2:4], fakeSHA1Hex[4:])
+		urlMap = &URLMap{Path: filepath.Join(dir, "urlmap.db")}
+	)
+	if err := urlMap.EnsureDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer urlMap.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileutils.CopyFile(path, "testdata/pdf/1906.02444.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		about   string
+		grobid  func(context.Context, string) (*grobidclient.Result, error)
+		state   string
+		folders []string
+	}{
+		{"grobid down", fakeGrobidFailed, StateFailed, []string{"pdf", "text"}},
+		// Derivatives stored by the failed attempt are not stored again.
+		{"retry", fakeGrobidOK, StateDone, []string{"grobid"}},
+	}
+	for _, c := range cases {
+		store := &fakeStore{}
+		w := &WalkFast{
+			Dir:           spool,
+			NumWorkers:    1,
+			GrobidWorkers: 1,
+			ScratchDir:    filepath.Join(dir, "scratch"),
+			Timeout:       time.Minute,
+			Require:       []string{"tei"},
+			Pipeline: &Pipeline{
+				ExtractFunc: fakeExtract("success"),
+				GrobidFunc:  c.grobid,
+				PutFunc:     store.put,
+				URLMap:      urlMap,
+			},
+		}
+		if err := w.Run(context.Background()); err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		st, err := urlMap.State(fakeSHA1Hex)
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if st == nil || st.State != c.state {
+			t.Fatalf("[%s] got %+v, want %v", c.about, st, c.state)
+		}
+		if !slices.Equal(store.folders, c.folders) {
+			t.Fatalf("[%s] got %v, want %v", c.about, store.folders, c.folders)
+		}
+	}
+}
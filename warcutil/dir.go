@@ -0,0 +1,226 @@
+package warcutil
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// sniffSize is the number of bytes read to detect the type of a file.
+const sniffSize = 3072
+
+// DirProcessor writes payloads as files into a directory, named after the
+// last segment of the URL path or by SHA1. Names from URLs are made unique
+// with a numeric suffix, e.g. a-1.pdf. It is safe for concurrent use.
+type DirProcessor struct {
+	Dir string
+	// NameBySHA1 names files by the SHA1 of the payload and an extension for
+	// its media type, e.g. 4e12...9f83.pdf, so a payload is stored once.
+	NameBySHA1 bool
+	// Verify checks, that each file written matches the media type of its
+	// payload, as detected from its content, e.g. starts with %PDF- for
+	// application/pdf, as servers often send wrong content types.
+	// Mismatching files are moved to Quarantine, or removed, if it is empty.
+	Verify     bool
+	Quarantine string
+	// Manifest receives a ManifestEntry as JSON line for each file written,
+	// so files can be traced back to their WARC records.
+	Manifest io.Writer
+
+	mu         sync.Mutex
+	enc        *json.Encoder
+	written    int
+	mismatched int
+}
+
+// ManifestEntry describes a file written by a DirProcessor.
+type ManifestEntry struct {
+	File        string    `json:"file"` // Name of the file in the directory.
+	URI         string    `json:"uri"`
+	Date        time.Time `json:"date"`
+	SHA1Hex     string    `json:"sha1hex"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	WARC        string    `json:"warc"` // Filename of the WARC file.
+	Offset      int64     `json:"offset"`
+}
+
+// Stats returns the number of files written and the number of files, that
+// did not match their media type.
+func (d *DirProcessor) Stats() (written, mismatched int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.written, d.mismatched
+}
+
+// Process writes a payload to a file.
+func (d *DirProcessor) Process(p *Payload) error {
+	var (
+		name   = urlFilename(p.URI)
+		f      *os.File
+		err    error
+		h      = sha1.New()
+		head   = &headWriter{max: sniffSize}
+		remove = func() { os.Remove(f.Name()) }
+	)
+	if d.NameBySHA1 {
+		if err := os.MkdirAll(d.Dir, 0755); err != nil {
+			return err
+		}
+		f, err = os.CreateTemp(d.Dir, ".payload-*")
+	} else {
+		f, err = createUnique(d.Dir, name)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(io.MultiWriter(f, h, head), p.Body)
+	if err != nil {
+		f.Close()
+		remove()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		remove()
+		return err
+	}
+	sha1hex := hex.EncodeToString(h.Sum(nil))
+	if d.NameBySHA1 {
+		ext := path.Ext(name)
+		if m := mimetype.Lookup(p.ContentType); m != nil && m.Extension() != "" {
+			ext = m.Extension()
+		}
+		name = sha1hex + ext
+	} else {
+		name = filepath.Base(f.Name())
+	}
+	if d.Verify && !matchesMediaType(head.b, p.ContentType) {
+		d.mu.Lock()
+		d.mismatched++
+		d.mu.Unlock()
+		return d.quarantine(f.Name(), name)
+	}
+	if d.NameBySHA1 {
+		// Renaming replaces an earlier copy of the same payload.
+		if err := os.Rename(f.Name(), filepath.Join(d.Dir, name)); err != nil {
+			remove()
+			return err
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written++
+	if d.Manifest == nil {
+		return nil
+	}
+	if d.enc == nil {
+		d.enc = json.NewEncoder(d.Manifest)
+	}
+	return d.enc.Encode(ManifestEntry{
+		File:        name,
+		URI:         p.URI,
+		Date:        p.Date,
+		SHA1Hex:     sha1hex,
+		Size:        n,
+		ContentType: p.ContentType,
+		WARC:        p.Filename,
+		Offset:      p.Offset,
+	})
+}
+
+// quarantine moves a file to the quarantine directory under a unique name,
+// or removes it, if there is no quarantine directory.
+func (d *DirProcessor) quarantine(filename, name string) error {
+	if d.Quarantine == "" {
+		return os.Remove(filename)
+	}
+	g, err := createUnique(d.Quarantine, name)
+	if err != nil {
+		return err
+	}
+	g.Close()
+	return os.Rename(filename, g.Name())
+}
+
+// matchesMediaType returns true, if the type detected from the start of a
+// file is the given media type or a more specific type, e.g. any type for
+// application/octet-stream. Files without a media type always match.
+func matchesMediaType(head []byte, mediaType string) bool {
+	if mediaType == "" {
+		return true
+	}
+	for m := mimetype.Detect(head); m != nil; m = m.Parent() {
+		if m.Is(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlFilename returns a file name for a URL, the last segment of its path,
+// or index, if there is none.
+func urlFilename(uri string) string {
+	name := "index"
+	if u, err := url.Parse(uri); err == nil {
+		if base := path.Base(u.Path); base != "/" && base != "." && base != ".." {
+			name = base
+		}
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == '/' || r == '\\' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 200 {
+		name = name[len(name)-200:]
+	}
+	return name
+}
+
+// createUnique creates a new file in dir, adding a numeric suffix to the name,
+// e.g. a-1.pdf, if a file with that name exists.
+func createUnique(dir, name string) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = stem + "-" + strconv.Itoa(i) + ext
+		}
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+}
+
+// headWriter keeps the first max bytes written.
+type headWriter struct {
+	b   []byte
+	max int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := min(len(p), w.max-len(w.b)); n > 0 {
+		w.b = append(w.b, p[:n]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,227 @@
+package warcutil
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// dirNames returns the sorted names of the files in a directory.
+func dirNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestDirProcessor(t *testing.T) {
+	payloads := []struct {
+		uri         string
+		contentType string
+		content     string
+	}{
+		{"http://example.org/a.pdf", "application/pdf", "%PDF-1.4 a"},
+		{"http://example.org/x/a.pdf?v=2", "application/pdf", "%PDF-1.4 b"},
+		{"http://example.org/b.pdf", "application/pdf", "<html><body>Not found</body></html>"},
+		{"http://example.org/c", "application/octet-stream", "%PDF-1.7 c"},
+		{"http://example.org/", "text/html", "<html></html>"},
+	}
+	var cases = []struct {
+		about       string
+		verify      bool
+		quarantine  bool
+		written     []string
+		quarantined []string
+		mismatched  int
+	}{
+		{"no verification", false, false, []string{"a-1.pdf", "a.pdf", "b.pdf", "c", "index"}, nil, 0},
+		{"remove", true, false, []string{"a-1.pdf", "a.pdf", "c", "index"}, nil, 1},
+		{"quarantine", true, true, []string{"a-1.pdf", "a.pdf", "c", "index"}, []string{"b.pdf"}, 1},
+	}
+	for _, c := range cases {
+		var (
+			dir = t.TempDir()
+			d   = &DirProcessor{Dir: filepath.Join(dir, "out"), Verify: c.verify}
+		)
+		if c.quarantine {
+			d.Quarantine = filepath.Join(dir, "quarantine")
+		}
+		for _, p := range payloads {
+			err := d.Process(&Payload{URI: p.uri, ContentType: p.contentType, Body: strings.NewReader(p.content)})
+			if err != nil {
+				t.Fatalf("[%s] got %v, want nil", c.about, err)
+			}
+		}
+		if got := dirNames(t, d.Dir); !reflect.DeepEqual(got, c.written) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.written)
+		}
+		if got := dirNames(t, filepath.Join(dir, "quarantine")); !reflect.DeepEqual(got, c.quarantined) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.quarantined)
+		}
+		if written, mismatched := d.Stats(); written != len(c.written) || mismatched != c.mismatched {
+			t.Fatalf("[%s] got %v, %v, want %v, %v", c.about, written, mismatched, len(c.written), c.mismatched)
+		}
+	}
+}
+
+func TestDirProcessorManifest(t *testing.T) {
+	payloads := []*Payload{
+		{URI: "http://example.org/a", ContentType: "application/pdf", Filename: "a.warc.gz", Offset: 0},
+		{URI: "http://example.org/b.pdf", ContentType: "application/pdf", Filename: "a.warc.gz", Offset: 310},
+		{URI: "http://example.org/", ContentType: "text/html", Filename: "b.warc.gz", Offset: 72},
+	}
+	contents := []string{"%PDF-1.4 a", "%PDF-1.4 a", "<html></html>"}
+	var cases = []struct {
+		about      string
+		nameBySHA1 bool
+		files      []string
+	}{
+		{"url", false, []string{"a", "b.pdf", "index"}},
+		{"sha1", true, nil},
+	}
+	for _, c := range cases {
+		var (
+			buf bytes.Buffer
+			d   = &DirProcessor{Dir: t.TempDir(), NameBySHA1: c.nameBySHA1, Manifest: &buf}
+		)
+		for i, p := range payloads {
+			p.Body = strings.NewReader(contents[i])
+			if err := d.Process(p); err != nil {
+				t.Fatalf("[%s] got %v, want nil", c.about, err)
+			}
+		}
+		var (
+			dec     = json.NewDecoder(&buf)
+			entries []ManifestEntry
+		)
+		for {
+			var entry ManifestEntry
+			if err := dec.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("[%s] got %v, want nil", c.about, err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(entries) != len(payloads) {
+			t.Fatalf("[%s] got %v entries, want %v", c.about, len(entries), len(payloads))
+		}
+		var files []string
+		for i, entry := range entries {
+			var (
+				p       = payloads[i]
+				h       = sha1.Sum([]byte(contents[i]))
+				sha1hex = hex.EncodeToString(h[:])
+			)
+			want := ManifestEntry{
+				File:        entry.File,
+				URI:         p.URI,
+				SHA1Hex:     sha1hex,
+				Size:        int64(len(contents[i])),
+				ContentType: p.ContentType,
+				WARC:        p.Filename,
+				Offset:      p.Offset,
+			}
+			if entry != want {
+				t.Fatalf("[%s] got %+v, want %+v", c.about, entry, want)
+			}
+			b, err := os.ReadFile(filepath.Join(d.Dir, entry.File))
+			if err != nil || string(b) != contents[i] {
+				t.Fatalf("[%s] got %q, %v, want %q", c.about, b, err, contents[i])
+			}
+			if c.nameBySHA1 {
+				if ext := map[string]string{"application/pdf": ".pdf", "text/html": ".html"}[p.ContentType]; entry.File != sha1hex+ext {
+					t.Fatalf("[%s] got %v, want %v", c.about, entry.File, sha1hex+ext)
+				}
+			}
+			if !slices.Contains(files, entry.File) {
+				files = append(files, entry.File)
+			}
+		}
+		slices.Sort(files)
+		// Identical payloads are stored once, when named by SHA1.
+		if got := dirNames(t, d.Dir); !reflect.DeepEqual(got, files) {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, files)
+		}
+		if c.files != nil && !reflect.DeepEqual(files, c.files) {
+			t.Fatalf("[%s] got %v, want %v", c.about, files, c.files)
+		}
+		if c.nameBySHA1 && len(files) != 2 {
+			t.Fatalf("[%s] got %v, want 2 files", c.about, files)
+		}
+	}
+}
+
+func TestDirProcessorPDFResponses(t *testing.T) {
+	// The fixture contains a PDF, a PDF in a chunked and gzip encoded response,
+	// an HTML error page served as application/pdf, a redirect and an HTML
+	// page.
+	f, err := os.Open("../testdata/warc/pdfs.warc.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var (
+		buf bytes.Buffer
+		dir = t.TempDir()
+		d   = &DirProcessor{
+			Dir:        filepath.Join(dir, "out"),
+			NameBySHA1: true,
+			Verify:     true,
+			Quarantine: filepath.Join(dir, "quarantine"),
+			Manifest:   &buf,
+		}
+		e = &Extractor{
+			Filename:   "pdfs.warc.gz",
+			MediaTypes: []string{"application/pdf"},
+			Processors: []Processor{d},
+		}
+	)
+	stats, err := e.Extract(f)
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	if want := (ExtractStats{Records: 7, Payloads: 4, Extracted: 3, SkippedByType: 1, Bytes: 762}); *stats != want {
+		t.Fatalf("got %+v, want %+v", *stats, want)
+	}
+	if written, mismatched := d.Stats(); written != 2 || mismatched != 1 {
+		t.Fatalf("got %v, %v, want 2, 1", written, mismatched)
+	}
+	const pdfSHA1 = "5c8e21a84d481f661502af42cdc1ba95fb121629"
+	if got, want := dirNames(t, d.Dir), []string{pdfSHA1 + ".pdf"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := dirNames(t, d.Quarantine); len(got) != 1 {
+		t.Fatalf("got %v, want a single quarantined file", got)
+	}
+	var uris []string
+	for dec := json.NewDecoder(&buf); ; {
+		var entry ManifestEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("got %v, want nil", err)
+		}
+		if entry.SHA1Hex != pdfSHA1 || entry.WARC != "pdfs.warc.gz" || entry.Offset == 0 || entry.Date.IsZero() {
+			t.Fatalf("got %+v, want PDF entry with WARC location and date", entry)
+		}
+		uris = append(uris, entry.URI)
+	}
+	if want := []string{"https://example.org/paper.pdf", "https://mirror.example.org/download?id=1"}; !reflect.DeepEqual(uris, want) {
+		t.Fatalf("got %v, want %v", uris, want)
+	}
+}
@@ -0,0 +1,220 @@
+package warcutil
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/miku/blobproc/spool"
+)
+
+// PartSuffix is appended to the name of a file, while it is downloaded.
+const PartSuffix = ".part"
+
+// ErrIdleTimeout is returned, if a request receives no data for longer than
+// the configured idle timeout.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// DownloadOptions configure Download. The zero value downloads without
+// retries.
+type DownloadOptions struct {
+	Client *http.Client // http.DefaultClient, if nil
+	// Retries is the number of times a failed request is sent again, after
+	// network errors, server errors and 429 responses. The download continues
+	// from where the previous request stopped.
+	Retries int
+	// Backoff is the time to wait before the first retry, doubled after each
+	// retry, up to MaxBackoff; 1s and 1m, if zero. A Retry-After header
+	// takes precedence, but is capped at MaxBackoff as well.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// IdleTimeout aborts a request, if no response or no data is received
+	// for that long. The request is retried like after a network error. A
+	// timeout of the client limits the whole transfer, which may take hours
+	// for large files, while a stalled connection is noticed only after the
+	// idle timeout. No limit, if zero.
+	IdleTimeout time.Duration
+	// SHA1Hex is the expected SHA1 of the file, not checked if empty.
+	SHA1Hex   string
+	UserAgent string
+}
+
+// errRetry wraps errors of a single request, that are worth trying again.
+type errRetry struct {
+	err   error
+	after time.Duration // from Retry-After, if set
+}
+
+func (e *errRetry) Error() string { return e.err.Error() }
+func (e *errRetry) Unwrap() error { return e.err }
+
+// Download fetches a URL into a file, e.g. a large WARC file. The content is
+// written to the file with PartSuffix first, which is renamed, once it is
+// complete and matches the expected SHA1. An existing part file, e.g. of an
+// interrupted download, is continued with a range request, if the server
+// supports it. A part file that does not match the expected SHA1 is removed.
+func Download(ctx context.Context, url, filename string, opts *DownloadOptions) error {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	var (
+		part    = filename + PartSuffix
+		backoff = opts.Backoff
+	)
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	maxBackoff := opts.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = time.Minute
+	}
+	for i := 0; ; i++ {
+		err := downloadPart(ctx, url, part, opts)
+		if err == nil {
+			break
+		}
+		var re *errRetry
+		if !errors.As(err, &re) || i >= opts.Retries || ctx.Err() != nil {
+			return err
+		}
+		wait := min(backoff, maxBackoff)
+		if re.after > 0 {
+			wait = min(re.after, maxBackoff)
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if opts.SHA1Hex != "" {
+		got, err := fileSHA1(part)
+		if err != nil {
+			return err
+		}
+		if got != opts.SHA1Hex {
+			os.Remove(part)
+			return fmt.Errorf("%s: %w: got %s, want %s", url, spool.ErrChecksumMismatch, got, opts.SHA1Hex)
+		}
+	}
+	return os.Rename(part, filename)
+}
+
+// downloadPart requests the content of a URL after the bytes already in the
+// part file and appends it to the file.
+func downloadPart(ctx context.Context, url, part string, opts *DownloadOptions) (err error) {
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var body = func(r io.Reader) io.Reader { return r }
+	if opts.IdleTimeout > 0 {
+		idle := time.AfterFunc(opts.IdleTimeout, func() { cancel(ErrIdleTimeout) })
+		defer idle.Stop()
+		body = func(r io.Reader) io.Reader {
+			return &idleReader{r: r, timer: idle, timeout: opts.IdleTimeout}
+		}
+		defer func() {
+			// The request failed with a context error, name the cause.
+			if err != nil && errors.Is(context.Cause(reqCtx), ErrIdleTimeout) {
+				err = &errRetry{err: fmt.Errorf("%s: %w after %v", url, ErrIdleTimeout, opts.IdleTimeout)}
+			}
+		}()
+	}
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &errRetry{err: err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return fmt.Errorf("%s: unexpected content range %q", url, resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored the range, start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The part file is complete already.
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var after time.Duration
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			after = time.Duration(seconds) * time.Second
+		}
+		return &errRetry{err: fmt.Errorf("%s: got HTTP %d", url, resp.StatusCode), after: after}
+	default:
+		return fmt.Errorf("%s: got HTTP %d", url, resp.StatusCode)
+	}
+	if _, err := io.Copy(f, body(resp.Body)); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return &errRetry{err: err}
+	}
+	return f.Close()
+}
+
+// idleReader resets a timer after each successful read.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// fileSHA1 returns the SHA1 of a file as hex string.
+func fileSHA1(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,259 @@
+package warcutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/spool"
+)
+
+func TestDownload(t *testing.T) {
+	var (
+		content = bytes.Repeat([]byte("WARC/1.0 0123456789\n"), 1000)
+		h       = sha1.Sum(content)
+		sha1hex = hex.EncodeToString(h[:])
+		serve   = func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}
+	)
+	var cases = []struct {
+		about string
+		// handle serves the nth request, starting at zero.
+		handle   func(n int, w http.ResponseWriter, r *http.Request)
+		part     []byte // existing part file
+		retries  int
+		sha1hex  string
+		requests int
+		ranges   []string // range headers sent
+		idle     time.Duration
+		err      error // error matched with errors.Is, if set
+		fail     bool
+	}{
+		{
+			about:    "ok",
+			handle:   func(n int, w http.ResponseWriter, r *http.Request) { serve(w, r) },
+			sha1hex:  sha1hex,
+			requests: 1,
+			ranges:   []string{""},
+		},
+		{
+			about: "retry server error",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				if n < 2 {
+					http.Error(w, "busy", http.StatusServiceUnavailable)
+					return
+				}
+				serve(w, r)
+			},
+			retries:  2,
+			requests: 3,
+			ranges:   []string{"", "", ""},
+		},
+		{
+			about: "too many server errors",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "busy", http.StatusTooManyRequests)
+			},
+			retries:  2,
+			requests: 3,
+			ranges:   []string{"", "", ""},
+			fail:     true,
+		},
+		{
+			about: "resume interrupted transfer",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				if n == 0 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.Write(content[:5000])
+					return
+				}
+				serve(w, r)
+			},
+			retries:  1,
+			sha1hex:  sha1hex,
+			requests: 2,
+			ranges:   []string{"", "bytes=5000-"},
+		},
+		{
+			about: "resume stalled transfer",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				if n == 0 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.Write(content[:5000])
+					w.(http.Flusher).Flush()
+					<-r.Context().Done()
+					return
+				}
+				serve(w, r)
+			},
+			retries:  1,
+			sha1hex:  sha1hex,
+			requests: 2,
+			ranges:   []string{"", "bytes=5000-"},
+			idle:     50 * time.Millisecond,
+		},
+		{
+			about: "stalled response",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				if n == 0 {
+					<-r.Context().Done()
+					return
+				}
+				serve(w, r)
+			},
+			retries:  1,
+			sha1hex:  sha1hex,
+			requests: 2,
+			ranges:   []string{"", ""},
+			idle:     50 * time.Millisecond,
+		},
+		{
+			about: "always stalled",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			retries:  1,
+			requests: 2,
+			ranges:   []string{"", ""},
+			idle:     50 * time.Millisecond,
+			err:      ErrIdleTimeout,
+		},
+		{
+			about: "retry after capped",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				if n == 0 {
+					w.Header().Set("Retry-After", "3600")
+					http.Error(w, "busy", http.StatusServiceUnavailable)
+					return
+				}
+				serve(w, r)
+			},
+			retries:  1,
+			sha1hex:  sha1hex,
+			requests: 2,
+			ranges:   []string{"", ""},
+		},
+		{
+			about:    "resume part file",
+			handle:   func(n int, w http.ResponseWriter, r *http.Request) { serve(w, r) },
+			part:     content[:1234],
+			sha1hex:  sha1hex,
+			requests: 1,
+			ranges:   []string{"bytes=1234-"},
+		},
+		{
+			about:    "complete part file",
+			handle:   func(n int, w http.ResponseWriter, r *http.Request) { serve(w, r) },
+			part:     content,
+			sha1hex:  sha1hex,
+			requests: 1,
+			ranges:   []string{"bytes=20000-"},
+		},
+		{
+			about: "range ignored",
+			handle: func(n int, w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			},
+			part:     []byte("stale"),
+			sha1hex:  sha1hex,
+			requests: 1,
+			ranges:   []string{"bytes=5-"},
+		},
+		{
+			about:    "checksum mismatch",
+			handle:   func(n int, w http.ResponseWriter, r *http.Request) { serve(w, r) },
+			part:     []byte("XXXXX"),
+			retries:  3,
+			sha1hex:  sha1hex,
+			requests: 1,
+			ranges:   []string{"bytes=5-"},
+			err:      spool.ErrChecksumMismatch,
+		},
+		{
+			about:    "not found",
+			handle:   func(n int, w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			retries:  3,
+			requests: 1,
+			ranges:   []string{""},
+			fail:     true,
+		},
+	}
+	for _, c := range cases {
+		var (
+			mu     sync.Mutex
+			ranges []string
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			n := len(ranges)
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+			c.handle(n, w, r)
+		}))
+		filename := filepath.Join(t.TempDir(), "a.warc.gz")
+		if c.part != nil {
+			if err := os.WriteFile(filename+PartSuffix, c.part, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		opts := &DownloadOptions{
+			Retries:     c.retries,
+			Backoff:     time.Millisecond,
+			MaxBackoff:  10 * time.Millisecond,
+			IdleTimeout: c.idle,
+			SHA1Hex:     c.sha1hex,
+		}
+		err := Download(context.Background(), ts.URL, filename, opts)
+		ts.Close()
+		switch {
+		case c.err != nil && !errors.Is(err, c.err):
+			t.Fatalf("[%s] got %v, want %v", c.about, err, c.err)
+		case c.fail && err == nil:
+			t.Fatalf("[%s] got nil, want error", c.about)
+		case c.err == nil && !c.fail && err != nil:
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if len(ranges) != c.requests || !slices.Equal(ranges, c.ranges) {
+			t.Fatalf("[%s] got %q, want %d requests with %q", c.about, ranges, c.requests, c.ranges)
+		}
+		b, err := os.ReadFile(filename)
+		if c.err != nil || c.fail {
+			if err == nil {
+				t.Fatalf("[%s] got file, want none", c.about)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(b, content) {
+			t.Fatalf("[%s] got %d bytes, %v, want %d bytes", c.about, len(b), err, len(content))
+		}
+		if _, err := os.Stat(filename + PartSuffix); !os.IsNotExist(err) {
+			t.Fatalf("[%s] got %v, want part file removed", c.about, err)
+		}
+	}
+}
+
+func TestDownloadCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts := &DownloadOptions{Retries: 100, Backoff: time.Hour}
+	err := Download(ctx, ts.URL, filepath.Join(t.TempDir(), "a.warc.gz"), opts)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,449 @@
+package warcutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBuffer is the size up to which a payload is kept in memory, when
+// it is passed to several processors.
+const DefaultMaxBuffer = 32 << 20
+
+// Payload is the content of a successful response or of a resource record,
+// without HTTP headers.
+type Payload struct {
+	URI         string
+	Date        time.Time
+	ContentType string // Media type, without parameters.
+	StatusCode  int    // HTTP status code, zero for resource records.
+	// ContentEncoding of the archived response, e.g. gzip. The body is
+	// always decoded, as is a chunked transfer encoding.
+	ContentEncoding string
+	// Size of the decoded body.
+	Size int64
+	// Filename and Offset of the record in the WARC file.
+	Filename string
+	Offset   int64
+	Body     io.Reader
+	// release frees the body, once it is processed, if it is buffered.
+	release func()
+}
+
+// Processor handles extracted payloads. The body of a payload must be read,
+// before Process returns.
+type Processor interface {
+	Process(p *Payload) error
+}
+
+// ProcessorFunc adapts a function to a Processor.
+type ProcessorFunc func(p *Payload) error
+
+// Process calls f.
+func (f ProcessorFunc) Process(p *Payload) error { return f(p) }
+
+// ExtractStats summarizes an extraction, so it is visible, what was dropped.
+type ExtractStats struct {
+	Records       int `json:"records"`
+	Payloads      int `json:"payloads"` // Successful responses and resources.
+	Extracted     int `json:"extracted"`
+	SkippedByType int `json:"skipped_by_type"`
+	SkippedBySize int `json:"skipped_by_size"`
+	// SkippedByEncoding counts payloads in an unsupported content encoding,
+	// like br, or that cannot be decoded.
+	SkippedByEncoding int   `json:"skipped_by_encoding"`
+	Bytes             int64 `json:"bytes"` // Bytes extracted.
+}
+
+// Add adds the counts of other to s, for a summary over several files.
+func (s *ExtractStats) Add(other *ExtractStats) {
+	s.Records += other.Records
+	s.Payloads += other.Payloads
+	s.Extracted += other.Extracted
+	s.SkippedByType += other.SkippedByType
+	s.SkippedBySize += other.SkippedBySize
+	s.SkippedByEncoding += other.SkippedByEncoding
+	s.Bytes += other.Bytes
+}
+
+// Extractor passes the payloads of the response records with HTTP status 200
+// and of the resource records of a WARC file to processors. Records are read
+// sequentially and payloads streamed, unless there are several processors or
+// workers, or the payload needs to be decoded. Bodies in a chunked transfer
+// encoding and in the gzip or deflate content encodings are decoded.
+type Extractor struct {
+	// Filename is passed on with each payload, usually the basename of the
+	// WARC file.
+	Filename string
+	// MediaTypes limits extraction to payloads of these media types, e.g.
+	// application/pdf, all payloads are extracted if empty.
+	MediaTypes []string
+	// MinPayloadSize and MaxPayloadSize limit extraction to payloads of a
+	// size in bytes, a zero MaxPayloadSize means no limit.
+	MinPayloadSize int64
+	MaxPayloadSize int64
+	// MaxBuffer is the size up to which a payload is kept in memory, when it
+	// is passed to several processors, larger payloads are written to a
+	// temporary file in TempDir. Defaults to DefaultMaxBuffer.
+	MaxBuffer int64
+	TempDir   string
+	// Processors are called in order for each payload.
+	Processors []Processor
+	// Workers is the number of payloads processed concurrently, while the
+	// records are read by a single goroutine, for processors that wait on
+	// I/O. With more than one worker, payloads are buffered, at most one per
+	// worker and one being read, and processors must be safe for concurrent
+	// use.
+	Workers int
+}
+
+// Extract reads a WARC file and passes each payload to the processors. It
+// stops at the first error.
+func (e *Extractor) Extract(r io.Reader) (*ExtractStats, error) {
+	wr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(ExtractStats)
+	if e.Workers > 1 {
+		return stats, e.extractConcurrently(wr, stats)
+	}
+	for {
+		p, err := e.next(wr, stats)
+		if err != nil || p == nil {
+			return stats, err
+		}
+		err = e.process(p)
+		if p.release != nil {
+			p.release()
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s at offset %d: %w", p.URI, p.Offset, err)
+		}
+		stats.Extracted++
+		stats.Bytes += p.Size
+	}
+}
+
+// extractConcurrently reads payloads and passes them to a pool of workers.
+func (e *Extractor) extractConcurrently(wr *Reader, stats *ExtractStats) error {
+	type job struct {
+		p       *Payload
+		body    io.ReadSeeker
+		release func()
+	}
+	var (
+		jobs     = make(chan job)
+		failed   = make(chan struct{}) // closed on the first processing error
+		once     sync.Once
+		firstErr error
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < e.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				err := e.processBuffered(j.p, j.body)
+				j.release()
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("%s at offset %d: %w", j.p.URI, j.p.Offset, err)
+						close(failed)
+					})
+					continue
+				}
+				// The reading goroutine only updates the other counts.
+				mu.Lock()
+				stats.Extracted++
+				stats.Bytes += j.p.Size
+				mu.Unlock()
+			}
+		}()
+	}
+	var err error
+loop:
+	for {
+		var p *Payload
+		if p, err = e.next(wr, stats); err != nil || p == nil {
+			break
+		}
+		body, release, berr := e.buffer(p)
+		if berr != nil {
+			err = fmt.Errorf("%s at offset %d: %w", p.URI, p.Offset, berr)
+			break
+		}
+		select {
+		case jobs <- job{p: p, body: body, release: release}:
+		case <-failed:
+			release()
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// next returns the next payload to extract, or nil, if there are no more
+// records.
+func (e *Extractor) next(wr *Reader, stats *ExtractStats) (*Payload, error) {
+	for {
+		record, err := wr.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Records++
+		p, err := e.payload(record)
+		if err != nil {
+			return nil, fmt.Errorf("record at offset %d: %w", record.Offset, err)
+		}
+		if p == nil {
+			continue
+		}
+		stats.Payloads++
+		if len(e.MediaTypes) > 0 && !slices.Contains(e.MediaTypes, p.ContentType) {
+			stats.SkippedByType++
+			continue
+		}
+		if p.Size < 0 || p.ContentEncoding != "" {
+			ok, err := e.decode(p)
+			if err != nil {
+				return nil, fmt.Errorf("record at offset %d: %w", record.Offset, err)
+			}
+			if !ok {
+				stats.SkippedByEncoding++
+				continue
+			}
+		}
+		if p.Size < e.MinPayloadSize || (e.MaxPayloadSize > 0 && p.Size > e.MaxPayloadSize) {
+			if p.release != nil {
+				p.release()
+			}
+			stats.SkippedBySize++
+			continue
+		}
+		return p, nil
+	}
+}
+
+// decode replaces the body of a payload with its decoded content, buffered to
+// determine its size, and returns false, if it cannot be decoded. Decoding
+// stops after MaxPayloadSize bytes, so the payload is skipped by size.
+func (e *Extractor) decode(p *Payload) (bool, error) {
+	var body io.Reader = p.Body
+	switch p.ContentEncoding {
+	case "":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return false, nil
+		}
+		body = zr
+	case "deflate":
+		// Servers send zlib wrapped data, as the standard requires, or raw
+		// deflate data.
+		br := bufio.NewReader(body)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return false, nil
+			}
+			body = zr
+		} else {
+			body = flate.NewReader(br)
+		}
+	default:
+		return false, nil
+	}
+	if e.MaxPayloadSize > 0 {
+		body = io.LimitReader(body, e.MaxPayloadSize+1)
+	}
+	r := &errReader{r: body}
+	buf, n, release, err := e.spill(r)
+	switch {
+	case err != nil && r.err != nil:
+		return false, nil // corrupt data or broken chunks
+	case err != nil:
+		return false, err
+	}
+	p.Body, p.Size, p.release = buf, n, release
+	return true, nil
+}
+
+// errReader records the first read error of the underlying reader.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// payload returns the payload of a record, or nil, if it has none to extract.
+func (e *Extractor) payload(record *Record) (*Payload, error) {
+	var (
+		content = record.Content.(*io.LimitedReader)
+		p       = &Payload{
+			URI:      record.TargetURI(),
+			Date:     record.Date(),
+			Filename: e.Filename,
+			Offset:   record.Offset,
+		}
+	)
+	switch {
+	case record.Type() == "resource":
+		p.ContentType = mediaType(record.Header.Get("Content-Type"))
+		p.Size = content.N
+		p.Body = content
+	case record.Type() == "response" && strings.HasPrefix(record.Header.Get("Content-Type"), "application/http"):
+		br := bufio.NewReader(content)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil
+		}
+		p.StatusCode = resp.StatusCode
+		p.ContentType = mediaType(resp.Header.Get("Content-Type"))
+		p.ContentEncoding = strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+		if p.ContentEncoding == "identity" {
+			p.ContentEncoding = ""
+		}
+		// The rest of the record is the payload, regardless of the length
+		// announced by the server.
+		p.Size = content.N + int64(br.Buffered())
+		p.Body = br
+		// Some crawlers store the body dechunked, but keep the header.
+		if slices.Contains(resp.TransferEncoding, "chunked") && isChunked(br) {
+			p.Size = -1 // known once decoded
+			p.Body = httputil.NewChunkedReader(br)
+		}
+	default:
+		return nil, nil
+	}
+	return p, nil
+}
+
+// isChunked returns true, if a body starts with a chunk size line.
+func isChunked(br *bufio.Reader) bool {
+	b, _ := br.Peek(64)
+	line, _, ok := bytes.Cut(b, []byte("\n"))
+	if !ok {
+		return false
+	}
+	size, _, _ := bytes.Cut(bytes.TrimRight(line, "\r"), []byte(";"))
+	size = bytes.TrimSpace(size)
+	if len(size) == 0 {
+		return false
+	}
+	for _, c := range size {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// process passes a payload to all processors. With several processors, the
+// payload is buffered, so each can read it.
+func (e *Extractor) process(p *Payload) error {
+	switch len(e.Processors) {
+	case 0:
+		return nil
+	case 1:
+		return e.Processors[0].Process(p)
+	}
+	body, release, err := e.buffer(p)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return e.processBuffered(p, body)
+}
+
+// processBuffered passes a payload with a buffered body to all processors.
+func (e *Extractor) processBuffered(p *Payload, body io.ReadSeeker) error {
+	for _, proc := range e.Processors {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		q := *p
+		q.Body = body
+		if err := proc.Process(&q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buffer returns the body of a payload, read into memory or into a temporary
+// file, unless it is already buffered, with a function to release it.
+func (e *Extractor) buffer(p *Payload) (io.ReadSeeker, func(), error) {
+	if p.release != nil {
+		release := p.release
+		p.release = nil
+		return p.Body.(io.ReadSeeker), release, nil
+	}
+	body, _, release, err := e.spill(p.Body)
+	return body, release, err
+}
+
+// spill reads r into memory, or into a temporary file in TempDir, if it is
+// larger than MaxBuffer, and returns the content with its size and a
+// function to release it.
+func (e *Extractor) spill(r io.Reader) (io.ReadSeeker, int64, func(), error) {
+	maxBuffer := e.MaxBuffer
+	if maxBuffer == 0 {
+		maxBuffer = DefaultMaxBuffer
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, maxBuffer+1))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if n <= maxBuffer {
+		return bytes.NewReader(buf.Bytes()), n, func() {}, nil
+	}
+	f, err := os.CreateTemp(e.TempDir, "warcutil-payload-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	release := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if n, err = io.Copy(f, io.MultiReader(&buf, r)); err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		release()
+		return nil, 0, nil, err
+	}
+	return f, n, release, nil
+}
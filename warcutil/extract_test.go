@@ -0,0 +1,281 @@
+package warcutil
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpResponse returns a serialized HTTP response with a body.
+func httpResponse(status, contentType, body string) string {
+	return "HTTP/1.1 " + status + "\r\nContent-Type: " + contentType + "\r\n\r\n" + body
+}
+
+// extractWARC returns a WARC file with records of all types.
+func extractWARC(t *testing.T) []byte {
+	records := []string{
+		warcRecord("warcinfo", "", "application/warc-fields", "software: test\r\n"),
+		warcRecord("request", "http://example.org/a.pdf", "application/http; msgtype=request",
+			"GET /a.pdf HTTP/1.1\r\n\r\n"),
+		warcRecord("response", "http://example.org/a.pdf", "application/http; msgtype=response",
+			httpResponse("200 OK", "application/pdf", "%PDF-1.4 a")),
+		warcRecord("response", "http://example.org/index.html", "application/http; msgtype=response",
+			httpResponse("200 OK", "text/html; charset=utf-8", "<html></html>")),
+		warcRecord("response", "http://example.org/gone.pdf", "application/http; msgtype=response",
+			httpResponse("404 Not Found", "application/pdf", "%PDF-")),
+		warcRecord("revisit", "http://example.org/a.pdf", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\n\r\n"),
+		warcRecord("resource", "file:///b.pdf", "application/pdf", "%PDF-1.7 larger b"),
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExtractor(t *testing.T) {
+	data := extractWARC(t)
+	var cases = []struct {
+		about     string
+		extractor Extractor
+		uris      []string
+		stats     ExtractStats
+	}{
+		{
+			about: "all",
+			uris:  []string{"http://example.org/a.pdf", "http://example.org/index.html", "file:///b.pdf"},
+			stats: ExtractStats{Records: 7, Payloads: 3, Extracted: 3, Bytes: 40},
+		},
+		{
+			about:     "pdf only",
+			extractor: Extractor{MediaTypes: []string{"application/pdf"}},
+			uris:      []string{"http://example.org/a.pdf", "file:///b.pdf"},
+			stats:     ExtractStats{Records: 7, Payloads: 3, Extracted: 2, SkippedByType: 1, Bytes: 27},
+		},
+		{
+			about:     "max size",
+			extractor: Extractor{MaxPayloadSize: 13},
+			uris:      []string{"http://example.org/a.pdf", "http://example.org/index.html"},
+			stats:     ExtractStats{Records: 7, Payloads: 3, Extracted: 2, SkippedBySize: 1, Bytes: 23},
+		},
+		{
+			about:     "min size",
+			extractor: Extractor{MinPayloadSize: 11},
+			uris:      []string{"http://example.org/index.html", "file:///b.pdf"},
+			stats:     ExtractStats{Records: 7, Payloads: 3, Extracted: 2, SkippedBySize: 1, Bytes: 30},
+		},
+	}
+	for _, c := range cases {
+		var uris []string
+		c.extractor.Processors = []Processor{ProcessorFunc(func(p *Payload) error {
+			b, err := io.ReadAll(p.Body)
+			if err != nil {
+				return err
+			}
+			if int64(len(b)) != p.Size {
+				t.Fatalf("[%s] got %v bytes, want %v", c.about, len(b), p.Size)
+			}
+			uris = append(uris, p.URI)
+			return nil
+		})}
+		stats, err := c.extractor.Extract(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if !reflect.DeepEqual(uris, c.uris) {
+			t.Fatalf("[%s] got %v, want %v", c.about, uris, c.uris)
+		}
+		if *stats != c.stats {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, *stats, c.stats)
+		}
+	}
+}
+
+func TestExtractorProcessors(t *testing.T) {
+	data := extractWARC(t)
+	// A payload of 10 bytes is kept in memory, the others are spilled to a
+	// temporary file.
+	for _, maxBuffer := range []int64{0, 10} {
+		var got [2][]string
+		e := &Extractor{MaxBuffer: maxBuffer, TempDir: t.TempDir()}
+		for i := range got {
+			e.Processors = append(e.Processors, ProcessorFunc(func(p *Payload) error {
+				b, err := io.ReadAll(p.Body)
+				got[i] = append(got[i], string(b))
+				return err
+			}))
+		}
+		if _, err := e.Extract(bytes.NewReader(data)); err != nil {
+			t.Fatalf("[%d] got %v, want nil", maxBuffer, err)
+		}
+		want := []string{"%PDF-1.4 a", "<html></html>", "%PDF-1.7 larger b"}
+		for i := range got {
+			if !reflect.DeepEqual(got[i], want) {
+				t.Fatalf("[%d] got %v, want %v", maxBuffer, got[i], want)
+			}
+		}
+	}
+}
+
+func TestExtractorError(t *testing.T) {
+	data := warcRecord("response", "http://example.org/", "application/http; msgtype=response", "not http")
+	_, err := (&Extractor{}).Extract(strings.NewReader(data))
+	if err == nil {
+		t.Fatalf("got nil, want error for invalid HTTP response")
+	}
+}
+
+func TestExtractorWorkers(t *testing.T) {
+	data := extractWARC(t)
+	var (
+		mu         sync.Mutex
+		got        []string
+		running    int
+		concurrent bool
+	)
+	e := &Extractor{Workers: 3, Processors: []Processor{ProcessorFunc(func(p *Payload) error {
+		mu.Lock()
+		running++
+		concurrent = concurrent || running > 1
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		b, err := io.ReadAll(p.Body)
+		mu.Lock()
+		running--
+		got = append(got, string(b))
+		mu.Unlock()
+		return err
+	})}}
+	stats, err := e.Extract(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+	slices.Sort(got)
+	if want := []string{"%PDF-1.4 a", "%PDF-1.7 larger b", "<html></html>"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if want := (ExtractStats{Records: 7, Payloads: 3, Extracted: 3, Bytes: 40}); *stats != want {
+		t.Fatalf("got %+v, want %+v", *stats, want)
+	}
+	if !concurrent {
+		t.Fatalf("got sequential processing, want concurrent")
+	}
+	// The first processing error is returned.
+	e.Processors = []Processor{ProcessorFunc(func(p *Payload) error {
+		if p.ContentType == "text/html" {
+			return errors.New("html")
+		}
+		return nil
+	})}
+	_, err = e.Extract(bytes.NewReader(data))
+	if err == nil || !strings.Contains(err.Error(), "http://example.org/index.html") {
+		t.Fatalf("got %v, want error for index.html", err)
+	}
+}
+
+func TestExtractorEncodings(t *testing.T) {
+	const content = "%PDF-1.4 content"
+	compress := func(newWriter func(io.Writer) io.WriteCloser) string {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	var (
+		gzipped = compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+		zlibbed = compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })
+		raw     = compress(func(w io.Writer) io.WriteCloser {
+			fw, err := flate.NewWriter(w, flate.DefaultCompression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fw
+		})
+		chunked = func(s string) string {
+			return fmt.Sprintf("%x\r\n%s\r\n%x\r\n%s\r\n0\r\n\r\n", 5, s[:5], len(s)-5, s[5:])
+		}
+	)
+	var cases = []struct {
+		about     string
+		headers   string
+		body      string
+		extractor Extractor
+		want      string
+		stats     ExtractStats
+	}{
+		{"plain", "", content, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"chunked", "Transfer-Encoding: chunked\r\n", chunked(content), Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"stored dechunked", "Transfer-Encoding: chunked\r\n", content, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"gzip", "Content-Encoding: gzip\r\n", gzipped, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"chunked gzip", "Transfer-Encoding: chunked\r\nContent-Encoding: gzip\r\n", chunked(gzipped), Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"gzip spilled", "Content-Encoding: gzip\r\n", gzipped, Extractor{MaxBuffer: 4}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"deflate", "Content-Encoding: deflate\r\n", zlibbed, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"raw deflate", "Content-Encoding: deflate\r\n", raw, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"identity", "Content-Encoding: identity\r\n", content, Extractor{}, content,
+			ExtractStats{Records: 1, Payloads: 1, Extracted: 1, Bytes: 16}},
+		{"decoded size limit", "Content-Encoding: gzip\r\n", gzipped, Extractor{MaxPayloadSize: 10}, "",
+			ExtractStats{Records: 1, Payloads: 1, SkippedBySize: 1}},
+		{"br", "Content-Encoding: br\r\n", "\x0b\x07\x80" + content, Extractor{}, "",
+			ExtractStats{Records: 1, Payloads: 1, SkippedByEncoding: 1}},
+		{"corrupt gzip", "Content-Encoding: gzip\r\n", gzipped[:len(gzipped)-8] + "garbage!", Extractor{}, "",
+			ExtractStats{Records: 1, Payloads: 1, SkippedByEncoding: 1}},
+	}
+	for _, c := range cases {
+		block := "HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\n" + c.headers + "\r\n" + c.body
+		data := warcRecord("response", "http://example.org/a.pdf", "application/http; msgtype=response", block)
+		var got []string
+		c.extractor.TempDir = t.TempDir()
+		c.extractor.Processors = []Processor{ProcessorFunc(func(p *Payload) error {
+			b, err := io.ReadAll(p.Body)
+			if int64(len(b)) != p.Size {
+				t.Fatalf("[%s] got %v bytes, want %v", c.about, len(b), p.Size)
+			}
+			got = append(got, string(b))
+			return err
+		})}
+		stats, err := c.extractor.Extract(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("[%s] got %v, want nil", c.about, err)
+		}
+		if *stats != c.stats {
+			t.Fatalf("[%s] got %+v, want %+v", c.about, *stats, c.stats)
+		}
+		if c.want != "" && (len(got) != 1 || got[0] != c.want) {
+			t.Fatalf("[%s] got %q, want %q", c.about, got, c.want)
+		}
+		if entries, err := os.ReadDir(c.extractor.TempDir); err != nil || len(entries) > 0 {
+			t.Fatalf("[%s] got %v, %v, want no temporary files left", c.about, entries, err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package warcutil
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/miku/blobproc/cdx"
+)
+
+// Indexer generates CDX or CDXJ records for the response, revisit and resource
+// records of a WARC file, so that single records can be fetched later by
+// offset.
+type Indexer struct {
+	// Filename is recorded in each CDX line, usually the basename of the WARC.
+	Filename string
+	// CDXJ selects CDXJ output instead of CDX with the default fields.
+	CDXJ bool
+}
+
+// indexedTypes are the WARC record types that get an index entry.
+var indexedTypes = []string{"response", "revisit", "resource"}
+
+// Records calls fn with an index record for each indexed WARC record.
+func (ix *Indexer) Records(r io.Reader, fn func(*cdx.Record) error) error {
+	wr, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+	// The length of a record is only known once the next record is read, so
+	// index records are emitted one step behind.
+	var (
+		prev    *Record
+		pending *cdx.Record
+	)
+	emit := func() error {
+		if pending == nil {
+			return nil
+		}
+		pending.CompressedRecordSize = int(prev.Length)
+		defer func() { pending = nil }()
+		return fn(pending)
+	}
+	for {
+		record, err := wr.Next()
+		if err == io.EOF {
+			return emit()
+		}
+		if err != nil {
+			return err
+		}
+		if err := emit(); err != nil {
+			return err
+		}
+		if !slices.Contains(indexedTypes, record.Type()) {
+			continue
+		}
+		entry, err := ix.entry(record)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", record.Offset, err)
+		}
+		prev, pending = record, entry
+	}
+}
+
+// Index writes CDX or CDXJ lines for a WARC file to w.
+func (ix *Indexer) Index(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if !ix.CDXJ {
+		if _, err := fmt.Fprintln(bw, cdx.Header); err != nil {
+			return err
+		}
+	}
+	err := ix.Records(r, func(record *cdx.Record) error {
+		var line string
+		if ix.CDXJ {
+			var err error
+			if line, err = record.CDXJ(); err != nil {
+				return err
+			}
+		} else {
+			line = record.CDX()
+		}
+		_, err := fmt.Fprintln(bw, line)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// entry creates an index record for a WARC record, without the length.
+func (ix *Indexer) entry(record *Record) (*cdx.Record, error) {
+	var (
+		targetURI = record.TargetURI()
+		entry     = &cdx.Record{
+			SURT:             SURT(targetURI),
+			URL:              targetURI,
+			Digest:           strings.TrimPrefix(record.Header.Get("WARC-Payload-Digest"), "sha1:"),
+			CompressedOffset: int(record.Offset),
+			Filename:         ix.Filename,
+		}
+	)
+	if t := record.Date(); !t.IsZero() {
+		entry.Timestamp = t.Format("20060102150405")
+	}
+	var payload io.Reader = record.Content
+	switch {
+	case record.Type() == "resource":
+		entry.MimeType = mediaType(record.Header.Get("Content-Type"))
+	case strings.HasPrefix(record.Header.Get("Content-Type"), "application/http"):
+		resp, err := http.ReadResponse(bufio.NewReader(record.Content), nil)
+		if err != nil {
+			if record.Type() == "revisit" {
+				break // revisits may come without HTTP headers
+			}
+			return nil, err
+		}
+		defer resp.Body.Close()
+		entry.ResponseCode = resp.StatusCode
+		entry.MimeType = mediaType(resp.Header.Get("Content-Type"))
+		payload = resp.Body
+	}
+	if record.Type() == "revisit" {
+		entry.MimeType = "warc/revisit"
+		return entry, nil
+	}
+	if entry.Digest == "" {
+		h := sha1.New()
+		if _, err := io.Copy(h, payload); err != nil {
+			return nil, err
+		}
+		entry.Digest = base32.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	if entry.MimeType == "" {
+		entry.MimeType = "unk"
+	}
+	return entry, nil
+}
+
+// mediaType returns the media type of a content type header value, without
+// parameters.
+func mediaType(v string) string {
+	if v == "" {
+		return ""
+	}
+	mt, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(v, ";")[0]))
+	}
+	return mt
+}
+
+// SURT returns the Sort-friendly URI Reordering Transform of a URL, in the
+// form commonly used in CDX files, e.g. "org,example)/a?b=1" for
+// "http://www.example.org/a?b=1". Scheme, "www" prefix, default ports and
+// fragments are dropped; the URL is returned unchanged, if it cannot be
+// parsed.
+func SURT(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(host, "www.")
+	parts := strings.Split(host, ".")
+	slices.Reverse(parts)
+	result := strings.Join(parts, ",")
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		result += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	result += ")" + strings.ToLower(path)
+	if u.RawQuery != "" {
+		query := strings.Split(u.RawQuery, "&")
+		slices.Sort(query)
+		result += "?" + strings.ToLower(strings.Join(query, "&"))
+	}
+	return result
+}
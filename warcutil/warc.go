@@ -0,0 +1,212 @@
+// Package warcutil reads WARC files and indexes their records, so that single
+// records can later be accessed by offset, e.g. with cdx.LocalFetcher, and
+// extracts their payloads, e.g. into a directory with a DirProcessor. Large
+// WARC files can be fetched with Download, which retries and resumes.
+package warcutil
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRecord = errors.New("invalid warc record")
+
+// Record is a single WARC record. The content must be read, before the next
+// record is requested. It is streamed from the underlying reader and never
+// buffered, so records of any size are read with constant memory.
+type Record struct {
+	// Offset and Length of the compressed record in the WARC file, or of the
+	// uncompressed record, if the file is not compressed.
+	Offset int64
+	Length int64
+	Header textproto.MIMEHeader
+	// Content is the record block, limited to Content-Length bytes.
+	Content io.Reader
+}
+
+// Type returns the WARC record type, e.g. "response".
+func (r *Record) Type() string { return r.Header.Get("WARC-Type") }
+
+// TargetURI returns the URI of the captured resource.
+func (r *Record) TargetURI() string { return r.Header.Get("WARC-Target-URI") }
+
+// Date returns the capture time of the record in UTC, or the zero time, if
+// it is missing or invalid.
+func (r *Record) Date() time.Time {
+	t, err := time.Parse(time.RFC3339, r.Header.Get("WARC-Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// countingReader counts the bytes consumed from the underlying reader. It
+// implements io.ByteReader, so gzip does not read ahead and offsets of gzip
+// members are exact.
+type countingReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.br.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// Reader reads records from a WARC file, compressed with one gzip member per
+// record, as is customary, or uncompressed.
+type Reader struct {
+	cr         *countingReader
+	compressed bool
+	gz         *gzip.Reader
+	body       *bufio.Reader // uncompressed current gzip member
+	pos        int64         // position in uncompressed files
+	start      int64
+	current    *Record
+}
+
+// NewReader returns a reader for a WARC file. Gzip compression is detected
+// automatically.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &countingReader{br: bufio.NewReader(r)}
+	magic, err := cr.br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &Reader{
+		cr:         cr,
+		compressed: len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b,
+	}, nil
+}
+
+// Next returns the next record, or io.EOF, if there are no more records.
+func (r *Reader) Next() (*Record, error) {
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	if !r.compressed {
+		r.start = r.pos
+		record, n, err := readRecord(r.cr.br)
+		if err != nil {
+			return nil, err
+		}
+		// The content is always consumed completely, in finish.
+		r.pos += n + record.Content.(*io.LimitedReader).N
+		record.Offset = r.start
+		r.current = record
+		return record, nil
+	}
+	if _, err := r.cr.br.Peek(1); err != nil {
+		return nil, err
+	}
+	r.start = r.cr.n
+	if r.gz == nil {
+		gz, err := gzip.NewReader(r.cr)
+		if err != nil {
+			return nil, err
+		}
+		r.gz = gz
+	} else if err := r.gz.Reset(r.cr); err != nil {
+		return nil, err
+	}
+	r.gz.Multistream(false)
+	r.body = bufio.NewReader(r.gz)
+	record, _, err := readRecord(r.body)
+	if err != nil {
+		return nil, err
+	}
+	record.Offset = r.start
+	r.current = record
+	return record, nil
+}
+
+// finish consumes the rest of the current record and sets its length.
+func (r *Reader) finish() error {
+	if r.current == nil {
+		return nil
+	}
+	defer func() { r.current = nil }()
+	if _, err := io.Copy(io.Discard, r.current.Content); err != nil {
+		return err
+	}
+	if r.compressed {
+		// Consume the record trailer and the gzip footer.
+		if _, err := io.Copy(io.Discard, r.body); err != nil {
+			return err
+		}
+		r.current.Length = r.cr.n - r.start
+		return nil
+	}
+	// Consume the newlines between records.
+	for {
+		b, err := r.cr.br.Peek(1)
+		if err != nil || (b[0] != '\r' && b[0] != '\n') {
+			break
+		}
+		_, _ = r.cr.br.ReadByte()
+		r.pos++
+	}
+	r.current.Length = r.pos - r.start
+	return nil
+}
+
+// readRecord reads the WARC version line and headers and returns a record
+// with the content limited to the content length, and the number of header
+// bytes read.
+func readRecord(br *bufio.Reader) (*Record, int64, error) {
+	var n int64
+	readLine := func() (string, error) {
+		line, err := br.ReadString('\n')
+		n += int64(len(line))
+		if err == io.EOF && line != "" {
+			err = io.ErrUnexpectedEOF
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	version, err := readLine()
+	if err != nil {
+		return nil, n, err
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, n, fmt.Errorf("%w: unexpected version line %q", ErrInvalidRecord, version)
+	}
+	header := make(textproto.MIMEHeader)
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, n, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+		}
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, n, fmt.Errorf("%w: invalid header line %q", ErrInvalidRecord, line)
+		}
+		header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, n, fmt.Errorf("%w: content length: %v", ErrInvalidRecord, err)
+	}
+	return &Record{
+		Header:  header,
+		Content: io.LimitReader(br, length),
+	}, n, nil
+}
@@ -0,0 +1,248 @@
+package warcutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/textproto"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miku/blobproc/cdx"
+)
+
+// warcRecord returns a serialized WARC record.
+func warcRecord(typ, uri, contentType, block string) string {
+	return fmt.Sprintf("WARC/1.0\r\n"+
+		"WARC-Type: %s\r\n"+
+		"WARC-Target-URI: %s\r\n"+
+		"WARC-Date: 2024-01-01T12:00:00Z\r\n"+
+		"Content-Type: %s\r\n"+
+		"Content-Length: %d\r\n\r\n%s\r\n\r\n", typ, uri, contentType, len(block), block)
+}
+
+// testWARC returns a WARC file with a warcinfo, a response and a revisit
+// record, and the offsets of the records.
+func testWARC(t *testing.T, compress bool) ([]byte, []int) {
+	records := []string{
+		warcRecord("warcinfo", "", "application/warc-fields", "software: test\r\n"),
+		warcRecord("response", "http://www.example.org/a.pdf", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\nContent-Length: 5\r\n\r\n%PDF-"),
+		warcRecord("revisit", "http://example.org/b", "application/http; msgtype=response",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/html\r\n\r\n"),
+	}
+	var (
+		buf     bytes.Buffer
+		offsets []int
+	)
+	for _, r := range records {
+		offsets = append(offsets, buf.Len())
+		if !compress {
+			buf.WriteString(r)
+			continue
+		}
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.WriteString(zw, r); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes(), append(offsets, buf.Len())
+}
+
+func TestReader(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		data, offsets := testWARC(t, compress)
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			types   []string
+			records []*Record
+		)
+		for {
+			record, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("[compress=%v] got %v, want nil", compress, err)
+			}
+			types = append(types, record.Type())
+			records = append(records, record)
+		}
+		if got, want := strings.Join(types, ","), "warcinfo,response,revisit"; got != want {
+			t.Fatalf("[compress=%v] got %v, want %v", compress, got, want)
+		}
+		for i, record := range records {
+			if record.Offset != int64(offsets[i]) {
+				t.Fatalf("[compress=%v] got offset %v, want %v", compress, record.Offset, offsets[i])
+			}
+			if want := int64(offsets[i+1] - offsets[i]); record.Length != want {
+				t.Fatalf("[compress=%v] got length %v, want %v", compress, record.Length, want)
+			}
+		}
+	}
+}
+
+func TestRecordDate(t *testing.T) {
+	var cases = []struct {
+		about string
+		date  string
+		want  time.Time
+	}{
+		{"utc", "2024-01-01T12:00:00Z", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"offset", "2024-01-01T13:00:00+01:00", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"missing", "", time.Time{}},
+		{"invalid", "20240101120000", time.Time{}},
+	}
+	for _, c := range cases {
+		r := &Record{Header: textproto.MIMEHeader{"Warc-Date": {c.date}}}
+		if got := r.Date(); !got.Equal(c.want) || got.Location() != time.UTC {
+			t.Fatalf("[%s] got %v, want %v", c.about, got, c.want)
+		}
+	}
+}
+
+func TestIndexer(t *testing.T) {
+	data, offsets := testWARC(t, true)
+	ix := &Indexer{Filename: "test.warc.gz"}
+	var records []cdx.Record
+	if err := ix.Records(bytes.NewReader(data), func(r *cdx.Record) error {
+		records = append(records, *r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []cdx.Record{
+		{
+			SURT:                 "org,example)/a.pdf",
+			Timestamp:            "20240101120000",
+			URL:                  "http://www.example.org/a.pdf",
+			MimeType:             "application/pdf",
+			ResponseCode:         200,
+			Digest:               "5BSRSUBLFCP2AYF6TGD4UU7XTOAVSU4L", // base32 sha1 of "%PDF-"
+			CompressedRecordSize: offsets[2] - offsets[1],
+			CompressedOffset:     offsets[1],
+			Filename:             "test.warc.gz",
+		},
+		{
+			SURT:                 "org,example)/b",
+			Timestamp:            "20240101120000",
+			URL:                  "http://example.org/b",
+			MimeType:             "warc/revisit",
+			ResponseCode:         200,
+			CompressedRecordSize: offsets[3] - offsets[2],
+			CompressedOffset:     offsets[2],
+			Filename:             "test.warc.gz",
+		},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %v, want %v", records, want)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Fatalf("got %+v, want %+v", records[i], want[i])
+		}
+	}
+	// Index output can be read back with the cdx reader.
+	var buf bytes.Buffer
+	if err := ix.Index(bytes.NewReader(data), &buf); err != nil {
+		t.Fatal(err)
+	}
+	r := cdx.New(&buf)
+	for i := range want {
+		record, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *record != want[i] {
+			t.Fatalf("got %+v, want %+v", *record, want[i])
+		}
+	}
+}
+
+func TestSURT(t *testing.T) {
+	var cases = []struct {
+		url    string
+		result string
+	}{
+		{"http://www.example.org/a.pdf", "org,example)/a.pdf"},
+		{"https://Example.ORG", "org,example)/"},
+		{"http://example.org:8080/A?b=2&a=1#frag", "org,example:8080)/a?a=1&b=2"},
+		{"https://example.org:443/", "org,example)/"},
+		{"not a url", "not a url"},
+	}
+	for _, c := range cases {
+		if got := SURT(c.url); got != c.result {
+			t.Fatalf("[%s] got %v, want %v", c.url, got, c.result)
+		}
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// TestRecordsStreaming checks, that the content of records is streamed, so
+// memory use does not grow with the size of a record.
+func TestRecordsStreaming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large record test in short mode")
+	}
+	const size = 256 << 20
+	for _, compress := range []bool{false, true} {
+		var (
+			resp   = fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/pdf\r\nContent-Length: %d\r\n\r\n", size)
+			header = fmt.Sprintf("WARC/1.0\r\n"+
+				"WARC-Type: response\r\n"+
+				"WARC-Target-URI: http://example.org/large.pdf\r\n"+
+				"Content-Type: application/http; msgtype=response\r\n"+
+				"Content-Length: %d\r\n\r\n", len(resp)+size)
+			record io.Reader = io.MultiReader(
+				strings.NewReader(header+resp),
+				io.LimitReader(zeros{}, size),
+				strings.NewReader("\r\n\r\n"),
+			)
+		)
+		if compress {
+			pr, pw := io.Pipe()
+			go func(r io.Reader) {
+				zw := gzip.NewWriter(pw)
+				_, err := io.Copy(zw, r)
+				if err == nil {
+					err = zw.Close()
+				}
+				pw.CloseWithError(err)
+			}(record)
+			record = pr
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var n int
+		err := (&Indexer{}).Records(record, func(*cdx.Record) error {
+			n++
+			return nil
+		})
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatalf("[compress=%v] got %v, want nil", compress, err)
+		}
+		if n != 1 {
+			t.Fatalf("[compress=%v] got %v, want 1", compress, n)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/16 {
+			t.Fatalf("[compress=%v] got %v bytes allocated, want at most %v", compress, alloc, size/16)
+		}
+	}
+}